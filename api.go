@@ -0,0 +1,826 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/exerrors"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/client"
+	"css.gomuks.app/database"
+)
+
+const apiPrefix = "/api/v1"
+
+// apiRoute describes a JSON API endpoint. The same definitions are used to register the handlers
+// and to generate the OpenAPI document, so the two can't drift apart.
+type apiRoute struct {
+	Name    string
+	Method  string
+	Path    string
+	Summary string
+	Auth    bool
+	// Request is a nil pointer of the JSON request body type, if the endpoint takes one.
+	Request any
+	// RawRequest lists the accepted content types for endpoints that take a non-JSON body.
+	RawRequest []string
+	Response   any
+	Status     int
+	Errors     []int
+	// RateLimit is the rate limit class of the endpoint. GET endpoints are in the read class by default,
+	// others in the write class.
+	RateLimit rateLimitClass
+	Handler   http.HandlerFunc
+}
+
+var apiRoutes = []*apiRoute{{
+	Name:     "getTheme",
+	Method:   http.MethodGet,
+	Path:     "/themes/{themeID}",
+	Summary:  "Get a theme and its latest version",
+	Response: (*database.Theme)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusNotFound},
+	Handler:  getAPITheme,
+}, {
+	Name:     "getCommits",
+	Method:   http.MethodGet,
+	Path:     "/themes/{themeID}/commits",
+	Summary:  "List all versions of a theme",
+	Response: (*[]*database.Commit)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusNotFound},
+	Handler:  getAPICommits,
+}, {
+	Name:      "createTheme",
+	Method:    http.MethodPost,
+	Path:      "/themes",
+	Summary:   "Create a new theme with its first version",
+	Auth:      true,
+	Request:   (*client.CreateThemeRequest)(nil),
+	Response:  (*database.Theme)(nil),
+	Status:    http.StatusCreated,
+	Errors:    []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict},
+	RateLimit: rateLimitCommit,
+	Handler:   postAPITheme,
+}, {
+	Name:      "updateTheme",
+	Method:    http.MethodPatch,
+	Path:      "/themes/{themeID}",
+	Summary:   "Change the name or description of a theme",
+	Auth:      true,
+	Request:   (*client.UpdateThemeRequest)(nil),
+	Response:  (*database.Theme)(nil),
+	Status:    http.StatusOK,
+	Errors:    []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	RateLimit: rateLimitCommit,
+	Handler:   patchAPITheme,
+}, {
+	Name:      "createCommit",
+	Method:    http.MethodPost,
+	Path:      "/themes/{themeID}/commits",
+	Summary:   "Publish a new version of a theme",
+	Auth:      true,
+	Request:   (*client.CommitRequest)(nil),
+	Response:  (*database.Commit)(nil),
+	Status:    http.StatusCreated,
+	Errors:    []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+	RateLimit: rateLimitCommit,
+	Handler:   postAPICommit,
+}, {
+	Name:       "uploadPreview",
+	Method:     http.MethodPost,
+	Path:       "/themes/{themeID}/previews",
+	Summary:    "Upload a preview image",
+	Auth:       true,
+	RawRequest: []string{"image/png", "image/jpeg", "image/webp"},
+	Response:   (*client.PreviewResponse)(nil),
+	Status:     http.StatusCreated,
+	Errors: []int{
+		http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestEntityTooLarge,
+	},
+	RateLimit: rateLimitUpload,
+	Handler:   postAPIPreview,
+}, {
+	Name:     "deletePreview",
+	Method:   http.MethodDelete,
+	Path:     "/themes/{themeID}/previews/{imageID}",
+	Summary:  "Remove a preview image",
+	Auth:     true,
+	Response: (*database.Theme)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	Handler:  deleteAPIPreview,
+}, {
+	Name:     "addAdmin",
+	Method:   http.MethodPut,
+	Path:     "/themes/{themeID}/admins/{userID}",
+	Summary:  "Add an admin to a theme",
+	Auth:     true,
+	Response: (*database.Theme)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	Handler:  putAPIAdmin,
+}, {
+	Name:     "removeAdmin",
+	Method:   http.MethodDelete,
+	Path:     "/themes/{themeID}/admins/{userID}",
+	Summary:  "Remove an admin from a theme",
+	Auth:     true,
+	Response: (*database.Theme)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+	Handler:  deleteAPIAdmin,
+}, {
+	Name:     "getDrafts",
+	Method:   http.MethodGet,
+	Path:     "/themes/{themeID}/drafts",
+	Summary:  "List the drafts of a theme with their preview links",
+	Auth:     true,
+	Response: (*client.DraftsResponse)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	Handler:  getAPIDrafts,
+}, {
+	Name:     "getReleases",
+	Method:   http.MethodGet,
+	Path:     "/themes/{themeID}/releases",
+	Summary:  "List the channels and tags of a theme",
+	Response: (*client.ReleasesResponse)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusNotFound},
+	Handler:  getAPIReleases,
+}, {
+	Name:     "createTag",
+	Method:   http.MethodPut,
+	Path:     "/themes/{themeID}/tags/{tag}",
+	Summary:  "Create a tag pointing at a version",
+	Auth:     true,
+	Request:  (*client.ReleaseRequest)(nil),
+	Response: (*database.Release)(nil),
+	Status:   http.StatusCreated,
+	Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict},
+	Handler:  putAPITag,
+}, {
+	Name:     "deleteTag",
+	Method:   http.MethodDelete,
+	Path:     "/themes/{themeID}/tags/{tag}",
+	Summary:  "Delete a tag",
+	Auth:     true,
+	Response: (*client.ReleasesResponse)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	Handler:  deleteAPITag,
+}, {
+	Name:     "setChannel",
+	Method:   http.MethodPut,
+	Path:     "/themes/{themeID}/channels/{channel}",
+	Summary:  "Move the stable or beta channel to a version",
+	Auth:     true,
+	Request:  (*client.ReleaseRequest)(nil),
+	Response: (*database.Release)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	Handler:  putAPIChannel,
+}, {
+	Name:     "clearChannel",
+	Method:   http.MethodDelete,
+	Path:     "/themes/{themeID}/channels/{channel}",
+	Summary:  "Unset a channel",
+	Auth:     true,
+	Response: (*client.ReleasesResponse)(nil),
+	Status:   http.StatusOK,
+	Errors:   []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound},
+	Handler:  deleteAPIChannel,
+}, {
+	Name:      "checkUpdates",
+	Method:    http.MethodPost,
+	Path:      "/updates",
+	Summary:   "Check multiple themes for newer versions",
+	Request:   (*client.UpdateCheckRequest)(nil),
+	Response:  (*client.UpdateCheckResponse)(nil),
+	Status:    http.StatusOK,
+	Errors:    []int{http.StatusBadRequest},
+	RateLimit: rateLimitRead,
+	Handler:   postAPIUpdates,
+}}
+
+func registerAPIRoutes(mux *http.ServeMux) {
+	for _, route := range apiRoutes {
+		pattern := fmt.Sprintf("%s %s%s", route.Method, apiPrefix, route.Path)
+		mux.HandleFunc(pattern, route.Handler)
+		if route.RateLimit != "" {
+			rateLimitRoutes[pattern] = route.RateLimit
+		}
+	}
+	mux.HandleFunc("GET "+apiPrefix+"/openapi.json", getOpenAPIDocument)
+	mux.HandleFunc("OPTIONS "+apiPrefix+"/updates", optionsAPIUpdates)
+	mux.HandleFunc("POST "+updatesAliasPath, postAPIUpdates)
+	mux.HandleFunc("OPTIONS "+updatesAliasPath, optionsAPIUpdates)
+	rateLimitRoutes["POST "+updatesAliasPath] = rateLimitRead
+}
+
+var (
+	errThemeExists     = errors.New("theme already exists")
+	errPreviewNotFound = errors.New("preview not found")
+	errLastAdmin       = errors.New("can't remove the last admin of a theme")
+)
+
+func writeAPIJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	exerrors.PanicIfNotNil(json.NewEncoder(w).Encode(data))
+}
+
+func writeAPIError(w http.ResponseWriter, status int, errcode, message string) {
+	writeAPIJSON(w, status, &client.Error{ErrCode: errcode, Message: message})
+}
+
+// writeAPIErrorFrom maps the known errors from the shared write paths to API errors.
+// Unknown errors are logged and returned as internal errors.
+func writeAPIErrorFrom(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errThemeNotFound), errors.Is(err, errPreviewNotFound), errors.Is(err, errReleaseNotFound):
+		writeAPIError(w, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, errNotAdmin), errors.Is(err, errTokenScopeDenied), errors.Is(err, errTokenReadDenied):
+		writeAPIError(w, http.StatusForbidden, "forbidden", err.Error())
+	case errors.Is(err, errServerBlocked):
+		writeAPIError(w, http.StatusForbidden, "server_blocked", err.Error())
+	case errors.Is(err, errUserBanned):
+		writeAPIError(w, http.StatusForbidden, "banned", err.Error())
+	case errors.Is(err, errThemeFrozen):
+		writeAPIError(w, http.StatusForbidden, "theme_frozen", err.Error())
+	case errors.Is(err, errInvalidVersion):
+		writeAPIError(w, http.StatusConflict, "version_conflict", "the theme has been updated since the expected version")
+	case errors.Is(err, errThemeExists), errors.Is(err, errLastAdmin), errors.Is(err, errTagExists):
+		writeAPIError(w, http.StatusConflict, "conflict", err.Error())
+	case errors.Is(err, errTooManyPreviews):
+		writeAPIError(w, http.StatusBadRequest, "too_many_previews", err.Error())
+	case errors.Is(err, errInvalidTagName), errors.Is(err, errUnknownChannel):
+		writeAPIError(w, http.StatusBadRequest, "invalid_name", err.Error())
+	case errors.Is(err, errReleaseVersionGone):
+		writeAPIError(w, http.StatusBadRequest, "unknown_version", err.Error())
+	case errors.Is(err, errMissingAuth), errors.Is(err, errUnsupportedAuth), errors.Is(err, errInvalidAPIToken):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="css.gomuks.app"`)
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+	default:
+		hlog.FromRequest(r).Err(err).Msg("API request failed")
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "internal server error")
+	}
+}
+
+// readAPIRequest decodes the JSON request body into the given struct and writes an error if it's invalid.
+func readAPIRequest(w http.ResponseWriter, r *http.Request, into any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(into); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_json", fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// apiAuth authenticates the request and checks that the token (if any) can write to the given theme.
+func apiAuth(w http.ResponseWriter, r *http.Request, themeID database.ThemeID) *authInfo {
+	auth, err := authenticateWrite(r)
+	if err == nil && !auth.CanWrite(themeID) {
+		err = errTokenScopeDenied
+	}
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return nil
+	}
+	return auth
+}
+
+// apiReadAuth authenticates the request and checks that the token (if any) can read private data of the theme.
+// Unlike writes, reads are allowed for banned users and blocked homeservers.
+func apiReadAuth(w http.ResponseWriter, r *http.Request, themeID database.ThemeID) *authInfo {
+	auth, err := authenticateRequest(r)
+	if err == nil && !auth.CanRead(themeID) {
+		err = errTokenReadDenied
+	}
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return nil
+	}
+	return auth
+}
+
+// getAdminTheme loads a theme inside a transaction and checks that the user is an admin of it.
+func getAdminTheme(ctx context.Context, themeID database.ThemeID, userID id.UserID) (*database.Theme, error) {
+	theme, err := db.Theme.Get(ctx, themeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get theme: %w", err)
+	} else if theme == nil {
+		return nil, errThemeNotFound
+	} else if !theme.IsAdmin(userID) {
+		return nil, errNotAdmin
+	}
+	return theme, nil
+}
+
+func validateThemeMeta(name, description string) string {
+	if len(name) > cfg.Limits.NameMaxLength {
+		return fmt.Sprintf("name is too long (maximum is %d bytes)", cfg.Limits.NameMaxLength)
+	} else if len(description) > cfg.Limits.DescriptionMaxLength {
+		return fmt.Sprintf("description is too long (maximum is %d bytes)", cfg.Limits.DescriptionMaxLength)
+	}
+	return ""
+}
+
+func getAPITheme(w http.ResponseWriter, r *http.Request) {
+	theme, err := db.Theme.Get(r.Context(), database.ThemeID(r.PathValue("themeID")))
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+	} else if theme == nil {
+		writeAPIErrorFrom(w, r, errThemeNotFound)
+	} else {
+		writeAPIJSON(w, http.StatusOK, theme)
+	}
+}
+
+func getAPICommits(w http.ResponseWriter, r *http.Request) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	theme, err := db.Theme.Get(r.Context(), themeID)
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	} else if theme == nil {
+		writeAPIErrorFrom(w, r, errThemeNotFound)
+		return
+	}
+	commits, err := db.Commit.GetAll(r.Context(), themeID)
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, commits)
+}
+
+func postAPITheme(w http.ResponseWriter, r *http.Request) {
+	var req client.CreateThemeRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	} else if !cfg.Limits.ValidThemeID(string(req.ID)) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_theme_id", "invalid theme ID")
+		return
+	} else if msg := validateThemeMeta(req.Name, req.Description); msg != "" {
+		writeAPIError(w, http.StatusBadRequest, "too_long", msg)
+		return
+	} else if err := validateCommitContent(req.Content, req.Message); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "too_long", err.Error())
+		return
+	}
+	auth := apiAuth(w, r, req.ID)
+	if auth == nil {
+		return
+	}
+	if req.Name == "" {
+		req.Name = string(req.ID)
+	}
+	var theme *database.Theme
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		existing, err := db.Theme.Get(ctx, req.ID)
+		if err != nil {
+			return err
+		} else if existing != nil {
+			return errThemeExists
+		}
+		theme, err = addThemeCommit(ctx, auth.UserID, &themeCommitParams{
+			ThemeID:     req.ID,
+			Version:     1,
+			Name:        req.Name,
+			Description: req.Description,
+			Content:     req.Content,
+			Message:     req.Message,
+		})
+		return err
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	countCommit("api", theme.LatestCommit.Version)
+	announceCommits(r.Context(), theme.ID, theme.LatestCommit.Version)
+	writeAPIJSON(w, http.StatusCreated, theme)
+}
+
+func patchAPITheme(w http.ResponseWriter, r *http.Request) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	var req client.UpdateThemeRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	auth := apiAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	var theme *database.Theme
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) (err error) {
+		theme, err = getAdminTheme(ctx, themeID, auth.UserID)
+		if err != nil {
+			return err
+		}
+		before := themeMeta(theme)
+		if req.Name != nil {
+			theme.Name = *req.Name
+			if theme.Name == "" {
+				theme.Name = string(theme.ID)
+			}
+		}
+		if req.Description != nil {
+			theme.Description = *req.Description
+		}
+		if req.FollowStable != nil {
+			theme.FollowStable = *req.FollowStable
+		}
+		if *before == *themeMeta(theme) {
+			return nil
+		} else if err = db.Theme.Update(ctx, theme); err != nil {
+			return err
+		}
+		return recordAudit(ctx, &database.AuditEntry{
+			Actor:   string(auth.UserID),
+			Action:  database.AuditThemeUpdate,
+			ThemeID: theme.ID,
+			Before:  auditJSON(before),
+			After:   auditJSON(themeMeta(theme)),
+		})
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, theme)
+}
+
+func postAPICommit(w http.ResponseWriter, r *http.Request) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	var req client.CommitRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	} else if err := validateCommitContent(req.Content, req.Message); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "too_long", err.Error())
+		return
+	}
+	auth := apiAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	var theme *database.Theme
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		existing, err := getAdminTheme(ctx, themeID, auth.UserID)
+		if err != nil {
+			return err
+		}
+		version := existing.LatestCommit.Version + 1
+		if req.ExpectedVersion != nil {
+			version = *req.ExpectedVersion + 1
+		}
+		theme, err = addThemeCommit(ctx, auth.UserID, &themeCommitParams{
+			ThemeID:  themeID,
+			Version:  version,
+			KeepMeta: true,
+			Content:  req.Content,
+			Message:  req.Message,
+			Breaking: req.Breaking,
+		})
+		return err
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	countCommit("api", theme.LatestCommit.Version)
+	announceCommits(r.Context(), theme.ID, theme.LatestCommit.Version)
+	writeAPIJSON(w, http.StatusCreated, &theme.LatestCommit)
+}
+
+func postAPIPreview(w http.ResponseWriter, r *http.Request) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	auth := apiAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, cfg.Limits.MaxPreviewSize+1))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "failed to read request body")
+		return
+	} else if int64(len(data)) > cfg.Limits.MaxPreviewSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf(
+			"preview images can be at most %d bytes", cfg.Limits.MaxPreviewSize,
+		))
+		return
+	}
+	preview, err := parsePreviewImage(data, themeID, auth.UserID)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_image", err.Error())
+		return
+	}
+	err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		theme, err := getAdminTheme(ctx, themeID, auth.UserID)
+		if err != nil {
+			return err
+		} else if len(theme.Previews) >= cfg.Limits.MaxPreviewCount {
+			return errTooManyPreviews
+		} else if err = db.PreviewImage.Add(ctx, preview); err != nil {
+			return err
+		} else if err = recordPreviewAudit(ctx, auth.UserID, database.AuditPreviewAdd, themeID, preview.ID); err != nil {
+			return err
+		}
+		return queuePreviewWebhooks(ctx, auth.UserID, themeID, []uuid.UUID{preview.ID}, nil)
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusCreated, &client.PreviewResponse{
+		ID:       preview.ID,
+		Width:    preview.Width,
+		Height:   preview.Height,
+		MimeType: preview.MimeType,
+	})
+}
+
+func deleteAPIPreview(w http.ResponseWriter, r *http.Request) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	imageID, err := uuid.Parse(r.PathValue("imageID"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "invalid image ID")
+		return
+	}
+	auth := apiAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	var theme *database.Theme
+	err = db.DoTxn(r.Context(), nil, func(ctx context.Context) (err error) {
+		theme, err = getAdminTheme(ctx, themeID, auth.UserID)
+		if err != nil {
+			return err
+		}
+		idx := slices.Index(theme.Previews, imageID)
+		if idx == -1 {
+			return errPreviewNotFound
+		}
+		theme.Previews = slices.Delete(theme.Previews, idx, idx+1)
+		if err = db.PreviewImage.Delete(ctx, imageID); err != nil {
+			return err
+		} else if err = recordPreviewAudit(ctx, auth.UserID, database.AuditPreviewDelete, themeID, imageID); err != nil {
+			return err
+		}
+		return queuePreviewWebhooks(ctx, auth.UserID, themeID, nil, []uuid.UUID{imageID})
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, theme)
+}
+
+func putAPIAdmin(w http.ResponseWriter, r *http.Request) {
+	updateAPIAdmin(w, r, true)
+}
+
+func deleteAPIAdmin(w http.ResponseWriter, r *http.Request) {
+	updateAPIAdmin(w, r, false)
+}
+
+func updateAPIAdmin(w http.ResponseWriter, r *http.Request, add bool) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	userID, err := parseUserID(r.PathValue("userID"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_user_id", err.Error())
+		return
+	}
+	auth := apiAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	var theme *database.Theme
+	err = db.DoTxn(r.Context(), nil, func(ctx context.Context) (err error) {
+		theme, err = getAdminTheme(ctx, themeID, auth.UserID)
+		if err != nil {
+			return err
+		}
+		before := slices.Clone(theme.Admins)
+		if add {
+			if theme.IsAdmin(userID) {
+				return nil
+			}
+			theme.Admins = append(theme.Admins, userID)
+			if err = db.Theme.AddAdmin(ctx, themeID, userID); err != nil {
+				return err
+			}
+			return recordAdminAudit(ctx, string(auth.UserID), database.AuditAdminAdd, themeID, userID, before, theme.Admins)
+		} else if !theme.IsAdmin(userID) {
+			return nil
+		} else if len(theme.Admins) == 1 {
+			return errLastAdmin
+		}
+		theme.Admins = slices.DeleteFunc(theme.Admins, func(admin id.UserID) bool {
+			return admin == userID
+		})
+		if err = db.Theme.RemoveAdmin(ctx, themeID, userID); err != nil {
+			return err
+		}
+		return recordAdminAudit(ctx, string(auth.UserID), database.AuditAdminRemove, themeID, userID, before, theme.Admins)
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, theme)
+}
+
+func getAPIDrafts(w http.ResponseWriter, r *http.Request) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	auth := apiReadAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	theme, err := getAdminTheme(r.Context(), themeID, auth.UserID)
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	resp := &client.DraftsResponse{PreviewExpiry: time.Now().Add(DraftPreviewLifetime)}
+	if resp.Drafts, err = db.Draft.GetByTheme(r.Context(), theme.ID); err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	resp.PreviewURLs = make(map[int64]string, len(resp.Drafts))
+	for _, draft := range resp.Drafts {
+		resp.PreviewURLs[draft.ID] = draftPreviewURL(draft, resp.PreviewExpiry)
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+func getAPIReleases(w http.ResponseWriter, r *http.Request) {
+	theme, err := db.Theme.Get(r.Context(), database.ThemeID(r.PathValue("themeID")))
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	} else if theme == nil {
+		writeAPIErrorFrom(w, r, errThemeNotFound)
+		return
+	}
+	writeAPIReleases(w, r, theme)
+}
+
+func writeAPIReleases(w http.ResponseWriter, r *http.Request, theme *database.Theme) {
+	resp := &client.ReleasesResponse{FollowStable: theme.FollowStable}
+	var err error
+	if resp.Channels, err = db.Channel.GetByTheme(r.Context(), theme.ID); err != nil {
+		writeAPIErrorFrom(w, r, err)
+	} else if resp.Tags, err = db.Tag.GetByTheme(r.Context(), theme.ID); err != nil {
+		writeAPIErrorFrom(w, r, err)
+	} else {
+		writeAPIJSON(w, http.StatusOK, resp)
+	}
+}
+
+func putAPITag(w http.ResponseWriter, r *http.Request) {
+	putAPIRelease(w, r, "tag", http.StatusCreated, createTag)
+}
+
+func putAPIChannel(w http.ResponseWriter, r *http.Request) {
+	putAPIRelease(w, r, "channel", http.StatusOK, setChannel)
+}
+
+// putAPIRelease creates a tag or moves a channel, depending on the update function.
+func putAPIRelease(
+	w http.ResponseWriter, r *http.Request, pathKey string, status int,
+	update func(ctx context.Context, userID id.UserID, theme *database.Theme, name string, version int) (*database.Release, error),
+) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	var req client.ReleaseRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+	auth := apiAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	var release *database.Release
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		theme, err := getAdminTheme(ctx, themeID, auth.UserID)
+		if err != nil {
+			return err
+		}
+		release, err = update(ctx, auth.UserID, theme, r.PathValue(pathKey), req.Version)
+		return err
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	writeAPIJSON(w, status, release)
+}
+
+func deleteAPITag(w http.ResponseWriter, r *http.Request) {
+	deleteAPIRelease(w, r, "tag", deleteTag)
+}
+
+func deleteAPIChannel(w http.ResponseWriter, r *http.Request) {
+	deleteAPIRelease(w, r, "channel", clearChannel)
+}
+
+func deleteAPIRelease(
+	w http.ResponseWriter, r *http.Request, pathKey string,
+	remove func(ctx context.Context, userID id.UserID, theme *database.Theme, name string) error,
+) {
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	auth := apiAuth(w, r, themeID)
+	if auth == nil {
+		return
+	}
+	var theme *database.Theme
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) (err error) {
+		theme, err = getAdminTheme(ctx, themeID, auth.UserID)
+		if err != nil {
+			return err
+		}
+		return remove(ctx, auth.UserID, theme, r.PathValue(pathKey))
+	})
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	writeAPIReleases(w, r, theme)
+}
+
+// updatesAliasPath serves the update check outside the versioned API prefix too, so that clients
+// embedded in gomuks web don't have to change when the API version is bumped.
+const updatesAliasPath = "/api/updates"
+
+// maxUpdateCheckThemes is the maximum number of themes in a single update check request.
+const maxUpdateCheckThemes = 100
+
+// optionsAPIUpdates allows update checks from any origin, as gomuks web runs on user-chosen domains.
+// The endpoint only returns public data, so credentials aren't allowed.
+func optionsAPIUpdates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func postAPIUpdates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var req client.UpdateCheckRequest
+	if !readAPIRequest(w, r, &req) {
+		return
+	} else if len(req.Themes) > maxUpdateCheckThemes {
+		writeAPIError(w, http.StatusBadRequest, "too_many_themes", fmt.Sprintf(
+			"at most %d themes can be checked at once", maxUpdateCheckThemes,
+		))
+		return
+	}
+	themeIDs := make([]database.ThemeID, 0, len(req.Themes))
+	versions := make([]int, 0, len(req.Themes))
+	for _, theme := range req.Themes {
+		if !slices.Contains(themeIDs, theme.ThemeID) {
+			themeIDs = append(themeIDs, theme.ThemeID)
+			versions = append(versions, theme.Version)
+		}
+	}
+	updates, err := db.Commit.GetUpdates(r.Context(), themeIDs, versions)
+	if err != nil {
+		writeAPIErrorFrom(w, r, err)
+		return
+	}
+	if updates == nil {
+		updates = []*database.ThemeUpdate{}
+	}
+	writeAPIJSON(w, http.StatusOK, &client.UpdateCheckResponse{Updates: updates})
+}
@@ -0,0 +1,80 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"css.gomuks.app/client"
+	"css.gomuks.app/database"
+)
+
+func TestPostAPIUpdates(t *testing.T) {
+	cfg = defaultConfig()
+	ctx := setupTestDB(t)
+	for _, theme := range []struct {
+		id       database.ThemeID
+		versions int
+	}{{"aaa", 3}, {"zzz", 2}} {
+		for version := 1; version <= theme.versions; version++ {
+			err := db.DoTxn(ctx, nil, func(ctx context.Context) error {
+				_, err := addThemeCommit(ctx, "@meow:example.com", &themeCommitParams{ThemeID: theme.id, Version: version, Name: string(theme.id), Content: "body {}", Breaking: version == 2})
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mux := http.NewServeMux()
+	registerAPIRoutes(mux)
+	body, _ := json.Marshal(&client.UpdateCheckRequest{Themes: []client.ThemeVersion{
+		{ThemeID: "zzz", Version: 2},
+		{ThemeID: "unknown", Version: 1},
+		{ThemeID: "aaa", Version: 1},
+	}})
+	for _, path := range []string{updatesAliasPath, apiPrefix + "/updates"} {
+		t.Run(path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)).WithContext(ctx))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+			}
+			var resp client.UpdateCheckResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			} else if len(resp.Updates) != 2 {
+				t.Fatalf("got %d updates, want 2", len(resp.Updates))
+			}
+			// Updates are in request order, with unknown themes left out
+			upToDate, updated := resp.Updates[0], resp.Updates[1]
+			if upToDate.ThemeID != "zzz" || upToDate.LatestVersion != 2 || len(upToDate.Changelog) != 0 || upToDate.Breaking {
+				t.Errorf("unexpected update for zzz: %+v", upToDate)
+			}
+			if updated.ThemeID != "aaa" || updated.LatestVersion != 3 || len(updated.Changelog) != 2 || !updated.Breaking {
+				t.Errorf("unexpected update for aaa: %+v", updated)
+			} else if updated.Changelog[0].Version != 3 || updated.Changelog[1].Version != 2 {
+				t.Errorf("changelog isn't newest first: %d, %d", updated.Changelog[0].Version, updated.Changelog[1].Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/exerrors"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+// cliActor is the audit log actor for operator subcommands.
+const cliActor = "cli"
+
+// auditThemeMeta is the before/after value of theme metadata edits.
+type auditThemeMeta struct {
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	FollowStable bool   `json:"follow_stable"`
+}
+
+func themeMeta(theme *database.Theme) *auditThemeMeta {
+	return &auditThemeMeta{Name: theme.Name, Description: theme.Description, FollowStable: theme.FollowStable}
+}
+
+// auditJSON marshals a before or after value for the audit log. Nil values are stored as NULL.
+func auditJSON(val any) json.RawMessage {
+	if val == nil {
+		return nil
+	}
+	return exerrors.Must(json.Marshal(val))
+}
+
+// recordAudit appends an entry to the audit log. It should be called in the same transaction
+// as the change itself, so that changes are never made without being logged.
+func recordAudit(ctx context.Context, entry *database.AuditEntry) error {
+	entry.CreatedAt = time.Now()
+	if err := db.AuditLog.Add(ctx, entry); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+func recordPreviewAudit(ctx context.Context, actor id.UserID, action database.AuditAction, themeID database.ThemeID, imageID uuid.UUID) error {
+	return recordAudit(ctx, &database.AuditEntry{
+		Actor:   string(actor),
+		Action:  action,
+		ThemeID: themeID,
+		Target:  imageID.String(),
+	})
+}
+
+// recordAdminAudit logs an admin being added or removed, with the full admin list before and after.
+func recordAdminAudit(ctx context.Context, actor string, action database.AuditAction, themeID database.ThemeID, target id.UserID, before, after []id.UserID) error {
+	return recordAudit(ctx, &database.AuditEntry{
+		Actor:   actor,
+		Action:  action,
+		ThemeID: themeID,
+		Target:  string(target),
+		Before:  auditJSON(before),
+		After:   auditJSON(after),
+	})
+}
+
+// deletedThemeAudit is the before value of deleted themes.
+func deletedThemeAudit(theme *database.Theme) any {
+	return map[string]any{
+		"name":        theme.Name,
+		"description": theme.Description,
+		"admins":      theme.Admins,
+		"version":     theme.LatestCommit.Version,
+	}
+}
+
+const auditPageSize = 100
+
+type AuditLogPageData struct {
+	Theme   *database.Theme
+	Entries []*database.AuditEntry
+	// NextBefore is the ID to pass as ?before= to get the next page, or 0 if this is the last page
+	NextBefore int64
+}
+
+func getAuditPageParams(r *http.Request) int64 {
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	return max(before, 0)
+}
+
+func sendAuditLogPage(w http.ResponseWriter, r *http.Request, title string, data *AuditLogPageData) {
+	if len(data.Entries) == auditPageSize {
+		data.NextBefore = data.Entries[len(data.Entries)-1].ID
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, http.StatusOK, &ContainerData{
+		PageTitle: title,
+		Page:      "audit-log.gohtml",
+		Data:      data,
+	})
+}
+
+func getThemeAuditLogPage(w http.ResponseWriter, r *http.Request) {
+	userID := verifyCookie(r)
+	if userID == "" {
+		redirectToLogin(w, r)
+		return
+	}
+	log := hlog.FromRequest(r)
+	theme, err := db.Theme.Get(r.Context(), database.ThemeID(r.PathValue("themeID")))
+	if err != nil {
+		log.Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if theme == nil {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	} else if !theme.IsAdmin(userID) && !viewerIsModerator(r) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return
+	}
+	entries, err := db.AuditLog.GetThemePage(r.Context(), theme.ID, getAuditPageParams(r), auditPageSize)
+	if err != nil {
+		log.Err(err).Msg("Failed to get audit log")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	sendAuditLogPage(w, r, theme.Name+" - audit log", &AuditLogPageData{Theme: theme, Entries: entries})
+}
+
+func getAuditLogPage(w http.ResponseWriter, r *http.Request) {
+	if verifyModerator(w, r) == "" {
+		return
+	}
+	entries, err := db.AuditLog.GetPage(r.Context(), getAuditPageParams(r), auditPageSize)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get audit log")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	sendAuditLogPage(w, r, "audit log", &AuditLogPageData{Entries: entries})
+}
@@ -0,0 +1,61 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+func TestThemeRenameMovesAuditLog(t *testing.T) {
+	cfg = defaultConfig()
+	ctx := setupTestDB(t)
+	const userID id.UserID = "@meow:example.com"
+	err := db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		_, err := addThemeCommit(ctx, userID, &themeCommitParams{ThemeID: "meowtheme", Version: 1, Name: "Meow theme", Content: "body { color: pink; }"})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Theme.Rename(ctx, "meowtheme", "nyantheme"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := db.AuditLog.GetThemePage(ctx, "meowtheme", 0, 10); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("got %d entries under the old ID, want 0", len(entries))
+	}
+	entries, err := db.AuditLog.GetThemePage(ctx, "nyantheme", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Action != database.AuditThemeCreate {
+		t.Fatalf("got %+v under the new ID, want the theme creation entry", entries)
+	}
+
+	// Moving entries is the only update the trigger allows
+	if _, err = db.Exec(ctx, "UPDATE audit_log SET actor = 'someone else' WHERE id = $1", entries[0].ID); err == nil {
+		t.Error("changing the actor of an audit log entry succeeded")
+	}
+	if _, err = db.Exec(ctx, "DELETE FROM audit_log WHERE id = $1", entries[0].ID); err == nil {
+		t.Error("deleting an audit log entry succeeded")
+	}
+}
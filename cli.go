@@ -0,0 +1,515 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/client"
+	"css.gomuks.app/database"
+)
+
+var errUsage = errors.New("invalid usage")
+
+type cliContext struct {
+	context.Context
+	Args  []string
+	Flags *flag.FlagSet
+	JSON  bool
+	Out   io.Writer
+}
+
+// Print writes data as JSON if the -json flag was given, otherwise it calls human with a tabwriter.
+func (cc *cliContext) Print(data any, human func(w io.Writer)) {
+	if cc.JSON {
+		enc := json.NewEncoder(cc.Out)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(data)
+		return
+	}
+	tw := tabwriter.NewWriter(cc.Out, 0, 4, 2, ' ', 0)
+	human(tw)
+	_ = tw.Flush()
+}
+
+type cliCommand struct {
+	Name        string
+	Args        string
+	Description string
+	MinArgs     int
+	MaxArgs     int
+	Flags       func(fs *flag.FlagSet)
+	Run         func(cc *cliContext) error
+}
+
+var cliCommands []*cliCommand
+
+func init() {
+	cliCommands = []*cliCommand{
+		{Name: "theme list", Description: "List all themes", Run: cliThemeList},
+		{Name: "theme show", Args: "<theme ID>", MinArgs: 1, MaxArgs: 1, Description: "Show theme details", Run: cliThemeShow},
+		{Name: "theme delete", Args: "<theme ID>", MinArgs: 1, MaxArgs: 1, Description: "Delete a theme including all commits and previews", Run: cliThemeDelete},
+		{Name: "theme rename", Args: "<old ID> <new ID>", MinArgs: 2, MaxArgs: 2, Description: "Change the ID of a theme", Run: cliThemeRename},
+		{Name: "admin add", Args: "<theme ID> <user ID>", MinArgs: 2, MaxArgs: 2, Description: "Add an admin to a theme", Run: cliAdminAdd},
+		{Name: "admin remove", Args: "<theme ID> <user ID>", MinArgs: 2, MaxArgs: 2, Description: "Remove an admin from a theme", Run: cliAdminRemove},
+		{Name: "commit show", Args: "<theme ID> <version>", MinArgs: 2, MaxArgs: 2, Description: "Show a single commit", Run: cliCommitShow},
+		{Name: "image gc", Description: "Delete preview images that don't belong to any theme", Run: cliImageGC, Flags: func(fs *flag.FlagSet) {
+			fs.Bool("dry-run", false, "Only count the images, don't delete them")
+		}},
+		{Name: "export", Args: "<file.tar.gz|->", MinArgs: 1, MaxArgs: 1, Description: "Export all themes, commits, admins and previews into an archive", Run: cliExport},
+		{Name: "import", Args: "<file.tar.gz|->", MinArgs: 1, MaxArgs: 1, Description: "Import an export archive, skipping existing data and reporting conflicts", Run: cliImport, Flags: func(fs *flag.FlagSet) {
+			fs.Bool("dry-run", false, "Roll back the import after reporting what would change")
+		}},
+		{Name: "moderator list", Description: "List site moderators", Run: cliModeratorList},
+		{Name: "moderator add", Args: "<user ID>", MinArgs: 1, MaxArgs: 1, Description: "Make a user a site moderator", Run: cliModeratorAdd},
+		{Name: "moderator remove", Args: "<user ID>", MinArgs: 1, MaxArgs: 1, Description: "Remove a site moderator added with moderator add", Run: cliModeratorRemove},
+		{Name: "user logout", Args: "<user ID>", MinArgs: 1, MaxArgs: 1, Description: "Revoke all login sessions of a user", Run: cliUserLogout},
+		{Name: "user purge", Args: "<user ID>", MinArgs: 1, MaxArgs: 1, Description: "Delete themes owned only by a user, their admin rights, preview images, API tokens and sessions", Run: cliUserPurge},
+	}
+}
+
+func printCLIUsage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Usage: %s [-config path] <command> [-json] [args...]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range cliCommands {
+		_, _ = fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.Name, cmd.Args, cmd.Description)
+	}
+	_ = tw.Flush()
+}
+
+func findCLICommand(args []string) (*cliCommand, []string) {
+	for _, cmd := range cliCommands {
+		parts := strings.Fields(cmd.Name)
+		if len(args) >= len(parts) && slices.Equal(args[:len(parts)], parts) {
+			return cmd, args[len(parts):]
+		}
+	}
+	return nil, nil
+}
+
+// runCLI runs an operator subcommand and returns the process exit code.
+func runCLI(ctx context.Context, args []string) int {
+	cmd, cmdArgs := findCLICommand(args)
+	if cmd == nil {
+		printCLIUsage(os.Stderr)
+		return 2
+	}
+	fs := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "Output JSON instead of human-readable text")
+	if cmd.Flags != nil {
+		cmd.Flags(fs)
+	}
+	if err := fs.Parse(cmdArgs); err != nil {
+		return 2
+	}
+	if fs.NArg() < cmd.MinArgs || fs.NArg() > cmd.MaxArgs {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], cmd.Name, cmd.Args)
+		return 2
+	}
+	cc := &cliContext{Context: ctx, Args: fs.Args(), Flags: fs, JSON: *jsonOutput, Out: os.Stdout}
+	if err := cmd.Run(cc); errors.Is(err, errUsage) {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], cmd.Name, cmd.Args)
+		return 2
+	} else if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func (cc *cliContext) flagBool(name string) bool {
+	return cc.Flags.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+func cliGetTheme(cc *cliContext, themeID database.ThemeID) (*database.Theme, error) {
+	theme, err := db.Theme.Get(cc, themeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get theme: %w", err)
+	} else if theme == nil {
+		return nil, fmt.Errorf("theme %s not found", themeID)
+	}
+	return theme, nil
+}
+
+type cliResult struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+func (cc *cliContext) printOK(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	cc.Print(&cliResult{OK: true, Message: msg}, func(w io.Writer) {
+		_, _ = fmt.Fprintln(w, msg)
+	})
+}
+
+func cliThemeList(cc *cliContext) error {
+	themes, err := db.Theme.GetAll(cc)
+	if err != nil {
+		return fmt.Errorf("failed to get themes: %w", err)
+	}
+	cc.Print(themes, func(w io.Writer) {
+		_, _ = fmt.Fprintln(w, "ID\tNAME\tVERSION\tUPDATED\tADMINS")
+		for _, theme := range themes {
+			_, _ = fmt.Fprintf(
+				w, "%s\t%s\t%d\t%s\t%s\n",
+				theme.ID, theme.Name, theme.LatestCommit.Version,
+				theme.LatestCommit.CreatedAt.Format("2006-01-02 15:04"), joinUserIDs(theme.Admins),
+			)
+		}
+	})
+	return nil
+}
+
+func joinUserIDs(userIDs []id.UserID) string {
+	strs := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		strs[i] = string(userID)
+	}
+	return strings.Join(strs, ", ")
+}
+
+func cliThemeShow(cc *cliContext) error {
+	theme, err := cliGetTheme(cc, database.ThemeID(cc.Args[0]))
+	if err != nil {
+		return err
+	}
+	cc.Print(theme, func(w io.Writer) {
+		_, _ = fmt.Fprintf(w, "ID:\t%s\n", theme.ID)
+		_, _ = fmt.Fprintf(w, "Name:\t%s\n", theme.Name)
+		_, _ = fmt.Fprintf(w, "Admins:\t%s\n", joinUserIDs(theme.Admins))
+		_, _ = fmt.Fprintf(w, "Latest version:\t%d\n", theme.LatestCommit.Version)
+		_, _ = fmt.Fprintf(w, "Updated at:\t%s\n", theme.LatestCommit.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+		_, _ = fmt.Fprintf(w, "Updated by:\t%s\n", theme.LatestCommit.CreatedBy)
+		_, _ = fmt.Fprintf(w, "Content size:\t%d bytes\n", len(theme.LatestCommit.Content))
+		for i, preview := range theme.Previews {
+			_, _ = fmt.Fprintf(w, "Preview #%d:\t%s\n", i+1, preview)
+		}
+		_, _ = fmt.Fprintf(w, "Description:\n%s\n", theme.Description)
+	})
+	return nil
+}
+
+func cliThemeDelete(cc *cliContext) error {
+	theme, err := cliGetTheme(cc, database.ThemeID(cc.Args[0]))
+	if err != nil {
+		return err
+	}
+	err = db.DoTxn(cc, nil, func(ctx context.Context) error {
+		err := queueWebhooks(ctx, &client.WebhookPayload{Event: client.WebhookEventDelete, ThemeID: theme.ID})
+		if err != nil {
+			return err
+		} else if err = db.Theme.Delete(ctx, theme.ID); err != nil {
+			return fmt.Errorf("failed to delete theme: %w", err)
+		}
+		return recordAudit(ctx, &database.AuditEntry{
+			Actor:   cliActor,
+			Action:  database.AuditThemeDelete,
+			ThemeID: theme.ID,
+			Before:  auditJSON(deletedThemeAudit(theme)),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cc.printOK("Deleted theme %s", theme.ID)
+	return nil
+}
+
+func cliThemeRename(cc *cliContext) error {
+	oldID, newID := database.ThemeID(cc.Args[0]), database.ThemeID(cc.Args[1])
+	if !cfg.Limits.ValidThemeID(string(newID)) {
+		return fmt.Errorf("%s is not a valid theme ID", newID)
+	} else if existing, err := db.Theme.Get(cc, newID); err != nil {
+		return fmt.Errorf("failed to check if new ID is in use: %w", err)
+	} else if existing != nil {
+		return fmt.Errorf("theme %s already exists", newID)
+	}
+	err := db.DoTxn(cc, nil, func(ctx context.Context) error {
+		if err := db.Theme.Rename(ctx, oldID, newID); err != nil {
+			return fmt.Errorf("failed to rename theme: %w", err)
+		}
+		return recordAudit(ctx, &database.AuditEntry{
+			Actor:   cliActor,
+			Action:  database.AuditThemeRename,
+			ThemeID: newID,
+			Before:  auditJSON(map[string]any{"id": oldID}),
+			After:   auditJSON(map[string]any{"id": newID}),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cc.printOK("Renamed theme %s to %s", oldID, newID)
+	return nil
+}
+
+func parseUserID(raw string) (id.UserID, error) {
+	userID := id.UserID(raw)
+	if _, _, err := userID.ParseAndValidate(); err != nil {
+		return "", fmt.Errorf("invalid user ID: %w", err)
+	}
+	return userID, nil
+}
+
+func cliAdminAdd(cc *cliContext) error {
+	theme, err := cliGetTheme(cc, database.ThemeID(cc.Args[0]))
+	if err != nil {
+		return err
+	}
+	userID, err := parseUserID(cc.Args[1])
+	if err != nil {
+		return err
+	} else if theme.IsAdmin(userID) {
+		return fmt.Errorf("%s is already an admin of %s", userID, theme.ID)
+	}
+	err = db.DoTxn(cc, nil, func(ctx context.Context) error {
+		if err := db.Theme.AddAdmin(ctx, theme.ID, userID); err != nil {
+			return fmt.Errorf("failed to add admin: %w", err)
+		}
+		after := append(slices.Clone(theme.Admins), userID)
+		return recordAdminAudit(ctx, cliActor, database.AuditAdminAdd, theme.ID, userID, theme.Admins, after)
+	})
+	if err != nil {
+		return err
+	}
+	cc.printOK("Added %s as an admin of %s", userID, theme.ID)
+	return nil
+}
+
+func cliAdminRemove(cc *cliContext) error {
+	theme, err := cliGetTheme(cc, database.ThemeID(cc.Args[0]))
+	if err != nil {
+		return err
+	}
+	userID := id.UserID(cc.Args[1])
+	if !theme.IsAdmin(userID) {
+		return fmt.Errorf("%s is not an admin of %s", userID, theme.ID)
+	}
+	err = db.DoTxn(cc, nil, func(ctx context.Context) error {
+		if err := db.Theme.RemoveAdmin(ctx, theme.ID, userID); err != nil {
+			return fmt.Errorf("failed to remove admin: %w", err)
+		}
+		after := slices.DeleteFunc(slices.Clone(theme.Admins), func(admin id.UserID) bool {
+			return admin == userID
+		})
+		return recordAdminAudit(ctx, cliActor, database.AuditAdminRemove, theme.ID, userID, theme.Admins, after)
+	})
+	if err != nil {
+		return err
+	}
+	cc.printOK("Removed %s from the admins of %s", userID, theme.ID)
+	return nil
+}
+
+func cliCommitShow(cc *cliContext) error {
+	themeID := database.ThemeID(cc.Args[0])
+	version, err := strconv.Atoi(cc.Args[1])
+	if err != nil {
+		return fmt.Errorf("%w: version must be an integer", errUsage)
+	}
+	commit, err := db.Commit.Get(cc, themeID, version)
+	if err != nil {
+		return fmt.Errorf("failed to get commit: %w", err)
+	} else if commit == nil {
+		return fmt.Errorf("commit %s v%d not found", themeID, version)
+	}
+	cc.Print(commit, func(w io.Writer) {
+		_, _ = fmt.Fprintf(w, "Theme:\t%s\n", commit.ThemeID)
+		_, _ = fmt.Fprintf(w, "Version:\t%d\n", commit.Version)
+		_, _ = fmt.Fprintf(w, "Created at:\t%s\n", commit.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+		_, _ = fmt.Fprintf(w, "Created by:\t%s\n", commit.CreatedBy)
+		_, _ = fmt.Fprintf(w, "Message:\n%s\n\n%s\n", commit.Message, commit.Content)
+	})
+	return nil
+}
+
+type imageGCResult struct {
+	DryRun bool  `json:"dry_run"`
+	Count  int64 `json:"count"`
+}
+
+func cliImageGC(cc *cliContext) error {
+	dryRun := cc.flagBool("dry-run")
+	count, err := db.PreviewImage.DeleteOrphaned(cc, dryRun)
+	if err != nil {
+		return fmt.Errorf("failed to delete orphaned images: %w", err)
+	}
+	cc.Print(&imageGCResult{DryRun: dryRun, Count: count}, func(w io.Writer) {
+		if dryRun {
+			_, _ = fmt.Fprintf(w, "Found %d orphaned preview images\n", count)
+		} else {
+			_, _ = fmt.Fprintf(w, "Deleted %d orphaned preview images\n", count)
+		}
+	})
+	return nil
+}
+
+type moderatorListEntry struct {
+	*database.Moderator
+	FromConfig bool `json:"from_config"`
+}
+
+func cliModeratorList(cc *cliContext) error {
+	mods, err := db.Moderator.GetAll(cc)
+	if err != nil {
+		return fmt.Errorf("failed to get moderators: %w", err)
+	}
+	entries := make([]moderatorListEntry, 0, len(cfg.Moderators)+len(mods))
+	for _, userID := range cfg.Moderators {
+		entries = append(entries, moderatorListEntry{Moderator: &database.Moderator{UserID: userID}, FromConfig: true})
+	}
+	for _, mod := range mods {
+		if !slices.Contains(cfg.Moderators, mod.UserID) {
+			entries = append(entries, moderatorListEntry{Moderator: mod})
+		}
+	}
+	cc.Print(entries, func(w io.Writer) {
+		_, _ = fmt.Fprintln(w, "USER ID\tADDED")
+		for _, entry := range entries {
+			if entry.FromConfig {
+				_, _ = fmt.Fprintf(w, "%s\tin config\n", entry.UserID)
+			} else {
+				_, _ = fmt.Fprintf(w, "%s\t%s by %s\n", entry.UserID, entry.AddedAt.Format("2006-01-02 15:04"), entry.AddedBy)
+			}
+		}
+	})
+	return nil
+}
+
+func cliModeratorAdd(cc *cliContext) error {
+	userID, err := parseUserID(cc.Args[0])
+	if err != nil {
+		return err
+	} else if isModerator(cc, userID) {
+		return fmt.Errorf("%s is already a moderator", userID)
+	}
+	err = db.DoTxn(cc, nil, func(ctx context.Context) error {
+		err := db.Moderator.Add(ctx, &database.Moderator{UserID: userID, AddedAt: time.Now(), AddedBy: cliActor})
+		if err != nil {
+			return fmt.Errorf("failed to add moderator: %w", err)
+		}
+		return recordAudit(ctx, &database.AuditEntry{Actor: cliActor, Action: database.AuditModeratorAdd, Target: string(userID)})
+	})
+	if err != nil {
+		return err
+	}
+	cc.printOK("Added %s as a moderator", userID)
+	return nil
+}
+
+func cliModeratorRemove(cc *cliContext) error {
+	userID := id.UserID(cc.Args[0])
+	if slices.Contains(cfg.Moderators, userID) {
+		return fmt.Errorf("%s is a moderator in the config file, remove them there instead", userID)
+	} else if mod, err := db.Moderator.Get(cc, userID); err != nil {
+		return fmt.Errorf("failed to get moderator: %w", err)
+	} else if mod == nil {
+		return fmt.Errorf("%s is not a moderator", userID)
+	}
+	err := db.DoTxn(cc, nil, func(ctx context.Context) error {
+		if err := db.Moderator.Remove(ctx, userID); err != nil {
+			return fmt.Errorf("failed to remove moderator: %w", err)
+		}
+		return recordAudit(ctx, &database.AuditEntry{Actor: cliActor, Action: database.AuditModeratorRemove, Target: string(userID)})
+	})
+	if err != nil {
+		return err
+	}
+	cc.printOK("Removed %s from the moderators", userID)
+	return nil
+}
+
+type userLogoutResult struct {
+	UserID   id.UserID `json:"user_id"`
+	Sessions int64     `json:"revoked_sessions"`
+}
+
+func cliUserLogout(cc *cliContext) error {
+	userID, err := parseUserID(cc.Args[0])
+	if err != nil {
+		return err
+	}
+	res := &userLogoutResult{UserID: userID}
+	if res.Sessions, err = db.Session.DeleteByUser(cc, userID); err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	cc.Print(res, func(w io.Writer) {
+		_, _ = fmt.Fprintf(w, "Revoked %d sessions of %s\n", res.Sessions, res.UserID)
+	})
+	return nil
+}
+
+type userPurgeResult struct {
+	UserID          id.UserID          `json:"user_id"`
+	DeletedThemes   []database.ThemeID `json:"deleted_themes"`
+	RemovedAdmin    int64              `json:"removed_admin"`
+	DeletedImages   int64              `json:"deleted_images"`
+	DeletedTokens   int64              `json:"deleted_tokens"`
+	RevokedSessions int64              `json:"revoked_sessions"`
+}
+
+func cliUserPurge(cc *cliContext) error {
+	res := &userPurgeResult{UserID: id.UserID(cc.Args[0])}
+	err := db.DoTxn(cc, nil, func(ctx context.Context) (err error) {
+		if res.DeletedThemes, err = db.Theme.DeleteBySoleAdmin(ctx, res.UserID); err != nil {
+			return fmt.Errorf("failed to delete themes: %w", err)
+		} else if res.RemovedAdmin, err = db.Theme.RemoveAdminFromAll(ctx, res.UserID); err != nil {
+			return fmt.Errorf("failed to remove admin rights: %w", err)
+		} else if res.DeletedImages, err = db.PreviewImage.DeleteByCreator(ctx, res.UserID); err != nil {
+			return fmt.Errorf("failed to delete preview images: %w", err)
+		} else if res.DeletedTokens, err = db.APIToken.DeleteByUser(ctx, res.UserID); err != nil {
+			return fmt.Errorf("failed to delete API tokens: %w", err)
+		} else if res.RevokedSessions, err = db.Session.DeleteByUser(ctx, res.UserID); err != nil {
+			return fmt.Errorf("failed to revoke sessions: %w", err)
+		}
+		return recordAudit(ctx, &database.AuditEntry{
+			Actor:  cliActor,
+			Action: database.AuditUserPurge,
+			Target: string(res.UserID),
+			After:  auditJSON(res),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cc.Print(res, func(w io.Writer) {
+		_, _ = fmt.Fprintf(w, "Purged %s\n", res.UserID)
+		_, _ = fmt.Fprintf(w, "Deleted themes:\t%d\n", len(res.DeletedThemes))
+		for _, themeID := range res.DeletedThemes {
+			_, _ = fmt.Fprintf(w, "\t%s\n", themeID)
+		}
+		_, _ = fmt.Fprintf(w, "Removed admin rights:\t%d\n", res.RemovedAdmin)
+		_, _ = fmt.Fprintf(w, "Deleted preview images:\t%d\n", res.DeletedImages)
+		_, _ = fmt.Fprintf(w, "Deleted API tokens:\t%d\n", res.DeletedTokens)
+		_, _ = fmt.Fprintf(w, "Revoked sessions:\t%d\n", res.RevokedSessions)
+	})
+	return nil
+}
@@ -0,0 +1,206 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package client is a Go client for the css.gomuks.app JSON API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+const DefaultServer = "https://css.gomuks.app"
+
+const apiPath = "/api/v1"
+
+type Client struct {
+	BaseURL *url.URL
+	// Token is an API token from the /tokens page. It's only needed for write calls.
+	Token     string
+	HTTP      *http.Client
+	UserAgent string
+}
+
+// New creates a client for the given server. An empty server URL means DefaultServer.
+func New(serverURL, token string) (*Client, error) {
+	if serverURL == "" {
+		serverURL = DefaultServer
+	}
+	parsed, err := url.Parse(strings.TrimSuffix(serverURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server URL: scheme must be http or https")
+	}
+	return &Client{
+		BaseURL:   parsed,
+		Token:     token,
+		HTTP:      http.DefaultClient,
+		UserAgent: "css.gomuks.app client",
+	}, nil
+}
+
+func (cli *Client) url(path ...string) string {
+	escaped := make([]string, len(path))
+	for i, part := range path {
+		escaped[i] = url.PathEscape(part)
+	}
+	return cli.BaseURL.String() + apiPath + "/" + strings.Join(escaped, "/")
+}
+
+func (cli *Client) do(ctx context.Context, method, url, contentType string, body io.Reader, into any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if cli.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cli.Token)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", cli.UserAgent)
+	resp, err := cli.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respErr := &Error{StatusCode: resp.StatusCode}
+		if json.NewDecoder(resp.Body).Decode(respErr) != nil || respErr.ErrCode == "" {
+			respErr.ErrCode = "unknown"
+			respErr.Message = resp.Status
+		}
+		return respErr
+	}
+	if into != nil {
+		if err = json.NewDecoder(resp.Body).Decode(into); err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return nil
+}
+
+func (cli *Client) doJSON(ctx context.Context, method, url string, reqData, into any) error {
+	var body io.Reader
+	var contentType string
+	if reqData != nil {
+		data, err := json.Marshal(reqData)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	return cli.do(ctx, method, url, contentType, body, into)
+}
+
+func (cli *Client) GetTheme(ctx context.Context, themeID database.ThemeID) (theme *database.Theme, err error) {
+	err = cli.doJSON(ctx, http.MethodGet, cli.url("themes", string(themeID)), nil, &theme)
+	return
+}
+
+func (cli *Client) GetCommits(ctx context.Context, themeID database.ThemeID) (commits []*database.Commit, err error) {
+	err = cli.doJSON(ctx, http.MethodGet, cli.url("themes", string(themeID), "commits"), nil, &commits)
+	return
+}
+
+func (cli *Client) CreateTheme(ctx context.Context, req *CreateThemeRequest) (theme *database.Theme, err error) {
+	err = cli.doJSON(ctx, http.MethodPost, cli.url("themes"), req, &theme)
+	return
+}
+
+func (cli *Client) UpdateTheme(ctx context.Context, themeID database.ThemeID, req *UpdateThemeRequest) (theme *database.Theme, err error) {
+	err = cli.doJSON(ctx, http.MethodPatch, cli.url("themes", string(themeID)), req, &theme)
+	return
+}
+
+func (cli *Client) CreateCommit(ctx context.Context, themeID database.ThemeID, req *CommitRequest) (commit *database.Commit, err error) {
+	err = cli.doJSON(ctx, http.MethodPost, cli.url("themes", string(themeID), "commits"), req, &commit)
+	return
+}
+
+// GetDrafts lists the drafts of a theme. The token only needs read access to the theme.
+func (cli *Client) GetDrafts(ctx context.Context, themeID database.ThemeID) (resp *DraftsResponse, err error) {
+	err = cli.doJSON(ctx, http.MethodGet, cli.url("themes", string(themeID), "drafts"), nil, &resp)
+	return
+}
+
+func (cli *Client) GetReleases(ctx context.Context, themeID database.ThemeID) (resp *ReleasesResponse, err error) {
+	err = cli.doJSON(ctx, http.MethodGet, cli.url("themes", string(themeID), "releases"), nil, &resp)
+	return
+}
+
+// CreateTag adds a tag pointing at a version. Tags can't be moved, so this fails if the tag already exists.
+func (cli *Client) CreateTag(ctx context.Context, themeID database.ThemeID, name string, version int) (tag *database.Release, err error) {
+	err = cli.doJSON(ctx, http.MethodPut, cli.url("themes", string(themeID), "tags", name), &ReleaseRequest{Version: version}, &tag)
+	return
+}
+
+func (cli *Client) DeleteTag(ctx context.Context, themeID database.ThemeID, name string) (resp *ReleasesResponse, err error) {
+	err = cli.doJSON(ctx, http.MethodDelete, cli.url("themes", string(themeID), "tags", name), nil, &resp)
+	return
+}
+
+// SetChannel moves the stable or beta channel to a version.
+func (cli *Client) SetChannel(ctx context.Context, themeID database.ThemeID, name string, version int) (channel *database.Release, err error) {
+	err = cli.doJSON(ctx, http.MethodPut, cli.url("themes", string(themeID), "channels", name), &ReleaseRequest{Version: version}, &channel)
+	return
+}
+
+func (cli *Client) ClearChannel(ctx context.Context, themeID database.ThemeID, name string) (resp *ReleasesResponse, err error) {
+	err = cli.doJSON(ctx, http.MethodDelete, cli.url("themes", string(themeID), "channels", name), nil, &resp)
+	return
+}
+
+// CheckUpdates finds newer versions of multiple themes at once. It doesn't require authentication.
+func (cli *Client) CheckUpdates(ctx context.Context, themes []ThemeVersion) (resp *UpdateCheckResponse, err error) {
+	err = cli.doJSON(ctx, http.MethodPost, cli.url("updates"), &UpdateCheckRequest{Themes: themes}, &resp)
+	return
+}
+
+// UploadPreview uploads a PNG, JPEG or WebP preview image for the theme.
+func (cli *Client) UploadPreview(ctx context.Context, themeID database.ThemeID, contentType string, data []byte) (resp *PreviewResponse, err error) {
+	err = cli.do(ctx, http.MethodPost, cli.url("themes", string(themeID), "previews"), contentType, bytes.NewReader(data), &resp)
+	return
+}
+
+func (cli *Client) DeletePreview(ctx context.Context, themeID database.ThemeID, imageID uuid.UUID) (theme *database.Theme, err error) {
+	err = cli.doJSON(ctx, http.MethodDelete, cli.url("themes", string(themeID), "previews", imageID.String()), nil, &theme)
+	return
+}
+
+func (cli *Client) AddAdmin(ctx context.Context, themeID database.ThemeID, userID id.UserID) (theme *database.Theme, err error) {
+	err = cli.doJSON(ctx, http.MethodPut, cli.url("themes", string(themeID), "admins", string(userID)), nil, &theme)
+	return
+}
+
+func (cli *Client) RemoveAdmin(ctx context.Context, themeID database.ThemeID, userID id.UserID) (theme *database.Theme, err error) {
+	err = cli.doJSON(ctx, http.MethodDelete, cli.url("themes", string(themeID), "admins", string(userID)), nil, &theme)
+	return
+}
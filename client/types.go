@@ -0,0 +1,171 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+// The request and response types below are shared with the server, which uses them to decode
+// requests and to generate the OpenAPI document. Themes and commits use the database types directly.
+
+type CreateThemeRequest struct {
+	ID          database.ThemeID `json:"id"`
+	Name        string           `json:"name,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Content     string           `json:"content"`
+	Message     string           `json:"message,omitempty"`
+}
+
+type UpdateThemeRequest struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+	// FollowStable makes /theme/{id}.css serve the stable channel instead of the latest version
+	FollowStable *bool `json:"follow_stable,omitempty"`
+}
+
+type CommitRequest struct {
+	Content string `json:"content"`
+	Message string `json:"message,omitempty"`
+	// ExpectedVersion is the version the client based its changes on. If it's set and
+	// another version was published in the meantime, the request fails with 409.
+	ExpectedVersion *int `json:"expected_version,omitempty"`
+	// Breaking marks the version as needing changes from users, which is shown in update checks.
+	Breaking bool `json:"breaking,omitempty"`
+}
+
+type ReleaseRequest struct {
+	Version int `json:"version"`
+}
+
+// DraftsResponse contains the unpublished drafts of a theme. The preview links are keyed by draft ID
+// and are valid until PreviewExpiry.
+type DraftsResponse struct {
+	Drafts        []*database.Draft `json:"drafts"`
+	PreviewURLs   map[int64]string  `json:"preview_urls"`
+	PreviewExpiry time.Time         `json:"preview_expiry"`
+}
+
+type ReleasesResponse struct {
+	FollowStable bool                `json:"follow_stable"`
+	Channels     []*database.Release `json:"channels"`
+	Tags         []*database.Release `json:"tags"`
+}
+
+type ThemeVersion struct {
+	ThemeID database.ThemeID `json:"theme_id"`
+	Version int              `json:"version"`
+}
+
+type UpdateCheckRequest struct {
+	Themes []ThemeVersion `json:"themes"`
+}
+
+// UpdateCheckResponse contains an entry for each known theme in the request, including ones that are up to date.
+type UpdateCheckResponse struct {
+	Updates []*database.ThemeUpdate `json:"updates"`
+}
+
+type PreviewResponse struct {
+	ID       uuid.UUID `json:"id"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	MimeType string    `json:"mime_type"`
+}
+
+// Error is the body of all non-2xx API responses.
+type Error struct {
+	StatusCode int    `json:"-"`
+	ErrCode    string `json:"errcode"`
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (HTTP %d): %s", e.ErrCode, e.StatusCode, e.Message)
+}
+
+// Is makes errors.Is match errors with the same errcode, e.g. errors.Is(err, client.ErrVersionConflict).
+func (e *Error) Is(other error) bool {
+	otherErr, ok := other.(*Error)
+	return ok && otherErr.ErrCode == e.ErrCode
+}
+
+var (
+	ErrNotFound        = &Error{ErrCode: "not_found"}
+	ErrForbidden       = &Error{ErrCode: "forbidden"}
+	ErrUnauthorized    = &Error{ErrCode: "unauthorized"}
+	ErrVersionConflict = &Error{ErrCode: "version_conflict"}
+)
+
+const (
+	WebhookEventCommit  = "commit"
+	WebhookEventPreview = "preview"
+	WebhookEventDelete  = "delete"
+
+	// WebhookEventHeader contains the event type of webhook requests.
+	WebhookEventHeader = "X-Gomuks-CSS-Event"
+	// WebhookDeliveryHeader contains a unique ID for each delivery, which stays the same when retrying.
+	WebhookDeliveryHeader = "X-Gomuks-CSS-Delivery"
+	// WebhookSignatureHeader contains the signature of the request body, see VerifyWebhookSignature.
+	WebhookSignatureHeader = "X-Gomuks-CSS-Signature"
+)
+
+// WebhookPayload is the body of webhook requests. Commit is set for commit events,
+// AddedPreviews and RemovedPreviews for preview events.
+type WebhookPayload struct {
+	Event     string           `json:"event"`
+	ThemeID   database.ThemeID `json:"theme_id"`
+	Sender    id.UserID        `json:"sender,omitempty"`
+	Timestamp time.Time        `json:"timestamp"`
+
+	Commit          *database.Commit `json:"commit,omitempty"`
+	AddedPreviews   []uuid.UUID      `json:"added_previews,omitempty"`
+	RemovedPreviews []uuid.UUID      `json:"removed_previews,omitempty"`
+}
+
+// SignWebhook returns the signature header value for a webhook body: sha256= followed by
+// the hex-encoded HMAC-SHA256 of the body, keyed with the webhook secret.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the signature header of a webhook request in constant time.
+func VerifyWebhookSignature(secret string, body []byte, signature string) bool {
+	sig, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	decoded, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
@@ -0,0 +1,105 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"css.gomuks.app/database"
+)
+
+// loginConfig is stored in the user config directory by the login command.
+type loginConfig struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func loginPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gomuks-css", "login.json"), nil
+}
+
+func loadLogin() (*loginConfig, error) {
+	login := &loginConfig{}
+	path, err := loginPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read login: %w", err)
+	} else if err == nil {
+		if err = json.Unmarshal(data, login); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	if server, ok := os.LookupEnv("GOMUKS_CSS_SERVER"); ok {
+		login.Server = server
+	}
+	if token, ok := os.LookupEnv("GOMUKS_CSS_TOKEN"); ok {
+		login.Token = token
+	}
+	return login, nil
+}
+
+func saveLogin(login *loginConfig) (string, error) {
+	path, err := loginPath()
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(login, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, data, 0600)
+}
+
+const dirStateFile = ".gomuks-css.json"
+
+// dirState remembers which theme the current directory is for and which version was last seen,
+// so that publish can detect when someone else has published in the meantime.
+type dirState struct {
+	ThemeID database.ThemeID `json:"theme_id"`
+	File    string           `json:"file"`
+	Version int              `json:"version"`
+}
+
+func loadDirState() *dirState {
+	state := &dirState{}
+	if data, err := os.ReadFile(dirStateFile); err == nil {
+		_ = json.Unmarshal(data, state)
+	}
+	return state
+}
+
+func saveDirState(state *dirState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dirStateFile, data, 0644)
+}
@@ -0,0 +1,309 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// gomuks-css is a command-line tool for publishing themes to css.gomuks.app.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"css.gomuks.app/client"
+	"css.gomuks.app/database"
+	"css.gomuks.app/linediff"
+)
+
+var errUsage = errors.New("invalid usage")
+
+type command struct {
+	Name        string
+	Args        string
+	Description string
+	MaxArgs     int
+	Flags       func(fs *flag.FlagSet)
+	Run         func(ctx context.Context, fs *flag.FlagSet) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{Name: "login", Args: "[token]", MaxArgs: 1, Description: "Save an API token from the /tokens page", Run: cmdLogin, Flags: func(fs *flag.FlagSet) {
+			fs.String("server", client.DefaultServer, "Server URL")
+		}},
+		{Name: "pull", Args: "[theme ID]", MaxArgs: 1, Description: "Download the latest version of a theme", Run: cmdPull, Flags: func(fs *flag.FlagSet) {
+			fs.String("o", "theme.css", "File to write the theme to")
+		}},
+		{Name: "publish", Args: "[file]", MaxArgs: 1, Description: "Publish a file as a new version of the theme", Run: cmdPublish, Flags: func(fs *flag.FlagSet) {
+			fs.String("t", "", "Theme ID (defaults to the last pulled or published theme in this directory)")
+			fs.String("m", "", "Commit message")
+			fs.Bool("force", false, "Publish even if someone else published a newer version since the last pull")
+			fs.Bool("breaking", false, "Mark the version as a breaking change")
+		}},
+		{Name: "history", Args: "[theme ID]", MaxArgs: 1, Description: "List all versions of a theme", Run: cmdHistory},
+		{Name: "diff", Args: "[file]", MaxArgs: 1, Description: "Compare a local file to the published theme", Run: cmdDiff, Flags: func(fs *flag.FlagSet) {
+			fs.String("t", "", "Theme ID (defaults to the last pulled or published theme in this directory)")
+			fs.Int("r", 0, "Version to compare to (defaults to the latest)")
+		}},
+	}
+}
+
+func printUsage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "Usage: %s <command> [flags] [args...]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		_, _ = fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.Name, cmd.Args, cmd.Description)
+	}
+	_ = tw.Flush()
+	_, _ = fmt.Fprintf(w, "\nThe GOMUKS_CSS_SERVER and GOMUKS_CSS_TOKEN environment variables override the saved login.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	var cmd *command
+	for _, c := range commands {
+		if c.Name == os.Args[1] {
+			cmd = c
+			break
+		}
+	}
+	if cmd == nil {
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(cmd.Name, flag.ExitOnError)
+	if cmd.Flags != nil {
+		cmd.Flags(fs)
+	}
+	_ = fs.Parse(os.Args[2:])
+	if fs.NArg() > cmd.MaxArgs {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], cmd.Name, cmd.Args)
+		os.Exit(2)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := cmd.Run(ctx, fs)
+	cancel()
+	if errors.Is(err, errUsage) {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], cmd.Name, cmd.Args)
+		os.Exit(2)
+	} else if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
+
+func flagString(fs *flag.FlagSet, name string) string {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(string)
+}
+
+func newClient() (*client.Client, error) {
+	login, err := loadLogin()
+	if err != nil {
+		return nil, err
+	}
+	return client.New(login.Server, login.Token)
+}
+
+func cmdLogin(_ context.Context, fs *flag.FlagSet) error {
+	token := fs.Arg(0)
+	if token == "" {
+		_, _ = fmt.Fprint(os.Stderr, "API token: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+		token = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(token, "gcss_") {
+		return fmt.Errorf("that doesn't look like an API token, create one at %s/tokens", flagString(fs, "server"))
+	}
+	path, err := saveLogin(&loginConfig{Server: flagString(fs, "server"), Token: token})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Saved login to", path)
+	return nil
+}
+
+// resolveTheme picks the theme ID from the flag or argument, falling back to the directory state.
+func resolveTheme(explicit string, state *dirState) (database.ThemeID, error) {
+	if explicit != "" {
+		return database.ThemeID(explicit), nil
+	} else if state.ThemeID != "" {
+		return state.ThemeID, nil
+	}
+	return "", fmt.Errorf("no theme ID given and nothing has been pulled in this directory: %w", errUsage)
+}
+
+func cmdPull(ctx context.Context, fs *flag.FlagSet) error {
+	state := loadDirState()
+	themeID, err := resolveTheme(fs.Arg(0), state)
+	if err != nil {
+		return err
+	}
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	theme, err := cli.GetTheme(ctx, themeID)
+	if err != nil {
+		return err
+	}
+	file := flagString(fs, "o")
+	if err = os.WriteFile(file, []byte(theme.LatestCommit.Content), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s v%d to %s\n", theme.ID, theme.LatestCommit.Version, file)
+	return saveDirState(&dirState{ThemeID: theme.ID, File: file, Version: theme.LatestCommit.Version})
+}
+
+func cmdPublish(ctx context.Context, fs *flag.FlagSet) error {
+	state := loadDirState()
+	themeID, err := resolveTheme(flagString(fs, "t"), state)
+	if err != nil {
+		return err
+	}
+	file := fs.Arg(0)
+	if file == "" {
+		file = state.File
+	}
+	if file == "" {
+		return fmt.Errorf("no file given: %w", errUsage)
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	req := &client.CommitRequest{
+		Content:  string(content),
+		Message:  flagString(fs, "m"),
+		Breaking: fs.Lookup("breaking").Value.(flag.Getter).Get().(bool),
+	}
+	force := fs.Lookup("force").Value.(flag.Getter).Get().(bool)
+	if state.ThemeID == themeID && state.Version > 0 && !force {
+		req.ExpectedVersion = &state.Version
+	}
+	commit, err := cli.CreateCommit(ctx, themeID, req)
+	if errors.Is(err, client.ErrNotFound) {
+		var theme *database.Theme
+		theme, err = cli.CreateTheme(ctx, &client.CreateThemeRequest{
+			ID:      themeID,
+			Content: req.Content,
+			Message: req.Message,
+		})
+		if err == nil {
+			commit = &theme.LatestCommit
+			fmt.Println("Created new theme", themeID)
+		}
+	}
+	if errors.Is(err, client.ErrVersionConflict) {
+		return fmt.Errorf("%s has been updated since v%d, pull or diff first, or use -force", themeID, state.Version)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("Published %s v%d\n", themeID, commit.Version)
+	return saveDirState(&dirState{ThemeID: themeID, File: file, Version: commit.Version})
+}
+
+func cmdHistory(ctx context.Context, fs *flag.FlagSet) error {
+	themeID, err := resolveTheme(fs.Arg(0), loadDirState())
+	if err != nil {
+		return err
+	}
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	commits, err := cli.GetCommits(ctx, themeID)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i := len(commits) - 1; i >= 0; i-- {
+		commit := commits[i]
+		message, _, _ := strings.Cut(commit.Message, "\n")
+		_, _ = fmt.Fprintf(
+			tw, "v%d\t%s\t%s\t%s\n",
+			commit.Version, commit.CreatedAt.Format("2006-01-02 15:04"), commit.CreatedBy, message,
+		)
+	}
+	return tw.Flush()
+}
+
+func cmdDiff(ctx context.Context, fs *flag.FlagSet) error {
+	state := loadDirState()
+	themeID, err := resolveTheme(flagString(fs, "t"), state)
+	if err != nil {
+		return err
+	}
+	file := fs.Arg(0)
+	if file == "" {
+		file = state.File
+	}
+	if file == "" {
+		return fmt.Errorf("no file given: %w", errUsage)
+	}
+	local, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	cli, err := newClient()
+	if err != nil {
+		return err
+	}
+	var remote *database.Commit
+	version := fs.Lookup("r").Value.(flag.Getter).Get().(int)
+	if version > 0 {
+		commits, err := cli.GetCommits(ctx, themeID)
+		if err != nil {
+			return err
+		}
+		for _, commit := range commits {
+			if commit.Version == version {
+				remote = commit
+			}
+		}
+		if remote == nil {
+			return fmt.Errorf("%s doesn't have a v%d", themeID, version)
+		}
+	} else {
+		theme, err := cli.GetTheme(ctx, themeID)
+		if err != nil {
+			return err
+		}
+		remote = &theme.LatestCommit
+	}
+	remoteName := string(themeID) + "@v" + strconv.Itoa(remote.Version)
+	linediff.WriteUnified(os.Stdout, remoteName, file, linediff.SplitLines(remote.Content), linediff.SplitLines(string(local)))
+	return nil
+}
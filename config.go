@@ -0,0 +1,507 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/glob"
+	"go.mau.fi/util/ptr"
+	"go.mau.fi/zeroconfig"
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix/id"
+)
+
+type LimitsConfig struct {
+	ThemeIDRegex         string `yaml:"theme_id_regex"`
+	NameMaxLength        int    `yaml:"name_max_length"`
+	DescriptionMaxLength int    `yaml:"description_max_length"`
+	ContentMaxLength     int    `yaml:"content_max_length"`
+	MaxPreviewSize       int64  `yaml:"max_preview_size"`
+	MaxPreviewCount      int    `yaml:"max_preview_count"`
+	MaxDraftCount        int    `yaml:"max_draft_count"`
+	MaxFormSize          int64  `yaml:"max_form_size"`
+	MaxPushSize          int64  `yaml:"max_push_size"`
+	MaxPushObjects       int    `yaml:"max_push_objects"`
+	MaxPushObjectSize    int    `yaml:"max_push_object_size"`
+	MaxPushUnpackedSize  int64  `yaml:"max_push_unpacked_size"`
+
+	themeIDRegex *regexp.Regexp
+}
+
+// ServerACLConfig restricts which homeservers users can log in and publish from.
+// The rules work like the m.room.server_acl event in Matrix, except that an empty
+// allow list allows all servers rather than none.
+type ServerACLConfig struct {
+	Allow           []string `yaml:"allow"`
+	Deny            []string `yaml:"deny"`
+	AllowIPLiterals bool     `yaml:"allow_ip_literals"`
+
+	allow []glob.Glob
+	deny  []glob.Glob
+}
+
+// RateLimitRule is the number of requests allowed per client IP and per logged-in user
+// in each window. A limit of zero disables that bucket.
+type RateLimitRule struct {
+	Window  time.Duration `yaml:"window"`
+	PerIP   int           `yaml:"per_ip"`
+	PerUser int           `yaml:"per_user"`
+}
+
+type RateLimitConfig struct {
+	// Backend is either memory (for single instances) or postgres (shared between replicas).
+	Backend string `yaml:"backend"`
+	// IPHeader is the header the reverse proxy puts the client IP in. If empty, the remote address is used.
+	IPHeader string `yaml:"ip_header"`
+
+	Login  RateLimitRule `yaml:"login"`
+	Commit RateLimitRule `yaml:"commit"`
+	Upload RateLimitRule `yaml:"upload"`
+	Read   RateLimitRule `yaml:"read"`
+	Write  RateLimitRule `yaml:"write"`
+}
+
+type WebhookConfig struct {
+	// AllowPrivateAddresses allows webhooks to loopback, private and link-local addresses.
+	AllowPrivateAddresses bool          `yaml:"allow_private_addresses"`
+	Timeout               time.Duration `yaml:"timeout"`
+	MaxAttempts           int           `yaml:"max_attempts"`
+	MaxPerTheme           int           `yaml:"max_per_theme"`
+}
+
+// MatrixConfig is the account of the bot that announces new theme versions in linked rooms.
+// The bot is disabled if the access token is empty.
+type MatrixConfig struct {
+	HomeserverURL string `yaml:"homeserver_url"`
+	AccessToken   string `yaml:"access_token"`
+}
+
+type TokenKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+type Config struct {
+	ListenAddress  string            `yaml:"listen_address"`
+	PublicURL      string            `yaml:"public_url"`
+	MetricsAddress string            `yaml:"metrics_listen_address"`
+	ShutdownGrace  time.Duration     `yaml:"shutdown_grace_period"`
+	Database       dbutil.Config     `yaml:"database"`
+	TokenSecret    string            `yaml:"token_secret"`
+	TokenKeys      []TokenKey        `yaml:"token_keys"`
+	ActiveTokenKey string            `yaml:"active_token_key"`
+	Logging        zeroconfig.Config `yaml:"logging"`
+	Limits         LimitsConfig      `yaml:"limits"`
+	ServerACL      ServerACLConfig   `yaml:"server_acl"`
+	Moderators     []id.UserID       `yaml:"moderators"`
+	RateLimit      RateLimitConfig   `yaml:"rate_limit"`
+	Webhooks       WebhookConfig     `yaml:"webhooks"`
+	Matrix         MatrixConfig      `yaml:"matrix"`
+
+	tokenKeys map[string][]byte
+}
+
+// legacyTokenKeyID is the key ID used for the single token_secret option.
+const legacyTokenKeyID = "default"
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress: ":8080",
+		PublicURL:     "https://css.gomuks.app",
+		ShutdownGrace: 5 * time.Second,
+		Database: dbutil.Config{
+			PoolConfig: dbutil.PoolConfig{
+				Type:         "postgres",
+				MaxOpenConns: 20,
+				MaxIdleConns: 2,
+			},
+		},
+		Logging: zeroconfig.Config{
+			Writers: []zeroconfig.WriterConfig{{
+				Type:     zeroconfig.WriterTypeStdout,
+				Format:   zeroconfig.LogFormatPrettyColored,
+				MinLevel: ptr.Ptr(zerolog.InfoLevel),
+			}, {
+				Type:   zeroconfig.WriterTypeFile,
+				Format: zeroconfig.LogFormatJSON,
+				FileConfig: zeroconfig.FileConfig{
+					Filename:   "/var/log/gomuks-css.log",
+					MaxSize:    100 * 1024,
+					MaxAge:     7,
+					MaxBackups: 10,
+				},
+			}},
+			MinLevel: ptr.Ptr(zerolog.TraceLevel),
+		},
+		Limits: LimitsConfig{
+			ThemeIDRegex:         `^[a-z0-9_-]{3,32}$`,
+			NameMaxLength:        64,
+			DescriptionMaxLength: 8 * 1024,
+			ContentMaxLength:     128 * 1024,
+			MaxPreviewSize:       512 * 1024,
+			MaxPreviewCount:      8,
+			MaxDraftCount:        10,
+			MaxFormSize:          5 * 1024 * 1024,
+			MaxPushSize:          5 * 1024 * 1024,
+			MaxPushObjects:       10000,
+			MaxPushObjectSize:    1024 * 1024,
+			MaxPushUnpackedSize:  64 * 1024 * 1024,
+		},
+		ServerACL: ServerACLConfig{
+			AllowIPLiterals: true,
+		},
+		RateLimit: RateLimitConfig{
+			Backend: "memory",
+			Login:   RateLimitRule{Window: 10 * time.Minute, PerIP: 30},
+			Commit:  RateLimitRule{Window: time.Hour, PerIP: 60, PerUser: 30},
+			Upload:  RateLimitRule{Window: time.Hour, PerIP: 60, PerUser: 30},
+			Read:    RateLimitRule{Window: time.Minute, PerIP: 600},
+			Write:   RateLimitRule{Window: time.Hour, PerIP: 300, PerUser: 120},
+		},
+		Webhooks: WebhookConfig{
+			Timeout:     10 * time.Second,
+			MaxAttempts: 8,
+			MaxPerTheme: 5,
+		},
+	}
+}
+
+// loadConfig reads the config file at the given path (if it exists) on top of the default values,
+// then applies any environment variable overrides. A missing file is only an error if required is true.
+func loadConfig(path string, required bool) (*Config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		// Environment variables only
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	} else if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err = cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func envString(key string, into *string) {
+	if val, ok := os.LookupEnv(key); ok {
+		*into = val
+	}
+}
+
+func envList(key string, into *[]string) {
+	if val, ok := os.LookupEnv(key); ok {
+		*into = nil
+		for _, item := range strings.Split(val, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*into = append(*into, item)
+			}
+		}
+	}
+}
+
+func envInt[T int | int64](key string, into *T) error {
+	if val, ok := os.LookupEnv(key); ok {
+		parsed, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		*into = T(parsed)
+	}
+	return nil
+}
+
+func (cfg *Config) applyEnv() error {
+	envString("LISTEN_ADDRESS", &cfg.ListenAddress)
+	host, port, hostPortErr := net.SplitHostPort(cfg.ListenAddress)
+	_, hasHost := os.LookupEnv("HOST")
+	_, hasPort := os.LookupEnv("PORT")
+	if hasHost || hasPort {
+		if hostPortErr != nil {
+			return fmt.Errorf("can't apply HOST or PORT to invalid listen address: %w", hostPortErr)
+		}
+		envString("HOST", &host)
+		envString("PORT", &port)
+		cfg.ListenAddress = net.JoinHostPort(host, port)
+	}
+	envString("PUBLIC_URL", &cfg.PublicURL)
+	envString("METRICS_LISTEN_ADDRESS", &cfg.MetricsAddress)
+	if val, ok := os.LookupEnv("SHUTDOWN_GRACE_PERIOD"); ok {
+		var err error
+		if cfg.ShutdownGrace, err = time.ParseDuration(val); err != nil {
+			return fmt.Errorf("invalid value for SHUTDOWN_GRACE_PERIOD: %w", err)
+		}
+	}
+	envString("DATABASE_URL", &cfg.Database.URI)
+	envString("TOKEN_SECRET", &cfg.TokenSecret)
+	envString("ACTIVE_TOKEN_KEY", &cfg.ActiveTokenKey)
+	if val, ok := os.LookupEnv("TOKEN_KEYS"); ok {
+		cfg.TokenKeys = nil
+		for _, pair := range strings.Split(val, ",") {
+			keyID, secret, found := strings.Cut(pair, ":")
+			if !found {
+				return fmt.Errorf("invalid value for TOKEN_KEYS: expected comma-separated id:secret pairs")
+			}
+			cfg.TokenKeys = append(cfg.TokenKeys, TokenKey{ID: keyID, Secret: secret})
+		}
+	}
+	envList("SERVER_ACL_ALLOW", &cfg.ServerACL.Allow)
+	envList("SERVER_ACL_DENY", &cfg.ServerACL.Deny)
+	envString("RATE_LIMIT_BACKEND", &cfg.RateLimit.Backend)
+	envString("RATE_LIMIT_IP_HEADER", &cfg.RateLimit.IPHeader)
+	envString("MATRIX_HOMESERVER_URL", &cfg.Matrix.HomeserverURL)
+	envString("MATRIX_ACCESS_TOKEN", &cfg.Matrix.AccessToken)
+	envString("THEME_ID_REGEX", &cfg.Limits.ThemeIDRegex)
+	return errors.Join(
+		envInt("NAME_MAX_LENGTH", &cfg.Limits.NameMaxLength),
+		envInt("DESCRIPTION_MAX_LENGTH", &cfg.Limits.DescriptionMaxLength),
+		envInt("CONTENT_MAX_LENGTH", &cfg.Limits.ContentMaxLength),
+		envInt("MAX_PREVIEW_SIZE", &cfg.Limits.MaxPreviewSize),
+		envInt("MAX_PREVIEW_COUNT", &cfg.Limits.MaxPreviewCount),
+		envInt("MAX_DRAFT_COUNT", &cfg.Limits.MaxDraftCount),
+		envInt("MAX_FORM_SIZE", &cfg.Limits.MaxFormSize),
+		envInt("MAX_PUSH_SIZE", &cfg.Limits.MaxPushSize),
+		envInt("MAX_PUSH_OBJECTS", &cfg.Limits.MaxPushObjects),
+		envInt("MAX_PUSH_OBJECT_SIZE", &cfg.Limits.MaxPushObjectSize),
+		envInt("MAX_PUSH_UNPACKED_SIZE", &cfg.Limits.MaxPushUnpackedSize),
+	)
+}
+
+// Validate checks the config for missing or invalid values and returns all problems at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("listen_address: %w", err))
+	}
+	cfg.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+	if parsed, err := url.Parse(cfg.PublicURL); err != nil {
+		errs = append(errs, fmt.Errorf("public_url: %w", err))
+	} else if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		errs = append(errs, fmt.Errorf("public_url: must be an absolute http(s) URL"))
+	}
+	if cfg.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.MetricsAddress); err != nil {
+			errs = append(errs, fmt.Errorf("metrics_listen_address: %w", err))
+		} else if cfg.MetricsAddress == cfg.ListenAddress {
+			errs = append(errs, fmt.Errorf("metrics_listen_address: must be different from listen_address"))
+		}
+	}
+	if cfg.ShutdownGrace < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_grace_period: must not be negative"))
+	}
+	if cfg.Database.Type != "postgres" {
+		errs = append(errs, fmt.Errorf("database.type: only postgres is supported"))
+	}
+	if cfg.Database.URI == "" {
+		errs = append(errs, fmt.Errorf("database.uri (or DATABASE_URL): required"))
+	}
+	for i, userID := range cfg.Moderators {
+		if _, _, err := userID.ParseAndValidate(); err != nil {
+			errs = append(errs, fmt.Errorf("moderators[%d]: %w", i, err))
+		}
+	}
+	errs = append(errs, cfg.validateTokenKeys(), cfg.Limits.validate(), cfg.ServerACL.validate(), cfg.RateLimit.validate(), cfg.Webhooks.validate(), cfg.Matrix.validate())
+	return errors.Join(errs...)
+}
+
+// validateTokenKeys builds the key ring used to sign and verify login cookies. The legacy
+// token_secret is included with the ID "default", so existing deployments keep working.
+func (cfg *Config) validateTokenKeys() error {
+	var errs []error
+	cfg.tokenKeys = make(map[string][]byte, len(cfg.TokenKeys)+1)
+	keys := cfg.TokenKeys
+	if cfg.TokenSecret != "" {
+		keys = append([]TokenKey{{ID: legacyTokenKeyID, Secret: cfg.TokenSecret}}, keys...)
+	}
+	for i, key := range keys {
+		if key.ID == "" || len(key.ID) > 255 {
+			errs = append(errs, fmt.Errorf("token_keys[%d].id: must be between 1 and 255 bytes", i))
+		} else if key.Secret == "" {
+			errs = append(errs, fmt.Errorf("token_keys[%d].secret: required", i))
+		} else if _, exists := cfg.tokenKeys[key.ID]; exists {
+			errs = append(errs, fmt.Errorf("token_keys[%d].id: duplicate key ID %q", i, key.ID))
+		} else {
+			cfg.tokenKeys[key.ID] = []byte(key.Secret)
+		}
+	}
+	if len(keys) == 0 {
+		errs = append(errs, fmt.Errorf("token_keys or token_secret (or TOKEN_SECRET): required"))
+	} else if cfg.ActiveTokenKey == "" && len(keys) == 1 {
+		cfg.ActiveTokenKey = keys[0].ID
+	} else if cfg.ActiveTokenKey == "" {
+		errs = append(errs, fmt.Errorf("active_token_key: required when there are multiple keys"))
+	} else if _, ok := cfg.tokenKeys[cfg.ActiveTokenKey]; !ok {
+		errs = append(errs, fmt.Errorf("active_token_key: key %q not found", cfg.ActiveTokenKey))
+	}
+	return errors.Join(errs...)
+}
+
+// TokenKey returns the secret for the given key ID, or nil if the key isn't in the key ring.
+func (cfg *Config) TokenKey(keyID string) []byte {
+	return cfg.tokenKeys[keyID]
+}
+
+func (lc *LimitsConfig) validate() error {
+	var errs []error
+	var err error
+	if lc.themeIDRegex, err = regexp.Compile(lc.ThemeIDRegex); err != nil {
+		errs = append(errs, fmt.Errorf("limits.theme_id_regex: %w", err))
+	}
+	positive := func(name string, val int64) {
+		if val <= 0 {
+			errs = append(errs, fmt.Errorf("limits.%s: must be positive", name))
+		}
+	}
+	positive("name_max_length", int64(lc.NameMaxLength))
+	positive("description_max_length", int64(lc.DescriptionMaxLength))
+	positive("content_max_length", int64(lc.ContentMaxLength))
+	positive("max_preview_size", lc.MaxPreviewSize)
+	positive("max_form_size", lc.MaxFormSize)
+	positive("max_push_size", lc.MaxPushSize)
+	positive("max_push_objects", int64(lc.MaxPushObjects))
+	positive("max_push_object_size", int64(lc.MaxPushObjectSize))
+	positive("max_push_unpacked_size", lc.MaxPushUnpackedSize)
+	if lc.MaxPreviewCount < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_preview_count: must not be negative"))
+	}
+	if lc.MaxDraftCount < 0 {
+		errs = append(errs, fmt.Errorf("limits.max_draft_count: must not be negative"))
+	}
+	if lc.MaxPushObjectSize < lc.ContentMaxLength {
+		errs = append(errs, fmt.Errorf("limits.max_push_object_size: must be at least content_max_length"))
+	}
+	if lc.MaxPushUnpackedSize < int64(lc.MaxPushObjectSize) {
+		errs = append(errs, fmt.Errorf("limits.max_push_unpacked_size: must be at least max_push_object_size"))
+	}
+	if lc.MaxFormSize < lc.MaxPreviewSize {
+		errs = append(errs, fmt.Errorf("limits.max_form_size: must be at least max_preview_size"))
+	}
+	return errors.Join(errs...)
+}
+
+func (lc *LimitsConfig) ValidThemeID(themeID string) bool {
+	return themeID != "new" && themeID != "commit" && lc.themeIDRegex.MatchString(themeID)
+}
+
+func (acl *ServerACLConfig) validate() error {
+	var errs []error
+	compile := func(name string, patterns []string) []glob.Glob {
+		globs := make([]glob.Glob, 0, len(patterns))
+		for i, pattern := range patterns {
+			compiled := glob.Compile(strings.ToLower(pattern))
+			if pattern == "" || compiled == nil {
+				errs = append(errs, fmt.Errorf("server_acl.%s[%d]: invalid pattern %q", name, i, pattern))
+				continue
+			}
+			globs = append(globs, compiled)
+		}
+		return globs
+	}
+	acl.allow = compile("allow", acl.Allow)
+	acl.deny = compile("deny", acl.Deny)
+	return errors.Join(errs...)
+}
+
+// IsAllowed checks whether users on the given server are allowed to log in and publish.
+// The port is ignored, and deny rules take precedence over allow rules.
+func (acl *ServerACLConfig) IsAllowed(serverName string) bool {
+	host := strings.ToLower(serverName)
+	if parsedHost, _, err := net.SplitHostPort(host); err == nil {
+		host = parsedHost
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" || (!acl.AllowIPLiterals && net.ParseIP(host) != nil) {
+		return false
+	}
+	for _, pattern := range acl.deny {
+		if pattern.Match(host) {
+			return false
+		}
+	}
+	if len(acl.allow) == 0 {
+		return true
+	}
+	for _, pattern := range acl.allow {
+		if pattern.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rlc *RateLimitConfig) validate() error {
+	var errs []error
+	if rlc.Backend != "memory" && rlc.Backend != "postgres" {
+		errs = append(errs, fmt.Errorf("rate_limit.backend: must be memory or postgres"))
+	}
+	rule := func(name string, rule RateLimitRule) {
+		if rule.PerIP < 0 || rule.PerUser < 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.%s: limits must not be negative", name))
+		} else if (rule.PerIP > 0 || rule.PerUser > 0) && rule.Window <= 0 {
+			errs = append(errs, fmt.Errorf("rate_limit.%s.window: must be positive", name))
+		}
+	}
+	rule("login", rlc.Login)
+	rule("commit", rlc.Commit)
+	rule("upload", rlc.Upload)
+	rule("read", rlc.Read)
+	rule("write", rlc.Write)
+	return errors.Join(errs...)
+}
+
+func (wc *WebhookConfig) validate() error {
+	var errs []error
+	if wc.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("webhooks.timeout: must be positive"))
+	}
+	if wc.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhooks.max_attempts: must be at least 1"))
+	}
+	if wc.MaxPerTheme < 0 {
+		errs = append(errs, fmt.Errorf("webhooks.max_per_theme: must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+func (mc *MatrixConfig) Enabled() bool {
+	return mc.AccessToken != ""
+}
+
+func (mc *MatrixConfig) validate() error {
+	if !mc.Enabled() {
+		return nil
+	}
+	parsed, err := url.Parse(mc.HomeserverURL)
+	if err != nil {
+		return fmt.Errorf("matrix.homeserver_url: %w", err)
+	} else if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("matrix.homeserver_url: must be an absolute http(s) URL")
+	}
+	return nil
+}
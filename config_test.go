@@ -0,0 +1,88 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestServerACLIsAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		acl     ServerACLConfig
+		server  string
+		allowed bool
+	}{
+		{"empty allows all", ServerACLConfig{AllowIPLiterals: true}, "example.com", true},
+		{"empty server name", ServerACLConfig{AllowIPLiterals: true}, "", false},
+		{"exact allow", ServerACLConfig{Allow: []string{"example.com"}}, "example.com", true},
+		{"not in allow list", ServerACLConfig{Allow: []string{"example.com"}}, "example.org", false},
+		{"allow doesn't match subdomain", ServerACLConfig{Allow: []string{"example.com"}}, "matrix.example.com", false},
+		{"star matches subdomain", ServerACLConfig{Allow: []string{"*.example.com"}}, "matrix.example.com", true},
+		{"star doesn't match bare domain", ServerACLConfig{Allow: []string{"*.example.com"}}, "example.com", false},
+		{"star matches dots", ServerACLConfig{Allow: []string{"*.example.com"}}, "a.b.example.com", true},
+		{"question mark matches one character", ServerACLConfig{Allow: []string{"matrix?.example.com"}}, "matrix1.example.com", true},
+		{"question mark doesn't match two characters", ServerACLConfig{Allow: []string{"matrix?.example.com"}}, "matrix12.example.com", false},
+		{"case insensitive server", ServerACLConfig{Allow: []string{"example.com"}}, "EXAMPLE.com", true},
+		{"case insensitive pattern", ServerACLConfig{Allow: []string{"*.Example.COM"}}, "matrix.example.com", true},
+		{"port is ignored", ServerACLConfig{Allow: []string{"example.com"}}, "example.com:8448", true},
+		{"port isn't part of the pattern", ServerACLConfig{Allow: []string{"example.com:8448"}}, "example.com:8448", false},
+		{"deny", ServerACLConfig{Deny: []string{"evil.example"}}, "evil.example", false},
+		{"deny glob", ServerACLConfig{Deny: []string{"*.evil.example"}}, "matrix.evil.example", false},
+		{"deny with port", ServerACLConfig{Deny: []string{"evil.example"}}, "evil.example:443", false},
+		{"not denied", ServerACLConfig{Deny: []string{"evil.example"}}, "example.com", true},
+		{"deny takes precedence", ServerACLConfig{Allow: []string{"*"}, Deny: []string{"evil.example"}}, "evil.example", false},
+		{"deny takes precedence over exact allow", ServerACLConfig{Allow: []string{"evil.example"}, Deny: []string{"evil.*"}}, "evil.example", false},
+		{"allow all with deny", ServerACLConfig{Allow: []string{"*"}, Deny: []string{"evil.example"}}, "example.com", true},
+		{"IPv4 literal allowed", ServerACLConfig{AllowIPLiterals: true}, "127.0.0.1", true},
+		{"IPv4 literal denied", ServerACLConfig{}, "127.0.0.1:8448", false},
+		{"IPv6 literal allowed", ServerACLConfig{AllowIPLiterals: true}, "[::1]:8448", true},
+		{"IPv6 literal denied", ServerACLConfig{}, "[::1]", false},
+		{"IP literal denied even if allowed by glob", ServerACLConfig{Allow: []string{"*"}}, "10.0.0.1", false},
+		{"IP literal in deny list", ServerACLConfig{AllowIPLiterals: true, Deny: []string{"10.*"}}, "10.0.0.1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.acl.validate(); err != nil {
+				t.Fatal(err)
+			}
+			if allowed := test.acl.IsAllowed(test.server); allowed != test.allowed {
+				t.Errorf("IsAllowed(%q) = %t, want %t", test.server, allowed, test.allowed)
+			}
+		})
+	}
+}
+
+func TestServerACLValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		acl   ServerACLConfig
+		valid bool
+	}{
+		{"empty", ServerACLConfig{}, true},
+		{"globs", ServerACLConfig{Allow: []string{"*.example.com", "example.com"}, Deny: []string{"evil.*"}}, true},
+		{"empty allow pattern", ServerACLConfig{Allow: []string{""}}, false},
+		{"empty deny pattern", ServerACLConfig{Deny: []string{"example.com", ""}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.acl.validate(); (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid = %t", err, test.valid)
+			}
+		})
+	}
+}
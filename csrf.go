@@ -0,0 +1,127 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"mime"
+	"net/http"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/exerrors"
+
+	"css.gomuks.app/database"
+)
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// csrfToken derives the CSRF token of a session. It's not stored anywhere, as it can always be
+// recomputed from the session ID with the same key that signed the session cookie.
+func csrfToken(session *database.Session) string {
+	hasher := hmac.New(sha256.New, cfg.TokenKey(session.KeyID))
+	hasher.Write([]byte("csrf\x00"))
+	hasher.Write([]byte(session.ID))
+	return base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+type sessionCacheKey struct{}
+
+// sessionCache stores the result of getSession and viewerIsModerator for the rest of the request.
+type sessionCache struct {
+	loaded  bool
+	session *database.Session
+
+	isModerator *bool
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sessionCacheMiddleware adds an empty sessionCache to the request context, so that the rate limiter,
+// csrfMiddleware and the handler only look up the session once.
+func sessionCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionCacheKey{}, &sessionCache{})))
+	})
+}
+
+// csrfMiddleware rejects state-changing requests authenticated with the session cookie unless they
+// include the CSRF token of the session, either in the csrf_token form field or the X-CSRF-Token header.
+// Requests with an Authorization header (API tokens and git) don't use the cookie and are exempt.
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) || r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session := getSession(r)
+		if session == nil {
+			// Nothing to protect, the handler will treat the request as unauthenticated
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+			var err error
+			switch mediaType {
+			case "multipart/form-data":
+				err = r.ParseMultipartForm(cfg.Limits.MaxFormSize)
+			case "application/x-www-form-urlencoded":
+				err = r.ParseForm()
+			}
+			if err != nil {
+				http.Error(w, "Invalid form body", http.StatusBadRequest)
+				return
+			}
+			token = r.PostFormValue(csrfFormField)
+		}
+		if !hmac.Equal([]byte(token), []byte(csrfToken(session))) {
+			hlog.FromRequest(r).Debug().Bool("token_present", token != "").Msg("Rejecting request with invalid CSRF token")
+			http.Error(w, "Invalid or missing CSRF token, please reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// renderContainer renders a page inside container.gohtml. The logged-in user is filled in from the
+// session, as well as the CSRF token of the container and pages with POST forms.
+func renderContainer(w http.ResponseWriter, r *http.Request, status int, data *ContainerData) {
+	var buf bytes.Buffer
+	if session := getSession(r); session != nil {
+		data.User = session.UserID
+		data.CSRFToken = csrfToken(session)
+		data.IsModerator = viewerIsModerator(r)
+		if page, ok := data.Data.(csrfPage); ok {
+			page.setCSRFToken(data.CSRFToken)
+		}
+	}
+	exerrors.PanicIfNotNil(Templates.ExecuteTemplate(&buf, "container.gohtml", data))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,134 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"css.gomuks.app/database"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	setTokenKeys(t, "a", TokenKey{ID: "a", Secret: "meow"})
+	session := &database.Session{ID: strings.Repeat("s", sessionIDLength), UserID: "@meow:example.com", KeyID: "a"}
+	otherSession := &database.Session{ID: strings.Repeat("o", sessionIDLength), UserID: "@meow:example.com", KeyID: "a"}
+	validToken := csrfToken(session)
+	form := func(token string) string {
+		return url.Values{csrfFormField: {token}, "name": {"meow"}}.Encode()
+	}
+	tests := []struct {
+		name        string
+		method      string
+		session     *database.Session
+		header      map[string]string
+		contentType string
+		body        string
+		status      int
+	}{
+		{name: "GET with session", method: http.MethodGet, session: session, status: http.StatusOK},
+		{name: "OPTIONS with session", method: http.MethodOptions, session: session, status: http.StatusOK},
+		{name: "POST without session", method: http.MethodPost, status: http.StatusOK},
+		{name: "POST with API token", method: http.MethodPost, session: session, header: map[string]string{"Authorization": "Bearer gcss_meow"}, status: http.StatusOK},
+		{name: "POST without token", method: http.MethodPost, session: session, status: http.StatusForbidden},
+		{name: "POST with header token", method: http.MethodPost, session: session, header: map[string]string{csrfHeader: validToken}, status: http.StatusOK},
+		{name: "POST with wrong header token", method: http.MethodPost, session: session, header: map[string]string{csrfHeader: "meow"}, status: http.StatusForbidden},
+		{name: "POST with token of other session", method: http.MethodPost, session: session, header: map[string]string{csrfHeader: csrfToken(otherSession)}, status: http.StatusForbidden},
+		{name: "POST with form token", method: http.MethodPost, session: session, contentType: "application/x-www-form-urlencoded", body: form(validToken), status: http.StatusOK},
+		{name: "POST with wrong form token", method: http.MethodPost, session: session, contentType: "application/x-www-form-urlencoded", body: form("meow"), status: http.StatusForbidden},
+		{name: "POST with token in JSON body", method: http.MethodPost, session: session, contentType: "application/json", body: `{"csrf_token":"` + validToken + `"}`, status: http.StatusForbidden},
+		{name: "DELETE without token", method: http.MethodDelete, session: session, status: http.StatusForbidden},
+	}
+	handler := csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "/theme/commit", strings.NewReader(test.body))
+			for key, value := range test.header {
+				r.Header.Set(key, value)
+			}
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			// Pre-fill the session cache so that the session isn't looked up from the database
+			cache := &sessionCache{loaded: true, session: test.session}
+			r = r.WithContext(context.WithValue(r.Context(), sessionCacheKey{}, cache))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	setTokenKeys(t, "b", TokenKey{ID: "a", Secret: "meow"}, TokenKey{ID: "b", Secret: "nyan"})
+	session := &database.Session{ID: strings.Repeat("s", sessionIDLength), KeyID: "a"}
+	token := csrfToken(session)
+	if csrfToken(session) != token {
+		t.Error("token isn't deterministic")
+	}
+	// The token uses the key of the session, not the active key
+	if csrfToken(&database.Session{ID: session.ID, KeyID: "b"}) == token {
+		t.Error("sessions with different keys got the same token")
+	}
+}
+
+var formTagRegex = regexp.MustCompile(`(?is)<form\b[^>]*>\s*(<input[^>]*>)?`)
+
+// TestPostFormsIncludeCSRFToken checks that every POST form in the templates starts with the CSRF token field.
+func TestPostFormsIncludeCSRFToken(t *testing.T) {
+	const csrfInput = `<input type="hidden" name="csrf_token" value="{{ $.CSRFToken }}"/>`
+	const containerCSRFInput = `<input type="hidden" name="csrf_token" value="{{ .CSRFToken }}"/>`
+	files, err := fs.Glob(TemplateFS, "templates/*.gohtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(TemplateFS, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range formTagRegex.FindAllStringSubmatch(string(data), -1) {
+			if !strings.Contains(strings.ToLower(match[0]), `method="post"`) {
+				continue
+			} else if match[1] != csrfInput && match[1] != containerCSRFInput {
+				t.Errorf("%s: form %q doesn't start with the CSRF token field", file, match[0])
+			}
+		}
+	}
+}
+
+func TestRenderCSRFToken(t *testing.T) {
+	var buf bytes.Buffer
+	data := &SessionsPageData{CSRFData: CSRFData{CSRFToken: "meow"}, Sessions: []*database.Session{{ID: "current"}, {ID: "other"}}, CurrentID: "current"}
+	if err := Templates.ExecuteTemplate(&buf, "sessions.gohtml", data); err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(buf.String(), `name="csrf_token" value="meow"`); count != 3 {
+		t.Errorf("got %d CSRF token fields, want 3", count)
+	}
+}
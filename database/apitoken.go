@@ -0,0 +1,151 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/exslices"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getAPITokensQuery = `
+		SELECT
+			id, user_id, name, created_at, expires_at, last_used_at,
+			ARRAY(SELECT theme_id FROM api_token_scope WHERE token_id = api_token.id),
+			ARRAY(SELECT theme_id FROM api_token_scope WHERE token_id = api_token.id AND can_write)
+		FROM api_token
+	`
+	getAPITokensByUserQuery = getAPITokensQuery + `WHERE user_id = $1 ORDER BY created_at DESC`
+	getAPITokenByHashQuery  = getAPITokensQuery + `WHERE token_hash = $1`
+	createAPITokenQuery     = `
+		INSERT INTO api_token (user_id, name, token_hash, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	addAPITokenScopeQuery = `
+		INSERT INTO api_token_scope (token_id, theme_id, can_write)
+		VALUES ($1, $2, $3)
+	`
+	markAPITokenUsedQuery = `
+		UPDATE api_token SET last_used_at = $2 WHERE id = $1
+	`
+	deleteAPITokenQuery = `
+		DELETE FROM api_token WHERE id = $1 AND user_id = $2
+	`
+	deleteAPITokensByUserQuery = `
+		DELETE FROM api_token WHERE user_id = $1
+	`
+)
+
+type APITokenQuery struct {
+	*dbutil.QueryHelper[*APIToken]
+}
+
+func (atq *APITokenQuery) GetByUser(ctx context.Context, userID id.UserID) ([]*APIToken, error) {
+	return atq.QueryMany(ctx, getAPITokensByUserQuery, userID)
+}
+
+func (atq *APITokenQuery) GetByHash(ctx context.Context, tokenHash []byte) (*APIToken, error) {
+	return atq.QueryOne(ctx, getAPITokenByHashQuery, tokenHash)
+}
+
+// Create inserts the token and its theme scopes. The ID field of the token is filled in.
+func (atq *APITokenQuery) Create(ctx context.Context, token *APIToken, tokenHash []byte) error {
+	return atq.GetDB().DoTxn(ctx, nil, func(ctx context.Context) error {
+		expiresAt := sql.NullTime{Time: token.ExpiresAt, Valid: !token.ExpiresAt.IsZero()}
+		err := atq.GetDB().QueryRow(
+			ctx, createAPITokenQuery, token.UserID, token.Name, tokenHash, token.CreatedAt, expiresAt,
+		).Scan(&token.ID)
+		if err != nil {
+			return err
+		}
+		for _, themeID := range token.ReadThemes {
+			canWrite := slices.Contains(token.WriteThemes, themeID)
+			if err = atq.Exec(ctx, addAPITokenScopeQuery, token.ID, themeID, canWrite); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (atq *APITokenQuery) MarkUsed(ctx context.Context, tokenID int64) error {
+	return atq.Exec(ctx, markAPITokenUsedQuery, tokenID, time.Now())
+}
+
+// Delete revokes a token. The user ID must match the token owner.
+func (atq *APITokenQuery) Delete(ctx context.Context, userID id.UserID, tokenID int64) error {
+	return atq.Exec(ctx, deleteAPITokenQuery, tokenID, userID)
+}
+
+func (atq *APITokenQuery) DeleteByUser(ctx context.Context, userID id.UserID) (int64, error) {
+	res, err := atq.GetDB().Exec(ctx, deleteAPITokensByUserQuery, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// APIToken is a personal access token. The token itself is only shown once when it's created,
+// the database only has a hash of it.
+type APIToken struct {
+	ID         int64
+	UserID     id.UserID
+	Name       string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	// ReadThemes contains all themes the token can access, WriteThemes is the subset that it can also modify.
+	ReadThemes  []ThemeID
+	WriteThemes []ThemeID
+}
+
+func (t *APIToken) Scan(row dbutil.Scannable) (*APIToken, error) {
+	var expiresAt, lastUsedAt sql.NullTime
+	var readThemes, writeThemes []string
+	err := row.Scan(
+		&t.ID, &t.UserID, &t.Name, &t.CreatedAt, &expiresAt, &lastUsedAt,
+		pq.Array(&readThemes), pq.Array(&writeThemes),
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.ExpiresAt = expiresAt.Time
+	t.LastUsedAt = lastUsedAt.Time
+	t.ReadThemes = exslices.CastToString[ThemeID](readThemes)
+	t.WriteThemes = exslices.CastToString[ThemeID](writeThemes)
+	return t, nil
+}
+
+func (t *APIToken) IsExpired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+func (t *APIToken) CanRead(themeID ThemeID) bool {
+	return slices.Contains(t.ReadThemes, themeID)
+}
+
+func (t *APIToken) CanWrite(themeID ThemeID) bool {
+	return slices.Contains(t.WriteThemes, themeID)
+}
@@ -0,0 +1,132 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+)
+
+const (
+	getAuditLogQuery = `
+		SELECT id, created_at, actor, action, theme_id, target, before, after FROM audit_log
+	`
+	// A before ID of 0 means the newest entries
+	getAuditLogPageQuery      = getAuditLogQuery + `WHERE $1 = 0 OR id < $1 ORDER BY id DESC LIMIT $2`
+	getThemeAuditLogPageQuery = getAuditLogQuery + `WHERE theme_id = $1 AND ($2 = 0 OR id < $2) ORDER BY id DESC LIMIT $3`
+	addAuditLogEntryQuery     = `
+		INSERT INTO audit_log (created_at, actor, action, theme_id, target, before, after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+)
+
+// AuditLogQuery accesses the audit log. The table is append-only, which is also enforced with a trigger.
+type AuditLogQuery struct {
+	*dbutil.QueryHelper[*AuditEntry]
+}
+
+// GetPage returns up to limit entries older than beforeID, newest first.
+func (alq *AuditLogQuery) GetPage(ctx context.Context, beforeID int64, limit int) ([]*AuditEntry, error) {
+	return alq.QueryMany(ctx, getAuditLogPageQuery, beforeID, limit)
+}
+
+// GetThemePage returns up to limit entries of a single theme older than beforeID, newest first.
+func (alq *AuditLogQuery) GetThemePage(ctx context.Context, themeID ThemeID, beforeID int64, limit int) ([]*AuditEntry, error) {
+	return alq.QueryMany(ctx, getThemeAuditLogPageQuery, themeID, beforeID, limit)
+}
+
+func (alq *AuditLogQuery) Add(ctx context.Context, entry *AuditEntry) error {
+	return alq.GetDB().QueryRow(ctx, addAuditLogEntryQuery, entry.sqlVariables()...).Scan(&entry.ID)
+}
+
+type AuditAction string
+
+const (
+	AuditLogin            AuditAction = "login"
+	AuditThemeCreate      AuditAction = "theme.create"
+	AuditThemeUpdate      AuditAction = "theme.update"
+	AuditThemeDelete      AuditAction = "theme.delete"
+	AuditThemeRename      AuditAction = "theme.rename"
+	AuditThemeHide        AuditAction = "theme.hide"
+	AuditThemeUnhide      AuditAction = "theme.unhide"
+	AuditThemeFreeze      AuditAction = "theme.freeze"
+	AuditThemeUnfreeze    AuditAction = "theme.unfreeze"
+	AuditAdminAdd         AuditAction = "admin.add"
+	AuditAdminRemove      AuditAction = "admin.remove"
+	AuditPreviewAdd       AuditAction = "preview.add"
+	AuditPreviewDelete    AuditAction = "preview.delete"
+	AuditUserBan          AuditAction = "user.ban"
+	AuditUserUnban        AuditAction = "user.unban"
+	AuditUserPurge        AuditAction = "user.purge"
+	AuditReportHandle     AuditAction = "report.handle"
+	AuditModeratorAdd     AuditAction = "moderator.add"
+	AuditModeratorRemove  AuditAction = "moderator.remove"
+	AuditWebhookAdd       AuditAction = "webhook.add"
+	AuditWebhookRemove    AuditAction = "webhook.remove"
+	AuditMatrixRoomLink   AuditAction = "matrix_room.link"
+	AuditMatrixRoomUnlink AuditAction = "matrix_room.unlink"
+	AuditTagCreate        AuditAction = "tag.create"
+	AuditTagDelete        AuditAction = "tag.delete"
+	AuditChannelSet       AuditAction = "channel.set"
+	AuditChannelClear     AuditAction = "channel.clear"
+)
+
+// AuditEntry is a single action in the audit log. The actor is a user ID, or "cli" for operator commands.
+// Target is the thing that was acted on other than the theme, like a user ID or preview image ID.
+// Before and After are JSON snapshots of whatever changed.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Actor     string          `json:"actor"`
+	Action    AuditAction     `json:"action"`
+	ThemeID   ThemeID         `json:"theme_id,omitempty"`
+	Target    string          `json:"target,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+func (ae *AuditEntry) Scan(row dbutil.Scannable) (*AuditEntry, error) {
+	var themeID, before, after sql.NullString
+	err := row.Scan(&ae.ID, &ae.CreatedAt, &ae.Actor, &ae.Action, &themeID, &ae.Target, &before, &after)
+	if err != nil {
+		return nil, err
+	}
+	ae.ThemeID = ThemeID(themeID.String)
+	if before.Valid {
+		ae.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		ae.After = json.RawMessage(after.String)
+	}
+	return ae, nil
+}
+
+func nullJSON(data json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(data), Valid: len(data) > 0}
+}
+
+func (ae *AuditEntry) sqlVariables() []any {
+	return []any{
+		ae.CreatedAt, ae.Actor, ae.Action, sql.NullString{String: string(ae.ThemeID), Valid: ae.ThemeID != ""},
+		ae.Target, nullJSON(ae.Before), nullJSON(ae.After),
+	}
+}
@@ -25,15 +25,28 @@ import (
 )
 
 const (
-	getAllCommitsQuery = `
-		SELECT theme_id, version, message, created_at, created_by, content
+	getCommitsBaseQuery = `
+		SELECT theme_id, version, message, created_at, created_by, content, COALESCE(git_hash, ''), breaking
 		FROM commit
-		WHERE theme_id = $1
 	`
-	getCommitQuery = getAllCommitsQuery + `AND version = $2`
+	getAllCommitsQuery = getCommitsBaseQuery + `WHERE theme_id = $1`
+	getCommitQuery     = getAllCommitsQuery + ` AND version = $2`
+	// Feeds only include commits of listed themes
+	getRecentListedCommitsQuery = getCommitsBaseQuery + `
+		INNER JOIN theme ON theme.id = commit.theme_id AND NOT theme.hidden
+	`
+	getRecentThemeCreationsQuery = getRecentListedCommitsQuery + `
+		WHERE version = 1 ORDER BY created_at DESC LIMIT $1
+	`
+	getRecentCommitsByCreatorQuery = getRecentListedCommitsQuery + `
+		WHERE created_by = $1 ORDER BY created_at DESC LIMIT $2
+	`
 	addCommitQuery = `
-		INSERT INTO commit (theme_id, version, message, created_at, created_by, content)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO commit (theme_id, version, message, created_at, created_by, content, git_hash, breaking)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+	setCommitGitHashQuery = `
+		UPDATE commit SET git_hash = $3 WHERE theme_id = $1 AND version = $2
 	`
 )
 
@@ -49,10 +62,26 @@ func (cq *CommitQuery) Get(ctx context.Context, themeID ThemeID, version int) (*
 	return cq.QueryOne(ctx, getCommitQuery, themeID, version)
 }
 
+// GetRecentCreations returns the first versions of the most recently created listed themes.
+func (cq *CommitQuery) GetRecentCreations(ctx context.Context, limit int) ([]*Commit, error) {
+	return cq.QueryMany(ctx, getRecentThemeCreationsQuery, limit)
+}
+
+// GetRecentByCreator returns the most recent commits by the given user to listed themes.
+func (cq *CommitQuery) GetRecentByCreator(ctx context.Context, userID id.UserID, limit int) ([]*Commit, error) {
+	return cq.QueryMany(ctx, getRecentCommitsByCreatorQuery, userID, limit)
+}
+
 func (cq *CommitQuery) Add(ctx context.Context, commit *Commit) error {
 	return cq.Exec(ctx, addCommitQuery, commit.sqlVariables()...)
 }
 
+// SetGitHash changes the git commit that a version points at. It's used when a push only
+// adds git commits that don't touch the theme CSS on top of the latest version.
+func (cq *CommitQuery) SetGitHash(ctx context.Context, themeID ThemeID, version int, gitHash string) error {
+	return cq.Exec(ctx, setCommitGitHashQuery, themeID, version, gitHash)
+}
+
 type Commit struct {
 	ThemeID   ThemeID   `json:"theme_id"`
 	Version   int       `json:"version"`
@@ -60,12 +89,19 @@ type Commit struct {
 	CreatedAt time.Time `json:"created_at"`
 	CreatedBy id.UserID `json:"created_by"`
 	Content   string    `json:"content"`
+	// GitHash is the hash of the git commit that was pushed to create this version.
+	// It's empty for commits made through the web editor, which are synthesized on demand.
+	GitHash string `json:"git_hash,omitempty"`
+	// Breaking is set by the author if the version needs changes from users, e.g. renamed variables.
+	Breaking bool `json:"breaking,omitempty"`
 }
 
 func (c *Commit) Scan(row dbutil.Scannable) (*Commit, error) {
-	return dbutil.ValueOrErr(c, row.Scan(&c.ThemeID, &c.Version, &c.Message, &c.CreatedAt, &c.CreatedBy, &c.Content))
+	return dbutil.ValueOrErr(c, row.Scan(
+		&c.ThemeID, &c.Version, &c.Message, &c.CreatedAt, &c.CreatedBy, &c.Content, &c.GitHash, &c.Breaking,
+	))
 }
 
 func (c *Commit) sqlVariables() []any {
-	return []any{c.ThemeID, c.Version, c.Message, c.CreatedAt, c.CreatedBy, c.Content}
+	return []any{c.ThemeID, c.Version, c.Message, c.CreatedAt, c.CreatedBy, c.Content, dbutil.StrPtr(c.GitHash), c.Breaking}
 }
@@ -17,8 +17,9 @@
 package database
 
 import (
+	"context"
+
 	_ "github.com/lib/pq"
-	"github.com/rs/zerolog"
 	"go.mau.fi/util/dbutil"
 
 	"css.gomuks.app/database/upgrades"
@@ -29,24 +30,70 @@ type Database struct {
 	Theme        *ThemeQuery
 	Commit       *CommitQuery
 	PreviewImage *PreviewImageQuery
+	GitObject    *GitObjectQuery
+	APIToken     *APITokenQuery
+	Session      *SessionQuery
+	Moderator    *ModeratorQuery
+	Ban          *BanQuery
+	Report       *ReportQuery
+	AuditLog     *AuditLogQuery
+	RateLimit    *RateLimitQuery
+	Webhook      *WebhookQuery
+	Delivery     *WebhookDeliveryQuery
+	MatrixRoom   *MatrixRoomQuery
+	Tag          *TagQuery
+	Channel      *ChannelQuery
+	Draft        *DraftQuery
 }
 
-func New(uri string, log zerolog.Logger) (*Database, error) {
-	db, err := dbutil.NewWithDialect(uri, "postgres")
+func New(cfg dbutil.Config, log dbutil.DatabaseLogger) (*Database, error) {
+	db, err := dbutil.NewFromConfig("css.gomuks.app", cfg, log)
 	if err != nil {
 		return nil, err
 	}
-	db.Owner = "css.gomuks.app"
-	db.Log = dbutil.ZeroLogger(log)
 	db.UpgradeTable = upgrades.Table
 	return &Database{
 		Database:     db,
 		Theme:        &ThemeQuery{dbutil.MakeQueryHelper(db, newTheme)},
 		Commit:       &CommitQuery{dbutil.MakeQueryHelper(db, newCommit)},
 		PreviewImage: &PreviewImageQuery{dbutil.MakeQueryHelper(db, newPreviewImage)},
+		GitObject:    &GitObjectQuery{dbutil.MakeQueryHelper(db, newGitObject)},
+		APIToken:     &APITokenQuery{dbutil.MakeQueryHelper(db, newAPIToken)},
+		Session:      &SessionQuery{dbutil.MakeQueryHelper(db, newSession)},
+		Moderator:    &ModeratorQuery{dbutil.MakeQueryHelper(db, newModerator)},
+		Ban:          &BanQuery{dbutil.MakeQueryHelper(db, newBan)},
+		Report:       &ReportQuery{dbutil.MakeQueryHelper(db, newReport)},
+		AuditLog:     &AuditLogQuery{dbutil.MakeQueryHelper(db, newAuditEntry)},
+		RateLimit:    &RateLimitQuery{db},
+		Webhook:      &WebhookQuery{dbutil.MakeQueryHelper(db, newWebhook)},
+		Delivery:     &WebhookDeliveryQuery{dbutil.MakeQueryHelper(db, newWebhookDelivery)},
+		MatrixRoom:   &MatrixRoomQuery{dbutil.MakeQueryHelper(db, newMatrixRoom)},
+		Tag:          &TagQuery{dbutil.MakeQueryHelper(db, newRelease)},
+		Channel:      &ChannelQuery{dbutil.MakeQueryHelper(db, newRelease)},
+		Draft:        &DraftQuery{dbutil.MakeQueryHelper(db, newDraft)},
 	}, nil
 }
 
+// SchemaVersion returns the schema version of the database and the latest version known to this build.
+func (db *Database) SchemaVersion(ctx context.Context) (current, latest int, err error) {
+	err = db.QueryRow(ctx, "SELECT version FROM "+db.VersionTable+" LIMIT 1").Scan(&current)
+	return current, len(db.UpgradeTable), err
+}
+
 func newTheme(_ *dbutil.QueryHelper[*Theme]) *Theme                      { return &Theme{} }
 func newCommit(_ *dbutil.QueryHelper[*Commit]) *Commit                   { return &Commit{} }
 func newPreviewImage(_ *dbutil.QueryHelper[*PreviewImage]) *PreviewImage { return &PreviewImage{} }
+func newGitObject(_ *dbutil.QueryHelper[*GitObject]) *GitObject          { return &GitObject{} }
+func newAPIToken(_ *dbutil.QueryHelper[*APIToken]) *APIToken             { return &APIToken{} }
+func newSession(_ *dbutil.QueryHelper[*Session]) *Session                { return &Session{} }
+func newModerator(_ *dbutil.QueryHelper[*Moderator]) *Moderator          { return &Moderator{} }
+func newBan(_ *dbutil.QueryHelper[*Ban]) *Ban                            { return &Ban{} }
+func newReport(_ *dbutil.QueryHelper[*Report]) *Report                   { return &Report{} }
+func newAuditEntry(_ *dbutil.QueryHelper[*AuditEntry]) *AuditEntry       { return &AuditEntry{} }
+func newWebhook(_ *dbutil.QueryHelper[*Webhook]) *Webhook                { return &Webhook{} }
+func newWebhookDelivery(_ *dbutil.QueryHelper[*WebhookDelivery]) *WebhookDelivery {
+	return &WebhookDelivery{}
+}
+func newMatrixRoom(_ *dbutil.QueryHelper[*MatrixRoom]) *MatrixRoom { return &MatrixRoom{} }
+func newRelease(_ *dbutil.QueryHelper[*Release]) *Release          { return &Release{} }
+func newDraft(_ *dbutil.QueryHelper[*Draft]) *Draft                { return &Draft{} }
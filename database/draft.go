@@ -0,0 +1,109 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getDraftsQuery = `
+		SELECT id, theme_id, base_version, message, content, breaking, created_at, created_by, updated_at, updated_by
+		FROM draft
+	`
+	getDraftsByThemeQuery = getDraftsQuery + `WHERE theme_id = $1 ORDER BY updated_at DESC`
+	getDraftQuery         = getDraftsQuery + `WHERE theme_id = $1 AND id = $2`
+	countDraftsQuery      = `SELECT COUNT(*) FROM draft WHERE theme_id = $1`
+	createDraftQuery      = `
+		INSERT INTO draft (theme_id, base_version, message, content, breaking, created_at, created_by, updated_at, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+	updateDraftQuery = `
+		UPDATE draft SET message = $3, content = $4, breaking = $5, updated_at = $6, updated_by = $7
+		WHERE theme_id = $1 AND id = $2
+	`
+	deleteDraftQuery = `
+		DELETE FROM draft WHERE theme_id = $1 AND id = $2
+	`
+)
+
+type DraftQuery struct {
+	*dbutil.QueryHelper[*Draft]
+}
+
+func (dq *DraftQuery) GetByTheme(ctx context.Context, themeID ThemeID) ([]*Draft, error) {
+	return dq.QueryMany(ctx, getDraftsByThemeQuery, themeID)
+}
+
+// Get returns a draft of the given theme, or nil if the theme doesn't have a draft with that ID.
+func (dq *DraftQuery) Get(ctx context.Context, themeID ThemeID, draftID int64) (*Draft, error) {
+	return dq.QueryOne(ctx, getDraftQuery, themeID, draftID)
+}
+
+func (dq *DraftQuery) Count(ctx context.Context, themeID ThemeID) (count int, err error) {
+	err = dq.GetDB().QueryRow(ctx, countDraftsQuery, themeID).Scan(&count)
+	return
+}
+
+func (dq *DraftQuery) Create(ctx context.Context, draft *Draft) error {
+	return dq.GetDB().QueryRow(
+		ctx, createDraftQuery,
+		draft.ThemeID, draft.BaseVersion, draft.Message, draft.Content, draft.Breaking,
+		draft.CreatedAt, draft.CreatedBy, draft.UpdatedAt, draft.UpdatedBy,
+	).Scan(&draft.ID)
+}
+
+func (dq *DraftQuery) Update(ctx context.Context, draft *Draft) error {
+	return dq.Exec(
+		ctx, updateDraftQuery,
+		draft.ThemeID, draft.ID, draft.Message, draft.Content, draft.Breaking,
+		draft.UpdatedAt, draft.UpdatedBy,
+	)
+}
+
+// Delete removes a draft. The theme ID must match the one the draft belongs to.
+func (dq *DraftQuery) Delete(ctx context.Context, themeID ThemeID, draftID int64) error {
+	return dq.Exec(ctx, deleteDraftQuery, themeID, draftID)
+}
+
+// Draft is an unpublished version of a theme. Drafts don't change the latest version of the theme
+// until they're published, which turns them into a normal commit.
+type Draft struct {
+	ID      int64   `json:"id"`
+	ThemeID ThemeID `json:"theme_id"`
+	// BaseVersion is the latest version of the theme when the draft was created
+	BaseVersion int       `json:"base_version"`
+	Message     string    `json:"message"`
+	Content     string    `json:"content"`
+	Breaking    bool      `json:"breaking,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   id.UserID `json:"created_by"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UpdatedBy   id.UserID `json:"updated_by"`
+}
+
+func (d *Draft) Scan(row dbutil.Scannable) (*Draft, error) {
+	return dbutil.ValueOrErr(d, row.Scan(
+		&d.ID, &d.ThemeID, &d.BaseVersion, &d.Message, &d.Content, &d.Breaking,
+		&d.CreatedAt, &d.CreatedBy, &d.UpdatedAt, &d.UpdatedBy,
+	))
+}
@@ -0,0 +1,62 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+
+	"go.mau.fi/util/dbutil"
+)
+
+const (
+	getGitObjectsQuery = `
+		SELECT theme_id, hash, type, data FROM git_object WHERE theme_id = $1
+	`
+	addGitObjectQuery = `
+		INSERT INTO git_object (theme_id, hash, type, data)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (theme_id, hash) DO NOTHING
+	`
+)
+
+type GitObjectQuery struct {
+	*dbutil.QueryHelper[*GitObject]
+}
+
+func (goq *GitObjectQuery) GetAll(ctx context.Context, themeID ThemeID) ([]*GitObject, error) {
+	return goq.QueryMany(ctx, getGitObjectsQuery, themeID)
+}
+
+func (goq *GitObjectQuery) Add(ctx context.Context, obj *GitObject) error {
+	return goq.Exec(ctx, addGitObjectQuery, obj.sqlVariables()...)
+}
+
+// GitObject is a raw git object that was received in a push.
+type GitObject struct {
+	ThemeID ThemeID
+	Hash    string
+	Type    int
+	Data    []byte
+}
+
+func (obj *GitObject) Scan(row dbutil.Scannable) (*GitObject, error) {
+	return dbutil.ValueOrErr(obj, row.Scan(&obj.ThemeID, &obj.Hash, &obj.Type, &obj.Data))
+}
+
+func (obj *GitObject) sqlVariables() []any {
+	return []any{obj.ThemeID, obj.Hash, obj.Type, obj.Data}
+}
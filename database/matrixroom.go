@@ -0,0 +1,68 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getMatrixRoomQuery = `
+		SELECT theme_id, room_id, linked_at, linked_by FROM matrix_room WHERE theme_id = $1
+	`
+	setMatrixRoomQuery = `
+		INSERT INTO matrix_room (theme_id, room_id, linked_at, linked_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (theme_id) DO UPDATE SET room_id = excluded.room_id, linked_at = excluded.linked_at, linked_by = excluded.linked_by
+	`
+	deleteMatrixRoomQuery = `
+		DELETE FROM matrix_room WHERE theme_id = $1
+	`
+)
+
+type MatrixRoomQuery struct {
+	*dbutil.QueryHelper[*MatrixRoom]
+}
+
+func (mrq *MatrixRoomQuery) Get(ctx context.Context, themeID ThemeID) (*MatrixRoom, error) {
+	return mrq.QueryOne(ctx, getMatrixRoomQuery, themeID)
+}
+
+// Set links a room to the theme, replacing the previously linked room if there is one.
+func (mrq *MatrixRoomQuery) Set(ctx context.Context, room *MatrixRoom) error {
+	return mrq.Exec(ctx, setMatrixRoomQuery, room.ThemeID, room.RoomID, room.LinkedAt, room.LinkedBy)
+}
+
+func (mrq *MatrixRoomQuery) Delete(ctx context.Context, themeID ThemeID) error {
+	return mrq.Exec(ctx, deleteMatrixRoomQuery, themeID)
+}
+
+// MatrixRoom is the Matrix room where new versions of a theme are announced.
+type MatrixRoom struct {
+	ThemeID  ThemeID
+	RoomID   id.RoomID
+	LinkedAt time.Time
+	LinkedBy id.UserID
+}
+
+func (mr *MatrixRoom) Scan(row dbutil.Scannable) (*MatrixRoom, error) {
+	return dbutil.ValueOrErr(mr, row.Scan(&mr.ThemeID, &mr.RoomID, &mr.LinkedAt, &mr.LinkedBy))
+}
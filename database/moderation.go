@@ -0,0 +1,129 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getModeratorsQuery = `
+		SELECT user_id, added_at, added_by FROM moderator
+	`
+	getAllModeratorsQuery = getModeratorsQuery + `ORDER BY added_at`
+	getModeratorQuery     = getModeratorsQuery + `WHERE user_id = $1`
+	addModeratorQuery     = `
+		INSERT INTO moderator (user_id, added_at, added_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO NOTHING
+	`
+	removeModeratorQuery = `
+		DELETE FROM moderator WHERE user_id = $1
+	`
+
+	getBansQuery = `
+		SELECT user_id, reason, banned_at, banned_by FROM banned_user
+	`
+	getAllBansQuery = getBansQuery + `ORDER BY banned_at DESC`
+	getBanQuery     = getBansQuery + `WHERE user_id = $1`
+	addBanQuery     = `
+		INSERT INTO banned_user (user_id, reason, banned_at, banned_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET reason = excluded.reason, banned_at = excluded.banned_at, banned_by = excluded.banned_by
+	`
+	removeBanQuery = `
+		DELETE FROM banned_user WHERE user_id = $1
+	`
+)
+
+type ModeratorQuery struct {
+	*dbutil.QueryHelper[*Moderator]
+}
+
+func (mq *ModeratorQuery) GetAll(ctx context.Context) ([]*Moderator, error) {
+	return mq.QueryMany(ctx, getAllModeratorsQuery)
+}
+
+func (mq *ModeratorQuery) Get(ctx context.Context, userID id.UserID) (*Moderator, error) {
+	return mq.QueryOne(ctx, getModeratorQuery, userID)
+}
+
+func (mq *ModeratorQuery) Add(ctx context.Context, mod *Moderator) error {
+	return mq.Exec(ctx, addModeratorQuery, mod.sqlVariables()...)
+}
+
+func (mq *ModeratorQuery) Remove(ctx context.Context, userID id.UserID) error {
+	return mq.Exec(ctx, removeModeratorQuery, userID)
+}
+
+// Moderator is a site moderator granted through the CLI. Moderators can also be listed in the config file,
+// in which case they don't have a row in the database.
+type Moderator struct {
+	UserID  id.UserID `json:"user_id"`
+	AddedAt time.Time `json:"added_at"`
+	AddedBy string    `json:"added_by"`
+}
+
+func (m *Moderator) Scan(row dbutil.Scannable) (*Moderator, error) {
+	return dbutil.ValueOrErr(m, row.Scan(&m.UserID, &m.AddedAt, &m.AddedBy))
+}
+
+func (m *Moderator) sqlVariables() []any {
+	return []any{m.UserID, m.AddedAt, m.AddedBy}
+}
+
+type BanQuery struct {
+	*dbutil.QueryHelper[*Ban]
+}
+
+func (bq *BanQuery) GetAll(ctx context.Context) ([]*Ban, error) {
+	return bq.QueryMany(ctx, getAllBansQuery)
+}
+
+// Get returns the ban of the given user, or nil if they're not banned.
+func (bq *BanQuery) Get(ctx context.Context, userID id.UserID) (*Ban, error) {
+	return bq.QueryOne(ctx, getBanQuery, userID)
+}
+
+// Add bans a user, or updates the reason if they're already banned.
+func (bq *BanQuery) Add(ctx context.Context, ban *Ban) error {
+	return bq.Exec(ctx, addBanQuery, ban.sqlVariables()...)
+}
+
+func (bq *BanQuery) Remove(ctx context.Context, userID id.UserID) error {
+	return bq.Exec(ctx, removeBanQuery, userID)
+}
+
+// Ban prevents a user from publishing anything. Banned users can still log in and view themes.
+type Ban struct {
+	UserID   id.UserID `json:"user_id"`
+	Reason   string    `json:"reason"`
+	BannedAt time.Time `json:"banned_at"`
+	BannedBy id.UserID `json:"banned_by"`
+}
+
+func (b *Ban) Scan(row dbutil.Scannable) (*Ban, error) {
+	return dbutil.ValueOrErr(b, row.Scan(&b.UserID, &b.Reason, &b.BannedAt, &b.BannedBy))
+}
+
+func (b *Ban) sqlVariables() []any {
+	return []any{b.UserID, b.Reason, b.BannedAt, b.BannedBy}
+}
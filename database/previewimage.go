@@ -26,18 +26,31 @@ import (
 )
 
 const (
-	getPreviewImageQuery = `
+	getPreviewImagesQuery = `
 		SELECT image_id, theme_id, created_at, created_by, width, height, mime_type, content
 		FROM preview_image
-		WHERE image_id = $1
 	`
-	addPreviewImageQuery = `
+	getPreviewImageQuery         = getPreviewImagesQuery + `WHERE image_id = $1`
+	getPreviewImagesByThemeQuery = getPreviewImagesQuery + `WHERE theme_id = $1 ORDER BY created_at`
+	addPreviewImageQuery         = `
 		INSERT INTO preview_image (image_id, theme_id, created_at, created_by, width, height, mime_type, content)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
 	deletePreviewImageQuery = `
 		DELETE FROM preview_image WHERE image_id = $1
 	`
+	deleteOrphanedPreviewImagesQuery = `
+		DELETE FROM preview_image WHERE theme_id IS NULL OR theme_id NOT IN (SELECT id FROM theme)
+	`
+	countOrphanedPreviewImagesQuery = `
+		SELECT COUNT(*) FROM preview_image WHERE theme_id IS NULL OR theme_id NOT IN (SELECT id FROM theme)
+	`
+	deletePreviewImagesByCreatorQuery = `
+		DELETE FROM preview_image WHERE created_by = $1
+	`
+	getPreviewStorageSizeQuery = `
+		SELECT COUNT(*), COALESCE(SUM(octet_length(content)), 0) FROM preview_image
+	`
 )
 
 type PreviewImageQuery struct {
@@ -48,6 +61,10 @@ func (piq *PreviewImageQuery) Get(ctx context.Context, imageID uuid.UUID) (*Prev
 	return piq.QueryOne(ctx, getPreviewImageQuery, imageID)
 }
 
+func (piq *PreviewImageQuery) GetByTheme(ctx context.Context, themeID ThemeID) ([]*PreviewImage, error) {
+	return piq.QueryMany(ctx, getPreviewImagesByThemeQuery, themeID)
+}
+
 func (piq *PreviewImageQuery) Add(ctx context.Context, image *PreviewImage) error {
 	return piq.Exec(ctx, addPreviewImageQuery, image.sqlVariables()...)
 }
@@ -56,6 +73,34 @@ func (piq *PreviewImageQuery) Delete(ctx context.Context, imageID uuid.UUID) err
 	return piq.Exec(ctx, deletePreviewImageQuery, imageID)
 }
 
+// DeleteOrphaned deletes preview images that don't belong to any theme. If dryRun is true,
+// the images are only counted.
+func (piq *PreviewImageQuery) DeleteOrphaned(ctx context.Context, dryRun bool) (count int64, err error) {
+	if dryRun {
+		err = piq.GetDB().QueryRow(ctx, countOrphanedPreviewImagesQuery).Scan(&count)
+		return
+	}
+	return piq.execCount(ctx, deleteOrphanedPreviewImagesQuery)
+}
+
+// GetStorageSize returns the number of stored preview images and their total size in bytes.
+func (piq *PreviewImageQuery) GetStorageSize(ctx context.Context) (count, size int64, err error) {
+	err = piq.GetDB().QueryRow(ctx, getPreviewStorageSizeQuery).Scan(&count, &size)
+	return
+}
+
+func (piq *PreviewImageQuery) DeleteByCreator(ctx context.Context, userID id.UserID) (int64, error) {
+	return piq.execCount(ctx, deletePreviewImagesByCreatorQuery, userID)
+}
+
+func (piq *PreviewImageQuery) execCount(ctx context.Context, query string, args ...any) (int64, error) {
+	res, err := piq.GetDB().Exec(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 type PreviewImage struct {
 	ID        uuid.UUID `json:"id"`
 	ThemeID   ThemeID   `json:"theme_id"`
@@ -0,0 +1,53 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+)
+
+const (
+	hitRateLimitQuery = `
+		INSERT INTO rate_limit (key, window_start, expires_at, count) VALUES ($1, $2, $3, 1)
+		ON CONFLICT (key) DO UPDATE
+			SET count=CASE WHEN rate_limit.window_start=excluded.window_start THEN rate_limit.count+1 ELSE 1 END,
+				window_start=excluded.window_start,
+				expires_at=excluded.expires_at
+		RETURNING count
+	`
+	deleteExpiredRateLimitsQuery = `DELETE FROM rate_limit WHERE expires_at<$1`
+)
+
+// RateLimitQuery stores rate limit counters, so that limits are shared between replicas.
+type RateLimitQuery struct {
+	db *dbutil.Database
+}
+
+// Hit increments the counter of the given key in the given window and returns the new count.
+// The counter is reset when the window changes.
+func (rlq *RateLimitQuery) Hit(ctx context.Context, key string, windowStart, expiresAt time.Time) (count int, err error) {
+	err = rlq.db.QueryRow(ctx, hitRateLimitQuery, key, windowStart, expiresAt).Scan(&count)
+	return
+}
+
+func (rlq *RateLimitQuery) DeleteExpired(ctx context.Context) error {
+	_, err := rlq.db.Exec(ctx, deleteExpiredRateLimitsQuery, time.Now())
+	return err
+}
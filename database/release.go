@@ -0,0 +1,114 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getTagsQuery = `
+		SELECT theme_id, name, version, created_at, created_by FROM theme_tag
+	`
+	getTagsByThemeQuery = getTagsQuery + `WHERE theme_id = $1 ORDER BY version DESC, name`
+	getTagQuery         = getTagsQuery + `WHERE theme_id = $1 AND name = $2`
+	addTagQuery         = `
+		INSERT INTO theme_tag (theme_id, name, version, created_at, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	deleteTagQuery = `
+		DELETE FROM theme_tag WHERE theme_id = $1 AND name = $2
+	`
+
+	getChannelsQuery = `
+		SELECT theme_id, name, version, updated_at, updated_by FROM theme_channel
+	`
+	getChannelsByThemeQuery = getChannelsQuery + `WHERE theme_id = $1 ORDER BY name`
+	getChannelQuery         = getChannelsQuery + `WHERE theme_id = $1 AND name = $2`
+	setChannelQuery         = `
+		INSERT INTO theme_channel (theme_id, name, version, updated_at, updated_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (theme_id, name) DO UPDATE
+			SET version = excluded.version, updated_at = excluded.updated_at, updated_by = excluded.updated_by
+	`
+	deleteChannelQuery = `
+		DELETE FROM theme_channel WHERE theme_id = $1 AND name = $2
+	`
+)
+
+// Release is a named pointer to a version of a theme. Tags are created once and never move,
+// while channels are moved to new versions by theme admins.
+type Release struct {
+	ThemeID   ThemeID   `json:"-"`
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy id.UserID `json:"updated_by"`
+}
+
+func (rel *Release) Scan(row dbutil.Scannable) (*Release, error) {
+	return dbutil.ValueOrErr(rel, row.Scan(&rel.ThemeID, &rel.Name, &rel.Version, &rel.UpdatedAt, &rel.UpdatedBy))
+}
+
+func (rel *Release) sqlVariables() []any {
+	return []any{rel.ThemeID, rel.Name, rel.Version, rel.UpdatedAt, rel.UpdatedBy}
+}
+
+type TagQuery struct {
+	*dbutil.QueryHelper[*Release]
+}
+
+func (tq *TagQuery) GetByTheme(ctx context.Context, themeID ThemeID) ([]*Release, error) {
+	return tq.QueryMany(ctx, getTagsByThemeQuery, themeID)
+}
+
+func (tq *TagQuery) Get(ctx context.Context, themeID ThemeID, name string) (*Release, error) {
+	return tq.QueryOne(ctx, getTagQuery, themeID, name)
+}
+
+func (tq *TagQuery) Add(ctx context.Context, tag *Release) error {
+	return tq.Exec(ctx, addTagQuery, tag.sqlVariables()...)
+}
+
+func (tq *TagQuery) Delete(ctx context.Context, themeID ThemeID, name string) error {
+	return tq.Exec(ctx, deleteTagQuery, themeID, name)
+}
+
+type ChannelQuery struct {
+	*dbutil.QueryHelper[*Release]
+}
+
+func (cq *ChannelQuery) GetByTheme(ctx context.Context, themeID ThemeID) ([]*Release, error) {
+	return cq.QueryMany(ctx, getChannelsByThemeQuery, themeID)
+}
+
+func (cq *ChannelQuery) Get(ctx context.Context, themeID ThemeID, name string) (*Release, error) {
+	return cq.QueryOne(ctx, getChannelQuery, themeID, name)
+}
+
+// Set moves a channel to the given version, creating it if necessary.
+func (cq *ChannelQuery) Set(ctx context.Context, channel *Release) error {
+	return cq.Exec(ctx, setChannelQuery, channel.sqlVariables()...)
+}
+
+func (cq *ChannelQuery) Delete(ctx context.Context, themeID ThemeID, name string) error {
+	return cq.Exec(ctx, deleteChannelQuery, themeID, name)
+}
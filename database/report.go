@@ -0,0 +1,153 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getReportsQuery = `
+		SELECT id, theme_id, version, image_id, reporter, category, reason, created_at, status, handled_by, handled_at
+		FROM report
+	`
+	getReportQuery = getReportsQuery + `WHERE id = $1`
+	// Escalated reports are shown first, then the oldest open reports
+	getReportQueueQuery = getReportsQuery + `
+		WHERE status IN ('open', 'escalated')
+		ORDER BY status = 'escalated' DESC, created_at
+	`
+	hasOpenReportQuery = `
+		SELECT EXISTS(
+			SELECT 1 FROM report
+			WHERE theme_id = $1 AND image_id IS NOT DISTINCT FROM $2 AND reporter = $3 AND status IN ('open', 'escalated')
+		)
+	`
+	countOpenReportsQuery = `
+		SELECT theme_id, COUNT(*) FROM report WHERE status IN ('open', 'escalated') GROUP BY theme_id
+	`
+	createReportQuery = `
+		INSERT INTO report (theme_id, version, image_id, reporter, category, reason, created_at, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+	setReportStatusQuery = `
+		UPDATE report SET status = $2, handled_by = $3, handled_at = $4 WHERE id = $1
+	`
+)
+
+type ReportStatus string
+
+const (
+	ReportStatusOpen      ReportStatus = "open"
+	ReportStatusEscalated ReportStatus = "escalated"
+	ReportStatusResolved  ReportStatus = "resolved"
+	ReportStatusDismissed ReportStatus = "dismissed"
+)
+
+type ReportQuery struct {
+	*dbutil.QueryHelper[*Report]
+}
+
+func (rq *ReportQuery) Get(ctx context.Context, reportID int64) (*Report, error) {
+	return rq.QueryOne(ctx, getReportQuery, reportID)
+}
+
+// GetQueue returns all open and escalated reports, escalated ones first.
+func (rq *ReportQuery) GetQueue(ctx context.Context) ([]*Report, error) {
+	return rq.QueryMany(ctx, getReportQueueQuery)
+}
+
+// HasOpen checks whether the user already has an unhandled report about the same theme or preview image.
+func (rq *ReportQuery) HasOpen(ctx context.Context, themeID ThemeID, imageID uuid.UUID, reporter id.UserID) (exists bool, err error) {
+	err = rq.GetDB().QueryRow(ctx, hasOpenReportQuery, themeID, uuid.NullUUID{UUID: imageID, Valid: imageID != uuid.Nil}, reporter).Scan(&exists)
+	return
+}
+
+// CountOpen returns the number of open and escalated reports of each theme that has any.
+func (rq *ReportQuery) CountOpen(ctx context.Context) (map[ThemeID]int, error) {
+	rows, err := rq.GetDB().Query(ctx, countOpenReportsQuery)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[ThemeID]int)
+	for rows.Next() {
+		var themeID ThemeID
+		var count int
+		if err = rows.Scan(&themeID, &count); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		counts[themeID] = count
+	}
+	return counts, rows.Err()
+}
+
+func (rq *ReportQuery) Create(ctx context.Context, report *Report) error {
+	return rq.GetDB().QueryRow(
+		ctx, createReportQuery,
+		report.ThemeID, report.Version, uuid.NullUUID{UUID: report.ImageID, Valid: report.ImageID != uuid.Nil},
+		report.Reporter, report.Category, report.Reason, report.CreatedAt, report.Status,
+	).Scan(&report.ID)
+}
+
+func (rq *ReportQuery) SetStatus(ctx context.Context, reportID int64, status ReportStatus, handledBy id.UserID) error {
+	return rq.Exec(ctx, setReportStatusQuery, reportID, status, handledBy, time.Now())
+}
+
+// Report is an abuse report about a theme version, or a single preview image if ImageID is set.
+type Report struct {
+	ID        int64        `json:"id"`
+	ThemeID   ThemeID      `json:"theme_id"`
+	Version   int          `json:"version"`
+	ImageID   uuid.UUID    `json:"image_id,omitempty"`
+	Reporter  id.UserID    `json:"reporter"`
+	Category  string       `json:"category"`
+	Reason    string       `json:"reason"`
+	CreatedAt time.Time    `json:"created_at"`
+	Status    ReportStatus `json:"status"`
+	HandledBy id.UserID    `json:"handled_by,omitempty"`
+	HandledAt time.Time    `json:"handled_at,omitempty"`
+}
+
+// HasImage returns true if the report is about a preview image rather than the theme CSS.
+func (r *Report) HasImage() bool {
+	return r.ImageID != uuid.Nil
+}
+
+func (r *Report) Scan(row dbutil.Scannable) (*Report, error) {
+	var imageID uuid.NullUUID
+	var handledBy sql.NullString
+	var handledAt sql.NullTime
+	err := row.Scan(
+		&r.ID, &r.ThemeID, &r.Version, &imageID, &r.Reporter, &r.Category, &r.Reason, &r.CreatedAt,
+		&r.Status, &handledBy, &handledAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	r.ImageID = imageID.UUID
+	r.HandledBy = id.UserID(handledBy.String)
+	r.HandledAt = handledAt.Time
+	return r, nil
+}
@@ -0,0 +1,130 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getSessionsQuery = `
+		SELECT id, user_id, created_at, expires_at, last_seen_at, user_agent, key_id FROM session
+	`
+	getSessionQuery        = getSessionsQuery + `WHERE id = $1 AND expires_at > $2`
+	getSessionsByUserQuery = getSessionsQuery + `WHERE user_id = $1 AND expires_at > $2 ORDER BY created_at DESC`
+	createSessionQuery     = `
+		INSERT INTO session (id, user_id, created_at, expires_at, last_seen_at, user_agent, key_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	updateSessionLastSeenQuery = `
+		UPDATE session SET last_seen_at = $2 WHERE id = $1
+	`
+	deleteSessionQuery = `
+		DELETE FROM session WHERE id = $1 AND user_id = $2
+	`
+	deleteSessionsByUserQuery = `
+		DELETE FROM session WHERE user_id = $1
+	`
+	countSessionsByKeyQuery = `
+		SELECT key_id, COUNT(*) FROM session WHERE expires_at > $1 GROUP BY key_id
+	`
+	deleteExpiredSessionsQuery = `
+		DELETE FROM session WHERE expires_at <= $1
+	`
+)
+
+type SessionQuery struct {
+	*dbutil.QueryHelper[*Session]
+}
+
+// Get returns the session with the given ID, or nil if it doesn't exist or has expired.
+func (sq *SessionQuery) Get(ctx context.Context, sessionID string) (*Session, error) {
+	return sq.QueryOne(ctx, getSessionQuery, sessionID, time.Now())
+}
+
+func (sq *SessionQuery) GetByUser(ctx context.Context, userID id.UserID) ([]*Session, error) {
+	return sq.QueryMany(ctx, getSessionsByUserQuery, userID, time.Now())
+}
+
+func (sq *SessionQuery) Create(ctx context.Context, session *Session) error {
+	return sq.Exec(ctx, createSessionQuery, session.sqlVariables()...)
+}
+
+func (sq *SessionQuery) UpdateLastSeen(ctx context.Context, sessionID string, lastSeen time.Time) error {
+	return sq.Exec(ctx, updateSessionLastSeenQuery, sessionID, lastSeen)
+}
+
+// Delete revokes a single session. The user ID must match the session owner.
+func (sq *SessionQuery) Delete(ctx context.Context, userID id.UserID, sessionID string) error {
+	return sq.Exec(ctx, deleteSessionQuery, sessionID, userID)
+}
+
+func (sq *SessionQuery) DeleteByUser(ctx context.Context, userID id.UserID) (int64, error) {
+	res, err := sq.GetDB().Exec(ctx, deleteSessionsByUserQuery, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CountByKey returns the number of unexpired sessions signed with each token key.
+func (sq *SessionQuery) CountByKey(ctx context.Context) (map[string]int, error) {
+	rows, err := sq.GetDB().Query(ctx, countSessionsByKeyQuery, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for rows.Next() {
+		var keyID string
+		var count int
+		if err = rows.Scan(&keyID, &count); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		counts[keyID] = count
+	}
+	return counts, rows.Err()
+}
+
+func (sq *SessionQuery) DeleteExpired(ctx context.Context) error {
+	return sq.Exec(ctx, deleteExpiredSessionsQuery, time.Now())
+}
+
+// Session is a login session. The ID is embedded in the signed login cookie,
+// so deleting the row immediately invalidates the cookie.
+type Session struct {
+	ID         string
+	UserID     id.UserID
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastSeenAt time.Time
+	UserAgent  string
+	// KeyID is the token key that the session cookie was signed with.
+	KeyID string
+}
+
+func (s *Session) Scan(row dbutil.Scannable) (*Session, error) {
+	return dbutil.ValueOrErr(s, row.Scan(&s.ID, &s.UserID, &s.CreatedAt, &s.ExpiresAt, &s.LastSeenAt, &s.UserAgent, &s.KeyID))
+}
+
+func (s *Session) sqlVariables() []any {
+	return []any{s.ID, s.UserID, s.CreatedAt, s.ExpiresAt, s.LastSeenAt, s.UserAgent, s.KeyID}
+}
@@ -18,6 +18,7 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"slices"
 
 	"github.com/google/uuid"
@@ -30,7 +31,7 @@ import (
 const (
 	getAllThemesQuery = `
 		SELECT
-			id, name, description,
+			id, name, description, hidden, frozen, follow_stable,
 			COALESCE(commit.version, 0), commit.created_at, COALESCE(commit.created_by, ''), COALESCE(commit.content, ''),
 			ARRAY(SELECT user_id FROM admin WHERE theme_id = theme.id),
 			ARRAY(SELECT image_id FROM preview_image WHERE theme_id = theme.id)
@@ -40,16 +41,38 @@ const (
 	getThemeByIDQuery     = getAllThemesQuery + `WHERE id = $1`
 	getThemesByAdminQuery = getAllThemesQuery + `INNER JOIN admin ON theme.id = admin.theme_id AND admin.user_id = $1`
 	createThemeQuery      = `
-		INSERT INTO theme (id, name, description, last_commit)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO theme (id, name, description, last_commit, follow_stable)
+		VALUES ($1, $2, $3, $4, $5)
 	`
 	updateThemeQuery = `
-		UPDATE theme SET name = $2, description = $3, last_commit = $4 WHERE id = $1
+		UPDATE theme SET name = $2, description = $3, last_commit = $4, follow_stable = $5 WHERE id = $1
 	`
 	setLatestThemeCommitQuery = `UPDATE theme SET last_commit = $2 WHERE id = $1`
+	setThemeHiddenQuery       = `UPDATE theme SET hidden = $2 WHERE id = $1`
+	setThemeFrozenQuery       = `UPDATE theme SET frozen = $2 WHERE id = $1`
 	deleteThemeQuery          = `
 		DELETE FROM theme WHERE id = $1
 	`
+	renameThemeQuery = `
+		UPDATE theme SET id = $2 WHERE id = $1
+	`
+	renameThemeTokenScopesQuery = `
+		UPDATE api_token_scope SET theme_id = $2 WHERE theme_id = $1
+	`
+	renameThemeAuditLogQuery = `
+		UPDATE audit_log SET theme_id = $2 WHERE theme_id = $1
+	`
+	clearLatestThemeCommitQuery  = `UPDATE theme SET last_commit = NULL WHERE id = $1`
+	deleteThemesBySoleAdminQuery = `
+		DELETE FROM theme
+		WHERE id IN (
+			SELECT theme_id FROM admin
+			WHERE theme_id IN (SELECT theme_id FROM admin WHERE user_id = $1)
+			GROUP BY theme_id
+			HAVING COUNT(*) = 1
+		)
+		RETURNING id
+	`
 	addThemeAdminQuery = `
 		INSERT INTO admin (theme_id, user_id)
 		VALUES ($1, $2)
@@ -58,6 +81,9 @@ const (
 	removeThemeAdminQuery = `
 		DELETE FROM admin WHERE theme_id = $1 AND user_id = $2
 	`
+	removeAdminFromAllThemesQuery = `
+		DELETE FROM admin WHERE user_id = $1
+	`
 )
 
 type ThemeQuery struct {
@@ -88,10 +114,52 @@ func (tq *ThemeQuery) SetLatestCommit(ctx context.Context, themeID ThemeID, late
 	return tq.Exec(ctx, setLatestThemeCommitQuery, themeID, latestCommit)
 }
 
+// SetHidden hides or unhides a theme from listings. Hidden themes can still be viewed and imported directly.
+func (tq *ThemeQuery) SetHidden(ctx context.Context, themeID ThemeID, hidden bool) error {
+	return tq.Exec(ctx, setThemeHiddenQuery, themeID, hidden)
+}
+
+// SetFrozen freezes or unfreezes a theme. Frozen themes don't accept new commits.
+func (tq *ThemeQuery) SetFrozen(ctx context.Context, themeID ThemeID, frozen bool) error {
+	return tq.Exec(ctx, setThemeFrozenQuery, themeID, frozen)
+}
+
 func (tq *ThemeQuery) Delete(ctx context.Context, id ThemeID) error {
 	return tq.Exec(ctx, deleteThemeQuery, id)
 }
 
+// Rename changes the ID of a theme. Commits, admins and preview images follow via ON UPDATE CASCADE,
+// but the latest commit reference is cleared and restored around the rename, as it points in the other direction.
+// API token scopes and audit log entries don't have a foreign key, so they're updated separately.
+func (tq *ThemeQuery) Rename(ctx context.Context, oldID, newID ThemeID) error {
+	return tq.GetDB().DoTxn(ctx, nil, func(ctx context.Context) error {
+		theme, err := tq.Get(ctx, oldID)
+		if err != nil {
+			return err
+		} else if theme == nil {
+			return fmt.Errorf("theme %s not found", oldID)
+		}
+		if err = tq.Exec(ctx, clearLatestThemeCommitQuery, oldID); err != nil {
+			return err
+		} else if err = tq.Exec(ctx, renameThemeQuery, oldID, newID); err != nil {
+			return err
+		} else if err = tq.Exec(ctx, renameThemeTokenScopesQuery, oldID, newID); err != nil {
+			return err
+		} else if err = tq.Exec(ctx, renameThemeAuditLogQuery, oldID, newID); err != nil {
+			return err
+		} else if theme.LatestCommit.Version > 0 {
+			return tq.SetLatestCommit(ctx, newID, theme.LatestCommit.Version)
+		}
+		return nil
+	})
+}
+
+// DeleteBySoleAdmin deletes all themes where the given user is the only admin and returns their IDs.
+func (tq *ThemeQuery) DeleteBySoleAdmin(ctx context.Context, userID id.UserID) ([]ThemeID, error) {
+	rows, err := tq.GetDB().Query(ctx, deleteThemesBySoleAdminQuery, userID)
+	return dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[ThemeID], err).AsList()
+}
+
 func (tq *ThemeQuery) AddAdmin(ctx context.Context, themeID ThemeID, adminID id.UserID) error {
 	return tq.Exec(ctx, addThemeAdminQuery, themeID, adminID)
 }
@@ -100,12 +168,25 @@ func (tq *ThemeQuery) RemoveAdmin(ctx context.Context, themeID ThemeID, adminID
 	return tq.Exec(ctx, removeThemeAdminQuery, themeID, adminID)
 }
 
+func (tq *ThemeQuery) RemoveAdminFromAll(ctx context.Context, adminID id.UserID) (int64, error) {
+	res, err := tq.GetDB().Exec(ctx, removeAdminFromAllThemesQuery, adminID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 type ThemeID string
 
 type Theme struct {
 	ID          ThemeID `json:"id"`
 	Name        string  `json:"name"`
 	Description string  `json:"description"`
+	// Moderation flags are only shown to moderators
+	Hidden bool `json:"-"`
+	Frozen bool `json:"-"`
+	// FollowStable makes the unversioned CSS URL serve the stable channel instead of the latest version
+	FollowStable bool `json:"follow_stable"`
 
 	LatestCommit Commit      `json:"latest_commit"`
 	Admins       []id.UserID `json:"admins,omitempty"`
@@ -115,7 +196,7 @@ type Theme struct {
 func (t *Theme) Scan(row dbutil.Scannable) (*Theme, error) {
 	var admins []string
 	err := row.Scan(
-		&t.ID, &t.Name, &t.Description,
+		&t.ID, &t.Name, &t.Description, &t.Hidden, &t.Frozen, &t.FollowStable,
 		&t.LatestCommit.Version, &t.LatestCommit.CreatedAt, &t.LatestCommit.CreatedBy, &t.LatestCommit.Content,
 		pq.Array(&admins), pq.Array(&t.Previews),
 	)
@@ -131,7 +212,7 @@ func (t *Theme) sqlVariables() []any {
 	if t.LatestCommit.Version > 0 {
 		lastCommitID = &t.LatestCommit.Version
 	}
-	return []any{t.ID, t.Name, t.Description, lastCommitID}
+	return []any{t.ID, t.Name, t.Description, lastCommitID, t.FollowStable}
 }
 
 func (t *Theme) IsAdmin(userID id.UserID) bool {
@@ -0,0 +1,114 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"go.mau.fi/util/dbutil"
+)
+
+// getThemeUpdatesQuery returns one row per newer commit of each requested theme, or a single row
+// with NULL commit columns for themes that are up to date. Unknown themes are left out, and the
+// rows are in the same order as the requested themes.
+const getThemeUpdatesQuery = `
+	SELECT req.theme_id, req.version, COALESCE(theme.last_commit, 0),
+	       commit.version, commit.message, commit.created_at, commit.breaking
+	FROM unnest($1::text[], $2::integer[]) WITH ORDINALITY AS req(theme_id, version, idx)
+	INNER JOIN theme ON theme.id = req.theme_id
+	LEFT JOIN commit ON commit.theme_id = theme.id AND commit.version > req.version AND commit.version <= theme.last_commit
+	ORDER BY req.idx, commit.version DESC
+`
+
+// ThemeUpdate is the result of checking a theme for versions newer than the one the client has.
+type ThemeUpdate struct {
+	ThemeID        ThemeID `json:"theme_id"`
+	CurrentVersion int     `json:"current_version"`
+	LatestVersion  int     `json:"latest_version"`
+	// Breaking is true if any version in the changelog is marked as breaking
+	Breaking bool `json:"breaking"`
+	// Changelog contains the versions after the current one, newest first
+	Changelog []*ChangelogEntry `json:"changelog"`
+}
+
+type ChangelogEntry struct {
+	Version   int       `json:"version"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+	Breaking  bool      `json:"breaking,omitempty"`
+}
+
+type themeUpdateRow struct {
+	ThemeUpdate
+	entry *ChangelogEntry
+}
+
+func scanThemeUpdateRow(row dbutil.Scannable) (*themeUpdateRow, error) {
+	var res themeUpdateRow
+	var version sql.NullInt32
+	var message sql.NullString
+	var createdAt sql.NullTime
+	var breaking sql.NullBool
+	err := row.Scan(
+		&res.ThemeID, &res.CurrentVersion, &res.LatestVersion,
+		&version, &message, &createdAt, &breaking,
+	)
+	if err != nil {
+		return nil, err
+	} else if version.Valid {
+		res.entry = &ChangelogEntry{
+			Version:   int(version.Int32),
+			Message:   message.String,
+			CreatedAt: createdAt.Time,
+			Breaking:  breaking.Bool,
+		}
+	}
+	return &res, nil
+}
+
+// GetUpdates checks multiple themes for updates in a single query. The versions are the ones
+// the client currently has, in the same order as the theme IDs, which must be unique.
+// The updates are returned in the same order as the theme IDs.
+func (cq *CommitQuery) GetUpdates(ctx context.Context, themeIDs []ThemeID, versions []int) ([]*ThemeUpdate, error) {
+	rows, err := cq.GetDB().Query(ctx, getThemeUpdatesQuery, pq.Array(themeIDs), pq.Array(versions))
+	updateRows, err := dbutil.NewRowIterWithError(rows, scanThemeUpdateRow, err).AsList()
+	if err != nil {
+		return nil, err
+	}
+	return groupThemeUpdates(updateRows), nil
+}
+
+// groupThemeUpdates merges consecutive rows of the same theme into a single update with a changelog.
+func groupThemeUpdates(updateRows []*themeUpdateRow) []*ThemeUpdate {
+	var updates []*ThemeUpdate
+	for _, row := range updateRows {
+		if len(updates) == 0 || updates[len(updates)-1].ThemeID != row.ThemeID {
+			update := row.ThemeUpdate
+			update.Changelog = []*ChangelogEntry{}
+			updates = append(updates, &update)
+		}
+		if row.entry != nil {
+			update := updates[len(updates)-1]
+			update.Changelog = append(update.Changelog, row.entry)
+			update.Breaking = update.Breaking || row.entry.Breaking
+		}
+	}
+	return updates
+}
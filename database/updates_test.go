@@ -0,0 +1,56 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupThemeUpdates(t *testing.T) {
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(version int, breaking bool) *ChangelogEntry {
+		return &ChangelogEntry{Version: version, Message: "meow", CreatedAt: ts.Add(time.Duration(version) * time.Hour), Breaking: breaking}
+	}
+	row := func(themeID ThemeID, current, latest int, entry *ChangelogEntry) *themeUpdateRow {
+		return &themeUpdateRow{ThemeUpdate: ThemeUpdate{ThemeID: themeID, CurrentVersion: current, LatestVersion: latest}, entry: entry}
+	}
+	rows := []*themeUpdateRow{
+		// Rows come in request order with the newest version first
+		row("zzz", 1, 4, entry(4, false)),
+		row("zzz", 1, 4, entry(3, true)),
+		row("zzz", 1, 4, entry(2, false)),
+		row("current", 2, 2, nil),
+		row("aaa", 5, 6, entry(6, false)),
+	}
+	want := []*ThemeUpdate{
+		{ThemeID: "zzz", CurrentVersion: 1, LatestVersion: 4, Breaking: true, Changelog: []*ChangelogEntry{entry(4, false), entry(3, true), entry(2, false)}},
+		{ThemeID: "current", CurrentVersion: 2, LatestVersion: 2, Changelog: []*ChangelogEntry{}},
+		{ThemeID: "aaa", CurrentVersion: 5, LatestVersion: 6, Changelog: []*ChangelogEntry{entry(6, false)}},
+	}
+	got := groupThemeUpdates(rows)
+	if !reflect.DeepEqual(got, want) {
+		for i := range got {
+			t.Logf("got[%d] = %+v", i, got[i])
+		}
+		t.Errorf("grouped updates don't match")
+	}
+	if got := groupThemeUpdates(nil); got != nil {
+		t.Errorf("got %+v for no rows, want nil", got)
+	}
+}
@@ -1,9 +1,13 @@
--- v0 -> v1 (compatible with v1+): Latest schema
+-- v0 -> v15 (compatible with v1+): Latest schema
 CREATE TABLE theme (
-    id          TEXT PRIMARY KEY,
-    name        TEXT NOT NULL,
-    description TEXT NOT NULL,
-    last_commit INTEGER
+    id            TEXT PRIMARY KEY,
+    name          TEXT NOT NULL,
+    description   TEXT NOT NULL,
+    last_commit   INTEGER,
+    hidden        BOOLEAN NOT NULL DEFAULT false,
+    frozen        BOOLEAN NOT NULL DEFAULT false,
+    -- Whether the unversioned CSS URL serves the stable channel instead of the latest version
+    follow_stable BOOLEAN NOT NULL DEFAULT false
 );
 
 CREATE TABLE commit (
@@ -13,6 +17,8 @@ CREATE TABLE commit (
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     created_by TEXT      NOT NULL,
     content    TEXT      NOT NULL,
+    git_hash   TEXT,
+    breaking   BOOLEAN   NOT NULL DEFAULT false,
 
     PRIMARY KEY (theme_id, version),
     CONSTRAINT commit_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
@@ -44,3 +50,203 @@ CREATE TABLE admin (
         ON DELETE CASCADE ON UPDATE CASCADE
 );
 CREATE INDEX admin_user_id_idx ON admin (user_id);
+
+CREATE TABLE git_object (
+    theme_id TEXT,
+    hash     TEXT,
+    type     INTEGER NOT NULL,
+    data     bytea   NOT NULL,
+
+    PRIMARY KEY (theme_id, hash),
+    CONSTRAINT git_object_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE api_token (
+    id           BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    user_id      TEXT      NOT NULL,
+    name         TEXT      NOT NULL,
+    token_hash   bytea     NOT NULL UNIQUE,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at   TIMESTAMP,
+    last_used_at TIMESTAMP,
+
+    CONSTRAINT api_token_user_name_unique UNIQUE (user_id, name)
+);
+
+-- Scopes intentionally don't reference the theme table, so that tokens can be created for themes
+-- which don't exist yet (e.g. to create a theme with git push). Writing also requires being an admin.
+CREATE TABLE api_token_scope (
+    token_id  BIGINT,
+    theme_id  TEXT,
+    can_write BOOLEAN NOT NULL,
+
+    PRIMARY KEY (token_id, theme_id),
+    CONSTRAINT api_token_scope_token_id_fkey FOREIGN KEY (token_id) REFERENCES api_token (id)
+        ON DELETE CASCADE
+);
+
+CREATE TABLE session (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT      NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    expires_at   TIMESTAMP NOT NULL,
+    last_seen_at TIMESTAMP NOT NULL,
+    user_agent   TEXT      NOT NULL,
+    key_id       TEXT      NOT NULL
+);
+CREATE INDEX session_user_id_idx ON session (user_id);
+
+CREATE TABLE moderator (
+    user_id  TEXT PRIMARY KEY,
+    added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    added_by TEXT      NOT NULL
+);
+
+CREATE TABLE banned_user (
+    user_id   TEXT PRIMARY KEY,
+    reason    TEXT      NOT NULL,
+    banned_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    banned_by TEXT      NOT NULL
+);
+
+CREATE TABLE report (
+    id         BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    theme_id   TEXT      NOT NULL,
+    version    INTEGER   NOT NULL,
+    image_id   uuid,
+    reporter   TEXT      NOT NULL,
+    category   TEXT      NOT NULL,
+    reason     TEXT      NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    status     TEXT      NOT NULL,
+    handled_by TEXT,
+    handled_at TIMESTAMP,
+
+    CONSTRAINT report_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX report_theme_id_idx ON report (theme_id);
+CREATE INDEX report_status_idx ON report (status);
+
+CREATE TABLE audit_log (
+    id         BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    created_at TIMESTAMP NOT NULL,
+    actor      TEXT      NOT NULL,
+    action     TEXT      NOT NULL,
+    -- The current ID of the theme, which is updated when the theme is renamed. There's intentionally
+    -- no foreign key, so that entries are kept when themes are deleted.
+    theme_id   TEXT,
+    target     TEXT      NOT NULL,
+    before     jsonb,
+    after      jsonb
+);
+CREATE INDEX audit_log_theme_id_idx ON audit_log (theme_id, id);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    -- Renaming a theme moves its entries to the new ID, but nothing else about an entry may change
+    IF TG_OP = 'UPDATE'
+        AND (NEW.id, NEW.created_at, NEW.actor, NEW.action, NEW.target, NEW.before, NEW.after)
+            IS NOT DISTINCT FROM (OLD.id, OLD.created_at, OLD.actor, OLD.action, OLD.target, OLD.before, OLD.after)
+    THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+CREATE TABLE rate_limit (
+    key          TEXT PRIMARY KEY,
+    window_start TIMESTAMP NOT NULL,
+    expires_at   TIMESTAMP NOT NULL,
+    count        INTEGER   NOT NULL
+);
+CREATE INDEX rate_limit_expires_at_idx ON rate_limit (expires_at);
+
+CREATE TABLE webhook (
+    id         BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    theme_id   TEXT      NOT NULL,
+    url        TEXT      NOT NULL,
+    secret     TEXT      NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    created_by TEXT      NOT NULL,
+
+    CONSTRAINT webhook_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX webhook_theme_id_idx ON webhook (theme_id);
+
+-- Deliveries intentionally don't reference the webhook table, so that the theme deletion event
+-- can still be delivered after the theme and its webhooks are gone. The payload is stored as
+-- text rather than jsonb, as the signature covers the exact bytes.
+CREATE TABLE webhook_delivery (
+    id               BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    webhook_id       BIGINT    NOT NULL,
+    url              TEXT      NOT NULL,
+    event            TEXT      NOT NULL,
+    payload          TEXT      NOT NULL,
+    signature        TEXT      NOT NULL,
+    status           TEXT      NOT NULL,
+    attempts         INTEGER   NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP NOT NULL,
+    next_attempt_at  TIMESTAMP NOT NULL,
+    last_attempt_at  TIMESTAMP,
+    last_status_code INTEGER,
+    last_error       TEXT
+);
+CREATE INDEX webhook_delivery_webhook_id_idx ON webhook_delivery (webhook_id, id);
+CREATE INDEX webhook_delivery_pending_idx ON webhook_delivery (next_attempt_at) WHERE status = 'pending';
+
+CREATE TABLE matrix_room (
+    theme_id  TEXT PRIMARY KEY,
+    room_id   TEXT      NOT NULL,
+    linked_at TIMESTAMP NOT NULL,
+    linked_by TEXT      NOT NULL,
+
+    CONSTRAINT matrix_room_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE theme_tag (
+    theme_id   TEXT,
+    name       TEXT,
+    version    INTEGER   NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    created_by TEXT      NOT NULL,
+
+    PRIMARY KEY (theme_id, name),
+    CONSTRAINT theme_tag_commit_fkey FOREIGN KEY (theme_id, version) REFERENCES commit (theme_id, version)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE theme_channel (
+    theme_id   TEXT,
+    name       TEXT,
+    version    INTEGER   NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    updated_by TEXT      NOT NULL,
+
+    PRIMARY KEY (theme_id, name),
+    CONSTRAINT theme_channel_commit_fkey FOREIGN KEY (theme_id, version) REFERENCES commit (theme_id, version)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE draft (
+    id           BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    theme_id     TEXT      NOT NULL,
+    base_version INTEGER   NOT NULL,
+    message      TEXT      NOT NULL,
+    content      TEXT      NOT NULL,
+    breaking     BOOLEAN   NOT NULL DEFAULT false,
+    created_at   TIMESTAMP NOT NULL,
+    created_by   TEXT      NOT NULL,
+    updated_at   TIMESTAMP NOT NULL,
+    updated_by   TEXT      NOT NULL,
+
+    CONSTRAINT draft_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX draft_theme_id_idx ON draft (theme_id);
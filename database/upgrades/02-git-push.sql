@@ -0,0 +1,19 @@
+-- v2 (compatible with v1+): Store pushed git objects and git tokens
+ALTER TABLE commit ADD COLUMN git_hash TEXT;
+
+CREATE TABLE git_object (
+    theme_id TEXT,
+    hash     TEXT,
+    type     INTEGER NOT NULL,
+    data     bytea   NOT NULL,
+
+    PRIMARY KEY (theme_id, hash),
+    CONSTRAINT git_object_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE git_token (
+    user_id    TEXT PRIMARY KEY,
+    token_hash bytea     NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
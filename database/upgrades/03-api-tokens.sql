@@ -0,0 +1,32 @@
+-- v3 (compatible with v1+): Replace git tokens with scoped API tokens
+CREATE TABLE api_token (
+    id           BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    user_id      TEXT      NOT NULL,
+    name         TEXT      NOT NULL,
+    token_hash   bytea     NOT NULL UNIQUE,
+    created_at   TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at   TIMESTAMP,
+    last_used_at TIMESTAMP,
+
+    CONSTRAINT api_token_user_name_unique UNIQUE (user_id, name)
+);
+
+CREATE TABLE api_token_scope (
+    token_id  BIGINT,
+    theme_id  TEXT,
+    can_write BOOLEAN NOT NULL,
+
+    PRIMARY KEY (token_id, theme_id),
+    CONSTRAINT api_token_scope_token_id_fkey FOREIGN KEY (token_id) REFERENCES api_token (id)
+        ON DELETE CASCADE
+);
+
+-- Existing git tokens keep working for the themes their owners currently manage
+INSERT INTO api_token (user_id, name, token_hash, created_at)
+SELECT user_id, 'git', token_hash, created_at FROM git_token;
+INSERT INTO api_token_scope (token_id, theme_id, can_write)
+SELECT api_token.id, admin.theme_id, true
+FROM api_token
+INNER JOIN admin ON admin.user_id = api_token.user_id;
+
+DROP TABLE git_token;
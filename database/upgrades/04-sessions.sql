@@ -0,0 +1,11 @@
+-- v4 (compatible with v1+): Add login sessions
+CREATE TABLE session (
+    id           TEXT PRIMARY KEY,
+    user_id      TEXT      NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    expires_at   TIMESTAMP NOT NULL,
+    last_seen_at TIMESTAMP NOT NULL,
+    user_agent   TEXT      NOT NULL,
+    key_id       TEXT      NOT NULL
+);
+CREATE INDEX session_user_id_idx ON session (user_id);
@@ -0,0 +1,5 @@
+-- v5 (compatible with v5+): Store token key ID in sessions
+-- The column is created by v4 since key IDs were added before sessions were released. Databases that ran
+-- an earlier v4 get it here, with existing sessions attributed to the legacy token_secret key.
+ALTER TABLE session ADD COLUMN IF NOT EXISTS key_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE session ALTER COLUMN key_id DROP DEFAULT;
@@ -0,0 +1,16 @@
+-- v6 (compatible with v1+): Add site moderators, bans and theme moderation flags
+ALTER TABLE theme ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE theme ADD COLUMN frozen BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE moderator (
+    user_id  TEXT PRIMARY KEY,
+    added_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    added_by TEXT      NOT NULL
+);
+
+CREATE TABLE banned_user (
+    user_id   TEXT PRIMARY KEY,
+    reason    TEXT      NOT NULL,
+    banned_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    banned_by TEXT      NOT NULL
+);
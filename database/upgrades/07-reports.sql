@@ -0,0 +1,19 @@
+-- v7 (compatible with v1+): Add abuse reports
+CREATE TABLE report (
+    id         BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    theme_id   TEXT      NOT NULL,
+    version    INTEGER   NOT NULL,
+    image_id   uuid,
+    reporter   TEXT      NOT NULL,
+    category   TEXT      NOT NULL,
+    reason     TEXT      NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    status     TEXT      NOT NULL,
+    handled_by TEXT,
+    handled_at TIMESTAMP,
+
+    CONSTRAINT report_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX report_theme_id_idx ON report (theme_id);
+CREATE INDEX report_status_idx ON report (status);
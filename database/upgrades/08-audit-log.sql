@@ -0,0 +1,22 @@
+-- v8 (compatible with v1+): Add audit log
+CREATE TABLE audit_log (
+    id         BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    created_at TIMESTAMP NOT NULL,
+    actor      TEXT      NOT NULL,
+    action     TEXT      NOT NULL,
+    -- The theme ID at the time of the action. There's intentionally no foreign key,
+    -- so that entries are kept when themes are deleted.
+    theme_id   TEXT,
+    target     TEXT      NOT NULL,
+    before     jsonb,
+    after      jsonb
+);
+CREATE INDEX audit_log_theme_id_idx ON audit_log (theme_id, id);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1,8 @@
+-- v9 (compatible with v1+): Add shared rate limit counters
+CREATE TABLE rate_limit (
+    key          TEXT PRIMARY KEY,
+    window_start TIMESTAMP NOT NULL,
+    expires_at   TIMESTAMP NOT NULL,
+    count        INTEGER   NOT NULL
+);
+CREATE INDEX rate_limit_expires_at_idx ON rate_limit (expires_at);
@@ -0,0 +1,34 @@
+-- v10 (compatible with v1+): Add webhooks
+CREATE TABLE webhook (
+    id         BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    theme_id   TEXT      NOT NULL,
+    url        TEXT      NOT NULL,
+    secret     TEXT      NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    created_by TEXT      NOT NULL,
+
+    CONSTRAINT webhook_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX webhook_theme_id_idx ON webhook (theme_id);
+
+-- Deliveries intentionally don't reference the webhook table, so that the theme deletion event
+-- can still be delivered after the theme and its webhooks are gone. The payload is stored as
+-- text rather than jsonb, as the signature covers the exact bytes.
+CREATE TABLE webhook_delivery (
+    id               BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    webhook_id       BIGINT    NOT NULL,
+    url              TEXT      NOT NULL,
+    event            TEXT      NOT NULL,
+    payload          TEXT      NOT NULL,
+    signature        TEXT      NOT NULL,
+    status           TEXT      NOT NULL,
+    attempts         INTEGER   NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP NOT NULL,
+    next_attempt_at  TIMESTAMP NOT NULL,
+    last_attempt_at  TIMESTAMP,
+    last_status_code INTEGER,
+    last_error       TEXT
+);
+CREATE INDEX webhook_delivery_webhook_id_idx ON webhook_delivery (webhook_id, id);
+CREATE INDEX webhook_delivery_pending_idx ON webhook_delivery (next_attempt_at) WHERE status = 'pending';
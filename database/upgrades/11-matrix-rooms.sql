@@ -0,0 +1,10 @@
+-- v11 (compatible with v1+): Add Matrix announcement rooms
+CREATE TABLE matrix_room (
+    theme_id  TEXT PRIMARY KEY,
+    room_id   TEXT      NOT NULL,
+    linked_at TIMESTAMP NOT NULL,
+    linked_by TEXT      NOT NULL,
+
+    CONSTRAINT matrix_room_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
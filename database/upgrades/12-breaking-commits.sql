@@ -0,0 +1,2 @@
+-- v12 (compatible with v1+): Add breaking flag to commits
+ALTER TABLE commit ADD COLUMN breaking BOOLEAN NOT NULL DEFAULT false;
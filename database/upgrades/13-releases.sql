@@ -0,0 +1,26 @@
+-- v13 (compatible with v1+): Add release tags and channels
+ALTER TABLE theme ADD COLUMN follow_stable BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE theme_tag (
+    theme_id   TEXT,
+    name       TEXT,
+    version    INTEGER   NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    created_by TEXT      NOT NULL,
+
+    PRIMARY KEY (theme_id, name),
+    CONSTRAINT theme_tag_commit_fkey FOREIGN KEY (theme_id, version) REFERENCES commit (theme_id, version)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE theme_channel (
+    theme_id   TEXT,
+    name       TEXT,
+    version    INTEGER   NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    updated_by TEXT      NOT NULL,
+
+    PRIMARY KEY (theme_id, name),
+    CONSTRAINT theme_channel_commit_fkey FOREIGN KEY (theme_id, version) REFERENCES commit (theme_id, version)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,17 @@
+-- v14 (compatible with v1+): Add draft commits
+CREATE TABLE draft (
+    id           BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    theme_id     TEXT      NOT NULL,
+    base_version INTEGER   NOT NULL,
+    message      TEXT      NOT NULL,
+    content      TEXT      NOT NULL,
+    breaking     BOOLEAN   NOT NULL DEFAULT false,
+    created_at   TIMESTAMP NOT NULL,
+    created_by   TEXT      NOT NULL,
+    updated_at   TIMESTAMP NOT NULL,
+    updated_by   TEXT      NOT NULL,
+
+    CONSTRAINT draft_theme_id_fkey FOREIGN KEY (theme_id) REFERENCES theme (id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX draft_theme_id_idx ON draft (theme_id);
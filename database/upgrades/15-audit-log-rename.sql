@@ -0,0 +1,13 @@
+-- v15 (compatible with v1+): Allow moving audit log entries when a theme is renamed
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    -- Renaming a theme moves its entries to the new ID, but nothing else about an entry may change
+    IF TG_OP = 'UPDATE'
+        AND (NEW.id, NEW.created_at, NEW.actor, NEW.action, NEW.target, NEW.before, NEW.after)
+            IS NOT DISTINCT FROM (OLD.id, OLD.created_at, OLD.actor, OLD.action, OLD.target, OLD.before, OLD.after)
+    THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
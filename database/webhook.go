@@ -0,0 +1,194 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getWebhooksQuery = `
+		SELECT id, theme_id, url, secret, created_at, created_by FROM webhook
+	`
+	getWebhooksByThemeQuery = getWebhooksQuery + `WHERE theme_id = $1 ORDER BY id`
+	createWebhookQuery      = `
+		INSERT INTO webhook (theme_id, url, secret, created_at, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+	deleteWebhookQuery = `
+		DELETE FROM webhook WHERE theme_id = $1 AND id = $2
+	`
+)
+
+type WebhookQuery struct {
+	*dbutil.QueryHelper[*Webhook]
+}
+
+func (wq *WebhookQuery) GetByTheme(ctx context.Context, themeID ThemeID) ([]*Webhook, error) {
+	return wq.QueryMany(ctx, getWebhooksByThemeQuery, themeID)
+}
+
+func (wq *WebhookQuery) Create(ctx context.Context, webhook *Webhook) error {
+	return wq.GetDB().QueryRow(
+		ctx, createWebhookQuery,
+		webhook.ThemeID, webhook.URL, webhook.Secret, webhook.CreatedAt, webhook.CreatedBy,
+	).Scan(&webhook.ID)
+}
+
+// Delete removes a webhook. The theme ID must match the one the webhook belongs to.
+func (wq *WebhookQuery) Delete(ctx context.Context, themeID ThemeID, webhookID int64) error {
+	return wq.Exec(ctx, deleteWebhookQuery, themeID, webhookID)
+}
+
+// Webhook is a URL that receives signed POST requests about changes to a theme.
+type Webhook struct {
+	ID        int64
+	ThemeID   ThemeID
+	URL       string
+	Secret    string
+	CreatedAt time.Time
+	CreatedBy id.UserID
+}
+
+func (w *Webhook) Scan(row dbutil.Scannable) (*Webhook, error) {
+	return dbutil.ValueOrErr(w, row.Scan(&w.ID, &w.ThemeID, &w.URL, &w.Secret, &w.CreatedAt, &w.CreatedBy))
+}
+
+const (
+	getWebhookDeliveriesQuery = `
+		SELECT id, webhook_id, url, event, payload, signature, status, attempts, created_at, next_attempt_at,
+		       last_attempt_at, last_status_code, last_error
+		FROM webhook_delivery
+	`
+	getWebhookDeliveriesByThemeQuery = getWebhookDeliveriesQuery + `
+		WHERE webhook_id IN (SELECT id FROM webhook WHERE theme_id = $1)
+		ORDER BY id DESC LIMIT $2
+	`
+	addWebhookDeliveryQuery = `
+		INSERT INTO webhook_delivery (webhook_id, url, event, payload, signature, status, created_at, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`
+	// Claimed deliveries are pushed forward by the lease time, so that other replicas don't pick them up,
+	// but they're retried if the process dies before recording the result.
+	claimWebhookDeliveriesQuery = `
+		UPDATE webhook_delivery SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM webhook_delivery
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, webhook_id, url, event, payload, signature, status, attempts, created_at, next_attempt_at,
+		          last_attempt_at, last_status_code, last_error
+	`
+	updateWebhookDeliveryQuery = `
+		UPDATE webhook_delivery
+		SET status = $2, attempts = $3, next_attempt_at = $4, last_attempt_at = $5, last_status_code = $6, last_error = $7
+		WHERE id = $1
+	`
+	deleteOldWebhookDeliveriesQuery = `
+		DELETE FROM webhook_delivery WHERE status <> 'pending' AND created_at < $1
+	`
+)
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryFailed    WebhookDeliveryStatus = "failed"
+)
+
+type WebhookDeliveryQuery struct {
+	*dbutil.QueryHelper[*WebhookDelivery]
+}
+
+// GetByTheme returns the most recent deliveries to the current webhooks of a theme, newest first.
+func (wdq *WebhookDeliveryQuery) GetByTheme(ctx context.Context, themeID ThemeID, limit int) ([]*WebhookDelivery, error) {
+	return wdq.QueryMany(ctx, getWebhookDeliveriesByThemeQuery, themeID, limit)
+}
+
+func (wdq *WebhookDeliveryQuery) Add(ctx context.Context, delivery *WebhookDelivery) error {
+	return wdq.GetDB().QueryRow(
+		ctx, addWebhookDeliveryQuery,
+		delivery.WebhookID, delivery.URL, delivery.Event, delivery.Payload, delivery.Signature, delivery.Status,
+		delivery.CreatedAt, delivery.NextAttemptAt,
+	).Scan(&delivery.ID)
+}
+
+// Claim returns up to limit pending deliveries that are due and postpones them until leaseUntil.
+func (wdq *WebhookDeliveryQuery) Claim(ctx context.Context, leaseUntil time.Time, limit int) ([]*WebhookDelivery, error) {
+	return wdq.QueryMany(ctx, claimWebhookDeliveriesQuery, time.Now(), leaseUntil, limit)
+}
+
+// Update saves the result of a delivery attempt.
+func (wdq *WebhookDeliveryQuery) Update(ctx context.Context, delivery *WebhookDelivery) error {
+	return wdq.Exec(
+		ctx, updateWebhookDeliveryQuery,
+		delivery.ID, delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.LastAttemptAt,
+		sql.NullInt32{Int32: int32(delivery.LastStatusCode), Valid: delivery.LastStatusCode != 0},
+		sql.NullString{String: delivery.LastError, Valid: delivery.LastError != ""},
+	)
+}
+
+// DeleteOld removes finished deliveries created before the given time.
+func (wdq *WebhookDeliveryQuery) DeleteOld(ctx context.Context, before time.Time) error {
+	return wdq.Exec(ctx, deleteOldWebhookDeliveriesQuery, before)
+}
+
+// WebhookDelivery is a single event queued for a webhook. The URL and signed payload are copied
+// from the webhook when the event happens, so deleting the webhook doesn't affect queued deliveries.
+type WebhookDelivery struct {
+	ID             int64
+	WebhookID      int64
+	URL            string
+	Event          string
+	Payload        string
+	Signature      string
+	Status         WebhookDeliveryStatus
+	Attempts       int
+	CreatedAt      time.Time
+	NextAttemptAt  time.Time
+	LastAttemptAt  time.Time
+	LastStatusCode int
+	LastError      string
+}
+
+func (wd *WebhookDelivery) Scan(row dbutil.Scannable) (*WebhookDelivery, error) {
+	var lastAttemptAt sql.NullTime
+	var lastStatusCode sql.NullInt32
+	var lastError sql.NullString
+	err := row.Scan(
+		&wd.ID, &wd.WebhookID, &wd.URL, &wd.Event, &wd.Payload, &wd.Signature, &wd.Status, &wd.Attempts,
+		&wd.CreatedAt, &wd.NextAttemptAt, &lastAttemptAt, &lastStatusCode, &lastError,
+	)
+	if err != nil {
+		return nil, err
+	}
+	wd.LastAttemptAt = lastAttemptAt.Time
+	wd.LastStatusCode = int(lastStatusCode.Int32)
+	wd.LastError = lastError.String
+	return wd, nil
+}
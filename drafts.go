@@ -0,0 +1,317 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+// DraftPreviewLifetime is how long the preview links shown on the drafts page stay valid.
+const DraftPreviewLifetime = 7 * 24 * time.Hour
+
+var (
+	errDraftNotFound       = errors.New("draft not found")
+	errTooManyDrafts       = errors.New("too many drafts")
+	errUnknownDraftAction  = errors.New("unknown action")
+	errDraftPreviewInvalid = errors.New("invalid or expired preview link")
+	errDraftOutdated       = errors.New("the theme has been updated since the draft was created, confirm to publish it anyway")
+)
+
+// makeDraftToken signs the theme ID, draft ID and expiry into a preview token using the active key.
+// The draft must still exist for the token to be accepted.
+func makeDraftToken(themeID database.ThemeID, draftID int64, expiry time.Time) string {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(draftID))
+	return signToken(tokenPurposeDraftPreview, expiry, append(payload, themeID...))
+}
+
+type draftTokenInfo struct {
+	ThemeID database.ThemeID
+	DraftID int64
+	Expiry  time.Time
+}
+
+// verifyDraftToken checks the signature and expiry of a preview token. It returns nil if the token is
+// invalid, expired or signed with a key that is no longer in the key ring.
+func verifyDraftToken(token string) *draftTokenInfo {
+	signed := verifySignedToken(tokenPurposeDraftPreview, token)
+	if signed == nil || len(signed.Payload) <= 8 {
+		return nil
+	}
+	return &draftTokenInfo{
+		ThemeID: database.ThemeID(signed.Payload[8:]),
+		DraftID: int64(binary.BigEndian.Uint64(signed.Payload)),
+		Expiry:  signed.Expiry,
+	}
+}
+
+func draftPreviewURL(draft *database.Draft, expiry time.Time) string {
+	return fmt.Sprintf("%s/draft/%s.css", cfg.PublicURL, makeDraftToken(draft.ThemeID, draft.ID, expiry))
+}
+
+// getDraftPreview serves the CSS of a draft to anyone who has a valid preview link.
+func getDraftPreview(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutSuffix(r.PathValue("token"), ".css")
+	info := verifyDraftToken(token)
+	if info == nil {
+		http.Error(w, errDraftPreviewInvalid.Error(), http.StatusNotFound)
+		return
+	}
+	theme, err := db.Theme.Get(r.Context(), info.ThemeID)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if theme == nil || theme.Frozen {
+		http.Error(w, errDraftNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	draft, err := db.Draft.Get(r.Context(), info.ThemeID, info.DraftID)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get draft")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if draft == nil {
+		http.Error(w, errDraftNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+	// Drafts change while they're being iterated on, and the links shouldn't end up in search engines
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	n, _ := w.Write([]byte(draft.Content))
+	cssBytesServed.Add(float64(n))
+}
+
+type draftParams struct {
+	ThemeID database.ThemeID
+	// DraftID is the draft to update, or zero to create a new one
+	DraftID  int64
+	Content  string
+	Message  string
+	Breaking bool
+}
+
+// saveDraft creates or updates a draft without changing the latest version of the theme.
+// It must be called inside a database transaction.
+func saveDraft(ctx context.Context, userID id.UserID, params *draftParams) (*database.Draft, error) {
+	theme, err := getAdminTheme(ctx, params.ThemeID, userID)
+	if err != nil {
+		return nil, err
+	} else if theme.Frozen {
+		return nil, errThemeFrozen
+	}
+	now := time.Now()
+	var draft *database.Draft
+	if params.DraftID != 0 {
+		draft, err = db.Draft.Get(ctx, theme.ID, params.DraftID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get draft: %w", err)
+		} else if draft == nil {
+			return nil, errDraftNotFound
+		}
+	} else {
+		count, err := db.Draft.Count(ctx, theme.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count drafts: %w", err)
+		} else if count >= cfg.Limits.MaxDraftCount {
+			return nil, errTooManyDrafts
+		}
+		draft = &database.Draft{
+			ThemeID:     theme.ID,
+			BaseVersion: theme.LatestCommit.Version,
+			CreatedAt:   now,
+			CreatedBy:   userID,
+		}
+	}
+	draft.Content = params.Content
+	draft.Message = params.Message
+	draft.Breaking = params.Breaking
+	draft.UpdatedAt = now
+	draft.UpdatedBy = userID
+	if draft.ID == 0 {
+		err = db.Draft.Create(ctx, draft)
+	} else {
+		err = db.Draft.Update(ctx, draft)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save draft: %w", err)
+	}
+	return draft, nil
+}
+
+// publishDraft adds the draft as the next version of the theme and deletes it. If other versions have been
+// published since the draft was created, it would silently revert them, so it's only published if confirmed.
+// It must be called inside a database transaction.
+func publishDraft(ctx context.Context, userID id.UserID, theme *database.Theme, draftID int64, confirmOutdated bool) (*database.Theme, error) {
+	draft, err := db.Draft.Get(ctx, theme.ID, draftID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get draft: %w", err)
+	} else if draft == nil {
+		return nil, errDraftNotFound
+	} else if draft.BaseVersion != theme.LatestCommit.Version && !confirmOutdated {
+		return nil, errDraftOutdated
+	}
+	theme, err = addThemeCommit(ctx, userID, &themeCommitParams{
+		ThemeID:  theme.ID,
+		Version:  theme.LatestCommit.Version + 1,
+		KeepMeta: true,
+		Content:  draft.Content,
+		Message:  draft.Message,
+		Breaking: draft.Breaking,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Draft.Delete(ctx, theme.ID, draftID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete published draft: %w", err)
+	}
+	return theme, nil
+}
+
+type DraftsPageData struct {
+	CSRFData
+	Theme  *database.Theme
+	Drafts []*database.Draft
+	// PreviewURLs contains the signed preview link of each draft, keyed by draft ID
+	PreviewURLs   map[int64]string
+	PreviewExpiry time.Time
+	Error         string
+}
+
+func getDraftsPage(w http.ResponseWriter, r *http.Request) {
+	userID := verifyCookie(r)
+	if userID == "" {
+		redirectToLogin(w, r)
+		return
+	}
+	theme, err := getAdminTheme(r.Context(), database.ThemeID(r.PathValue("themeID")), userID)
+	if errors.Is(err, errThemeNotFound) {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, errNotAdmin) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return
+	} else if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	sendDraftsPage(w, r, http.StatusOK, &DraftsPageData{Theme: theme})
+}
+
+func postDraftsPage(w http.ResponseWriter, r *http.Request) {
+	auth := verifyWriteAuth(w, r)
+	if auth == nil {
+		return
+	}
+	userID := auth.UserID
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	if !auth.CanWrite(themeID) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		// TODO write body
+		return
+	}
+	draftID, _ := strconv.ParseInt(r.PostForm.Get("draft_id"), 10, 64)
+	action := r.PostForm.Get("action")
+	data := &DraftsPageData{}
+	var published *database.Theme
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) (err error) {
+		data.Theme, err = getAdminTheme(ctx, themeID, userID)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case "publish":
+			published, err = publishDraft(ctx, userID, data.Theme, draftID, r.PostForm.Get("confirm_outdated") == "on")
+		case "delete":
+			err = db.Draft.Delete(ctx, themeID, draftID)
+		default:
+			err = errUnknownDraftAction
+		}
+		return
+	})
+	switch {
+	case err == nil && published != nil:
+		countCommit("web", published.LatestCommit.Version)
+		announceCommits(r.Context(), themeID, published.LatestCommit.Version)
+		w.Header().Set("Location", fmt.Sprintf("/theme/%s", themeID))
+		w.WriteHeader(http.StatusSeeOther)
+	case err == nil:
+		sendDraftsPage(w, r, http.StatusOK, data)
+	case errors.Is(err, errThemeNotFound):
+		http.Error(w, "Theme not found", http.StatusNotFound)
+	case errors.Is(err, errNotAdmin):
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+	case errors.Is(err, errThemeFrozen), errors.Is(err, errServerBlocked), errors.Is(err, errUserBanned):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errDraftNotFound), errors.Is(err, errUnknownDraftAction):
+		data.Error = err.Error()
+		sendDraftsPage(w, r, http.StatusBadRequest, data)
+	case errors.Is(err, errDraftOutdated):
+		data.Error = err.Error()
+		sendDraftsPage(w, r, http.StatusConflict, data)
+	default:
+		hlog.FromRequest(r).Err(err).Msg("Failed to update drafts")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+	}
+}
+
+func sendDraftsPage(w http.ResponseWriter, r *http.Request, status int, data *DraftsPageData) {
+	var err error
+	if data.Drafts, err = db.Draft.GetByTheme(r.Context(), data.Theme.ID); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get drafts")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	data.PreviewExpiry = time.Now().Add(DraftPreviewLifetime)
+	data.PreviewURLs = make(map[int64]string, len(data.Drafts))
+	for _, draft := range data.Drafts {
+		data.PreviewURLs[draft.ID] = draftPreviewURL(draft, data.PreviewExpiry)
+	}
+	renderContainer(w, r, status, &ContainerData{
+		PageTitle: data.Theme.Name + " - drafts",
+		Page:      "drafts.gohtml",
+		Data:      data,
+	})
+}
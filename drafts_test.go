@@ -0,0 +1,165 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+func TestVerifyDraftToken(t *testing.T) {
+	oldKey := TokenKey{ID: "2024-01", Secret: "old secret"}
+	newKey := TokenKey{ID: "2025-01", Secret: "new secret"}
+	const themeID database.ThemeID = "meowtheme"
+	const draftID int64 = 1234
+	tests := []struct {
+		name       string
+		signActive string
+		verifyKeys []TokenKey
+		make       func() string
+		valid      bool
+	}{
+		{
+			name: "valid", signActive: oldKey.ID, verifyKeys: []TokenKey{oldKey}, valid: true,
+			make: func() string { return makeDraftToken(themeID, draftID, time.Now().Add(time.Hour)) },
+		},
+		{
+			name: "expired", signActive: oldKey.ID, verifyKeys: []TokenKey{oldKey},
+			make: func() string { return makeDraftToken(themeID, draftID, time.Now().Add(-time.Minute)) },
+		},
+		{
+			name: "retired key after rotation", signActive: oldKey.ID, verifyKeys: []TokenKey{newKey, oldKey}, valid: true,
+			make: func() string { return makeDraftToken(themeID, draftID, time.Now().Add(time.Hour)) },
+		},
+		{
+			name: "removed key", signActive: oldKey.ID, verifyKeys: []TokenKey{newKey},
+			make: func() string { return makeDraftToken(themeID, draftID, time.Now().Add(time.Hour)) },
+		},
+		{
+			name: "modified theme ID", signActive: oldKey.ID, verifyKeys: []TokenKey{oldKey},
+			make: func() string {
+				data, _ := base64.RawURLEncoding.DecodeString(makeDraftToken(themeID, draftID, time.Now().Add(time.Hour)))
+				data[len(data)-33] = 'x'
+				return base64.RawURLEncoding.EncodeToString(data)
+			},
+		},
+		{
+			// Login cookies and return-to values are signed with the same keys, but for a different purpose
+			name: "login cookie", signActive: oldKey.ID, verifyKeys: []TokenKey{oldKey},
+			make: func() string {
+				return makeToken(strings.Repeat("s", sessionIDLength), "@meow:example.com", time.Now().Add(time.Hour))
+			},
+		},
+		{
+			name: "return-to value", signActive: oldKey.ID, verifyKeys: []TokenKey{oldKey},
+			make: func() string { return signNext("/theme/meowtheme") },
+		},
+		{
+			name: "truncated", signActive: oldKey.ID, verifyKeys: []TokenKey{oldKey},
+			make: func() string { return makeDraftToken(themeID, draftID, time.Now().Add(time.Hour))[:20] },
+		},
+		{
+			name: "empty", signActive: oldKey.ID, verifyKeys: []TokenKey{oldKey},
+			make: func() string { return "" },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTokenKeys(t, test.signActive, oldKey, newKey)
+			token := test.make()
+			setTokenKeys(t, test.verifyKeys[0].ID, test.verifyKeys...)
+			info := verifyDraftToken(token)
+			if !test.valid {
+				if info != nil {
+					t.Errorf("expected token to be rejected, got %+v", info)
+				}
+				return
+			} else if info == nil {
+				t.Fatal("expected token to be accepted")
+			}
+			if info.ThemeID != themeID || info.DraftID != draftID {
+				t.Errorf("got %+v", info)
+			}
+		})
+	}
+}
+
+func TestPublishDraftOutdated(t *testing.T) {
+	cfg = defaultConfig()
+	ctx := setupTestDB(t)
+	const userID id.UserID = "@meow:example.com"
+	const themeID database.ThemeID = "meowtheme"
+	commit := func(version int, content string) {
+		t.Helper()
+		err := db.DoTxn(ctx, nil, func(ctx context.Context) error {
+			_, err := addThemeCommit(ctx, userID, &themeCommitParams{ThemeID: themeID, Version: version, Name: "Meow theme", Content: content})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish := func(draftID int64, confirmOutdated bool) (*database.Theme, error) {
+		var published *database.Theme
+		err := db.DoTxn(ctx, nil, func(ctx context.Context) error {
+			theme, err := db.Theme.Get(ctx, themeID)
+			if err != nil {
+				return err
+			}
+			published, err = publishDraft(ctx, userID, theme, draftID, confirmOutdated)
+			return err
+		})
+		return published, err
+	}
+
+	commit(1, "body { color: pink; }")
+	draft, err := saveDraft(ctx, userID, &draftParams{ThemeID: themeID, Content: "body { color: hotpink; }", Message: "Hotter pink"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(2, "body { color: pink; background: black; }")
+
+	if _, err = publish(draft.ID, false); !errors.Is(err, errDraftOutdated) {
+		t.Fatalf("got error %v, want %v", err, errDraftOutdated)
+	}
+	if existing, err := db.Draft.Get(ctx, themeID, draft.ID); err != nil {
+		t.Fatal(err)
+	} else if existing == nil {
+		t.Fatal("rejected draft was deleted")
+	}
+	published, err := publish(draft.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if published.LatestCommit.Version != 3 || published.LatestCommit.Content != draft.Content {
+		t.Errorf("draft wasn't published as v3: %+v", published.LatestCommit)
+	}
+
+	current, err := saveDraft(ctx, userID, &draftParams{ThemeID: themeID, Content: "body { color: red; }"})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err = publish(current.ID, false); err != nil {
+		t.Errorf("publishing an up-to-date draft failed: %v", err)
+	}
+}
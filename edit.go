@@ -19,11 +19,11 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"image"
 	"io"
 	"net/http"
-	"regexp"
 	"slices"
 	"strconv"
 	"time"
@@ -32,26 +32,19 @@ import (
 	"github.com/rs/zerolog/hlog"
 	"maunium.net/go/mautrix/id"
 
+	"css.gomuks.app/client"
 	"css.gomuks.app/database"
 )
 
-var themeIDRegex = regexp.MustCompile(`^[a-z0-9_-]{3,32}$`)
-
-const nameMaxLength = 64
-const descriptionMaxLength = 8 * 1024
-const contentMaxLength = 128 * 1024
-const maxPreviewSize = 512 * 1024
-const maxPreviewCount = 8
-
 func postThemeEditPage(w http.ResponseWriter, r *http.Request) {
 	log := hlog.FromRequest(r)
-	userID := verifyCookie(r)
-	if userID == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		// TODO write body
+	auth := verifyWriteAuth(w, r)
+	if auth == nil {
 		return
 	}
-	err := r.ParseMultipartForm(5 * 1024 * 1024)
+	userID := auth.UserID
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	err := r.ParseMultipartForm(cfg.Limits.MaxFormSize)
 	if err != nil {
 		log.Err(err).Msg("Failed to parse form")
 		// TODO write body
@@ -59,10 +52,14 @@ func postThemeEditPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	themeID := database.ThemeID(r.Form.Get("theme_id"))
-	if themeID == "new" || themeID == "commit" || !themeIDRegex.MatchString(string(themeID)) {
+	if !cfg.Limits.ValidThemeID(string(themeID)) {
 		w.WriteHeader(http.StatusBadRequest)
 		// TODO write body
 		return
+	} else if !auth.CanWrite(themeID) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return
 	}
 	commitVersion, err := strconv.Atoi(r.Form.Get("commit_id"))
 	if err != nil {
@@ -71,7 +68,7 @@ func postThemeEditPage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	themeName := r.Form.Get("name")
-	if len(themeName) > nameMaxLength {
+	if len(themeName) > cfg.Limits.NameMaxLength {
 		w.WriteHeader(http.StatusBadRequest)
 		// TODO write body
 		return
@@ -80,27 +77,46 @@ func postThemeEditPage(w http.ResponseWriter, r *http.Request) {
 		themeName = string(themeID)
 	}
 	themeDescription := r.Form.Get("description")
-	if len(themeDescription) > descriptionMaxLength {
+	if len(themeDescription) > cfg.Limits.DescriptionMaxLength {
 		w.WriteHeader(http.StatusBadRequest)
 		// TODO write body
 		return
 	}
 	commitContent := r.Form.Get("content")
-	if len(commitContent) > contentMaxLength {
+	commitMessage := r.Form.Get("message")
+	if err = validateCommitContent(commitContent, commitMessage); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		// TODO write body
 		return
 	}
-	commitMessage := r.Form.Get("message")
-	if len(commitMessage) > descriptionMaxLength {
-		w.WriteHeader(http.StatusBadRequest)
-		// TODO write body
+	var draftID int64
+	if draftIDStr := r.Form.Get("draft_id"); draftIDStr != "" {
+		draftID, err = strconv.ParseInt(draftIDStr, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			// TODO write body
+			return
+		}
+	}
+	if r.Form.Get("action") == "draft" {
+		// Drafts only contain the CSS and commit message, the name, description and previews are always live
+		if len(r.MultipartForm.File["preview"]) > 0 {
+			http.Error(w, "Preview images can't be added to drafts", http.StatusBadRequest)
+			return
+		}
+		saveThemeDraft(w, r, userID, &draftParams{
+			ThemeID:  themeID,
+			DraftID:  draftID,
+			Content:  commitContent,
+			Message:  commitMessage,
+			Breaking: r.Form.Get("breaking") == "on",
+		})
 		return
 	}
 	var newPreviews []*database.PreviewImage
 	var removedPreviews []uuid.UUID
 	for _, preview := range r.MultipartForm.File["preview"] {
-		if preview.Size > maxPreviewSize {
+		if preview.Size > cfg.Limits.MaxPreviewSize {
 			w.WriteHeader(http.StatusBadRequest)
 			// TODO write body
 			return
@@ -119,114 +135,249 @@ func postThemeEditPage(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+		img, err := parsePreviewImage(data, themeID, userID)
 		if err != nil {
-			log.Err(err).Msg("Failed to decode image config")
-			// TODO write body
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		} else if format != "png" && format != "jpeg" && format != "webp" {
-			log.Err(err).Msg("Invalid image format")
+			log.Err(err).Msg("Invalid preview image")
 			// TODO write body
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		newPreviews = append(newPreviews, &database.PreviewImage{
-			ID:        uuid.New(),
-			ThemeID:   themeID,
-			CreatedAt: time.Now(),
-			CreatedBy: userID,
-			Width:     cfg.Width,
-			Height:    cfg.Height,
-			MimeType:  "image/" + format,
-			Content:   data,
-		})
+		newPreviews = append(newPreviews, img)
 	}
-	var theme *database.Theme
 	err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
-		var err error
-		theme, err = db.Theme.Get(r.Context(), themeID)
-		if err != nil {
-			log.Err(err).Msg("Failed to get theme")
-			return err
-		} else if theme == nil && commitVersion != 1 {
-			return fmt.Errorf("theme not found")
-		} else if theme != nil {
-			if commitVersion != theme.LatestCommit.Version+1 {
-				return fmt.Errorf("invalid commit version")
-			} else if !slices.Contains(theme.Admins, userID) {
-				return fmt.Errorf("not an admin")
-			}
-		}
-		if theme == nil || theme.Name != themeName || theme.Description != themeDescription {
-			if theme == nil {
-				theme = &database.Theme{
-					ID:          themeID,
-					Name:        themeName,
-					Description: themeDescription,
-					Admins:      []id.UserID{userID},
-				}
-				err = db.Theme.Create(ctx, theme)
-				if err != nil {
-					return fmt.Errorf("failed to create theme: %w", err)
-				}
-				err = db.Theme.AddAdmin(ctx, theme.ID, userID)
-				if err != nil {
-					return fmt.Errorf("failed to add theme admin: %w", err)
-				}
-			} else {
-				theme.Description = themeDescription
-				theme.Name = themeName
-				err = db.Theme.Update(ctx, theme)
-				if err != nil {
-					return fmt.Errorf("failed to update theme: %w", err)
-				}
-			}
-		}
-		if len(newPreviews)+len(theme.Previews) > maxPreviewCount {
-			return fmt.Errorf("too many previews")
-		}
-		commit := &database.Commit{
-			ThemeID:   theme.ID,
-			Version:   commitVersion,
-			Message:   commitMessage,
-			CreatedAt: time.Now(),
-			CreatedBy: userID,
-			Content:   commitContent,
-		}
-		err = db.Commit.Add(ctx, commit)
-		if err != nil {
-			return fmt.Errorf("failed to add commit: %w", err)
+		_, err := addThemeCommit(ctx, userID, &themeCommitParams{
+			ThemeID:         themeID,
+			Version:         commitVersion,
+			Name:            themeName,
+			Description:     themeDescription,
+			Content:         commitContent,
+			Message:         commitMessage,
+			Breaking:        r.Form.Get("breaking") == "on",
+			NewPreviews:     newPreviews,
+			RemovedPreviews: removedPreviews,
+		})
+		if err == nil && draftID != 0 {
+			// Committing from a draft publishes it, so the draft isn't needed anymore
+			err = db.Draft.Delete(ctx, themeID, draftID)
 		}
-		theme.LatestCommit = *commit
-		err = db.Theme.SetLatestCommit(ctx, theme.ID, commit.Version)
-		if err != nil {
-			return fmt.Errorf("failed to update latest theme commit: %w", err)
-		}
-		for _, preview := range newPreviews {
-			err = db.PreviewImage.Add(ctx, preview)
-			if err != nil {
-				return fmt.Errorf("failed to add preview image: %w", err)
-			}
-			theme.Previews = append(theme.Previews, preview.ID)
-		}
-		for _, previewID := range removedPreviews {
-			err = db.PreviewImage.Delete(ctx, previewID)
-			if err != nil {
-				return fmt.Errorf("failed to delete preview image: %w", err)
-			}
-			theme.Previews = slices.DeleteFunc(theme.Previews, func(u uuid.UUID) bool {
-				return u == previewID
-			})
-		}
-		return nil
+		return err
 	})
-	if err != nil {
+	if errors.Is(err, errThemeFrozen) || errors.Is(err, errServerBlocked) || errors.Is(err, errUserBanned) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		log.Err(err).Msg("Failed to save theme")
 		// TODO write body
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	countCommit("web", commitVersion)
+	announceCommits(r.Context(), themeID, commitVersion)
 	w.Header().Set("Location", fmt.Sprintf("/theme/%s", themeID))
 	w.WriteHeader(http.StatusSeeOther)
 }
+
+func saveThemeDraft(w http.ResponseWriter, r *http.Request, userID id.UserID, params *draftParams) {
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		_, err := saveDraft(ctx, userID, params)
+		return err
+	})
+	switch {
+	case err == nil:
+		w.Header().Set("Location", fmt.Sprintf("/theme/%s/drafts", params.ThemeID))
+		w.WriteHeader(http.StatusSeeOther)
+	case errors.Is(err, errThemeNotFound), errors.Is(err, errDraftNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNotAdmin):
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+	case errors.Is(err, errThemeFrozen):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errTooManyDrafts):
+		http.Error(w, fmt.Sprintf("Themes can have at most %d drafts", cfg.Limits.MaxDraftCount), http.StatusBadRequest)
+	default:
+		hlog.FromRequest(r).Err(err).Msg("Failed to save draft")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+	}
+}
+
+var (
+	errThemeNotFound   = errors.New("theme not found")
+	errInvalidVersion  = errors.New("invalid commit version")
+	errNotAdmin        = errors.New("not an admin")
+	errTooManyPreviews = errors.New("too many previews")
+	errThemeFrozen     = errors.New("the theme has been frozen by a moderator")
+)
+
+// parsePreviewImage checks that the data is a supported image and wraps it in a new preview image.
+// The size limit must be checked by the caller.
+func parsePreviewImage(data []byte, themeID database.ThemeID, userID id.UserID) (*database.PreviewImage, error) {
+	imgCfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image config: %w", err)
+	} else if format != "png" && format != "jpeg" && format != "webp" {
+		return nil, fmt.Errorf("unsupported image format %s", format)
+	}
+	return &database.PreviewImage{
+		ID:        uuid.New(),
+		ThemeID:   themeID,
+		CreatedAt: time.Now(),
+		CreatedBy: userID,
+		Width:     imgCfg.Width,
+		Height:    imgCfg.Height,
+		MimeType:  "image/" + format,
+		Content:   data,
+	}, nil
+}
+
+func validateCommitContent(content, message string) error {
+	if len(content) > cfg.Limits.ContentMaxLength {
+		return fmt.Errorf("content is too long (maximum is %d bytes)", cfg.Limits.ContentMaxLength)
+	} else if len(message) > cfg.Limits.DescriptionMaxLength {
+		return fmt.Errorf("commit message is too long (maximum is %d bytes)", cfg.Limits.DescriptionMaxLength)
+	}
+	return nil
+}
+
+type themeCommitParams struct {
+	ThemeID database.ThemeID
+	Version int
+	// KeepMeta leaves the name and description of existing themes untouched
+	KeepMeta    bool
+	Name        string
+	Description string
+	Content     string
+	Message     string
+	GitHash     string
+	Breaking    bool
+
+	NewPreviews     []*database.PreviewImage
+	RemovedPreviews []uuid.UUID
+}
+
+// addThemeCommit creates the theme if necessary and adds a new version to it. The server ACL and bans
+// are checked here rather than only at authentication, so that every way of publishing is covered.
+// It must be called inside a database transaction.
+func addThemeCommit(ctx context.Context, userID id.UserID, params *themeCommitParams) (*database.Theme, error) {
+	if err := checkCanPublish(ctx, userID); err != nil {
+		return nil, err
+	}
+	theme, err := db.Theme.Get(ctx, params.ThemeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get theme: %w", err)
+	} else if theme == nil && params.Version != 1 {
+		return nil, errThemeNotFound
+	} else if theme != nil {
+		if params.Version != theme.LatestCommit.Version+1 {
+			return nil, errInvalidVersion
+		} else if !theme.IsAdmin(userID) {
+			return nil, errNotAdmin
+		} else if theme.Frozen {
+			return nil, errThemeFrozen
+		}
+	}
+	if theme == nil {
+		theme = &database.Theme{
+			ID:          params.ThemeID,
+			Name:        params.Name,
+			Description: params.Description,
+			Admins:      []id.UserID{userID},
+		}
+		err = db.Theme.Create(ctx, theme)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create theme: %w", err)
+		}
+		err = db.Theme.AddAdmin(ctx, theme.ID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add theme admin: %w", err)
+		}
+		err = recordAudit(ctx, &database.AuditEntry{
+			Actor:   string(userID),
+			Action:  database.AuditThemeCreate,
+			ThemeID: theme.ID,
+			After:   auditJSON(themeMeta(theme)),
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if !params.KeepMeta && (theme.Name != params.Name || theme.Description != params.Description) {
+		before := themeMeta(theme)
+		theme.Description = params.Description
+		theme.Name = params.Name
+		err = db.Theme.Update(ctx, theme)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update theme: %w", err)
+		}
+		err = recordAudit(ctx, &database.AuditEntry{
+			Actor:   string(userID),
+			Action:  database.AuditThemeUpdate,
+			ThemeID: theme.ID,
+			Before:  auditJSON(before),
+			After:   auditJSON(themeMeta(theme)),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(params.NewPreviews)+len(theme.Previews) > cfg.Limits.MaxPreviewCount {
+		return nil, errTooManyPreviews
+	}
+	commit := &database.Commit{
+		ThemeID:   theme.ID,
+		Version:   params.Version,
+		Message:   params.Message,
+		CreatedAt: time.Now(),
+		CreatedBy: userID,
+		Content:   params.Content,
+		GitHash:   params.GitHash,
+		Breaking:  params.Breaking,
+	}
+	err = db.Commit.Add(ctx, commit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add commit: %w", err)
+	}
+	theme.LatestCommit = *commit
+	err = db.Theme.SetLatestCommit(ctx, theme.ID, commit.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update latest theme commit: %w", err)
+	}
+	for _, preview := range params.NewPreviews {
+		err = db.PreviewImage.Add(ctx, preview)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add preview image: %w", err)
+		} else if err = recordPreviewAudit(ctx, userID, database.AuditPreviewAdd, theme.ID, preview.ID); err != nil {
+			return nil, err
+		}
+		theme.Previews = append(theme.Previews, preview.ID)
+	}
+	for _, previewID := range params.RemovedPreviews {
+		err = db.PreviewImage.Delete(ctx, previewID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete preview image: %w", err)
+		} else if err = recordPreviewAudit(ctx, userID, database.AuditPreviewDelete, theme.ID, previewID); err != nil {
+			return nil, err
+		}
+		theme.Previews = slices.DeleteFunc(theme.Previews, func(u uuid.UUID) bool {
+			return u == previewID
+		})
+	}
+	err = queueWebhooks(ctx, &client.WebhookPayload{
+		Event:   client.WebhookEventCommit,
+		ThemeID: theme.ID,
+		Sender:  userID,
+		Commit:  commit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	addedPreviews := make([]uuid.UUID, len(params.NewPreviews))
+	for i, preview := range params.NewPreviews {
+		addedPreviews[i] = preview.ID
+	}
+	err = queuePreviewWebhooks(ctx, userID, theme.ID, addedPreviews, params.RemovedPreviews)
+	if err != nil {
+		return nil, err
+	}
+	return theme, nil
+}
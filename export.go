@@ -0,0 +1,919 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+	"css.gomuks.app/gitproto"
+)
+
+// The export archive is a gzipped tarball with the following layout:
+//
+//	manifest.json                              exportManifest
+//	moderators.json                            list of database.Moderator
+//	bans.json                                  list of database.Ban
+//	themes/<theme ID>/theme.json               exportTheme
+//	themes/<theme ID>/commits/<version>.json   exportCommit
+//	themes/<theme ID>/commits/<version>.css    raw CSS content of the commit
+//	themes/<theme ID>/previews/<uuid>.json     exportPreview
+//	themes/<theme ID>/previews/<uuid>          raw image data
+//	themes/<theme ID>/git/<hash>.<type>        raw git object received in a push
+//	themes/<theme ID>/drafts/<id>.json         exportDraft
+//	themes/<theme ID>/drafts/<id>.css          raw CSS content of the draft
+//
+// Entries of a theme are always written after its theme.json, and each .json file before its data file,
+// but the importer doesn't rely on the order.
+const exportFormatName = "css.gomuks.app-export"
+const exportFormatVersion = 2
+
+type exportManifest struct {
+	Format     string             `json:"format"`
+	Version    int                `json:"version"`
+	ExportedAt time.Time          `json:"exported_at"`
+	Themes     []database.ThemeID `json:"themes"`
+}
+
+type exportTheme struct {
+	ID            database.ThemeID    `json:"id"`
+	Name          string              `json:"name"`
+	Description   string              `json:"description"`
+	LatestVersion int                 `json:"latest_version"`
+	Admins        []id.UserID         `json:"admins"`
+	Hidden        bool                `json:"hidden,omitempty"`
+	Frozen        bool                `json:"frozen,omitempty"`
+	FollowStable  bool                `json:"follow_stable,omitempty"`
+	Channels      []*database.Release `json:"channels,omitempty"`
+	Tags          []*database.Release `json:"tags,omitempty"`
+}
+
+type exportCommit struct {
+	Version   int       `json:"version"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy id.UserID `json:"created_by"`
+	GitHash   string    `json:"git_hash,omitempty"`
+	Breaking  bool      `json:"breaking,omitempty"`
+}
+
+type exportDraft struct {
+	ID          int64     `json:"id"`
+	BaseVersion int       `json:"base_version"`
+	Message     string    `json:"message"`
+	Breaking    bool      `json:"breaking,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   id.UserID `json:"created_by"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UpdatedBy   id.UserID `json:"updated_by"`
+}
+
+type exportPreview struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy id.UserID `json:"created_by"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	MimeType  string    `json:"mime_type"`
+}
+
+type tarWriter struct {
+	*tar.Writer
+	now time.Time
+}
+
+func (tw *tarWriter) writeFile(name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  tw.now,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func (tw *tarWriter) writeJSON(name string, data any) error {
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return tw.writeFile(name, jsonData)
+}
+
+type exportStats struct {
+	Themes     int `json:"themes"`
+	Commits    int `json:"commits"`
+	Previews   int `json:"previews"`
+	GitObjects int `json:"git_objects"`
+	Drafts     int `json:"drafts"`
+	Moderators int `json:"moderators"`
+	Bans       int `json:"bans"`
+}
+
+func exportInstance(ctx context.Context, w io.Writer) (*exportStats, error) {
+	themes, err := db.Theme.GetAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get themes: %w", err)
+	}
+	moderators, err := db.Moderator.GetAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get moderators: %w", err)
+	}
+	bans, err := db.Ban.GetAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bans: %w", err)
+	}
+	gzw := gzip.NewWriter(w)
+	tw := &tarWriter{Writer: tar.NewWriter(gzw), now: time.Now()}
+	manifest := &exportManifest{
+		Format:     exportFormatName,
+		Version:    exportFormatVersion,
+		ExportedAt: tw.now,
+		Themes:     make([]database.ThemeID, len(themes)),
+	}
+	for i, theme := range themes {
+		manifest.Themes[i] = theme.ID
+	}
+	if err = tw.writeHeader(manifest, moderators, bans); err != nil {
+		return nil, err
+	}
+	stats := exportStats{Moderators: len(moderators), Bans: len(bans)}
+	// Themes are loaded one at a time so that only the previews of a single theme are in memory at once
+	for _, theme := range themes {
+		at, err := loadArchiveTheme(ctx, theme)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", theme.ID, err)
+		} else if err = tw.writeTheme(at); err != nil {
+			return nil, fmt.Errorf("failed to export %s: %w", theme.ID, err)
+		}
+		stats.Themes++
+		stats.Commits += len(at.Commits)
+		stats.Previews += len(at.Previews)
+		stats.GitObjects += len(at.GitObjects)
+		stats.Drafts += len(at.Drafts)
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	} else if err = gzw.Close(); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// loadArchiveTheme gets everything that's exported for a theme from the database.
+func loadArchiveTheme(ctx context.Context, theme *database.Theme) (*archiveTheme, error) {
+	at := newArchiveTheme()
+	channels, err := db.Channel.GetByTheme(ctx, theme.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channels: %w", err)
+	}
+	tags, err := db.Tag.GetByTheme(ctx, theme.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %w", err)
+	}
+	at.Meta = &exportTheme{
+		ID:            theme.ID,
+		Name:          theme.Name,
+		Description:   theme.Description,
+		LatestVersion: theme.LatestCommit.Version,
+		Admins:        theme.Admins,
+		Hidden:        theme.Hidden,
+		Frozen:        theme.Frozen,
+		FollowStable:  theme.FollowStable,
+		Channels:      channels,
+		Tags:          tags,
+	}
+	commits, err := db.Commit.GetAll(ctx, theme.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commits: %w", err)
+	}
+	for _, commit := range commits {
+		at.Commits[commit.Version] = commit
+	}
+	previews, err := db.PreviewImage.GetByTheme(ctx, theme.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get preview images: %w", err)
+	}
+	for _, preview := range previews {
+		at.Previews[preview.ID] = preview
+	}
+	at.GitObjects, err = db.GitObject.GetAll(ctx, theme.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git objects: %w", err)
+	}
+	drafts, err := db.Draft.GetByTheme(ctx, theme.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get drafts: %w", err)
+	}
+	for _, draft := range drafts {
+		at.Drafts[draft.ID] = draft
+	}
+	return at, nil
+}
+
+func (tw *tarWriter) writeHeader(manifest *exportManifest, moderators []*database.Moderator, bans []*database.Ban) error {
+	if err := tw.writeJSON("manifest.json", manifest); err != nil {
+		return err
+	} else if err = tw.writeJSON("moderators.json", moderators); err != nil {
+		return err
+	}
+	return tw.writeJSON("bans.json", bans)
+}
+
+func (tw *tarWriter) writeTheme(at *archiveTheme) error {
+	dir := path.Join("themes", string(at.Meta.ID))
+	if err := tw.writeJSON(path.Join(dir, "theme.json"), at.Meta); err != nil {
+		return err
+	}
+	for _, version := range slices.Sorted(maps.Keys(at.Commits)) {
+		commit := at.Commits[version]
+		name := path.Join(dir, "commits", strconv.Itoa(version))
+		err := tw.writeJSON(name+".json", &exportCommit{
+			Version:   version,
+			Message:   commit.Message,
+			CreatedAt: commit.CreatedAt,
+			CreatedBy: commit.CreatedBy,
+			GitHash:   commit.GitHash,
+			Breaking:  commit.Breaking,
+		})
+		if err != nil {
+			return err
+		} else if err = tw.writeFile(name+".css", []byte(commit.Content)); err != nil {
+			return err
+		}
+	}
+	for _, imageID := range slices.SortedFunc(maps.Keys(at.Previews), compareUUIDs) {
+		preview := at.Previews[imageID]
+		name := path.Join(dir, "previews", imageID.String())
+		err := tw.writeJSON(name+".json", &exportPreview{
+			ID:        imageID,
+			CreatedAt: preview.CreatedAt,
+			CreatedBy: preview.CreatedBy,
+			Width:     preview.Width,
+			Height:    preview.Height,
+			MimeType:  preview.MimeType,
+		})
+		if err != nil {
+			return err
+		} else if err = tw.writeFile(name, preview.Content); err != nil {
+			return err
+		}
+	}
+	for _, obj := range at.GitObjects {
+		name := path.Join(dir, "git", fmt.Sprintf("%s.%s", obj.Hash, gitproto.ObjectType(obj.Type)))
+		if err := tw.writeFile(name, obj.Data); err != nil {
+			return err
+		}
+	}
+	for _, draftID := range slices.Sorted(maps.Keys(at.Drafts)) {
+		draft := at.Drafts[draftID]
+		name := path.Join(dir, "drafts", strconv.FormatInt(draftID, 10))
+		err := tw.writeJSON(name+".json", &exportDraft{
+			ID:          draftID,
+			BaseVersion: draft.BaseVersion,
+			Message:     draft.Message,
+			Breaking:    draft.Breaking,
+			CreatedAt:   draft.CreatedAt,
+			CreatedBy:   draft.CreatedBy,
+			UpdatedAt:   draft.UpdatedAt,
+			UpdatedBy:   draft.UpdatedBy,
+		})
+		if err != nil {
+			return err
+		} else if err = tw.writeFile(name+".css", []byte(draft.Content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compareUUIDs(a, b uuid.UUID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// archiveTheme is everything in the archive about a single theme.
+type archiveTheme struct {
+	Meta       *exportTheme
+	Commits    map[int]*database.Commit
+	Previews   map[uuid.UUID]*database.PreviewImage
+	GitObjects []*database.GitObject
+	// Drafts are keyed by their ID in the exporting instance. New IDs are assigned on import.
+	Drafts map[int64]*database.Draft
+
+	// The content files that were found, which are tracked separately as empty CSS is valid content
+	commitsWithCSS map[int]struct{}
+	draftsWithCSS  map[int64]struct{}
+}
+
+type importArchive struct {
+	Manifest   *exportManifest
+	Moderators []*database.Moderator
+	Bans       []*database.Ban
+	Themes     map[database.ThemeID]*archiveTheme
+}
+
+func newArchiveTheme() *archiveTheme {
+	return &archiveTheme{
+		Commits:  make(map[int]*database.Commit),
+		Previews: make(map[uuid.UUID]*database.PreviewImage),
+		Drafts:   make(map[int64]*database.Draft),
+
+		draftsWithCSS:  make(map[int64]struct{}),
+		commitsWithCSS: make(map[int]struct{}),
+	}
+}
+
+func (ia *importArchive) getTheme(themeID database.ThemeID) *archiveTheme {
+	theme, ok := ia.Themes[themeID]
+	if !ok {
+		theme = newArchiveTheme()
+		ia.Themes[themeID] = theme
+	}
+	return theme
+}
+
+func readImportArchive(r io.Reader) (*importArchive, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+	}
+	tr := tar.NewReader(gzr)
+	archive := &importArchive{Themes: make(map[database.ThemeID]*archiveTheme)}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		} else if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", hdr.Name, err)
+		}
+		if err = archive.addFile(hdr.Name, data); err != nil {
+			return nil, fmt.Errorf("invalid file %s in archive: %w", hdr.Name, err)
+		}
+	}
+	if archive.Manifest == nil {
+		return nil, fmt.Errorf("archive doesn't contain manifest.json")
+	}
+	for themeID, theme := range archive.Themes {
+		if theme.Meta == nil {
+			return nil, fmt.Errorf("archive is missing theme.json for %s", themeID)
+		}
+		for version, commit := range theme.Commits {
+			if commit.CreatedBy == "" {
+				return nil, fmt.Errorf("archive is missing metadata for %s v%d", themeID, version)
+			} else if _, ok := theme.commitsWithCSS[version]; !ok {
+				return nil, fmt.Errorf("archive is missing content for %s v%d", themeID, version)
+			}
+		}
+		for draftID, draft := range theme.Drafts {
+			if draft.CreatedBy == "" {
+				return nil, fmt.Errorf("archive is missing metadata for %s draft #%d", themeID, draftID)
+			} else if _, ok := theme.draftsWithCSS[draftID]; !ok {
+				return nil, fmt.Errorf("archive is missing content for %s draft #%d", themeID, draftID)
+			}
+		}
+		for imageID, preview := range theme.Previews {
+			if preview.MimeType == "" {
+				return nil, fmt.Errorf("archive is missing metadata for preview %s", imageID)
+			} else if preview.Content == nil {
+				return nil, fmt.Errorf("archive is missing data for preview %s", imageID)
+			}
+		}
+	}
+	return archive, nil
+}
+
+func (ia *importArchive) addFile(name string, data []byte) error {
+	if name == "manifest.json" {
+		ia.Manifest = &exportManifest{}
+		if err := json.Unmarshal(data, ia.Manifest); err != nil {
+			return err
+		} else if ia.Manifest.Format != exportFormatName {
+			return fmt.Errorf("unknown format %q", ia.Manifest.Format)
+		} else if ia.Manifest.Version > exportFormatVersion {
+			return fmt.Errorf("unsupported format version %d", ia.Manifest.Version)
+		}
+		return nil
+	} else if name == "moderators.json" {
+		return json.Unmarshal(data, &ia.Moderators)
+	} else if name == "bans.json" {
+		return json.Unmarshal(data, &ia.Bans)
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) < 3 || parts[0] != "themes" {
+		return fmt.Errorf("unexpected path")
+	}
+	themeID := database.ThemeID(parts[1])
+	theme := ia.getTheme(themeID)
+	switch {
+	case len(parts) == 3 && parts[2] == "theme.json":
+		theme.Meta = &exportTheme{}
+		if err := json.Unmarshal(data, theme.Meta); err != nil {
+			return err
+		} else if theme.Meta.ID != themeID {
+			return fmt.Errorf("theme ID doesn't match path")
+		}
+	case len(parts) == 4 && parts[2] == "commits":
+		base, ext := splitExt(parts[3])
+		version, err := strconv.Atoi(base)
+		if err != nil {
+			return fmt.Errorf("invalid commit version: %w", err)
+		}
+		commit, ok := theme.Commits[version]
+		if !ok {
+			commit = &database.Commit{ThemeID: themeID, Version: version}
+			theme.Commits[version] = commit
+		}
+		switch ext {
+		case ".json":
+			var meta exportCommit
+			if err = json.Unmarshal(data, &meta); err != nil {
+				return err
+			} else if meta.Version != version {
+				return fmt.Errorf("commit version doesn't match path")
+			}
+			commit.Message, commit.CreatedAt, commit.CreatedBy = meta.Message, meta.CreatedAt, meta.CreatedBy
+			commit.GitHash, commit.Breaking = meta.GitHash, meta.Breaking
+		case ".css":
+			commit.Content = string(data)
+			theme.commitsWithCSS[version] = struct{}{}
+		default:
+			return fmt.Errorf("unexpected file extension")
+		}
+	case len(parts) == 4 && parts[2] == "previews":
+		base, ext := splitExt(parts[3])
+		imageID, err := uuid.Parse(base)
+		if err != nil {
+			return fmt.Errorf("invalid preview ID: %w", err)
+		}
+		preview, ok := theme.Previews[imageID]
+		if !ok {
+			preview = &database.PreviewImage{ID: imageID, ThemeID: themeID}
+			theme.Previews[imageID] = preview
+		}
+		switch ext {
+		case ".json":
+			var meta exportPreview
+			if err = json.Unmarshal(data, &meta); err != nil {
+				return err
+			} else if meta.ID != imageID {
+				return fmt.Errorf("preview ID doesn't match path")
+			}
+			preview.CreatedAt, preview.CreatedBy = meta.CreatedAt, meta.CreatedBy
+			preview.Width, preview.Height, preview.MimeType = meta.Width, meta.Height, meta.MimeType
+		case "":
+			preview.Content = data
+		default:
+			return fmt.Errorf("unexpected file extension")
+		}
+	case len(parts) == 4 && parts[2] == "git":
+		base, ext := splitExt(parts[3])
+		var objType gitproto.ObjectType
+		for _, knownType := range []gitproto.ObjectType{gitproto.ObjectCommit, gitproto.ObjectTree, gitproto.ObjectBlob, gitproto.ObjectTag} {
+			if ext == "."+knownType.String() {
+				objType = knownType
+			}
+		}
+		if objType == 0 {
+			return fmt.Errorf("unknown git object type")
+		} else if hash := gitproto.NewObject(objType, data).Hash(); hash.String() != base {
+			return fmt.Errorf("git object hash doesn't match content")
+		}
+		theme.GitObjects = append(theme.GitObjects, &database.GitObject{
+			ThemeID: themeID,
+			Hash:    base,
+			Type:    int(objType),
+			Data:    data,
+		})
+	case len(parts) == 4 && parts[2] == "drafts":
+		base, ext := splitExt(parts[3])
+		draftID, err := strconv.ParseInt(base, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid draft ID: %w", err)
+		}
+		draft, ok := theme.Drafts[draftID]
+		if !ok {
+			draft = &database.Draft{ThemeID: themeID}
+			theme.Drafts[draftID] = draft
+		}
+		switch ext {
+		case ".json":
+			var meta exportDraft
+			if err = json.Unmarshal(data, &meta); err != nil {
+				return err
+			} else if meta.ID != draftID {
+				return fmt.Errorf("draft ID doesn't match path")
+			}
+			draft.BaseVersion, draft.Message, draft.Breaking = meta.BaseVersion, meta.Message, meta.Breaking
+			draft.CreatedAt, draft.CreatedBy = meta.CreatedAt, meta.CreatedBy
+			draft.UpdatedAt, draft.UpdatedBy = meta.UpdatedAt, meta.UpdatedBy
+		case ".css":
+			draft.Content = string(data)
+			theme.draftsWithCSS[draftID] = struct{}{}
+		default:
+			return fmt.Errorf("unexpected file extension")
+		}
+	default:
+		return fmt.Errorf("unexpected path")
+	}
+	return nil
+}
+
+func splitExt(name string) (string, string) {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext), ext
+}
+
+type importConflict struct {
+	ThemeID database.ThemeID `json:"theme_id"`
+	Kind    string           `json:"kind"`
+	Detail  string           `json:"detail"`
+}
+
+type importReport struct {
+	DryRun           bool              `json:"dry_run"`
+	ThemesCreated    int               `json:"themes_created"`
+	ThemesExisting   int               `json:"themes_existing"`
+	CommitsAdded     int               `json:"commits_added"`
+	CommitsExisting  int               `json:"commits_existing"`
+	AdminsAdded      int               `json:"admins_added"`
+	PreviewsAdded    int               `json:"previews_added"`
+	PreviewsExisting int               `json:"previews_existing"`
+	GitObjectsAdded  int               `json:"git_objects_added"`
+	ReleasesAdded    int               `json:"releases_added"`
+	DraftsAdded      int               `json:"drafts_added"`
+	DraftsExisting   int               `json:"drafts_existing"`
+	ModeratorsAdded  int               `json:"moderators_added"`
+	BansAdded        int               `json:"bans_added"`
+	Conflicts        []*importConflict `json:"conflicts"`
+}
+
+func (ir *importReport) conflict(themeID database.ThemeID, kind, format string, args ...any) {
+	ir.Conflicts = append(ir.Conflicts, &importConflict{
+		ThemeID: themeID,
+		Kind:    kind,
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+var errDryRunRollback = errors.New("dry run")
+
+// importInstance restores an export archive. Existing rows that are identical to the archive are skipped,
+// while rows that differ are left untouched and reported as conflicts, so running the same import twice is safe.
+func importInstance(ctx context.Context, archive *importArchive, dryRun bool) (*importReport, error) {
+	report := &importReport{DryRun: dryRun, Conflicts: []*importConflict{}}
+	err := db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		err := importModeration(ctx, archive, report)
+		if err == nil && dryRun {
+			err = errDryRunRollback
+		}
+		return err
+	})
+	if err != nil && !errors.Is(err, errDryRunRollback) {
+		return report, fmt.Errorf("failed to import moderators and bans: %w", err)
+	}
+	themeIDs := make([]database.ThemeID, 0, len(archive.Themes))
+	for themeID := range archive.Themes {
+		themeIDs = append(themeIDs, themeID)
+	}
+	slices.Sort(themeIDs)
+	for _, themeID := range themeIDs {
+		err := db.DoTxn(ctx, nil, func(ctx context.Context) error {
+			err := importTheme(ctx, archive.Themes[themeID], report)
+			if err == nil && dryRun {
+				err = errDryRunRollback
+			}
+			return err
+		})
+		if err != nil && !errors.Is(err, errDryRunRollback) {
+			return report, fmt.Errorf("failed to import %s: %w", themeID, err)
+		}
+	}
+	return report, nil
+}
+
+// importModeration restores site moderators and bans. Existing bans with a different reason are kept as-is.
+func importModeration(ctx context.Context, archive *importArchive, report *importReport) error {
+	for _, mod := range archive.Moderators {
+		existing, err := db.Moderator.Get(ctx, mod.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get moderator %s: %w", mod.UserID, err)
+		} else if existing == nil {
+			if err = db.Moderator.Add(ctx, mod); err != nil {
+				return fmt.Errorf("failed to add moderator %s: %w", mod.UserID, err)
+			}
+			report.ModeratorsAdded++
+		}
+	}
+	for _, ban := range archive.Bans {
+		existing, err := db.Ban.Get(ctx, ban.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get ban of %s: %w", ban.UserID, err)
+		} else if existing == nil {
+			if err = db.Ban.Add(ctx, ban); err != nil {
+				return fmt.Errorf("failed to add ban of %s: %w", ban.UserID, err)
+			}
+			report.BansAdded++
+		} else if existing.Reason != ban.Reason {
+			report.conflict("", "ban", "%s is already banned with a different reason, keeping existing ban", ban.UserID)
+		}
+	}
+	return nil
+}
+
+func importTheme(ctx context.Context, it *archiveTheme, report *importReport) error {
+	meta := it.Meta
+	theme, err := db.Theme.Get(ctx, meta.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get theme: %w", err)
+	} else if theme == nil {
+		theme = &database.Theme{ID: meta.ID, Name: meta.Name, Description: meta.Description, FollowStable: meta.FollowStable}
+		if err = db.Theme.Create(ctx, theme); err != nil {
+			return fmt.Errorf("failed to create theme: %w", err)
+		} else if meta.Hidden {
+			if err = db.Theme.SetHidden(ctx, meta.ID, true); err != nil {
+				return fmt.Errorf("failed to hide theme: %w", err)
+			}
+		}
+		if meta.Frozen {
+			if err = db.Theme.SetFrozen(ctx, meta.ID, true); err != nil {
+				return fmt.Errorf("failed to freeze theme: %w", err)
+			}
+		}
+		report.ThemesCreated++
+	} else {
+		report.ThemesExisting++
+		if theme.Name != meta.Name || theme.Description != meta.Description {
+			report.conflict(meta.ID, "theme", "name or description differs, keeping existing values")
+		}
+		if theme.Hidden != meta.Hidden || theme.Frozen != meta.Frozen {
+			report.conflict(meta.ID, "moderation", "hidden or frozen flag differs, keeping existing values")
+		}
+		if theme.FollowStable != meta.FollowStable {
+			report.conflict(meta.ID, "follow_stable", "follow_stable differs, keeping existing value")
+		}
+	}
+	for _, admin := range meta.Admins {
+		if !theme.IsAdmin(admin) {
+			if err = db.Theme.AddAdmin(ctx, meta.ID, admin); err != nil {
+				return fmt.Errorf("failed to add admin: %w", err)
+			}
+			report.AdminsAdded++
+		}
+	}
+	existingObjects, err := db.GitObject.GetAll(ctx, meta.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get git objects: %w", err)
+	}
+	existingHashes := make(map[string]struct{}, len(existingObjects))
+	for _, obj := range existingObjects {
+		existingHashes[obj.Hash] = struct{}{}
+	}
+	for _, obj := range it.GitObjects {
+		// Git objects are content-addressed, so existing ones are always identical
+		if _, exists := existingHashes[obj.Hash]; !exists {
+			if err = db.GitObject.Add(ctx, obj); err != nil {
+				return fmt.Errorf("failed to add git object %s: %w", obj.Hash, err)
+			}
+			report.GitObjectsAdded++
+		}
+	}
+	versions := make([]int, 0, len(it.Commits))
+	for version := range it.Commits {
+		versions = append(versions, version)
+	}
+	slices.Sort(versions)
+	canMoveLatest := true
+	for _, version := range versions {
+		commit := it.Commits[version]
+		existing, err := db.Commit.Get(ctx, meta.ID, version)
+		if err != nil {
+			return fmt.Errorf("failed to get commit v%d: %w", version, err)
+		} else if existing == nil {
+			if err = db.Commit.Add(ctx, commit); err != nil {
+				return fmt.Errorf("failed to add commit v%d: %w", version, err)
+			}
+			report.CommitsAdded++
+		} else if existing.Content != commit.Content || existing.Message != commit.Message || existing.GitHash != commit.GitHash {
+			report.conflict(meta.ID, "commit", "v%d differs from the archive, keeping existing commit", version)
+			canMoveLatest = false
+		} else {
+			report.CommitsExisting++
+		}
+	}
+	if _, hasLatest := it.Commits[meta.LatestVersion]; hasLatest && meta.LatestVersion > theme.LatestCommit.Version {
+		if !canMoveLatest {
+			report.conflict(meta.ID, "latest_version", "not moving latest version to v%d due to commit conflicts", meta.LatestVersion)
+		} else if err = db.Theme.SetLatestCommit(ctx, meta.ID, meta.LatestVersion); err != nil {
+			return fmt.Errorf("failed to set latest commit: %w", err)
+		}
+	}
+	if err = importReleases(ctx, it, theme.LatestCommit.Version, report); err != nil {
+		return err
+	} else if err = importDrafts(ctx, it, report); err != nil {
+		return err
+	}
+	for imageID, preview := range it.Previews {
+		existing, err := db.PreviewImage.Get(ctx, imageID)
+		if err != nil {
+			return fmt.Errorf("failed to get preview %s: %w", imageID, err)
+		} else if existing == nil {
+			if err = db.PreviewImage.Add(ctx, preview); err != nil {
+				return fmt.Errorf("failed to add preview %s: %w", imageID, err)
+			}
+			report.PreviewsAdded++
+		} else if existing.ThemeID != meta.ID || !bytes.Equal(existing.Content, preview.Content) {
+			report.conflict(meta.ID, "preview", "preview %s already exists with different content or theme", imageID)
+		} else {
+			report.PreviewsExisting++
+		}
+	}
+	return nil
+}
+
+// importReleases restores the channels and tags of a theme. It must be called after the commits are imported.
+// Releases that point at a version that doesn't exist in the archive or the database are reported as conflicts.
+func importReleases(ctx context.Context, it *archiveTheme, existingLatest int, report *importReport) error {
+	meta := it.Meta
+	hasVersion := func(version int) bool {
+		_, inArchive := it.Commits[version]
+		return inArchive || (version > 0 && version <= existingLatest)
+	}
+	importRelease := func(kind string, rel *database.Release, get func() (*database.Release, error), add func() error) error {
+		rel.ThemeID = meta.ID
+		existing, err := get()
+		if err != nil {
+			return fmt.Errorf("failed to get %s %s: %w", kind, rel.Name, err)
+		} else if existing != nil {
+			if existing.Version != rel.Version {
+				report.conflict(meta.ID, kind, "%s points at v%d instead of v%d, keeping existing value", rel.Name, existing.Version, rel.Version)
+			}
+			return nil
+		} else if !hasVersion(rel.Version) {
+			report.conflict(meta.ID, kind, "%s points at v%d, which doesn't exist", rel.Name, rel.Version)
+			return nil
+		} else if err = add(); err != nil {
+			return fmt.Errorf("failed to add %s %s: %w", kind, rel.Name, err)
+		}
+		report.ReleasesAdded++
+		return nil
+	}
+	for _, channel := range meta.Channels {
+		err := importRelease("channel", channel, func() (*database.Release, error) {
+			return db.Channel.Get(ctx, meta.ID, channel.Name)
+		}, func() error {
+			return db.Channel.Set(ctx, channel)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, tag := range meta.Tags {
+		err := importRelease("tag", tag, func() (*database.Release, error) {
+			return db.Tag.Get(ctx, meta.ID, tag.Name)
+		}, func() error {
+			return db.Tag.Add(ctx, tag)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importDrafts restores the drafts of a theme. Draft IDs aren't preserved, so existing drafts are matched by
+// their creator and creation time instead, and preview links from the old instance stop working.
+func importDrafts(ctx context.Context, it *archiveTheme, report *importReport) error {
+	existingDrafts, err := db.Draft.GetByTheme(ctx, it.Meta.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get drafts: %w", err)
+	}
+	draftIDs := slices.Sorted(maps.Keys(it.Drafts))
+	for _, draftID := range draftIDs {
+		draft := it.Drafts[draftID]
+		existingIdx := slices.IndexFunc(existingDrafts, func(existing *database.Draft) bool {
+			return existing.CreatedBy == draft.CreatedBy && existing.CreatedAt.Equal(draft.CreatedAt)
+		})
+		if existingIdx < 0 {
+			if err = db.Draft.Create(ctx, draft); err != nil {
+				return fmt.Errorf("failed to add draft #%d: %w", draftID, err)
+			}
+			report.DraftsAdded++
+		} else if existing := existingDrafts[existingIdx]; existing.Content != draft.Content || existing.Message != draft.Message {
+			report.conflict(it.Meta.ID, "draft", "draft #%d differs from the archive, keeping existing draft #%d", draftID, existing.ID)
+		} else {
+			report.DraftsExisting++
+		}
+	}
+	return nil
+}
+
+func openArchivePath(name string, write bool) (io.ReadWriteCloser, error) {
+	if name == "-" {
+		if write {
+			return os.Stdout, nil
+		}
+		return os.Stdin, nil
+	} else if write {
+		return os.Create(name)
+	}
+	return os.Open(name)
+}
+
+func cliExport(cc *cliContext) error {
+	file, err := openArchivePath(cc.Args[0], true)
+	if err != nil {
+		return fmt.Errorf("failed to open output file: %w", err)
+	}
+	stats, err := exportInstance(cc, file)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close output file: %w", closeErr)
+	}
+	if err != nil {
+		return err
+	}
+	if cc.Args[0] != "-" {
+		cc.Print(stats, func(w io.Writer) {
+			_, _ = fmt.Fprintf(
+				w, "Exported %d themes with %d commits, %d preview images, %d git objects and %d drafts, %d moderators and %d bans\n",
+				stats.Themes, stats.Commits, stats.Previews, stats.GitObjects, stats.Drafts, stats.Moderators, stats.Bans,
+			)
+		})
+	}
+	return nil
+}
+
+func cliImport(cc *cliContext) error {
+	file, err := openArchivePath(cc.Args[0], false)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	archive, err := readImportArchive(file)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	report, err := importInstance(cc, archive, cc.flagBool("dry-run"))
+	if report != nil {
+		cc.Print(report, func(w io.Writer) {
+			if report.DryRun {
+				_, _ = fmt.Fprintln(w, "Dry run, nothing was saved")
+			}
+			_, _ = fmt.Fprintf(w, "Themes created:\t%d\t(%d already existed)\n", report.ThemesCreated, report.ThemesExisting)
+			_, _ = fmt.Fprintf(w, "Commits added:\t%d\t(%d already existed)\n", report.CommitsAdded, report.CommitsExisting)
+			_, _ = fmt.Fprintf(w, "Admins added:\t%d\n", report.AdminsAdded)
+			_, _ = fmt.Fprintf(w, "Previews added:\t%d\t(%d already existed)\n", report.PreviewsAdded, report.PreviewsExisting)
+			_, _ = fmt.Fprintf(w, "Git objects added:\t%d\n", report.GitObjectsAdded)
+			_, _ = fmt.Fprintf(w, "Tags and channels added:\t%d\n", report.ReleasesAdded)
+			_, _ = fmt.Fprintf(w, "Drafts added:\t%d\t(%d already existed)\n", report.DraftsAdded, report.DraftsExisting)
+			_, _ = fmt.Fprintf(w, "Moderators added:\t%d\n", report.ModeratorsAdded)
+			_, _ = fmt.Fprintf(w, "Bans added:\t%d\n", report.BansAdded)
+			_, _ = fmt.Fprintf(w, "Conflicts:\t%d\n", len(report.Conflicts))
+			for _, conflict := range report.Conflicts {
+				_, _ = fmt.Fprintf(w, "\t%s\t%s: %s\n", conflict.ThemeID, conflict.Kind, conflict.Detail)
+			}
+		})
+	}
+	return err
+}
@@ -0,0 +1,370 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+	"css.gomuks.app/gitproto"
+)
+
+func writeTestArchive(t *testing.T, manifest *exportManifest, moderators []*database.Moderator, bans []*database.Ban, themes ...*archiveTheme) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := &tarWriter{Writer: tar.NewWriter(gzw), now: manifest.ExportedAt}
+	if err := tw.writeHeader(manifest, moderators, bans); err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range themes {
+		if err := tw.writeTheme(at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeRawTestArchive writes the given files as-is, so that invalid archives can be tested.
+func writeRawTestArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := &tarWriter{Writer: tar.NewWriter(gzw), now: time.Now()}
+	for name, data := range files {
+		if err := tw.writeFile(name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTestArchiveTheme() *archiveTheme {
+	ts := time.Date(2024, 12, 24, 12, 34, 56, 789000000, time.UTC)
+	const themeID database.ThemeID = "meowtheme"
+	at := newArchiveTheme()
+	at.Meta = &exportTheme{
+		ID:            themeID,
+		Name:          "Meow theme",
+		Description:   "Very pink",
+		LatestVersion: 2,
+		Admins:        []id.UserID{"@meow:example.com", "@nyan:example.com"},
+		Hidden:        true,
+		Frozen:        true,
+		FollowStable:  true,
+		Channels:      []*database.Release{{Name: "stable", Version: 1, UpdatedAt: ts, UpdatedBy: "@meow:example.com"}},
+		Tags:          []*database.Release{{Name: "v1.0.0", Version: 1, UpdatedAt: ts, UpdatedBy: "@meow:example.com"}},
+	}
+	blob := gitproto.NewObject(gitproto.ObjectBlob, []byte("body { color: pink; }\n"))
+	at.Commits[1] = &database.Commit{ThemeID: themeID, Version: 1, Message: "Initial version", CreatedAt: ts, CreatedBy: "@meow:example.com", Content: "body { color: pink; }\n", GitHash: strings.Repeat("a", 40)}
+	// Empty CSS is valid content
+	at.Commits[2] = &database.Commit{ThemeID: themeID, Version: 2, Message: "Remove everything", CreatedAt: ts.Add(time.Hour), CreatedBy: "@nyan:example.com", Content: "", Breaking: true}
+	previewID := uuid.MustParse("0193fa2e-5c3b-7000-8000-000000000001")
+	at.Previews[previewID] = &database.PreviewImage{ID: previewID, ThemeID: themeID, CreatedAt: ts, CreatedBy: "@meow:example.com", Width: 640, Height: 480, MimeType: "image/png", Content: []byte("\x89PNG\r\n\x1a\nmeow")}
+	at.GitObjects = []*database.GitObject{{ThemeID: themeID, Hash: blob.Hash().String(), Type: int(gitproto.ObjectBlob), Data: blob.Data}}
+	at.Drafts[5] = &database.Draft{ThemeID: themeID, BaseVersion: 2, Message: "Bring back pink", Content: "body { color: hotpink; }\n", CreatedAt: ts.Add(2 * time.Hour), CreatedBy: "@meow:example.com", UpdatedAt: ts.Add(3 * time.Hour), UpdatedBy: "@nyan:example.com"}
+	return at
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ts := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	manifest := &exportManifest{Format: exportFormatName, Version: exportFormatVersion, ExportedAt: ts, Themes: []database.ThemeID{"meowtheme", "empty"}}
+	moderators := []*database.Moderator{{UserID: "@mod:example.com", AddedAt: ts, AddedBy: "cli"}}
+	bans := []*database.Ban{{UserID: "@spam:example.com", Reason: "spam", BannedAt: ts, BannedBy: "@mod:example.com"}}
+	theme := makeTestArchiveTheme()
+	empty := newArchiveTheme()
+	empty.Meta = &exportTheme{ID: "empty", Name: "Empty", Admins: []id.UserID{"@meow:example.com"}}
+
+	archive, err := readImportArchive(bytes.NewReader(writeTestArchive(t, manifest, moderators, bans, theme, empty)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(archive.Manifest, manifest) {
+		t.Errorf("manifest: got %+v, want %+v", archive.Manifest, manifest)
+	}
+	if !reflect.DeepEqual(archive.Moderators, moderators) {
+		t.Errorf("moderators: got %+v, want %+v", archive.Moderators, moderators)
+	}
+	if !reflect.DeepEqual(archive.Bans, bans) {
+		t.Errorf("bans: got %+v, want %+v", archive.Bans, bans)
+	}
+	if len(archive.Themes) != 2 {
+		t.Fatalf("got %d themes, want 2", len(archive.Themes))
+	}
+	for _, want := range []*archiveTheme{theme, empty} {
+		got := archive.Themes[want.Meta.ID]
+		if got == nil {
+			t.Errorf("theme %s is missing", want.Meta.ID)
+			continue
+		}
+		fields := []struct {
+			name      string
+			got, want any
+		}{
+			{"meta", got.Meta, want.Meta},
+			{"commits", got.Commits, want.Commits},
+			{"previews", got.Previews, want.Previews},
+			{"git objects", got.GitObjects, want.GitObjects},
+			{"drafts", got.Drafts, want.Drafts},
+		}
+		for _, field := range fields {
+			if !reflect.DeepEqual(field.got, field.want) {
+				t.Errorf("%s %s: got %+v, want %+v", want.Meta.ID, field.name, field.got, field.want)
+			}
+		}
+	}
+}
+
+func TestReadImportArchiveInvalid(t *testing.T) {
+	manifest := `{"format":"` + exportFormatName + `","version":2,"exported_at":"2025-01-02T03:04:05Z","themes":["meowtheme"]}`
+	themeJSON := `{"id":"meowtheme","name":"Meow theme","description":"","latest_version":1,"admins":[]}`
+	commitJSON := `{"version":1,"message":"","created_at":"2025-01-02T03:04:05Z","created_by":"@meow:example.com"}`
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{"missing manifest", map[string]string{"themes/meowtheme/theme.json": themeJSON}, "doesn't contain manifest.json"},
+		{"unknown format", map[string]string{"manifest.json": `{"format":"meow","version":1}`}, "unknown format"},
+		{"newer version", map[string]string{"manifest.json": `{"format":"` + exportFormatName + `","version":99}`}, "unsupported format version 99"},
+		{"unexpected file", map[string]string{"manifest.json": manifest, "meow.txt": ""}, "unexpected path"},
+		{"missing theme.json", map[string]string{
+			"manifest.json":                   manifest,
+			"themes/meowtheme/commits/1.json": commitJSON,
+			"themes/meowtheme/commits/1.css":  "",
+		}, "missing theme.json"},
+		{"theme ID mismatch", map[string]string{
+			"manifest.json":           manifest,
+			"themes/other/theme.json": themeJSON,
+		}, "theme ID doesn't match path"},
+		{"missing commit CSS", map[string]string{
+			"manifest.json":                   manifest,
+			"themes/meowtheme/theme.json":     themeJSON,
+			"themes/meowtheme/commits/1.json": commitJSON,
+		}, "missing content for meowtheme v1"},
+		{"missing commit metadata", map[string]string{
+			"manifest.json":                  manifest,
+			"themes/meowtheme/theme.json":    themeJSON,
+			"themes/meowtheme/commits/1.css": "",
+		}, "missing metadata for meowtheme v1"},
+		{"commit version mismatch", map[string]string{
+			"manifest.json":                   manifest,
+			"themes/meowtheme/theme.json":     themeJSON,
+			"themes/meowtheme/commits/2.json": commitJSON,
+		}, "commit version doesn't match path"},
+		{"missing draft CSS", map[string]string{
+			"manifest.json":                  manifest,
+			"themes/meowtheme/theme.json":    themeJSON,
+			"themes/meowtheme/drafts/5.json": `{"id":5,"created_by":"@meow:example.com"}`,
+		}, "missing content for meowtheme draft #5"},
+		{"missing preview data", map[string]string{
+			"manifest.json":               manifest,
+			"themes/meowtheme/theme.json": themeJSON,
+			"themes/meowtheme/previews/0193fa2e-5c3b-7000-8000-000000000001.json": `{"id":"0193fa2e-5c3b-7000-8000-000000000001","mime_type":"image/png"}`,
+		}, "missing data for preview"},
+		{"git object hash mismatch", map[string]string{
+			"manifest.json":               manifest,
+			"themes/meowtheme/theme.json": themeJSON,
+			"themes/meowtheme/git/" + strings.Repeat("a", 40) + ".blob": "meow",
+		}, "hash doesn't match content"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readImportArchive(bytes.NewReader(writeRawTestArchive(t, test.files)))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func readTestArchive(t *testing.T, moderators []*database.Moderator, bans []*database.Ban, themes ...*archiveTheme) *importArchive {
+	t.Helper()
+	manifest := &exportManifest{Format: exportFormatName, Version: exportFormatVersion, ExportedAt: time.Now().UTC()}
+	for _, at := range themes {
+		manifest.Themes = append(manifest.Themes, at.Meta.ID)
+	}
+	archive, err := readImportArchive(bytes.NewReader(writeTestArchive(t, manifest, moderators, bans, themes...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func conflictKinds(report *importReport) []string {
+	kinds := make([]string, len(report.Conflicts))
+	for i, conflict := range report.Conflicts {
+		kinds[i] = conflict.Kind
+	}
+	return kinds
+}
+
+var testImportModerators = []*database.Moderator{{UserID: "@mod:example.com", AddedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), AddedBy: "cli"}}
+
+func testImportBans() []*database.Ban {
+	return []*database.Ban{{UserID: "@spam:example.com", Reason: "spam", BannedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), BannedBy: "@mod:example.com"}}
+}
+
+func TestImportInstanceIdempotent(t *testing.T) {
+	ctx := setupTestDB(t)
+	archive := readTestArchive(t, testImportModerators, testImportBans(), makeTestArchiveTheme())
+
+	report, err := importInstance(ctx, archive, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &importReport{
+		ThemesCreated:   1,
+		CommitsAdded:    2,
+		AdminsAdded:     2,
+		PreviewsAdded:   1,
+		GitObjectsAdded: 1,
+		ReleasesAdded:   2,
+		DraftsAdded:     1,
+		ModeratorsAdded: 1,
+		BansAdded:       1,
+		Conflicts:       []*importConflict{},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("first import: got %+v, want %+v", report, want)
+	}
+	theme, err := db.Theme.Get(ctx, "meowtheme")
+	if err != nil {
+		t.Fatal(err)
+	} else if theme == nil {
+		t.Fatal("theme wasn't created")
+	} else if theme.LatestCommit.Version != 2 || !theme.Hidden || !theme.Frozen || !theme.FollowStable {
+		t.Errorf("imported theme doesn't match archive: %+v", theme)
+	}
+
+	report, err = importInstance(ctx, archive, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &importReport{
+		ThemesExisting:   1,
+		CommitsExisting:  2,
+		PreviewsExisting: 1,
+		DraftsExisting:   1,
+		Conflicts:        []*importConflict{},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("second import: got %+v, want %+v", report, want)
+	}
+}
+
+func TestImportInstanceConflicts(t *testing.T) {
+	ctx := setupTestDB(t)
+	if _, err := importInstance(ctx, readTestArchive(t, testImportModerators, testImportBans(), makeTestArchiveTheme()), false); err != nil {
+		t.Fatal(err)
+	}
+
+	bans := testImportBans()
+	bans[0].Reason = "different reason"
+	theme := makeTestArchiveTheme()
+	theme.Meta.FollowStable = false
+	theme.Meta.LatestVersion = 3
+	theme.Commits[1].Message = "Rewritten history"
+	theme.Commits[3] = &database.Commit{ThemeID: theme.Meta.ID, Version: 3, Message: "Pink again", CreatedAt: theme.Commits[2].CreatedAt.Add(time.Hour), CreatedBy: "@meow:example.com", Content: "body { color: pink; }\n"}
+	report, err := importInstance(ctx, readTestArchive(t, testImportModerators, bans, theme), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKinds := []string{"ban", "follow_stable", "commit", "latest_version"}
+	if kinds := conflictKinds(report); !reflect.DeepEqual(kinds, wantKinds) {
+		t.Errorf("got conflicts %v, want %v", kinds, wantKinds)
+	}
+	if report.CommitsAdded != 1 || report.CommitsExisting != 1 {
+		t.Errorf("got %d commits added and %d existing, want 1 and 1", report.CommitsAdded, report.CommitsExisting)
+	}
+
+	ban, err := db.Ban.Get(ctx, "@spam:example.com")
+	if err != nil {
+		t.Fatal(err)
+	} else if ban.Reason != "spam" {
+		t.Errorf("existing ban reason was overwritten with %q", ban.Reason)
+	}
+	commit, err := db.Commit.Get(ctx, theme.Meta.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if commit.Message != "Initial version" {
+		t.Errorf("existing commit message was overwritten with %q", commit.Message)
+	}
+	dbTheme, err := db.Theme.Get(ctx, theme.Meta.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if dbTheme.LatestCommit.Version != 2 {
+		t.Errorf("latest version moved to v%d despite commit conflicts", dbTheme.LatestCommit.Version)
+	} else if !dbTheme.FollowStable {
+		t.Error("existing follow_stable value was overwritten")
+	}
+}
+
+func TestImportInstanceDryRun(t *testing.T) {
+	ctx := setupTestDB(t)
+	archive := readTestArchive(t, testImportModerators, testImportBans(), makeTestArchiveTheme())
+
+	dryReport, err := importInstance(ctx, archive, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if !dryReport.DryRun || dryReport.ThemesCreated != 1 || dryReport.CommitsAdded != 2 || dryReport.BansAdded != 1 {
+		t.Errorf("dry run didn't report what it would import: %+v", dryReport)
+	}
+	if theme, err := db.Theme.Get(ctx, "meowtheme"); err != nil {
+		t.Fatal(err)
+	} else if theme != nil {
+		t.Error("dry run created the theme")
+	}
+	if mod, err := db.Moderator.Get(ctx, "@mod:example.com"); err != nil {
+		t.Fatal(err)
+	} else if mod != nil {
+		t.Error("dry run added the moderator")
+	}
+	if ban, err := db.Ban.Get(ctx, "@spam:example.com"); err != nil {
+		t.Fatal(err)
+	} else if ban != nil {
+		t.Error("dry run added the ban")
+	}
+
+	report, err := importInstance(ctx, archive, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryReport.DryRun = false
+	if !reflect.DeepEqual(report, dryReport) {
+		t.Errorf("real import after dry run: got %+v, want %+v", report, dryReport)
+	}
+}
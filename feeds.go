@@ -0,0 +1,310 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/exerrors"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+	"css.gomuks.app/linediff"
+)
+
+const (
+	feedSize = 50
+	// feedTagDate is the date part of the tag URIs used as feed and entry IDs.
+	// It must never change, or feed readers will see every entry as new.
+	feedTagDate = "2024"
+)
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Links   []atomLink   `xml:"link"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Author    atomPerson `xml:"author"`
+	Links     []atomLink `xml:"link"`
+	Content   atomText   `xml:"content"`
+}
+
+func atomTime(ts time.Time) string {
+	return ts.UTC().Format(time.RFC3339)
+}
+
+// feedTag builds a tag URI (RFC 4151) for feed and entry IDs.
+func feedTag(specific string) string {
+	return fmt.Sprintf("tag:%s,%s:%s", exerrors.Must(url.Parse(cfg.PublicURL)).Host, feedTagDate, specific)
+}
+
+// themeTag identifies a theme by its first version rather than the theme ID, so that it doesn't change
+// when the theme is renamed. The commit rows are moved along with the theme, so the values stay the same.
+func themeTag(first *database.Commit) string {
+	return feedTag(fmt.Sprintf("theme/%s/%d", first.CreatedBy, first.CreatedAt.UnixMicro()))
+}
+
+// commitTag identifies a version within the theme identified by themeTag. Several versions can be created
+// by the same user at the same time in a single push, so the creator and timestamp alone aren't unique.
+func commitTag(themeTag string, commit *database.Commit) string {
+	return fmt.Sprintf("%s/%d", themeTag, commit.Version)
+}
+
+// getThemeTag finds the tag of the theme that the given commit belongs to.
+// It falls back to the theme ID like getThemeFeed if the first version doesn't exist.
+func getThemeTag(ctx context.Context, commit *database.Commit) (string, error) {
+	first := commit
+	if commit.Version != 1 {
+		var err error
+		first, err = db.Commit.Get(ctx, commit.ThemeID, 1)
+		if err != nil {
+			return "", err
+		} else if first == nil {
+			return feedTag("theme/" + string(commit.ThemeID)), nil
+		}
+	}
+	return themeTag(first), nil
+}
+
+func userAuthor(userID id.UserID) atomPerson {
+	return atomPerson{Name: string(userID), URI: cfg.PublicURL + "/user/" + url.PathEscape(string(userID))}
+}
+
+func alternateLink(path string) atomLink {
+	return atomLink{Rel: "alternate", Type: "text/html", Href: cfg.PublicURL + path}
+}
+
+// diffSummary describes the change from the previous version, which is nil for the first version.
+func diffSummary(commit, prev *database.Commit) string {
+	if prev == nil {
+		return fmt.Sprintf("Initial version with %d lines", len(linediff.SplitLines(commit.Content)))
+	}
+	added, removed := linediff.Stat(prev.Content, commit.Content)
+	return fmt.Sprintf("%d lines added, %d lines removed", added, removed)
+}
+
+func commitEntry(themeName, themeTag string, commit, prev *database.Commit) *atomEntry {
+	title := fmt.Sprintf("%s v%d", themeName, commit.Version)
+	content := diffSummary(commit, prev)
+	if commit.Message != "" {
+		title += ": " + firstLine(commit.Message)
+		content = commit.Message + "\n\n" + content
+	}
+	return &atomEntry{
+		ID:        commitTag(themeTag, commit),
+		Title:     title,
+		Updated:   atomTime(commit.CreatedAt),
+		Published: atomTime(commit.CreatedAt),
+		Author:    userAuthor(commit.CreatedBy),
+		Links:     []atomLink{alternateLink(fmt.Sprintf("/theme/%s/commit/%d", commit.ThemeID, commit.Version))},
+		Content:   atomText{Type: "text", Body: content},
+	}
+}
+
+func writeAtomFeed(w http.ResponseWriter, feed *atomFeed, selfPath string, fallbackUpdated time.Time) {
+	feed.Links = append(feed.Links, atomLink{Rel: "self", Type: "application/atom+xml", Href: cfg.PublicURL + selfPath})
+	feed.Updated = atomTime(fallbackUpdated)
+	if len(feed.Entries) > 0 {
+		// Entries are sorted newest first
+		feed.Updated = feed.Entries[0].Updated
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	exerrors.PanicIfNotNil(enc.Encode(feed))
+}
+
+func getThemeFeed(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	theme, err := db.Theme.Get(r.Context(), database.ThemeID(r.PathValue("themeID")))
+	if err != nil {
+		log.Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if theme == nil || theme.Hidden {
+		w.WriteHeader(http.StatusNotFound)
+		// TODO write body
+		return
+	}
+	commits, err := db.Commit.GetAll(r.Context(), theme.ID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get commits")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	slices.SortFunc(commits, func(a, b *database.Commit) int {
+		return cmp.Compare(a.Version, b.Version)
+	})
+	feed := &atomFeed{
+		ID:    feedTag("theme/" + string(theme.ID)),
+		Title: theme.Name + " - version history",
+		Links: []atomLink{alternateLink(fmt.Sprintf("/theme/%s/commits", theme.ID))},
+	}
+	if len(commits) > 0 && commits[0].Version == 1 {
+		feed.ID = themeTag(commits[0])
+	}
+	for i := len(commits) - 1; i >= max(len(commits)-feedSize, 0); i-- {
+		var prev *database.Commit
+		if i > 0 {
+			prev = commits[i-1]
+		}
+		feed.Entries = append(feed.Entries, commitEntry(theme.Name, feed.ID, commits[i], prev))
+	}
+	writeAtomFeed(w, feed, fmt.Sprintf("/theme/%s/commits.atom", theme.ID), theme.LatestCommit.CreatedAt)
+}
+
+func getThemesByID(r *http.Request) (map[database.ThemeID]*database.Theme, error) {
+	themes, err := db.Theme.GetAll(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	themesByID := make(map[database.ThemeID]*database.Theme, len(themes))
+	for _, theme := range themes {
+		themesByID[theme.ID] = theme
+	}
+	return themesByID, nil
+}
+
+func getThemesFeed(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	themes, err := getThemesByID(r)
+	if err != nil {
+		log.Err(err).Msg("Failed to get themes")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	creations, err := db.Commit.GetRecentCreations(r.Context(), feedSize)
+	if err != nil {
+		log.Err(err).Msg("Failed to get new themes")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	feed := &atomFeed{
+		ID:    feedTag("themes"),
+		Title: "gomuks css - new themes",
+		Links: []atomLink{alternateLink("/")},
+	}
+	for _, first := range creations {
+		theme, ok := themes[first.ThemeID]
+		if !ok {
+			continue
+		}
+		feed.Entries = append(feed.Entries, &atomEntry{
+			ID:        themeTag(first),
+			Title:     theme.Name,
+			Updated:   atomTime(first.CreatedAt),
+			Published: atomTime(first.CreatedAt),
+			Author:    userAuthor(first.CreatedBy),
+			Links:     []atomLink{alternateLink("/theme/" + string(theme.ID))},
+			Content:   atomText{Type: "text", Body: theme.Description},
+		})
+	}
+	writeAtomFeed(w, feed, "/themes.atom", time.Unix(0, 0))
+}
+
+func getUserFeed(w http.ResponseWriter, r *http.Request, userID id.UserID) {
+	log := hlog.FromRequest(r)
+	themes, err := getThemesByID(r)
+	if err != nil {
+		log.Err(err).Msg("Failed to get themes")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	commits, err := db.Commit.GetRecentByCreator(r.Context(), userID, feedSize)
+	if err != nil {
+		log.Err(err).Msg("Failed to get commits")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	feed := &atomFeed{
+		ID:    feedTag("user/" + string(userID)),
+		Title: "gomuks css - " + string(userID),
+		Links: []atomLink{alternateLink("/user/" + url.PathEscape(string(userID)))},
+	}
+	themeTags := make(map[database.ThemeID]string)
+	for _, commit := range commits {
+		tag, ok := themeTags[commit.ThemeID]
+		if !ok {
+			tag, err = getThemeTag(r.Context(), commit)
+			if err != nil {
+				log.Err(err).Msg("Failed to get first commit")
+				w.WriteHeader(http.StatusInternalServerError)
+				// TODO write body
+				return
+			}
+			themeTags[commit.ThemeID] = tag
+		}
+		var prev *database.Commit
+		if commit.Version > 1 {
+			prev, err = db.Commit.Get(r.Context(), commit.ThemeID, commit.Version-1)
+			if err != nil {
+				log.Err(err).Msg("Failed to get previous commit")
+				w.WriteHeader(http.StatusInternalServerError)
+				// TODO write body
+				return
+			}
+		}
+		themeName := string(commit.ThemeID)
+		if theme, ok := themes[commit.ThemeID]; ok {
+			themeName = theme.Name
+		}
+		feed.Entries = append(feed.Entries, commitEntry(themeName, tag, commit, prev))
+	}
+	writeAtomFeed(w, feed, "/user/"+url.PathEscape(string(userID))+".atom", time.Unix(0, 0))
+}
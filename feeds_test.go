@@ -0,0 +1,47 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"css.gomuks.app/database"
+)
+
+func TestCommitEntryIDs(t *testing.T) {
+	cfg = defaultConfig()
+	ts := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := &database.Commit{ThemeID: "meowtheme", Version: 1, CreatedAt: ts, CreatedBy: "@meow:example.com"}
+	tag := themeTag(first)
+	if tag != "tag:css.gomuks.app,2024:theme/@meow:example.com/1735689600000000" {
+		t.Errorf("unexpected theme tag %q", tag)
+	}
+	// Versions created by one push share the creator and the timestamp
+	pushTime := ts.Add(time.Hour)
+	v2 := &database.Commit{ThemeID: "meowtheme", Version: 2, CreatedAt: pushTime, CreatedBy: "@nyan:example.com"}
+	v3 := &database.Commit{ThemeID: "meowtheme", Version: 3, CreatedAt: pushTime, CreatedBy: "@nyan:example.com"}
+	e2 := commitEntry("Meow theme", tag, v2, first)
+	e3 := commitEntry("Meow theme", tag, v3, v2)
+	if e2.ID != tag+"/2" || e3.ID != tag+"/3" {
+		t.Errorf("got entry IDs %q and %q, want %q and %q", e2.ID, e3.ID, tag+"/2", tag+"/3")
+	}
+	other := commitEntry("Other theme", themeTag(&database.Commit{Version: 1, CreatedAt: ts.Add(time.Minute), CreatedBy: "@meow:example.com"}), v2, nil)
+	if other.ID == e2.ID {
+		t.Errorf("versions of different themes got the same entry ID %q", other.ID)
+	}
+}
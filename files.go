@@ -33,22 +33,40 @@ var TemplateFS embed.FS
 var StaticFS embed.FS
 
 var templateFuncs = map[string]any{
-	"add": func(a, b int) int { return a + b },
-	"firstline": func(s string) string {
-		if i := strings.IndexByte(s, '\n'); i != -1 {
-			return s[:i]
-		}
-		return s
-	},
+	"add":       func(a, b int) int { return a + b },
+	"firstline": firstLine,
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i != -1 {
+		return s[:i]
+	}
+	return s
 }
 
 var Templates = exerrors.Must(template.New("templates").
 	Funcs(templateFuncs).
 	ParseFS(exerrors.Must(fs.Sub(TemplateFS, "templates")), "*.gohtml"))
 
+// CSRFData is embedded in the data of pages with POST forms. Each form must include the token in a hidden
+// csrf_token field, and renderContainer fills it in when the user is logged in.
+type CSRFData struct {
+	CSRFToken string
+}
+
+func (cd *CSRFData) setCSRFToken(token string) {
+	cd.CSRFToken = token
+}
+
+type csrfPage interface {
+	setCSRFToken(token string)
+}
+
 type ContainerData struct {
-	PageTitle string
-	User      id.UserID
-	Page      string
-	Data      any
+	CSRFData
+	PageTitle   string
+	User        id.UserID
+	IsModerator bool
+	Page        string
+	Data        any
 }
@@ -0,0 +1,178 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package gitproto implements the small subset of git object encoding, pkt-line framing and packfiles
+// needed to serve synthesized repositories over the smart HTTP protocol.
+package gitproto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Hash [20]byte
+
+var ZeroHash Hash
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+func (h Hash) IsZero() bool {
+	return h == ZeroHash
+}
+
+func ParseHash(s string) (h Hash, err error) {
+	if len(s) != 40 {
+		return h, fmt.Errorf("invalid hash length %d", len(s))
+	}
+	_, err = hex.Decode(h[:], []byte(s))
+	return
+}
+
+type ObjectType int
+
+const (
+	ObjectCommit ObjectType = 1
+	ObjectTree   ObjectType = 2
+	ObjectBlob   ObjectType = 3
+	ObjectTag    ObjectType = 4
+
+	objectOfsDelta ObjectType = 6
+	objectRefDelta ObjectType = 7
+)
+
+func (ot ObjectType) String() string {
+	switch ot {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
+	default:
+		return "unknown-" + strconv.Itoa(int(ot))
+	}
+}
+
+type Object struct {
+	Type ObjectType
+	Data []byte
+
+	hash *Hash
+}
+
+func NewObject(objType ObjectType, data []byte) *Object {
+	return &Object{Type: objType, Data: data}
+}
+
+// Hash returns the SHA-1 object ID, which is computed over a "<type> <size>\0" header and the data.
+func (o *Object) Hash() Hash {
+	if o.hash == nil {
+		hasher := sha1.New()
+		_, _ = fmt.Fprintf(hasher, "%s %d\x00", o.Type, len(o.Data))
+		hasher.Write(o.Data)
+		var h Hash
+		copy(h[:], hasher.Sum(nil))
+		o.hash = &h
+	}
+	return *o.hash
+}
+
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+func (s Signature) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), s.When.Format("-0700"))
+}
+
+type Commit struct {
+	Tree         Hash
+	Parents      []Hash
+	Author       Signature
+	Committer    Signature
+	ExtraHeaders []string
+	Message      string
+}
+
+func (c *Commit) Encode() *Object {
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, "tree %s\n", c.Tree)
+	for _, parent := range c.Parents {
+		_, _ = fmt.Fprintf(&buf, "parent %s\n", parent)
+	}
+	_, _ = fmt.Fprintf(&buf, "author %s\ncommitter %s\n", c.Author, c.Committer)
+	for _, header := range c.ExtraHeaders {
+		buf.WriteString(header)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(c.Message)
+	if len(c.Message) == 0 || c.Message[len(c.Message)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	return NewObject(ObjectCommit, buf.Bytes())
+}
+
+const ModeFile = "100644"
+const ModeExecutable = "100755"
+
+type TreeEntry struct {
+	Mode string
+	Name string
+	Hash Hash
+}
+
+func (te TreeEntry) sortKey() string {
+	if te.Mode == ModeTree {
+		return te.Name + "/"
+	}
+	return te.Name
+}
+
+// SetTreeEntry returns a copy of the entries where any existing entry with the same name
+// is replaced with the given one, sorted in the order git expects.
+func SetTreeEntry(entries []TreeEntry, entry TreeEntry) []TreeEntry {
+	entries = slices.DeleteFunc(slices.Clone(entries), func(te TreeEntry) bool {
+		return te.Name == entry.Name
+	})
+	entries = append(entries, entry)
+	slices.SortFunc(entries, func(a, b TreeEntry) int {
+		return strings.Compare(a.sortKey(), b.sortKey())
+	})
+	return entries
+}
+
+// EncodeTree encodes tree entries, which must already be sorted by name.
+func EncodeTree(entries []TreeEntry) *Object {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(&buf, "%s %s\x00", entry.Mode, entry.Name)
+		buf.Write(entry.Hash[:])
+	}
+	return NewObject(ObjectTree, buf.Bytes())
+}
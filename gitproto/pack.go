@@ -0,0 +1,333 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gitproto
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// WritePack writes a version 2 packfile containing the given objects without any deltas.
+func WritePack(w io.Writer, objects []*Object) error {
+	hasher := sha1.New()
+	mw := io.MultiWriter(w, hasher)
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(objects)))
+	if _, err := mw.Write(header); err != nil {
+		return err
+	}
+	zw := zlib.NewWriter(mw)
+	for _, obj := range objects {
+		if _, err := mw.Write(encodePackObjectHeader(obj.Type, len(obj.Data))); err != nil {
+			return err
+		}
+		zw.Reset(mw)
+		if _, err := zw.Write(obj.Data); err != nil {
+			return err
+		} else if err = zw.Close(); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(hasher.Sum(nil))
+	return err
+}
+
+func encodePackObjectHeader(objType ObjectType, size int) []byte {
+	out := []byte{byte(objType)<<4 | byte(size&0x0f)}
+	size >>= 4
+	for size > 0 {
+		out[len(out)-1] |= 0x80
+		out = append(out, byte(size&0x7f))
+		size >>= 7
+	}
+	return out
+}
+
+// packReader tracks the current offset and checksum while reading a pack byte by byte,
+// so that the zlib reader never consumes more than the current object.
+type packReader struct {
+	r      *bufio.Reader
+	hasher hash.Hash
+	offset int64
+}
+
+func (pr *packReader) ReadByte() (byte, error) {
+	b, err := pr.r.ReadByte()
+	if err == nil {
+		pr.hasher.Write([]byte{b})
+		pr.offset++
+	}
+	return b, err
+}
+
+func (pr *packReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.hasher.Write(p[:n])
+	pr.offset += int64(n)
+	return n, err
+}
+
+type packEntry struct {
+	offset     int64
+	objType    ObjectType
+	data       []byte
+	baseOffset int64
+	baseHash   Hash
+	resolved   *Object
+}
+
+// PackLimits bounds the memory that reading an untrusted pack can use. The sizes in object and delta
+// headers are checked against the limits before anything is allocated for them.
+type PackLimits struct {
+	MaxObjects int
+	// MaxObjectSize is the maximum size of a single object or delta after decompression
+	MaxObjectSize int
+	// MaxTotalSize is the maximum combined size of all decompressed objects and resolved deltas
+	MaxTotalSize int64
+}
+
+// ReadPack reads a version 2 packfile and resolves all deltas. Bases of ref-deltas that aren't in the pack
+// itself (i.e. thin packs) are looked up with the external function, which may return nil if the object is unknown.
+func ReadPack(r io.Reader, limits PackLimits, external func(Hash) *Object) ([]*Object, error) {
+	pr := &packReader{r: bufio.NewReader(r), hasher: sha1.New()}
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(pr, header); err != nil {
+		return nil, fmt.Errorf("failed to read pack header: %w", err)
+	} else if string(header[:4]) != "PACK" {
+		return nil, fmt.Errorf("invalid pack signature")
+	} else if version := binary.BigEndian.Uint32(header[4:]); version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported pack version %d", version)
+	}
+	count := int(binary.BigEndian.Uint32(header[8:]))
+	if count > limits.MaxObjects {
+		return nil, fmt.Errorf("too many objects in pack (%d > %d)", count, limits.MaxObjects)
+	}
+	var totalSize int64
+	addSize := func(size int) error {
+		totalSize += int64(size)
+		if totalSize > limits.MaxTotalSize {
+			return fmt.Errorf("pack is too large when unpacked (maximum is %d bytes)", limits.MaxTotalSize)
+		}
+		return nil
+	}
+	entries := make([]*packEntry, count)
+	byOffset := make(map[int64]*packEntry, count)
+	for i := range entries {
+		entry, err := readPackEntry(pr, limits.MaxObjectSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object #%d: %w", i+1, err)
+		} else if err = addSize(len(entry.data)); err != nil {
+			return nil, err
+		}
+		entries[i] = entry
+		byOffset[entry.offset] = entry
+	}
+	expectedChecksum := pr.hasher.Sum(nil)
+	checksum := make([]byte, 20)
+	if _, err := io.ReadFull(pr.r, checksum); err != nil {
+		return nil, fmt.Errorf("failed to read pack checksum: %w", err)
+	} else if !bytes.Equal(checksum, expectedChecksum) {
+		return nil, fmt.Errorf("pack checksum mismatch")
+	}
+
+	byHash := make(map[Hash]*Object, count)
+	for _, entry := range entries {
+		if entry.objType != objectOfsDelta && entry.objType != objectRefDelta {
+			entry.resolved = NewObject(entry.objType, entry.data)
+			byHash[entry.resolved.Hash()] = entry.resolved
+		}
+	}
+	for progress := true; progress; {
+		progress = false
+		for _, entry := range entries {
+			if entry.resolved != nil {
+				continue
+			}
+			var base *Object
+			if entry.objType == objectOfsDelta {
+				if baseEntry, ok := byOffset[entry.baseOffset]; !ok {
+					return nil, fmt.Errorf("ofs-delta at %d points to unknown offset %d", entry.offset, entry.baseOffset)
+				} else {
+					base = baseEntry.resolved
+				}
+			} else if base = byHash[entry.baseHash]; base == nil && external != nil {
+				base = external(entry.baseHash)
+			}
+			if base == nil {
+				continue
+			}
+			data, err := applyDelta(base.Data, entry.data, limits.MaxObjectSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to apply delta at %d: %w", entry.offset, err)
+			} else if err = addSize(len(data)); err != nil {
+				return nil, err
+			}
+			entry.resolved = NewObject(base.Type, data)
+			byHash[entry.resolved.Hash()] = entry.resolved
+			progress = true
+		}
+	}
+	objects := make([]*Object, len(entries))
+	for i, entry := range entries {
+		if entry.resolved == nil {
+			return nil, fmt.Errorf("couldn't resolve delta base for object at %d", entry.offset)
+		}
+		objects[i] = entry.resolved
+	}
+	return objects, nil
+}
+
+func readPackEntry(pr *packReader, maxSize int) (*packEntry, error) {
+	entry := &packEntry{offset: pr.offset}
+	b, err := pr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	entry.objType = ObjectType((b >> 4) & 0x07)
+	size := uint64(b & 0x0f)
+	for shift := 4; b&0x80 != 0; shift += 7 {
+		if b, err = pr.ReadByte(); err != nil {
+			return nil, err
+		}
+		if shift > 57 {
+			return nil, fmt.Errorf("object size header is too long")
+		}
+		size |= uint64(b&0x7f) << shift
+	}
+	switch entry.objType {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+	case objectOfsDelta:
+		b, err = pr.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		offset := int64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = pr.ReadByte(); err != nil {
+				return nil, err
+			}
+			offset = ((offset + 1) << 7) | int64(b&0x7f)
+		}
+		entry.baseOffset = entry.offset - offset
+	case objectRefDelta:
+		if _, err = io.ReadFull(pr, entry.baseHash[:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown object type %d", entry.objType)
+	}
+	if size > uint64(maxSize) {
+		return nil, fmt.Errorf("object is too large (%d > %d bytes)", size, maxSize)
+	}
+	zr, err := zlib.NewReader(pr)
+	if err != nil {
+		return nil, err
+	}
+	entry.data = make([]byte, size)
+	if _, err = io.ReadFull(zr, entry.data); err != nil {
+		return nil, err
+	}
+	// Read until the end of the zlib stream so that the checksum is consumed too
+	if n, err := zr.Read(make([]byte, 1)); n != 0 {
+		return nil, fmt.Errorf("object is larger than declared size")
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return entry, zr.Close()
+}
+
+func readDeltaSize(delta []byte) (uint64, []byte, error) {
+	var size uint64
+	for shift := 0; ; shift += 7 {
+		if len(delta) == 0 {
+			return 0, nil, fmt.Errorf("truncated delta header")
+		}
+		b := delta[0]
+		delta = delta[1:]
+		if shift > 57 {
+			return 0, nil, fmt.Errorf("delta size header is too long")
+		}
+		size |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return size, delta, nil
+		}
+	}
+}
+
+func applyDelta(base, delta []byte, maxSize int) ([]byte, error) {
+	srcSize, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	} else if srcSize != uint64(len(base)) {
+		return nil, fmt.Errorf("delta base size mismatch")
+	}
+	dstSize, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	} else if dstSize > uint64(maxSize) {
+		return nil, fmt.Errorf("delta result is too large (%d > %d bytes)", dstSize, maxSize)
+	}
+	out := make([]byte, 0, dstSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 != 0 {
+			var offset, size uint64
+			for i := 0; i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				} else if len(delta) == 0 {
+					return nil, fmt.Errorf("truncated copy instruction")
+				}
+				if i < 4 {
+					offset |= uint64(delta[0]) << (8 * i)
+				} else {
+					size |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > uint64(len(base)) {
+				return nil, fmt.Errorf("copy instruction out of bounds")
+			}
+			out = append(out, base[offset:offset+size]...)
+		} else if op != 0 {
+			if int(op) > len(delta) {
+				return nil, fmt.Errorf("truncated insert instruction")
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		} else {
+			return nil, fmt.Errorf("invalid delta opcode 0")
+		}
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, fmt.Errorf("delta result size mismatch")
+	}
+	return out, nil
+}
@@ -0,0 +1,281 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gitproto
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+var testLimits = PackLimits{MaxObjects: 10, MaxObjectSize: 1024, MaxTotalSize: 4096}
+
+func encodeDeltaSize(size uint64) []byte {
+	var out []byte
+	for {
+		b := byte(size & 0x7f)
+		size >>= 7
+		if size == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// rawPackEntry is a pack entry with the header bytes written as-is, so that invalid headers can be tested.
+type rawPackEntry struct {
+	header []byte
+	data   []byte
+}
+
+func buildPack(t *testing.T, entries ...rawPackEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(entries)))
+	buf.Write(header)
+	for _, entry := range entries {
+		buf.Write(entry.header)
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		} else if err = zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksum := sha1.Sum(buf.Bytes())
+	buf.Write(checksum[:])
+	return buf.Bytes()
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	blob := NewObject(ObjectBlob, []byte("body { color: pink; }\n"))
+	tree := EncodeTree([]TreeEntry{{Mode: ModeFile, Name: "theme.css", Hash: blob.Hash()}})
+	commit := (&Commit{
+		Tree:      tree.Hash(),
+		Author:    Signature{Name: "meow", Email: "meow@example.com"},
+		Committer: Signature{Name: "meow", Email: "meow@example.com"},
+		Message:   "Make it pinker\n",
+	}).Encode()
+	objects := []*Object{commit, tree, blob, NewObject(ObjectBlob, nil)}
+	var buf bytes.Buffer
+	if err := WritePack(&buf, objects); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPack(&buf, testLimits, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != len(objects) {
+		t.Fatalf("got %d objects, want %d", len(got), len(objects))
+	}
+	for i, obj := range objects {
+		if got[i].Type != obj.Type || got[i].Hash() != obj.Hash() {
+			t.Errorf("object %d: got %s %s, want %s %s", i, got[i].Type, got[i].Hash(), obj.Type, obj.Hash())
+		}
+	}
+}
+
+func TestReadPackDeltas(t *testing.T) {
+	base := NewObject(ObjectBlob, []byte("body { color: red; }\n"))
+	// Copy "body { color: ", insert "pink", copy "; }\n"
+	delta := append(encodeDeltaSize(uint64(len(base.Data))), encodeDeltaSize(22)...)
+	delta = append(delta, 0x90, 14, 4, 'p', 'i', 'n', 'k', 0x91, 17, 4)
+	want := "body { color: pink; }\n"
+
+	t.Run("ref-delta", func(t *testing.T) {
+		// The delta comes before its base and the header is followed by the base hash
+		baseHash := base.Hash()
+		pack := buildPack(t,
+			rawPackEntry{append(encodePackObjectHeader(objectRefDelta, len(delta)), baseHash[:]...), delta},
+			rawPackEntry{encodePackObjectHeader(ObjectBlob, len(base.Data)), base.Data},
+		)
+		objects, err := ReadPack(bytes.NewReader(pack), testLimits, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(objects[0].Data) != want || objects[0].Type != ObjectBlob {
+			t.Errorf("got %s %q, want blob %q", objects[0].Type, objects[0].Data, want)
+		}
+	})
+	t.Run("thin pack", func(t *testing.T) {
+		baseHash := base.Hash()
+		pack := buildPack(t, rawPackEntry{append(encodePackObjectHeader(objectRefDelta, len(delta)), baseHash[:]...), delta})
+		if _, err := ReadPack(bytes.NewReader(pack), testLimits, nil); err == nil {
+			t.Error("expected error for missing base")
+		}
+		objects, err := ReadPack(bytes.NewReader(pack), testLimits, func(hash Hash) *Object {
+			if hash == baseHash {
+				return base
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if string(objects[0].Data) != want {
+			t.Errorf("got %q, want %q", objects[0].Data, want)
+		}
+	})
+	t.Run("ofs-delta", func(t *testing.T) {
+		baseHeader := encodePackObjectHeader(ObjectBlob, len(base.Data))
+		var baseBuf bytes.Buffer
+		zw := zlib.NewWriter(&baseBuf)
+		_, _ = zw.Write(base.Data)
+		_ = zw.Close()
+		// The delta starts right after the base, which starts after the 12 byte pack header
+		offset := len(baseHeader) + baseBuf.Len()
+		if offset >= 0x80 {
+			t.Fatal("test offset must fit in one byte")
+		}
+		pack := buildPack(t,
+			rawPackEntry{baseHeader, base.Data},
+			rawPackEntry{append(encodePackObjectHeader(objectOfsDelta, len(delta)), byte(offset)), delta},
+		)
+		objects, err := ReadPack(bytes.NewReader(pack), testLimits, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(objects[1].Data) != want {
+			t.Errorf("got %q, want %q", objects[1].Data, want)
+		}
+	})
+}
+
+func TestReadPackLimits(t *testing.T) {
+	blob := []byte(strings.Repeat("a", 600))
+	tooLongHeader := []byte{byte(ObjectBlob)<<4 | 0x8f}
+	for range 9 {
+		tooLongHeader = append(tooLongHeader, 0xff)
+	}
+	tooLongHeader = append(tooLongHeader, 0x01)
+	tests := []struct {
+		name string
+		pack func(t *testing.T) []byte
+		err  string
+	}{{
+		name: "too many objects",
+		pack: func(t *testing.T) []byte {
+			entries := make([]rawPackEntry, testLimits.MaxObjects+1)
+			for i := range entries {
+				entries[i] = rawPackEntry{encodePackObjectHeader(ObjectBlob, 0), nil}
+			}
+			return buildPack(t, entries...)
+		},
+		err: "too many objects",
+	}, {
+		name: "oversized object",
+		pack: func(t *testing.T) []byte {
+			// The declared size is checked before the data is read
+			return buildPack(t, rawPackEntry{encodePackObjectHeader(ObjectBlob, 1<<40), nil})
+		},
+		err: "object is too large",
+	}, {
+		name: "too long size header",
+		pack: func(t *testing.T) []byte {
+			return buildPack(t, rawPackEntry{tooLongHeader, nil})
+		},
+		err: "object size header is too long",
+	}, {
+		name: "larger than declared",
+		pack: func(t *testing.T) []byte {
+			return buildPack(t, rawPackEntry{encodePackObjectHeader(ObjectBlob, 3), []byte("abcd")})
+		},
+		err: "larger than declared",
+	}, {
+		name: "truncated object",
+		pack: func(t *testing.T) []byte {
+			return buildPack(t, rawPackEntry{encodePackObjectHeader(ObjectBlob, 5), []byte("abcd")})
+		},
+		err: "unexpected EOF",
+	}, {
+		name: "total size",
+		pack: func(t *testing.T) []byte {
+			entries := make([]rawPackEntry, 7)
+			for i := range entries {
+				data := append([]byte{byte(i)}, blob...)
+				entries[i] = rawPackEntry{encodePackObjectHeader(ObjectBlob, len(data)), data}
+			}
+			return buildPack(t, entries...)
+		},
+		err: "too large when unpacked",
+	}, {
+		name: "checksum mismatch",
+		pack: func(t *testing.T) []byte {
+			pack := buildPack(t, rawPackEntry{encodePackObjectHeader(ObjectBlob, 3), []byte("abc")})
+			pack[len(pack)-1] ^= 0xff
+			return pack
+		},
+		err: "checksum mismatch",
+	}, {
+		name: "invalid signature",
+		pack: func(t *testing.T) []byte {
+			return []byte("KCAP\x00\x00\x00\x02\x00\x00\x00\x00")
+		},
+		err: "invalid pack signature",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadPack(bytes.NewReader(test.pack(t)), testLimits, nil)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("0123456789")
+	header := func(src, dst uint64) []byte {
+		return append(encodeDeltaSize(src), encodeDeltaSize(dst)...)
+	}
+	tests := []struct {
+		name  string
+		delta []byte
+		want  string
+		err   string
+	}{
+		{"copy and insert", append(header(10, 7), 0x91, 2, 3, 2, 'a', 'b', 0x90, 2), "234ab01", ""},
+		{"empty result", header(10, 0), "", ""},
+		{"truncated source size", []byte{0x8a}, "", "truncated delta header"},
+		{"truncated result size", append(encodeDeltaSize(10), 0x80), "", "truncated delta header"},
+		{"too long source size", bytes.Repeat([]byte{0x80}, 10), "", "delta size header is too long"},
+		{"too long result size", append(encodeDeltaSize(10), bytes.Repeat([]byte{0x80}, 10)...), "", "delta size header is too long"},
+		{"base size mismatch", header(11, 1), "", "base size mismatch"},
+		{"oversized result", header(10, 1<<40), "", "delta result is too large"},
+		{"truncated copy", append(header(10, 1), 0x91, 2), "", "truncated copy instruction"},
+		{"copy out of bounds", append(header(10, 2), 0x91, 9, 2), "", "copy instruction out of bounds"},
+		{"truncated insert", append(header(10, 3), 3, 'a'), "", "truncated insert instruction"},
+		{"opcode 0", append(header(10, 0), 0), "", "invalid delta opcode 0"},
+		{"result size mismatch", append(header(10, 5), 1, 'a'), "", "delta result size mismatch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := applyDelta(base, test.delta, 1024)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if string(got) != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
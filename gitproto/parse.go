@@ -0,0 +1,107 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gitproto
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseCommit parses the headers and message of a commit object. Headers other than tree, parent,
+// author and committer are returned in ExtraHeaders so callers can decide whether to accept them.
+func ParseCommit(data []byte) (*Commit, error) {
+	headers, message, found := bytes.Cut(data, []byte("\n\n"))
+	if !found {
+		headers = bytes.TrimSuffix(data, []byte("\n"))
+	}
+	commit := &Commit{Message: string(message)}
+	var hasTree bool
+	for _, line := range strings.Split(string(headers), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "tree":
+			commit.Tree, err = ParseHash(value)
+			hasTree = true
+		case "parent":
+			var parent Hash
+			parent, err = ParseHash(value)
+			commit.Parents = append(commit.Parents, parent)
+		case "author":
+			commit.Author, err = parseSignature(value)
+		case "committer":
+			commit.Committer, err = parseSignature(value)
+		default:
+			commit.ExtraHeaders = append(commit.ExtraHeaders, line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", key, err)
+		}
+	}
+	if !hasTree {
+		return nil, fmt.Errorf("commit has no tree")
+	}
+	return commit, nil
+}
+
+func parseSignature(val string) (sig Signature, err error) {
+	emailStart := strings.IndexByte(val, '<')
+	emailEnd := strings.LastIndexByte(val, '>')
+	if emailStart == -1 || emailEnd < emailStart {
+		return sig, fmt.Errorf("missing email")
+	}
+	sig.Name = strings.TrimSpace(val[:emailStart])
+	sig.Email = val[emailStart+1 : emailEnd]
+	tsStr, tzStr, _ := strings.Cut(strings.TrimSpace(val[emailEnd+1:]), " ")
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return sig, fmt.Errorf("invalid timestamp: %w", err)
+	}
+	loc := time.UTC
+	if tz, err := time.Parse("-0700", tzStr); err == nil {
+		_, offset := tz.Zone()
+		loc = time.FixedZone("", offset)
+	}
+	sig.When = time.Unix(ts, 0).In(loc)
+	return sig, nil
+}
+
+const ModeTree = "40000"
+const ModeGitlink = "160000"
+
+// ParseTree parses the entries of a tree object.
+func ParseTree(data []byte) ([]TreeEntry, error) {
+	var entries []TreeEntry
+	for len(data) > 0 {
+		modeAndName, rest, found := bytes.Cut(data, []byte{0})
+		if !found || len(rest) < 20 {
+			return nil, fmt.Errorf("truncated tree entry")
+		}
+		mode, name, found := bytes.Cut(modeAndName, []byte{' '})
+		if !found {
+			return nil, fmt.Errorf("invalid tree entry")
+		}
+		entry := TreeEntry{Mode: string(mode), Name: string(name)}
+		copy(entry.Hash[:], rest[:20])
+		entries = append(entries, entry)
+		data = rest[20:]
+	}
+	return entries, nil
+}
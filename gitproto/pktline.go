@@ -0,0 +1,94 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gitproto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const maxPktLineData = 65516
+
+var ErrFlush = errors.New("flush packet")
+
+type PktLineWriter struct {
+	w   io.Writer
+	err error
+}
+
+func NewPktLineWriter(w io.Writer) *PktLineWriter {
+	return &PktLineWriter{w: w}
+}
+
+// Write writes a single pkt-line. Errors are sticky and returned from Err.
+func (pw *PktLineWriter) Write(data []byte) {
+	if pw.err != nil {
+		return
+	} else if len(data) > maxPktLineData {
+		pw.err = fmt.Errorf("pkt-line too long")
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, "%04x", len(data)+4)
+	if pw.err == nil {
+		_, pw.err = pw.w.Write(data)
+	}
+}
+
+func (pw *PktLineWriter) WriteString(format string, args ...any) {
+	pw.Write([]byte(fmt.Sprintf(format, args...)))
+}
+
+func (pw *PktLineWriter) Flush() {
+	if pw.err == nil {
+		_, pw.err = io.WriteString(pw.w, "0000")
+	}
+}
+
+func (pw *PktLineWriter) Err() error {
+	return pw.err
+}
+
+type PktLineReader struct {
+	r io.Reader
+}
+
+func NewPktLineReader(r io.Reader) *PktLineReader {
+	return &PktLineReader{r: r}
+}
+
+// Read reads a single pkt-line. Flush packets are returned as ErrFlush.
+func (pr *PktLineReader) Read() ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(pr.r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseUint(string(lenBuf[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length: %w", err)
+	} else if length == 0 {
+		return nil, ErrFlush
+	} else if length < 4 {
+		return nil, fmt.Errorf("invalid pkt-line length %d", length)
+	}
+	data := make([]byte, length-4)
+	if _, err = io.ReadFull(pr.r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,131 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gitproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPktLineWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(pw *PktLineWriter)
+		want  string
+		err   bool
+	}{
+		{"empty", func(pw *PktLineWriter) { pw.Write(nil) }, "0004", false},
+		{"line", func(pw *PktLineWriter) { pw.WriteString("want %s\n", "abc") }, "000dwant abc\n", false},
+		{"flush", func(pw *PktLineWriter) { pw.Flush() }, "0000", false},
+		{"lines and flush", func(pw *PktLineWriter) {
+			pw.Write([]byte("a"))
+			pw.Write([]byte("bc"))
+			pw.Flush()
+		}, "0005a0006bc0000", false},
+		{"max length", func(pw *PktLineWriter) { pw.Write(make([]byte, maxPktLineData)) }, "fff0" + strings.Repeat("\x00", maxPktLineData), false},
+		{"too long", func(pw *PktLineWriter) { pw.Write(make([]byte, maxPktLineData+1)) }, "", true},
+		{"sticky error", func(pw *PktLineWriter) {
+			pw.Write(make([]byte, maxPktLineData+1))
+			pw.Write([]byte("a"))
+			pw.Flush()
+		}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			pw := NewPktLineWriter(&buf)
+			test.write(pw)
+			if err := pw.Err(); (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			} else if buf.String() != test.want {
+				t.Errorf("got %q, want %q", buf.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestPktLineReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   string
+	}{
+		{"lines", "0009want\n0008have0000", []string{"want\n", "have"}, ""},
+		{"empty line", "0004", []string{""}, ""},
+		{"flush only", "0000", nil, ""},
+		{"eof", "", nil, ""},
+		{"invalid hex", "00zz", nil, "invalid pkt-line length"},
+		{"reserved length", "0002", nil, "invalid pkt-line length 2"},
+		{"truncated length", "00", nil, "unexpected EOF"},
+		{"truncated data", "0010abc", nil, "unexpected EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pr := NewPktLineReader(strings.NewReader(test.input))
+			var got []string
+			var err error
+			for {
+				var line []byte
+				line, err = pr.Read()
+				if err != nil {
+					break
+				}
+				got = append(got, string(line))
+			}
+			if test.err == "" {
+				if !errors.Is(err, ErrFlush) && !errors.Is(err, io.EOF) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want %q", err, test.err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPktLineRoundTrip(t *testing.T) {
+	lines := []string{"# service=git-upload-pack\n", "", strings.Repeat("x", maxPktLineData)}
+	var buf bytes.Buffer
+	pw := NewPktLineWriter(&buf)
+	for _, line := range lines {
+		pw.Write([]byte(line))
+	}
+	pw.Flush()
+	if err := pw.Err(); err != nil {
+		t.Fatal(err)
+	}
+	pr := NewPktLineReader(&buf)
+	for i, want := range lines {
+		got, err := pr.Read()
+		if err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		} else if string(got) != want {
+			t.Errorf("line %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := pr.Read(); !errors.Is(err, ErrFlush) {
+		t.Errorf("expected flush, got %v", err)
+	}
+}
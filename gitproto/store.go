@@ -0,0 +1,112 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package gitproto
+
+import (
+	"fmt"
+)
+
+// ObjectStore is an in-memory set of git objects keyed by their hash.
+type ObjectStore map[Hash]*Object
+
+func (s ObjectStore) Add(obj *Object) Hash {
+	hash := obj.Hash()
+	s[hash] = obj
+	return hash
+}
+
+func (s ObjectStore) GetCommit(hash Hash) (*Commit, error) {
+	obj, ok := s[hash]
+	if !ok {
+		return nil, fmt.Errorf("missing commit %s", hash)
+	} else if obj.Type != ObjectCommit {
+		return nil, fmt.Errorf("object %s is a %s, not a commit", hash, obj.Type)
+	}
+	return ParseCommit(obj.Data)
+}
+
+func (s ObjectStore) GetTree(hash Hash) ([]TreeEntry, error) {
+	obj, ok := s[hash]
+	if !ok {
+		return nil, fmt.Errorf("missing tree %s", hash)
+	} else if obj.Type != ObjectTree {
+		return nil, fmt.Errorf("object %s is a %s, not a tree", hash, obj.Type)
+	}
+	return ParseTree(obj.Data)
+}
+
+// Reachable returns all objects reachable from the wanted commits that aren't reachable
+// from the haves. Unknown haves are ignored, but missing objects under wants are an error.
+func (s ObjectStore) Reachable(wants, haves []Hash) ([]*Object, error) {
+	seen := make(map[Hash]struct{})
+	for _, have := range haves {
+		if _, ok := s[have]; ok {
+			if err := s.walk(have, seen, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var objects []*Object
+	for _, want := range wants {
+		err := s.walk(want, seen, func(obj *Object) {
+			objects = append(objects, obj)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+func (s ObjectStore) walk(hash Hash, seen map[Hash]struct{}, fn func(obj *Object)) error {
+	stack := []Hash{hash}
+	for len(stack) > 0 {
+		hash = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seen[hash]; ok {
+			continue
+		}
+		obj, ok := s[hash]
+		if !ok {
+			return fmt.Errorf("missing object %s", hash)
+		}
+		seen[hash] = struct{}{}
+		if fn != nil {
+			fn(obj)
+		}
+		switch obj.Type {
+		case ObjectCommit:
+			commit, err := ParseCommit(obj.Data)
+			if err != nil {
+				return fmt.Errorf("failed to parse commit %s: %w", hash, err)
+			}
+			stack = append(stack, commit.Tree)
+			stack = append(stack, commit.Parents...)
+		case ObjectTree:
+			entries, err := ParseTree(obj.Data)
+			if err != nil {
+				return fmt.Errorf("failed to parse tree %s: %w", hash, err)
+			}
+			for _, entry := range entries {
+				if entry.Mode != ModeGitlink {
+					stack = append(stack, entry.Hash)
+				}
+			}
+		}
+	}
+	return nil
+}
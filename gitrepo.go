@@ -0,0 +1,651 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+	"css.gomuks.app/gitproto"
+)
+
+const gitBranch = "refs/heads/main"
+const gitFileName = "theme.css"
+const gitAgent = "agent=css.gomuks.app"
+
+// themeRepo is a git repository for a theme. Commits that were pushed over git are stored verbatim
+// in the git_object table, while commits made through the web editor are synthesized on demand
+// on top of the previous version's tree, only replacing theme.css.
+type themeRepo struct {
+	ID      database.ThemeID
+	Theme   *database.Theme
+	Store   gitproto.ObjectStore
+	Head    gitproto.Hash
+	persist map[gitproto.Hash]struct{}
+}
+
+func gitSignature(commit *database.Commit) gitproto.Signature {
+	email := string(commit.CreatedBy)
+	if localpart, server, err := commit.CreatedBy.Parse(); err == nil {
+		email = fmt.Sprintf("%s@%s", localpart, server)
+	}
+	return gitproto.Signature{Name: string(commit.CreatedBy), Email: email, When: commit.CreatedAt}
+}
+
+func buildThemeRepo(theme *database.Theme, commits []*database.Commit, objects []*database.GitObject) (*themeRepo, error) {
+	repo := &themeRepo{
+		ID:      theme.ID,
+		Theme:   theme,
+		Store:   make(gitproto.ObjectStore, len(objects)+len(commits)*3),
+		persist: make(map[gitproto.Hash]struct{}, len(objects)),
+	}
+	for _, obj := range objects {
+		repo.persist[repo.Store.Add(gitproto.NewObject(gitproto.ObjectType(obj.Type), obj.Data))] = struct{}{}
+	}
+	slices.SortFunc(commits, func(a, b *database.Commit) int {
+		return a.Version - b.Version
+	})
+	for _, commit := range commits {
+		if commit.GitHash != "" {
+			hash, err := gitproto.ParseHash(commit.GitHash)
+			if err != nil {
+				return nil, fmt.Errorf("invalid git hash in v%d: %w", commit.Version, err)
+			} else if _, ok := repo.Store[hash]; !ok {
+				return nil, fmt.Errorf("git commit %s of v%d is missing", hash, commit.Version)
+			}
+			repo.Head = hash
+		} else if err := repo.synthesize(commit); err != nil {
+			return nil, fmt.Errorf("failed to synthesize v%d: %w", commit.Version, err)
+		}
+	}
+	return repo, nil
+}
+
+func (repo *themeRepo) synthesize(commit *database.Commit) error {
+	var entries []gitproto.TreeEntry
+	var parents []gitproto.Hash
+	if !repo.Head.IsZero() {
+		head, err := repo.Store.GetCommit(repo.Head)
+		if err != nil {
+			return err
+		} else if entries, err = repo.Store.GetTree(head.Tree); err != nil {
+			return err
+		}
+		parents = []gitproto.Hash{repo.Head}
+	}
+	entries = gitproto.SetTreeEntry(entries, gitproto.TreeEntry{
+		Mode: gitproto.ModeFile,
+		Name: gitFileName,
+		Hash: repo.Store.Add(gitproto.NewObject(gitproto.ObjectBlob, []byte(commit.Content))),
+	})
+	signature := gitSignature(commit)
+	repo.Head = repo.Store.Add((&gitproto.Commit{
+		Tree:      repo.Store.Add(gitproto.EncodeTree(entries)),
+		Parents:   parents,
+		Author:    signature,
+		Committer: signature,
+		Message:   commit.Message,
+	}).Encode())
+	return nil
+}
+
+// getGitThemeID returns the theme ID from a git URL path, which may optionally end in .git.
+func getGitThemeID(r *http.Request) database.ThemeID {
+	return database.ThemeID(strings.TrimSuffix(r.PathValue("themeID"), ".git"))
+}
+
+// loadThemeRepo loads the git repository of the theme in the request. If allowMissing is true,
+// an empty repository is returned for nonexistent themes with valid IDs.
+func loadThemeRepo(w http.ResponseWriter, r *http.Request, allowMissing bool) *themeRepo {
+	themeID := getGitThemeID(r)
+	theme, err := db.Theme.Get(r.Context(), themeID)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get theme")
+		http.Error(w, "Failed to get theme", http.StatusInternalServerError)
+		return nil
+	} else if theme == nil {
+		if !allowMissing || !cfg.Limits.ValidThemeID(string(themeID)) {
+			http.Error(w, "Theme not found", http.StatusNotFound)
+			return nil
+		}
+		return &themeRepo{ID: themeID, Store: make(gitproto.ObjectStore)}
+	}
+	commits, err := db.Commit.GetAll(r.Context(), themeID)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get commits")
+		http.Error(w, "Failed to get commits", http.StatusInternalServerError)
+		return nil
+	}
+	objects, err := db.GitObject.GetAll(r.Context(), themeID)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get git objects")
+		http.Error(w, "Failed to get git objects", http.StatusInternalServerError)
+		return nil
+	}
+	repo, err := buildThemeRepo(theme, commits, objects)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to build git repository")
+		http.Error(w, "Failed to build git repository", http.StatusInternalServerError)
+		return nil
+	}
+	return repo
+}
+
+// verifyGitAuth checks the API token in the password field of HTTP basic auth, or in a bearer
+// authorization header. If the token is missing or invalid, it writes a 401 response asking git
+// to prompt for credentials. The token must have write access to the theme.
+func verifyGitAuth(w http.ResponseWriter, r *http.Request) *authInfo {
+	token := requestAPIToken(r)
+	var apiToken *database.APIToken
+	if token != "" {
+		var err error
+		apiToken, err = checkAPIToken(r.Context(), token)
+		if err != nil {
+			hlog.FromRequest(r).Err(err).Msg("Failed to check API token")
+			http.Error(w, "Failed to check API token", http.StatusInternalServerError)
+			return nil
+		}
+	}
+	if apiToken == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="css.gomuks.app git push"`)
+		http.Error(w, "An API token is required to push. You can create one at /tokens", http.StatusUnauthorized)
+		return nil
+	} else if !apiToken.CanWrite(getGitThemeID(r)) {
+		http.Error(w, errTokenScopeDenied.Error(), http.StatusForbidden)
+		return nil
+	} else if err := checkCanPublish(r.Context(), apiToken.UserID); errors.Is(err, errServerBlocked) || errors.Is(err, errUserBanned) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	} else if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to check if user can publish")
+		http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		return nil
+	}
+	return &authInfo{UserID: apiToken.UserID, Token: apiToken}
+}
+
+func getGitInfoRefs(w http.ResponseWriter, r *http.Request) {
+	service := r.URL.Query().Get("service")
+	var repo *themeRepo
+	switch service {
+	case "git-upload-pack":
+		repo = loadThemeRepo(w, r, false)
+	case "git-receive-pack":
+		auth := verifyGitAuth(w, r)
+		if auth == nil {
+			return
+		}
+		repo = loadThemeRepo(w, r, true)
+		if repo != nil && repo.Theme != nil && !repo.Theme.IsAdmin(auth.UserID) {
+			http.Error(w, "You're not an admin of this theme", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "Only the smart HTTP protocol is supported", http.StatusForbidden)
+		return
+	}
+	if repo != nil {
+		repo.writeRefAdvertisement(w, service)
+	}
+}
+
+func (repo *themeRepo) writeRefAdvertisement(w http.ResponseWriter, service string) {
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	pw := gitproto.NewPktLineWriter(w)
+	pw.WriteString("# service=%s\n", service)
+	pw.Flush()
+	var caps string
+	if service == "git-receive-pack" {
+		caps = fmt.Sprintf("report-status ofs-delta %s", gitAgent)
+	} else {
+		caps = fmt.Sprintf("symref=HEAD:%s no-progress %s", gitBranch, gitAgent)
+	}
+	if repo.Head.IsZero() {
+		pw.WriteString("%s capabilities^{}\x00%s\n", gitproto.ZeroHash, caps)
+	} else if service == "git-receive-pack" {
+		pw.WriteString("%s %s\x00%s\n", repo.Head, gitBranch, caps)
+	} else {
+		pw.WriteString("%s HEAD\x00%s\n", repo.Head, caps)
+		pw.WriteString("%s %s\n", repo.Head, gitBranch)
+	}
+	pw.Flush()
+}
+
+// getRequestBody limits the size of the request body, decompressing it first if it's gzipped.
+// The limit applies to both the compressed and decompressed size.
+func getRequestBody(w http.ResponseWriter, r *http.Request, limit int64) (io.Reader, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return http.MaxBytesReader(w, zr, limit), nil
+	}
+	return r.Body, nil
+}
+
+type uploadPackRequest struct {
+	Wants []gitproto.Hash
+	Haves []gitproto.Hash
+	Done  bool
+}
+
+func readUploadPackRequest(r io.Reader) (*uploadPackRequest, error) {
+	pr := gitproto.NewPktLineReader(r)
+	var req uploadPackRequest
+	for {
+		line, err := pr.Read()
+		if errors.Is(err, gitproto.ErrFlush) {
+			continue
+		} else if errors.Is(err, io.EOF) {
+			return &req, nil
+		} else if err != nil {
+			return nil, err
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), " ")
+		switch cmd {
+		case "want", "have":
+			hashStr, _, _ := strings.Cut(arg, " ")
+			hash, err := gitproto.ParseHash(hashStr)
+			if err != nil {
+				return nil, err
+			}
+			if cmd == "want" {
+				req.Wants = append(req.Wants, hash)
+			} else {
+				req.Haves = append(req.Haves, hash)
+			}
+		case "done":
+			req.Done = true
+			return &req, nil
+		default:
+			return nil, fmt.Errorf("unsupported command %q", cmd)
+		}
+	}
+}
+
+func postGitUploadPack(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	body, err := getRequestBody(w, r, cfg.Limits.MaxPushSize)
+	if err != nil {
+		http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+		return
+	}
+	req, err := readUploadPackRequest(body)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to parse upload-pack request")
+		http.Error(w, "Invalid upload-pack request", http.StatusBadRequest)
+		return
+	}
+	repo := loadThemeRepo(w, r, false)
+	if repo != nil {
+		repo.serveUploadPack(w, r, req)
+	}
+}
+
+func (repo *themeRepo) serveUploadPack(w http.ResponseWriter, r *http.Request, req *uploadPackRequest) {
+	log := hlog.FromRequest(r)
+	for _, want := range req.Wants {
+		if obj, ok := repo.Store[want]; !ok || obj.Type != gitproto.ObjectCommit {
+			http.Error(w, fmt.Sprintf("Unknown commit %s", want), http.StatusBadRequest)
+			return
+		}
+	}
+	var common []gitproto.Hash
+	for _, have := range req.Haves {
+		if _, ok := repo.Store[have]; ok {
+			common = append(common, have)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	pw := gitproto.NewPktLineWriter(w)
+	if len(common) > 0 {
+		pw.WriteString("ACK %s\n", common[0])
+	} else {
+		pw.WriteString("NAK\n")
+	}
+	if !req.Done || len(req.Wants) == 0 {
+		return
+	} else if err := pw.Err(); err != nil {
+		log.Debug().Err(err).Msg("Failed to write upload-pack acknowledgement")
+		return
+	}
+	objects, err := repo.Store.Reachable(req.Wants, common)
+	if err != nil {
+		log.Err(err).Msg("Failed to collect objects for pack")
+		return
+	}
+	var buf bytes.Buffer
+	if err = gitproto.WritePack(&buf, objects); err != nil {
+		log.Err(err).Msg("Failed to generate pack")
+		return
+	}
+	_, _ = w.Write(buf.Bytes())
+}
+
+type receivePackCommand struct {
+	Old gitproto.Hash
+	New gitproto.Hash
+	Ref string
+}
+
+func readReceivePackCommands(pr *gitproto.PktLineReader) ([]*receivePackCommand, error) {
+	var commands []*receivePackCommand
+	for {
+		line, err := pr.Read()
+		if errors.Is(err, gitproto.ErrFlush) {
+			return commands, nil
+		} else if err != nil {
+			return nil, err
+		}
+		line, _, _ = bytes.Cut(line, []byte{0})
+		parts := strings.Fields(string(line))
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid command line")
+		}
+		var cmd receivePackCommand
+		if cmd.Old, err = gitproto.ParseHash(parts[0]); err != nil {
+			return nil, err
+		} else if cmd.New, err = gitproto.ParseHash(parts[1]); err != nil {
+			return nil, err
+		}
+		cmd.Ref = parts[2]
+		commands = append(commands, &cmd)
+	}
+}
+
+func writeReceivePackStatus(w http.ResponseWriter, unpackErr error, refStatuses map[string]error) {
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	pw := gitproto.NewPktLineWriter(w)
+	if unpackErr != nil {
+		pw.WriteString("unpack %s\n", strings.ReplaceAll(unpackErr.Error(), "\n", " "))
+	} else {
+		pw.WriteString("unpack ok\n")
+	}
+	for ref, err := range refStatuses {
+		if err != nil {
+			pw.WriteString("ng %s %s\n", ref, strings.ReplaceAll(err.Error(), "\n", " "))
+		} else {
+			pw.WriteString("ok %s\n", ref)
+		}
+	}
+	pw.Flush()
+}
+
+func postGitReceivePack(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	auth := verifyGitAuth(w, r)
+	if auth == nil {
+		return
+	}
+	userID := auth.UserID
+	repo := loadThemeRepo(w, r, true)
+	if repo == nil {
+		return
+	} else if repo.Theme != nil && !repo.Theme.IsAdmin(userID) {
+		http.Error(w, "You're not an admin of this theme", http.StatusForbidden)
+		return
+	}
+	body, err := getRequestBody(w, r, cfg.Limits.MaxPushSize)
+	if err != nil {
+		http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+		return
+	}
+	commands, err := readReceivePackCommands(gitproto.NewPktLineReader(body))
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to parse receive-pack commands")
+		http.Error(w, "Invalid receive-pack request", http.StatusBadRequest)
+		return
+	}
+	statuses := make(map[string]error, len(commands))
+	hasUpdate := false
+	for _, cmd := range commands {
+		if cmd.Ref != gitBranch {
+			statuses[cmd.Ref] = fmt.Errorf("only %s can be pushed", gitBranch)
+		} else if cmd.New.IsZero() {
+			statuses[cmd.Ref] = fmt.Errorf("the branch can't be deleted")
+		} else {
+			hasUpdate = true
+		}
+	}
+	if !hasUpdate {
+		writeReceivePackStatus(w, nil, statuses)
+		return
+	}
+	objects, err := gitproto.ReadPack(body, gitproto.PackLimits{
+		MaxObjects:    cfg.Limits.MaxPushObjects,
+		MaxObjectSize: cfg.Limits.MaxPushObjectSize,
+		MaxTotalSize:  cfg.Limits.MaxPushUnpackedSize,
+	}, func(hash gitproto.Hash) *gitproto.Object {
+		return repo.Store[hash]
+	})
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to read pushed pack")
+		writeReceivePackStatus(w, err, map[string]error{gitBranch: fmt.Errorf("unpacker error")})
+		return
+	}
+	for _, obj := range objects {
+		repo.Store.Add(obj)
+	}
+	for _, cmd := range commands {
+		if cmd.Ref == gitBranch && !cmd.New.IsZero() {
+			err = repo.applyPush(r.Context(), userID, cmd)
+			if err != nil {
+				log.Debug().Err(err).Stringer("new_hash", cmd.New).Msg("Rejected git push")
+			} else {
+				log.Info().
+					Str("theme_id", string(repo.ID)).
+					Stringer("new_hash", cmd.New).
+					Msg("Accepted git push")
+			}
+			statuses[cmd.Ref] = err
+		}
+	}
+	writeReceivePackStatus(w, nil, statuses)
+}
+
+type pushError struct {
+	msg string
+}
+
+func (pe *pushError) Error() string {
+	return pe.msg
+}
+
+func newPushError(format string, args ...any) error {
+	return &pushError{msg: fmt.Sprintf(format, args...)}
+}
+
+// firstParentChain returns the commits between from (exclusive) and to (inclusive), oldest first,
+// following first parents. It fails if from isn't a first-parent ancestor of to.
+func (repo *themeRepo) firstParentChain(from, to gitproto.Hash) ([]gitproto.Hash, error) {
+	var chain []gitproto.Hash
+	for cur := to; cur != from; {
+		if len(chain) > len(repo.Store) {
+			return nil, newPushError("commit graph contains a cycle")
+		}
+		commit, err := repo.Store.GetCommit(cur)
+		if err != nil {
+			return nil, newPushError("invalid commit %s: %v", cur, err)
+		}
+		chain = append(chain, cur)
+		if len(commit.Parents) == 0 {
+			if !from.IsZero() {
+				return nil, newPushError("non-fast-forward")
+			}
+			break
+		}
+		cur = commit.Parents[0]
+	}
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+func (repo *themeRepo) readThemeFile(commitHash gitproto.Hash) (string, error) {
+	commit, err := repo.Store.GetCommit(commitHash)
+	if err != nil {
+		return "", err
+	}
+	entries, err := repo.Store.GetTree(commit.Tree)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if entry.Name == gitFileName && (entry.Mode == gitproto.ModeFile || entry.Mode == gitproto.ModeExecutable) {
+			blob, ok := repo.Store[entry.Hash]
+			if !ok || blob.Type != gitproto.ObjectBlob {
+				return "", fmt.Errorf("missing %s blob", gitFileName)
+			}
+			return string(blob.Data), nil
+		}
+	}
+	return "", newPushError("commit %s doesn't contain %s", commitHash, gitFileName)
+}
+
+// hasBreakingChangeFooter checks for a BREAKING CHANGE footer like in Conventional Commits,
+// which marks pushed versions as breaking.
+func hasBreakingChangeFooter(message string) bool {
+	for _, line := range strings.Split(message, "\n") {
+		if strings.HasPrefix(line, "BREAKING CHANGE:") || strings.HasPrefix(line, "BREAKING-CHANGE:") {
+			return true
+		}
+	}
+	return false
+}
+
+type pushPlan struct {
+	Versions   []*themeCommitParams
+	NewObjects []*gitproto.Object
+	Tip        gitproto.Hash
+}
+
+// planPush validates a push and turns every pushed commit that changes theme.css into a new version.
+func (repo *themeRepo) planPush(cmd *receivePackCommand) (*pushPlan, error) {
+	if cmd.Old != repo.Head {
+		return nil, newPushError("fetch first")
+	}
+	chain, err := repo.firstParentChain(cmd.Old, cmd.New)
+	if err != nil {
+		return nil, err
+	}
+	plan := &pushPlan{Tip: cmd.New}
+	plan.NewObjects, err = repo.Store.Reachable([]gitproto.Hash{cmd.New}, nil)
+	if err != nil {
+		return nil, newPushError("incomplete push: %v", err)
+	}
+	prevContent := ""
+	nextVersion := 1
+	if repo.Theme != nil {
+		prevContent = repo.Theme.LatestCommit.Content
+		nextVersion = repo.Theme.LatestCommit.Version + 1
+	}
+	for _, hash := range chain {
+		content, err := repo.readThemeFile(hash)
+		if err != nil {
+			return nil, err
+		} else if content == prevContent && nextVersion > 1 {
+			continue
+		}
+		commit, _ := repo.Store.GetCommit(hash)
+		message := strings.TrimSuffix(commit.Message, "\n")
+		if err = validateCommitContent(content, message); err != nil {
+			return nil, newPushError("commit %s: %v", hash, err)
+		}
+		plan.Versions = append(plan.Versions, &themeCommitParams{
+			ThemeID:  repo.ID,
+			Version:  nextVersion,
+			KeepMeta: true,
+			Name:     string(repo.ID),
+			Content:  content,
+			Message:  message,
+			GitHash:  hash.String(),
+			Breaking: hasBreakingChangeFooter(message),
+		})
+		prevContent = content
+		nextVersion++
+	}
+	if len(plan.Versions) == 0 && repo.Theme == nil {
+		return nil, newPushError("push doesn't contain %s", gitFileName)
+	} else if len(plan.Versions) > 0 {
+		// Any trailing commits that don't touch theme.css are attached to the last version
+		plan.Versions[len(plan.Versions)-1].GitHash = cmd.New.String()
+	}
+	return plan, nil
+}
+
+// applyPush saves a push using the same version and admin checks as the web editor.
+func (repo *themeRepo) applyPush(ctx context.Context, userID id.UserID, cmd *receivePackCommand) error {
+	plan, err := repo.planPush(cmd)
+	if err != nil {
+		return err
+	}
+	err = db.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, obj := range plan.NewObjects {
+			if _, alreadyStored := repo.persist[obj.Hash()]; alreadyStored {
+				continue
+			}
+			err := db.GitObject.Add(ctx, &database.GitObject{
+				ThemeID: repo.ID,
+				Hash:    obj.Hash().String(),
+				Type:    int(obj.Type),
+				Data:    obj.Data,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to store git object: %w", err)
+			}
+		}
+		for _, params := range plan.Versions {
+			if _, err := addThemeCommit(ctx, userID, params); err != nil {
+				return err
+			}
+		}
+		if len(plan.Versions) == 0 {
+			return db.Commit.SetGitHash(ctx, repo.ID, repo.Theme.LatestCommit.Version, plan.Tip.String())
+		}
+		return nil
+	})
+	if errors.Is(err, errNotAdmin) || errors.Is(err, errInvalidVersion) || errors.Is(err, errThemeNotFound) ||
+		errors.Is(err, errThemeFrozen) || errors.Is(err, errServerBlocked) || errors.Is(err, errUserBanned) {
+		return newPushError("%v", err)
+	} else if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save pushed commits")
+		return newPushError("internal error")
+	}
+	versions := make([]int, len(plan.Versions))
+	for i, params := range plan.Versions {
+		countCommit("git", params.Version)
+		versions[i] = params.Version
+	}
+	announceCommits(ctx, repo.ID, versions...)
+	return nil
+}
@@ -0,0 +1,119 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// upgradeDone is set once db.Upgrade has finished at startup.
+	upgradeDone atomic.Bool
+	// shuttingDown is set when a shutdown signal is received, so that load balancers
+	// stop sending new requests during the shutdown grace period.
+	shuttingDown atomic.Bool
+)
+
+type ReadinessCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Ready      bool                       `json:"ready"`
+	Components map[string]*ReadinessCheck `json:"components"`
+}
+
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	writeAPIJSON(w, http.StatusOK, map[string]bool{"alive": true})
+}
+
+func checkReadiness(ctx context.Context) *ReadinessResponse {
+	resp := &ReadinessResponse{Ready: true, Components: make(map[string]*ReadinessCheck)}
+	set := func(name string, err error) {
+		if err != nil {
+			resp.Ready = false
+			resp.Components[name] = &ReadinessCheck{Error: err.Error()}
+		} else {
+			resp.Components[name] = &ReadinessCheck{OK: true}
+		}
+	}
+	if shuttingDown.Load() {
+		set("shutdown", fmt.Errorf("server is shutting down"))
+	} else {
+		set("shutdown", nil)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := db.RawDB.PingContext(ctx); err != nil {
+		set("database", err)
+		// The other checks need the database
+		return resp
+	}
+	set("database", nil)
+	if !upgradeDone.Load() {
+		set("upgrade", fmt.Errorf("database upgrade hasn't completed"))
+	} else {
+		set("upgrade", nil)
+	}
+	if current, latest, err := db.SchemaVersion(ctx); err != nil {
+		set("schema", fmt.Errorf("failed to get schema version: %w", err))
+	} else if current != latest {
+		set("schema", fmt.Errorf("schema version is %d, expected %d", current, latest))
+	} else {
+		set("schema", nil)
+	}
+	return resp
+}
+
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := checkReadiness(r.Context())
+	status := http.StatusOK
+	if !resp.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeAPIJSON(w, status, resp)
+}
+
+// upgradeGateMiddleware returns 503 for everything except the health probes until the database upgrade
+// at startup has completed, so that handlers never run against an old schema.
+func upgradeGateMiddleware(mux *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if upgradeDone.Load() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			_, pattern := mux.Handler(r)
+			if pattern == "GET /healthz" || pattern == "GET /readyz" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Retry-After", "10")
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				writeAPIError(w, http.StatusServiceUnavailable, "starting", "the server is starting up, try again later")
+			} else {
+				http.Error(w, "The server is starting up, please try again later", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
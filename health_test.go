@@ -0,0 +1,59 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpgradeGateMiddleware(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", noop)
+	mux.HandleFunc("GET /readyz", noop)
+	mux.HandleFunc("GET /theme/{themeID}", noop)
+	mux.HandleFunc("POST /theme/commit", noop)
+	mux.HandleFunc("GET "+apiPrefix+"/themes", noop)
+	handler := upgradeGateMiddleware(mux)(mux)
+	tests := []struct {
+		method   string
+		path     string
+		upgraded bool
+		status   int
+	}{
+		{http.MethodGet, "/healthz", false, http.StatusOK},
+		{http.MethodGet, "/readyz", false, http.StatusOK},
+		{http.MethodGet, "/theme/meowtheme", false, http.StatusServiceUnavailable},
+		{http.MethodPost, "/theme/commit", false, http.StatusServiceUnavailable},
+		{http.MethodGet, apiPrefix + "/themes", false, http.StatusServiceUnavailable},
+		{http.MethodGet, "/theme/meowtheme", true, http.StatusOK},
+		{http.MethodPost, "/theme/commit", true, http.StatusOK},
+	}
+	defer upgradeDone.Store(false)
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			upgradeDone.Store(test.upgraded)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
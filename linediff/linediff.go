@@ -0,0 +1,181 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package linediff implements line-based diffs of theme CSS.
+package linediff
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const Context = 3
+
+type Op struct {
+	Kind byte // ' ', '-' or '+'
+	Line string
+}
+
+// SplitLines splits text into lines that keep their trailing newline, so a missing
+// newline at the end of the file shows up in the diff.
+func SplitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Lines computes a shortest edit script from a to b with the Myers algorithm.
+func Lines(a, b []string) []Op {
+	n, m := len(a), len(b)
+	maxD := n + m
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace [][]int
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, offset, d)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrack(a, b []string, trace [][]int, offset, d int) []Op {
+	x, y := len(a), len(b)
+	ops := make([]Op, 0, x+y)
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, Op{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, Op{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, Op{'-', a[x]})
+		}
+	}
+	for x > 0 {
+		x--
+		ops = append(ops, Op{' ', a[x]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// WriteUnified writes the difference between a and b in the unified diff format.
+func WriteUnified(w io.Writer, nameA, nameB string, a, b []string) {
+	ops := Lines(a, b)
+	wroteHeader := false
+	for start := 0; start < len(ops); {
+		// Find the next change
+		for start < len(ops) && ops[start].Kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		hunkStart := max(start-Context, 0)
+		// Extend the hunk until there are more than 2*context unchanged lines in a row
+		end := start
+		for unchanged := 0; end < len(ops) && unchanged <= 2*Context; end++ {
+			if ops[end].Kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		hunkEnd := end
+		for hunkEnd > start && ops[hunkEnd-1].Kind == ' ' {
+			hunkEnd--
+		}
+		hunkEnd = min(hunkEnd+Context, len(ops))
+		if !wroteHeader {
+			_, _ = fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+			wroteHeader = true
+		}
+		lineA, lineB := 1, 1
+		for _, op := range ops[:hunkStart] {
+			if op.Kind != '+' {
+				lineA++
+			}
+			if op.Kind != '-' {
+				lineB++
+			}
+		}
+		var countA, countB int
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.Kind != '+' {
+				countA++
+			}
+			if op.Kind != '-' {
+				countB++
+			}
+		}
+		_, _ = fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+		for _, op := range ops[hunkStart:hunkEnd] {
+			_, _ = fmt.Fprintf(w, "%c%s", op.Kind, op.Line)
+			if !strings.HasSuffix(op.Line, "\n") {
+				_, _ = fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		start = hunkEnd
+	}
+}
+
+// Stat returns the number of added and removed lines between two versions of a file.
+func Stat(a, b string) (added, removed int) {
+	for _, op := range Lines(SplitLines(a), SplitLines(b)) {
+		switch op.Kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	return
+}
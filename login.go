@@ -18,88 +18,321 @@ package main
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/binary"
+	"errors"
+	"fmt"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/federation"
 	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
 )
 
 var fc = federation.NewClient("", nil)
-var tokenSecret = os.Getenv("TOKEN_SECRET")
 
 const CookieLifetime = 24 * time.Hour
 
-func init() {
-	if tokenSecret == "" {
-		panic("TOKEN_SECRET env var is required")
-	}
+const sessionIDLength = 32
+
+// makeToken signs the session ID, user ID and expiry into a cookie value using the active key.
+// The session must also exist in the database for the token to be accepted, which allows revoking it
+// before it expires.
+func makeToken(sessionID string, userID id.UserID, expiry time.Time) string {
+	return signToken(tokenPurposeLogin, expiry, []byte(sessionID+string(userID)))
 }
 
-func makeToken(userID id.UserID, expiry time.Time) string {
-	expiryTS := expiry.Unix()
-	tokenData := make([]byte, 8+len(userID), 8+len(userID)+32)
-	binary.BigEndian.PutUint64(tokenData, uint64(expiryTS))
-	copy(tokenData[8:], userID)
-	hasher := hmac.New(sha256.New, []byte(tokenSecret))
-	hasher.Write(tokenData)
-	return base64.RawURLEncoding.EncodeToString(hasher.Sum(tokenData))
+type tokenInfo struct {
+	KeyID     string
+	SessionID string
+	UserID    id.UserID
 }
 
-func verifyToken(token string) id.UserID {
-	data, err := base64.RawURLEncoding.DecodeString(token)
-	if err != nil || len(data) <= 40 {
-		return ""
+// verifyToken checks the signature and expiry of a login cookie. It returns nil if the token is invalid,
+// expired or signed with a key that is no longer in the key ring.
+func verifyToken(token string) *tokenInfo {
+	signed := verifySignedToken(tokenPurposeLogin, token)
+	if signed == nil || len(signed.Payload) <= sessionIDLength {
+		return nil
 	}
-	hasher := hmac.New(sha256.New, []byte(tokenSecret))
-	hasher.Write(data[:len(data)-32])
-	if !hmac.Equal(data[len(data)-32:], hasher.Sum(nil)) {
-		return ""
+	return &tokenInfo{
+		KeyID:     signed.KeyID,
+		SessionID: string(signed.Payload[:sessionIDLength]),
+		UserID:    id.UserID(signed.Payload[sessionIDLength:]),
 	}
-	expiryTS := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
-	if time.Now().After(expiryTS) {
-		return ""
+}
+
+// sessionLastSeenInterval limits how often requests update the last seen time of a session.
+const sessionLastSeenInterval = 5 * time.Minute
+
+// getSession returns the session of the login cookie, or nil if there's no valid session.
+func getSession(r *http.Request) *database.Session {
+	cache, ok := r.Context().Value(sessionCacheKey{}).(*sessionCache)
+	if !ok {
+		return loadSession(r)
+	} else if !cache.loaded {
+		cache.session = loadSession(r)
+		cache.loaded = true
 	}
-	return id.UserID(data[8 : len(data)-32])
+	return cache.session
 }
 
-func verifyCookie(r *http.Request) id.UserID {
+func loadSession(r *http.Request) *database.Session {
 	cookie, err := r.Cookie(cookieName)
 	if cookie == nil || err != nil {
-		return ""
+		return nil
+	}
+	token := verifyToken(cookie.Value)
+	if token == nil {
+		return nil
 	}
-	return verifyToken(cookie.Value)
+	log := hlog.FromRequest(r)
+	session, err := db.Session.Get(r.Context(), token.SessionID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get session")
+		return nil
+	} else if session == nil || session.UserID != token.UserID || session.KeyID != token.KeyID {
+		return nil
+	}
+	if time.Since(session.LastSeenAt) > sessionLastSeenInterval {
+		session.LastSeenAt = time.Now()
+		if err = db.Session.UpdateLastSeen(r.Context(), session.ID, session.LastSeenAt); err != nil {
+			log.Err(err).Msg("Failed to update session last seen time")
+		}
+	}
+	return session
+}
+
+func verifyCookie(r *http.Request) id.UserID {
+	if session := getSession(r); session != nil {
+		return session.UserID
+	}
+	return ""
 }
 
 const cookieName = "gomuks-css-auth"
 
+type LoginPageData struct {
+	User  id.UserID
+	Error string
+	Next  string
+}
+
+func sendLoginPage(w http.ResponseWriter, r *http.Request, status int, data *LoginPageData) {
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, status, &ContainerData{
+		PageTitle: "log in",
+		Page:      "login.gohtml",
+		Data:      data,
+	})
+}
+
+// describeLoginError turns a failed OpenID token check into something the user can act on.
+func describeLoginError(serverName string, err error) string {
+	var httpErr mautrix.HTTPError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Sprintf("%s didn't respond in time.", serverName)
+	case errors.Is(err, mautrix.MUnknownToken):
+		return fmt.Sprintf("%s didn't recognize the login token. It may have expired or already been used.", serverName)
+	case errors.As(err, &httpErr) && httpErr.RespError != nil:
+		return fmt.Sprintf("%s rejected the login token: %s (%s)", serverName, httpErr.RespError.Err, httpErr.RespError.ErrCode)
+	case errors.As(err, &httpErr) && httpErr.Response != nil && httpErr.Response.StatusCode >= 400:
+		return fmt.Sprintf("%s rejected the login token with HTTP %d.", serverName, httpErr.Response.StatusCode)
+	default:
+		return fmt.Sprintf("Failed to verify the login token with %s: %v", serverName, err)
+	}
+}
+
 func handleRemoteLogin(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	log := hlog.FromRequest(r)
+	next := getNext(r)
+	serverName, openIDToken := q.Get("server_name"), q.Get("token")
+	if serverName == "" && openIDToken == "" {
+		userID := verifyCookie(r)
+		if userID != "" && next != "" {
+			clearNextCookie(w)
+			w.Header().Set("Location", next)
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		} else if signedNext := q.Get("next"); verifyNext(signedNext) != "" {
+			setNextCookie(w, signedNext)
+		}
+		sendLoginPage(w, r, http.StatusOK, &LoginPageData{User: userID, Next: next})
+		return
+	} else if serverName == "" || openIDToken == "" {
+		sendLoginPage(w, r, http.StatusBadRequest, &LoginPageData{
+			Error: "The login link is incomplete, it must include both the server name and the OpenID token.",
+			Next:  next,
+		})
+		return
+	}
 	timeoutCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
-	resp, err := fc.GetOpenIDUserInfo(timeoutCtx, q.Get("server_name"), q.Get("token"))
+	resp, err := fc.GetOpenIDUserInfo(timeoutCtx, serverName, openIDToken)
 	cancel()
 	if err != nil {
-		log.Err(err).Msg("Failed to get OpenID user info")
-		w.WriteHeader(http.StatusUnauthorized)
+		loginAttempts.WithLabelValues("failure").Inc()
+		log.Err(err).Str("server_name", serverName).Msg("Failed to get OpenID user info")
+		sendLoginPage(w, r, http.StatusUnauthorized, &LoginPageData{
+			Error: describeLoginError(serverName, err),
+			Next:  next,
+		})
+		return
+	} else if resp.Sub.Homeserver() != serverName {
+		loginAttempts.WithLabelValues("failure").Inc()
+		log.Warn().Str("server_name", serverName).Stringer("user_id", resp.Sub).Msg("OpenID user info returned user on another server")
+		sendLoginPage(w, r, http.StatusUnauthorized, &LoginPageData{
+			Error: fmt.Sprintf("%s vouched for %s, which isn't a user on that server.", serverName, resp.Sub),
+			Next:  next,
+		})
+		return
+	} else if !cfg.ServerACL.IsAllowed(serverName) {
+		loginAttempts.WithLabelValues("blocked").Inc()
+		log.Debug().Stringer("user_id", resp.Sub).Msg("Rejecting login from blocked server")
+		sendLoginPage(w, r, http.StatusForbidden, &LoginPageData{
+			Error: fmt.Sprintf("Users on %s aren't allowed to log in to this site.", serverName),
+			Next:  next,
+		})
+		return
+	}
+	now := time.Now()
+	session := &database.Session{
+		ID:         random.String(sessionIDLength),
+		UserID:     resp.Sub,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(CookieLifetime),
+		LastSeenAt: now,
+		UserAgent:  r.UserAgent(),
+		KeyID:      cfg.ActiveTokenKey,
+	}
+	if err = db.Session.DeleteExpired(r.Context()); err != nil {
+		log.Warn().Err(err).Msg("Failed to delete expired sessions")
+	}
+	err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		if err := db.Session.Create(ctx, session); err != nil {
+			return err
+		}
+		return recordAudit(ctx, &database.AuditEntry{
+			Actor:  string(session.UserID),
+			Action: database.AuditLogin,
+			After:  auditJSON(map[string]any{"user_agent": session.UserAgent, "server_name": serverName}),
+		})
+	})
+	if err != nil {
+		loginAttempts.WithLabelValues("error").Inc()
+		log.Err(err).Msg("Failed to create session")
+		w.WriteHeader(http.StatusInternalServerError)
 		// TODO write body
 		return
 	}
-	cookieExpiry := time.Now().Add(CookieLifetime)
+	loginAttempts.WithLabelValues("success").Inc()
+	cookieExpiry := session.ExpiresAt
 	http.SetCookie(w, &http.Cookie{
 		Name:     cookieName,
-		Value:    makeToken(resp.Sub, cookieExpiry),
+		Value:    makeToken(session.ID, resp.Sub, cookieExpiry),
 		Expires:  cookieExpiry,
 		Secure:   true,
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 	})
+	if next == "" {
+		next = "/"
+	}
+	clearNextCookie(w)
+	w.Header().Set("Location", next)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func postLogout(w http.ResponseWriter, r *http.Request) {
+	if session := getSession(r); session != nil {
+		if err := db.Session.Delete(r.Context(), session.UserID, session.ID); err != nil {
+			hlog.FromRequest(r).Err(err).Msg("Failed to delete session")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    "",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
 	w.Header().Set("Location", "/")
 	w.WriteHeader(http.StatusSeeOther)
 }
+
+type SessionsPageData struct {
+	CSRFData
+	Sessions  []*database.Session
+	CurrentID string
+}
+
+func getSessionsPage(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if session == nil {
+		redirectToLogin(w, r)
+		return
+	}
+	sendSessionsPage(w, r, session)
+}
+
+func postSessionsPage(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if session == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		// TODO write body
+		return
+	}
+	var err error
+	switch r.PostFormValue("action") {
+	case "revoke":
+		err = db.Session.Delete(r.Context(), session.UserID, r.PostFormValue("session_id"))
+	case "revoke_others":
+		var sessions []*database.Session
+		sessions, err = db.Session.GetByUser(r.Context(), session.UserID)
+		for _, other := range sessions {
+			if err == nil && other.ID != session.ID {
+				err = db.Session.Delete(r.Context(), session.UserID, other.ID)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		// TODO write body
+		return
+	}
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to revoke session")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	if r.PostFormValue("session_id") == session.ID {
+		// Revoking the current session is the same as logging out
+		postLogout(w, r)
+		return
+	}
+	sendSessionsPage(w, r, session)
+}
+
+func sendSessionsPage(w http.ResponseWriter, r *http.Request, session *database.Session) {
+	sessions, err := db.Session.GetByUser(r.Context(), session.UserID)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get sessions")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, http.StatusOK, &ContainerData{
+		PageTitle: "sessions",
+		Page:      "sessions.gohtml",
+		Data:      &SessionsPageData{Sessions: sessions, CurrentID: session.ID},
+	})
+}
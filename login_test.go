@@ -0,0 +1,158 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func setTokenKeys(t *testing.T, active string, keys ...TokenKey) {
+	t.Helper()
+	cfg = defaultConfig()
+	cfg.TokenKeys = keys
+	cfg.ActiveTokenKey = active
+	if err := cfg.validateTokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	oldKey := TokenKey{ID: "2024-01", Secret: "old secret"}
+	newKey := TokenKey{ID: "2025-01", Secret: "new secret"}
+	sessionID := strings.Repeat("s", sessionIDLength)
+	const userID id.UserID = "@meow:example.com"
+	tamper := func(token string, fn func(data []byte)) string {
+		data, _ := base64.RawURLEncoding.DecodeString(token)
+		fn(data)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	tests := []struct {
+		name string
+		// signKeys and signActive are the key ring when the token is made, verifyKeys when it's verified
+		signActive string
+		signKeys   []TokenKey
+		verifyKeys []TokenKey
+		expiry     time.Duration
+		modify     func(token string) string
+		valid      bool
+	}{
+		{name: "valid", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey}, expiry: time.Hour, valid: true},
+		{name: "expired", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey}, expiry: -time.Second},
+		{name: "unknown key ID", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{newKey}, expiry: time.Hour},
+		{name: "retired key after rotation", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{newKey, oldKey}, expiry: time.Hour, valid: true},
+		{name: "active key after rotation", signActive: newKey.ID, signKeys: []TokenKey{newKey, oldKey}, verifyKeys: []TokenKey{newKey, oldKey}, expiry: time.Hour, valid: true},
+		{name: "removed key after rotation", signActive: oldKey.ID, signKeys: []TokenKey{newKey, oldKey}, verifyKeys: []TokenKey{newKey}, expiry: time.Hour},
+		{name: "same key ID with different secret", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{{ID: oldKey.ID, Secret: "other"}}, expiry: time.Hour},
+		{
+			name: "modified user ID", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey}, expiry: time.Hour,
+			modify: func(token string) string {
+				return tamper(token, func(data []byte) { data[len(data)-33] = 'x' })
+			},
+		},
+		{
+			name: "modified key ID", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey, {ID: "2024-02", Secret: "old secret"}}, expiry: time.Hour,
+			modify: func(token string) string {
+				return tamper(token, func(data []byte) { data[7] = '2' })
+			},
+		},
+		{
+			name: "key ID length past the end", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey}, expiry: time.Hour,
+			modify: func(token string) string {
+				return tamper(token, func(data []byte) { data[0] = 0xff })
+			},
+		},
+		{
+			name: "truncated", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey}, expiry: time.Hour,
+			modify: func(token string) string { return token[:20] },
+		},
+		{
+			name: "not base64", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey}, expiry: time.Hour,
+			modify: func(token string) string { return "!" + token },
+		},
+		{
+			name: "empty", signActive: oldKey.ID, signKeys: []TokenKey{oldKey}, verifyKeys: []TokenKey{oldKey}, expiry: time.Hour,
+			modify: func(token string) string { return "" },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTokenKeys(t, test.signActive, test.signKeys...)
+			token := makeToken(sessionID, userID, time.Now().Add(test.expiry))
+			if test.modify != nil {
+				token = test.modify(token)
+			}
+			setTokenKeys(t, test.verifyKeys[0].ID, test.verifyKeys...)
+			info := verifyToken(token)
+			if !test.valid {
+				if info != nil {
+					t.Errorf("expected token to be rejected, got %+v", info)
+				}
+				return
+			} else if info == nil {
+				t.Fatal("expected token to be accepted")
+			}
+			if info.KeyID != test.signActive || info.SessionID != sessionID || info.UserID != userID {
+				t.Errorf("got %+v", info)
+			}
+		})
+	}
+}
+
+func TestValidateTokenKeys(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		keys       []TokenKey
+		active     string
+		wantActive string
+		err        string
+	}{
+		{name: "legacy secret", secret: "meow", wantActive: legacyTokenKeyID},
+		{name: "single key", keys: []TokenKey{{ID: "a", Secret: "1"}}, wantActive: "a"},
+		{name: "legacy secret and key", secret: "meow", keys: []TokenKey{{ID: "a", Secret: "1"}}, active: "a", wantActive: "a"},
+		{name: "no keys", err: "required"},
+		{name: "multiple keys without active", keys: []TokenKey{{ID: "a", Secret: "1"}, {ID: "b", Secret: "2"}}, err: "active_token_key: required"},
+		{name: "unknown active key", keys: []TokenKey{{ID: "a", Secret: "1"}}, active: "b", err: `key "b" not found`},
+		{name: "duplicate key ID", keys: []TokenKey{{ID: "a", Secret: "1"}, {ID: "a", Secret: "2"}}, active: "a", err: "duplicate key ID"},
+		{name: "duplicate legacy key ID", secret: "meow", keys: []TokenKey{{ID: legacyTokenKeyID, Secret: "2"}}, active: legacyTokenKeyID, err: "duplicate key ID"},
+		{name: "missing secret", keys: []TokenKey{{ID: "a"}}, active: "a", err: "secret: required"},
+		{name: "too long key ID", keys: []TokenKey{{ID: strings.Repeat("a", 256), Secret: "1"}}, err: "between 1 and 255 bytes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg = defaultConfig()
+			cfg.TokenSecret = test.secret
+			cfg.TokenKeys = test.keys
+			cfg.ActiveTokenKey = test.active
+			err := cfg.validateTokenKeys()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if cfg.ActiveTokenKey != test.wantActive {
+				t.Errorf("got active key %q, want %q", cfg.ActiveTokenKey, test.wantActive)
+			}
+		})
+	}
+}
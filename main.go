@@ -19,6 +19,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
@@ -28,88 +29,187 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"go.mau.fi/util/exerrors"
 	"go.mau.fi/util/exhttp"
 	"go.mau.fi/util/exzerolog"
-	"go.mau.fi/util/ptr"
 	"go.mau.fi/util/requestlog"
 	"go.mau.fi/zeroconfig"
 
 	"css.gomuks.app/database"
 )
 
+var configPath = flag.String("config", "config.yaml", "Path to the config file")
+
 func init() {
-	if _, hasPort := os.LookupEnv("PORT"); !hasPort {
-		exerrors.PanicIfNotNil(os.Setenv("PORT", "8080"))
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config path] [command]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		_, _ = fmt.Fprintln(flag.CommandLine.Output(), "\nWithout a command, the web server is started.")
+		printCLIUsage(flag.CommandLine.Output())
 	}
 }
 
+var cfg *Config
 var defLog *zerolog.Logger
 var db *database.Database
 
 func main() {
-	defLog = exerrors.Must((&zeroconfig.Config{
-		Writers: []zeroconfig.WriterConfig{{
-			Type:     zeroconfig.WriterTypeStdout,
-			Format:   zeroconfig.LogFormatPrettyColored,
-			MinLevel: ptr.Ptr(zerolog.InfoLevel),
-		}, {
-			Type:   zeroconfig.WriterTypeFile,
-			Format: zeroconfig.LogFormatJSON,
-			FileConfig: zeroconfig.FileConfig{
-				Filename:   "/var/log/gomuks-css.log",
-				MaxSize:    100 * 1024,
-				MaxAge:     7,
-				MaxBackups: 10,
-			},
-		}},
-		MinLevel: ptr.Ptr(zerolog.TraceLevel),
-	}).Compile())
+	flag.Parse()
+	var err error
+	cfg, err = loadConfig(*configPath, isFlagSet("config"))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(10)
+	}
+	isCLI := flag.NArg() > 0
+	if isCLI {
+		// Keep stdout clean for command output
+		for i, writer := range cfg.Logging.Writers {
+			if writer.Type == zeroconfig.WriterTypeStdout {
+				cfg.Logging.Writers[i].Type = zeroconfig.WriterTypeStderr
+			}
+		}
+	}
+	defLog, err = cfg.Logging.Compile()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to initialize logger:", err)
+		os.Exit(11)
+	}
 	exzerolog.SetupDefaults(defLog)
-	db = exerrors.Must(database.New(os.Getenv("DATABASE_URL"), defLog.With().Str("component", "database").Logger()))
+	db = exerrors.Must(database.New(cfg.Database, newDBLogger(defLog.With().Str("component", "database").Logger())))
+	if isCLI {
+		ctx := defLog.WithContext(context.Background())
+		exerrors.PanicIfNotNil(db.Upgrade(ctx))
+		os.Exit(runCLI(ctx, flag.Args()))
+	}
+	if cfg.Matrix.Enabled() {
+		exerrors.PanicIfNotNil(initMatrixBot())
+	}
 
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", getHealthz)
+	mux.HandleFunc("GET /readyz", getReadyz)
 	mux.HandleFunc("GET /{$}", getIndexPage)
+	mux.HandleFunc("GET /themes.atom", getThemesFeed)
 	mux.HandleFunc("GET /user/{userID}", getUserPage)
 	mux.HandleFunc("GET /theme/{themeID}", getThemePage)
 	mux.HandleFunc("GET /theme/{themeID}/commit/{version}", getThemePage)
 	mux.HandleFunc("GET /theme/{themeID}/commits", getThemeHistoryPage)
+	mux.HandleFunc("GET /theme/{themeID}/commits.atom", getThemeFeed)
 	mux.HandleFunc("GET /theme/{themeID}/edit", getThemeEditPage)
+	mux.HandleFunc("GET /theme/{themeID}/audit", getThemeAuditLogPage)
+	mux.HandleFunc("GET /theme/{themeID}/releases", getReleasesPage)
+	mux.HandleFunc("POST /theme/{themeID}/releases", postReleasesPage)
+	mux.HandleFunc("GET /theme/{themeID}/drafts", getDraftsPage)
+	mux.HandleFunc("POST /theme/{themeID}/drafts", postDraftsPage)
+	mux.HandleFunc("GET /theme/{themeID}/webhooks", getWebhooksPage)
+	mux.HandleFunc("POST /theme/{themeID}/webhooks", postWebhooksPage)
+	mux.HandleFunc("GET /theme/{themeID}/info/refs", getGitInfoRefs)
+	mux.HandleFunc("POST /theme/{themeID}/git-upload-pack", postGitUploadPack)
+	mux.HandleFunc("POST /theme/{themeID}/git-receive-pack", postGitReceivePack)
 	mux.HandleFunc("GET /theme/new", getThemeEditPage)
 	mux.HandleFunc("POST /theme/commit", postThemeEditPage)
 	mux.HandleFunc("GET /image/{imageID}", getImage)
+	mux.HandleFunc("GET /draft/{token}", getDraftPreview)
 	mux.HandleFunc("GET /login", handleRemoteLogin)
+	mux.HandleFunc("POST /logout", postLogout)
+	mux.HandleFunc("GET /sessions", getSessionsPage)
+	mux.HandleFunc("POST /sessions", postSessionsPage)
+	registerAPIRoutes(mux)
+	mux.HandleFunc("GET /moderation", getModerationPage)
+	mux.HandleFunc("POST /moderation/theme/{themeID}", postModerateTheme)
+	mux.HandleFunc("POST /moderation/user/{userID}", postModerateUser)
+	mux.HandleFunc("GET /moderation/reports", getReportQueuePage)
+	mux.HandleFunc("POST /moderation/reports/{reportID}", postReportAction)
+	mux.HandleFunc("GET /moderation/audit", getAuditLogPage)
+	mux.HandleFunc("GET /theme/{themeID}/report", getReportPage)
+	mux.HandleFunc("POST /theme/{themeID}/report", postReport)
+	mux.HandleFunc("GET /tokens", getAPITokensPage)
+	mux.HandleFunc("POST /tokens", postAPITokensPage)
+	if cfg.MetricsAddress == "" {
+		mux.Handle("GET /metrics", promhttp.Handler())
+	}
 	mux.Handle("/static/", http.FileServer(http.FS(StaticFS)))
 
 	server := http.Server{
-		Addr: fmt.Sprintf("%s:%s", os.Getenv("HOST"), os.Getenv("PORT")),
+		Addr: cfg.ListenAddress,
 		Handler: exhttp.ApplyMiddleware(
 			mux,
 			hlog.NewHandler(*defLog),
 			requestlog.AccessLogger(true),
+			httpMetricsMiddleware(mux),
+			upgradeGateMiddleware(mux),
+			sessionCacheMiddleware,
+			newRateLimiter(mux).Middleware,
+			csrfMiddleware,
 		),
 	}
 
 	ctx := defLog.WithContext(context.Background())
-	exerrors.PanicIfNotNil(db.Upgrade(ctx))
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	// Upgrade in the background so that /healthz responds during long upgrades. /readyz and every other
+	// route return 503 until it's done.
+	go func() {
+		if err := db.Upgrade(ctx); err != nil {
+			defLog.Err(err).Msg("Failed to upgrade database")
+			os.Exit(12)
+		}
+		upgradeDone.Store(true)
+		defLog.Info().Msg("Database upgrade complete")
+		go runWebhookWorker(workerCtx)
+	}()
+
+	var metricsServer *http.Server
+	if cfg.MetricsAddress != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", promhttp.Handler())
+		metricsServer = &http.Server{Addr: cfg.MetricsAddress, Handler: metricsMux}
+		go func() {
+			defLog.Info().Str("listen_address", metricsServer.Addr).Msg("Starting metrics server")
+			err := metricsServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic(err)
+			}
+		}()
+	}
 
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
+		shuttingDown.Store(true)
+		if cfg.ShutdownGrace > 0 {
+			defLog.Info().Dur("grace_period", cfg.ShutdownGrace).Msg("Shutting down after grace period")
+			time.Sleep(cfg.ShutdownGrace)
+		}
+		stopWorkers()
 		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 		exerrors.PanicIfNotNil(server.Shutdown(ctx))
+		if metricsServer != nil {
+			exerrors.PanicIfNotNil(metricsServer.Shutdown(ctx))
+		}
 		cancel()
 	}()
 	defLog.Info().Str("listen_address", server.Addr).Msg("Starting server")
-	err := server.ListenAndServe()
+	err = server.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
 }
 
+func isFlagSet(name string) (found bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return
+}
+
 func getImage(w http.ResponseWriter, r *http.Request) {
 	imageID, err := uuid.Parse(r.PathValue("imageID"))
 	if err != nil {
@@ -0,0 +1,191 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+// matrixBot is the client used to announce new versions. It's nil if the bot isn't configured.
+var matrixBot *mautrix.Client
+
+const matrixAnnounceTimeout = 2 * time.Minute
+
+func initMatrixBot() error {
+	cli, err := mautrix.NewClient(cfg.Matrix.HomeserverURL, "", cfg.Matrix.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to create Matrix client: %w", err)
+	}
+	cli.Log = defLog.With().Str("component", "matrix").Logger()
+	cli.UserAgent = "css.gomuks.app " + mautrix.DefaultUserAgent
+	cli.DefaultHTTPRetries = 4
+	matrixBot = cli
+	return nil
+}
+
+// joinMatrixRoom makes the bot join the given room ID or alias on behalf of the given user and returns the room ID.
+// The bot can join public rooms and rooms it has been invited to, but only stays if the user is in the room
+// with at least the power level needed to change its state, so that it can't be used to post in other rooms.
+func joinMatrixRoom(ctx context.Context, roomIDOrAlias string, linkedBy id.UserID) (id.RoomID, error) {
+	var roomID id.RoomID
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		resp, err := matrixBot.ResolveAlias(ctx, id.RoomAlias(roomIDOrAlias))
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve room alias: %w", err)
+		}
+		roomID = resp.RoomID
+	} else if strings.HasPrefix(roomIDOrAlias, "!") {
+		roomID = id.RoomID(roomIDOrAlias)
+	} else {
+		return "", fmt.Errorf("enter a room ID (!...) or alias (#...)")
+	}
+	joinedRooms, err := matrixBot.JoinedRooms(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get joined rooms: %w", err)
+	}
+	alreadyJoined := slices.Contains(joinedRooms.JoinedRooms, roomID)
+	if !alreadyJoined {
+		// Join with the alias if there is one, as it lets the homeserver find other servers in the room
+		if _, err = matrixBot.JoinRoom(ctx, roomIDOrAlias, nil); err != nil {
+			return "", fmt.Errorf("the bot couldn't join the room, make sure it's invited: %w", err)
+		}
+	}
+	if err = checkMatrixRoomPermission(ctx, roomID, linkedBy); err != nil {
+		// Don't leave rooms that were already linked to other themes
+		if !alreadyJoined {
+			if _, leaveErr := matrixBot.LeaveRoom(ctx, roomID); leaveErr != nil {
+				zerolog.Ctx(ctx).Err(leaveErr).Stringer("room_id", roomID).Msg("Failed to leave room after rejecting link")
+			}
+		}
+		return "", err
+	}
+	return roomID, nil
+}
+
+var errMatrixRoomPermission = errors.New("you must be in the room with permission to change room settings to link it")
+
+func checkMatrixRoomPermission(ctx context.Context, roomID id.RoomID, userID id.UserID) error {
+	var member event.MemberEventContent
+	err := matrixBot.StateEvent(ctx, roomID, event.StateMember, userID.String(), &member)
+	if errors.Is(err, mautrix.MNotFound) || (err == nil && member.Membership != event.MembershipJoin) {
+		return errMatrixRoomPermission
+	} else if err != nil {
+		return fmt.Errorf("failed to get your membership in the room: %w", err)
+	}
+	var powerLevels event.PowerLevelsEventContent
+	if err = matrixBot.StateEvent(ctx, roomID, event.StatePowerLevels, "", &powerLevels); err != nil {
+		return fmt.Errorf("failed to get room power levels: %w", err)
+	} else if powerLevels.GetUserLevel(userID) < powerLevels.StateDefault() {
+		return errMatrixRoomPermission
+	}
+	return nil
+}
+
+// announceCommits posts new versions to the Matrix room linked to the theme, if there is one.
+// It's called after the versions have been saved and sends the announcements in order in the background.
+func announceCommits(ctx context.Context, themeID database.ThemeID, versions ...int) {
+	if matrixBot == nil || len(versions) == 0 {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "matrix").
+		Str("theme_id", string(themeID)).
+		Logger()
+	go func() {
+		ctx, cancel := context.WithTimeout(log.WithContext(context.Background()), matrixAnnounceTimeout)
+		defer cancel()
+		for _, version := range versions {
+			if err := sendCommitAnnouncement(ctx, themeID, version); err != nil {
+				log.Err(err).Int("version", version).Msg("Failed to announce new version")
+			}
+		}
+	}()
+}
+
+func sendCommitAnnouncement(ctx context.Context, themeID database.ThemeID, version int) error {
+	room, err := db.MatrixRoom.Get(ctx, themeID)
+	if err != nil {
+		return fmt.Errorf("failed to get linked room: %w", err)
+	} else if room == nil {
+		return nil
+	}
+	theme, err := db.Theme.Get(ctx, themeID)
+	if err != nil {
+		return fmt.Errorf("failed to get theme: %w", err)
+	} else if theme == nil || theme.Hidden {
+		return nil
+	}
+	commit, err := db.Commit.Get(ctx, themeID, version)
+	if err != nil {
+		return fmt.Errorf("failed to get commit: %w", err)
+	} else if commit == nil {
+		return fmt.Errorf("commit v%d not found", version)
+	}
+	var prev *database.Commit
+	if version > 1 {
+		if prev, err = db.Commit.Get(ctx, themeID, version-1); err != nil {
+			return fmt.Errorf("failed to get previous commit: %w", err)
+		}
+	}
+	return postCommitAnnouncement(ctx, room.RoomID, theme, commit, prev)
+}
+
+func postCommitAnnouncement(ctx context.Context, roomID id.RoomID, theme *database.Theme, commit, prev *database.Commit) error {
+	// The transaction ID makes retries idempotent. The creation time is included so that
+	// a deleted and recreated theme with the same ID doesn't reuse transaction IDs.
+	txnID := fmt.Sprintf("gcss-%s-%d-%d", theme.ID, commit.Version, commit.CreatedAt.UnixMilli())
+	_, err := matrixBot.SendMessageEvent(ctx, roomID, event.EventMessage, formatCommitAnnouncement(theme, commit, prev), mautrix.ReqSendEvent{
+		TransactionID: txnID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send message to %s: %w", roomID, err)
+	}
+	zerolog.Ctx(ctx).Debug().Stringer("room_id", roomID).Int("version", commit.Version).Msg("Announced new version")
+	return nil
+}
+
+func formatCommitAnnouncement(theme *database.Theme, commit, prev *database.Commit) *event.MessageEventContent {
+	link := fmt.Sprintf("%s/theme/%s/commit/%d", cfg.PublicURL, commit.ThemeID, commit.Version)
+	title := fmt.Sprintf("%s v%d", theme.Name, commit.Version)
+	var message string
+	if commit.Message != "" {
+		message = ": " + firstLine(commit.Message)
+	}
+	stats := diffSummary(commit, prev)
+	return &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("%s%s (%s) %s", title, message, stats, link),
+		Format:  event.FormatHTML,
+		FormattedBody: fmt.Sprintf(
+			`<a href="%s">%s</a>%s (%s)`,
+			html.EscapeString(link), html.EscapeString(title), html.EscapeString(message), html.EscapeString(stats),
+		),
+	}
+}
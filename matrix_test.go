@@ -0,0 +1,302 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+// fakeHomeserver is a stand-in for the parts of the client-server API that the bot uses.
+type fakeHomeserver struct {
+	lock        sync.Mutex
+	aliases     map[id.RoomAlias]id.RoomID
+	joined      []id.RoomID
+	joinable    []id.RoomID
+	members     map[id.RoomID]map[id.UserID]event.Membership
+	powerLevels map[id.RoomID]*event.PowerLevelsEventContent
+	left        []id.RoomID
+	sent        map[string]*event.MessageEventContent
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, errcode string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"errcode": errcode, "error": errcode})
+}
+
+func writeMatrixJSON(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func (fh *fakeHomeserver) resolve(roomIDOrAlias string) id.RoomID {
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		return fh.aliases[id.RoomAlias(roomIDOrAlias)]
+	}
+	return id.RoomID(roomIDOrAlias)
+}
+
+func (fh *fakeHomeserver) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_matrix/client/v3/directory/room/{alias}", func(w http.ResponseWriter, r *http.Request) {
+		fh.lock.Lock()
+		defer fh.lock.Unlock()
+		if roomID := fh.resolve(r.PathValue("alias")); roomID != "" {
+			writeMatrixJSON(w, map[string]any{"room_id": roomID, "servers": []string{"example.com"}})
+		} else {
+			writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+		}
+	})
+	mux.HandleFunc("GET /_matrix/client/v3/joined_rooms", func(w http.ResponseWriter, r *http.Request) {
+		fh.lock.Lock()
+		defer fh.lock.Unlock()
+		writeMatrixJSON(w, map[string]any{"joined_rooms": append([]id.RoomID{}, fh.joined...)})
+	})
+	mux.HandleFunc("POST /_matrix/client/v3/join/{room}", func(w http.ResponseWriter, r *http.Request) {
+		fh.lock.Lock()
+		defer fh.lock.Unlock()
+		roomID := fh.resolve(r.PathValue("room"))
+		if !slices.Contains(fh.joinable, roomID) {
+			writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN")
+			return
+		}
+		fh.joined = append(fh.joined, roomID)
+		writeMatrixJSON(w, map[string]any{"room_id": roomID})
+	})
+	mux.HandleFunc("POST /_matrix/client/v3/rooms/{room}/leave", func(w http.ResponseWriter, r *http.Request) {
+		fh.lock.Lock()
+		defer fh.lock.Unlock()
+		roomID := id.RoomID(r.PathValue("room"))
+		fh.left = append(fh.left, roomID)
+		fh.joined = slices.DeleteFunc(fh.joined, func(joined id.RoomID) bool { return joined == roomID })
+		writeMatrixJSON(w, map[string]any{})
+	})
+	getState := func(w http.ResponseWriter, r *http.Request) {
+		fh.lock.Lock()
+		defer fh.lock.Unlock()
+		roomID := id.RoomID(r.PathValue("room"))
+		if !slices.Contains(fh.joined, roomID) {
+			writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN")
+			return
+		}
+		switch r.PathValue("type") {
+		case event.StateMember.Type:
+			if membership, ok := fh.members[roomID][id.UserID(r.PathValue("key"))]; ok {
+				writeMatrixJSON(w, &event.MemberEventContent{Membership: membership})
+				return
+			}
+		case event.StatePowerLevels.Type:
+			if pl, ok := fh.powerLevels[roomID]; ok {
+				writeMatrixJSON(w, pl)
+				return
+			}
+		}
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND")
+	}
+	mux.HandleFunc("GET /_matrix/client/v3/rooms/{room}/state/{type}", getState)
+	mux.HandleFunc("GET /_matrix/client/v3/rooms/{room}/state/{type}/{key...}", getState)
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{room}/send/{type}/{txnID}", func(w http.ResponseWriter, r *http.Request) {
+		fh.lock.Lock()
+		defer fh.lock.Unlock()
+		var content event.MessageEventContent
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			writeMatrixError(w, http.StatusBadRequest, "M_BAD_JSON")
+			return
+		}
+		fh.sent[r.PathValue("room")+"/"+r.PathValue("txnID")] = &content
+		writeMatrixJSON(w, map[string]any{"event_id": "$meow"})
+	})
+	return mux
+}
+
+func startFakeHomeserver(t *testing.T, fh *fakeHomeserver) {
+	t.Helper()
+	server := httptest.NewServer(fh.handler())
+	t.Cleanup(server.Close)
+	cli, err := mautrix.NewClient(server.URL, "@bot:example.com", "meow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.DefaultHTTPRetries = 0
+	matrixBot = cli
+	t.Cleanup(func() {
+		matrixBot = nil
+	})
+}
+
+func TestJoinMatrixRoom(t *testing.T) {
+	const (
+		admin      id.UserID = "@admin:example.com"
+		publicRoom id.RoomID = "!public:example.com"
+		linkedRoom id.RoomID = "!linked:example.com"
+		closedRoom id.RoomID = "!closed:example.com"
+	)
+	tests := []struct {
+		name       string
+		room       string
+		membership event.Membership
+		level      int
+		wantRoom   id.RoomID
+		err        error
+		errText    string
+		wantJoined bool
+		wantLeft   bool
+	}{
+		{name: "moderator by alias", room: "#public:example.com", membership: event.MembershipJoin, level: 50, wantRoom: publicRoom, wantJoined: true},
+		{name: "moderator by ID", room: string(publicRoom), membership: event.MembershipJoin, level: 100, wantRoom: publicRoom, wantJoined: true},
+		{name: "low power level", room: string(publicRoom), membership: event.MembershipJoin, level: 0, err: errMatrixRoomPermission, wantLeft: true},
+		{name: "not in room", room: string(publicRoom), err: errMatrixRoomPermission, wantLeft: true},
+		{name: "left room", room: string(publicRoom), membership: event.MembershipLeave, level: 100, err: errMatrixRoomPermission, wantLeft: true},
+		{name: "already joined room isn't left", room: string(linkedRoom), membership: event.MembershipJoin, level: 0, err: errMatrixRoomPermission, wantJoined: true},
+		{name: "already joined room", room: string(linkedRoom), membership: event.MembershipJoin, level: 50, wantRoom: linkedRoom, wantJoined: true},
+		{name: "can't join", room: string(closedRoom), errText: "make sure it's invited"},
+		{name: "unknown alias", room: "#unknown:example.com", errText: "failed to resolve room alias"},
+		{name: "not a room", room: "public", errText: "enter a room ID"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fh := &fakeHomeserver{
+				aliases:  map[id.RoomAlias]id.RoomID{"#public:example.com": publicRoom},
+				joined:   []id.RoomID{linkedRoom},
+				joinable: []id.RoomID{publicRoom},
+				members:  make(map[id.RoomID]map[id.UserID]event.Membership),
+				powerLevels: map[id.RoomID]*event.PowerLevelsEventContent{
+					publicRoom: {Users: map[id.UserID]int{admin: test.level}},
+					linkedRoom: {Users: map[id.UserID]int{admin: test.level}},
+				},
+			}
+			if test.membership != "" {
+				for _, roomID := range []id.RoomID{publicRoom, linkedRoom} {
+					fh.members[roomID] = map[id.UserID]event.Membership{admin: test.membership}
+				}
+			}
+			startFakeHomeserver(t, fh)
+			roomID, err := joinMatrixRoom(context.Background(), test.room, admin)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Errorf("got error %v, want %v", err, test.err)
+				}
+			} else if test.errText != "" {
+				if err == nil || !strings.Contains(err.Error(), test.errText) {
+					t.Errorf("got error %v, want %q", err, test.errText)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if roomID != test.wantRoom {
+				t.Errorf("got room %s, want %s", roomID, test.wantRoom)
+			}
+			checkRoom := test.wantRoom
+			if checkRoom == "" && strings.HasPrefix(test.room, "!") {
+				checkRoom = id.RoomID(test.room)
+			}
+			if joined := slices.Contains(fh.joined, checkRoom); joined != test.wantJoined {
+				t.Errorf("got joined %t, want %t", joined, test.wantJoined)
+			}
+			if left := len(fh.left) > 0; left != test.wantLeft {
+				t.Errorf("got left %t, want %t", left, test.wantLeft)
+			}
+		})
+	}
+}
+
+func TestFormatCommitAnnouncement(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.PublicURL = "https://css.example.com"
+	theme := &database.Theme{ID: "meowtheme", Name: "Meow <theme>"}
+	prev := &database.Commit{ThemeID: "meowtheme", Version: 2, Content: "a\nb\n"}
+	tests := []struct {
+		name          string
+		commit        *database.Commit
+		prev          *database.Commit
+		body          string
+		formattedBody string
+	}{{
+		name:          "first line of message",
+		commit:        &database.Commit{ThemeID: "meowtheme", Version: 3, Message: "Make it pinker\n\nAlso bluer", Content: "a\nc\nd\n"},
+		prev:          prev,
+		body:          "Meow <theme> v3: Make it pinker (2 lines added, 1 lines removed) https://css.example.com/theme/meowtheme/commit/3",
+		formattedBody: `<a href="https://css.example.com/theme/meowtheme/commit/3">Meow &lt;theme&gt; v3</a>: Make it pinker (2 lines added, 1 lines removed)`,
+	}, {
+		name:          "no message",
+		commit:        &database.Commit{ThemeID: "meowtheme", Version: 3, Content: "a\nb\n"},
+		prev:          prev,
+		body:          "Meow <theme> v3 (0 lines added, 0 lines removed) https://css.example.com/theme/meowtheme/commit/3",
+		formattedBody: `<a href="https://css.example.com/theme/meowtheme/commit/3">Meow &lt;theme&gt; v3</a> (0 lines added, 0 lines removed)`,
+	}, {
+		name:          "initial version",
+		commit:        &database.Commit{ThemeID: "meowtheme", Version: 1, Message: "<b>hi</b>", Content: "a\nb\nc\n"},
+		body:          "Meow <theme> v1: <b>hi</b> (Initial version with 3 lines) https://css.example.com/theme/meowtheme/commit/1",
+		formattedBody: `<a href="https://css.example.com/theme/meowtheme/commit/1">Meow &lt;theme&gt; v1</a>: &lt;b&gt;hi&lt;/b&gt; (Initial version with 3 lines)`,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := formatCommitAnnouncement(theme, test.commit, test.prev)
+			if content.MsgType != event.MsgNotice || content.Format != event.FormatHTML {
+				t.Errorf("got msgtype %s and format %s", content.MsgType, content.Format)
+			}
+			if content.Body != test.body {
+				t.Errorf("got body\n%s\nwant\n%s", content.Body, test.body)
+			}
+			if content.FormattedBody != test.formattedBody {
+				t.Errorf("got formatted body\n%s\nwant\n%s", content.FormattedBody, test.formattedBody)
+			}
+		})
+	}
+}
+
+func TestPostCommitAnnouncement(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.PublicURL = "https://css.example.com"
+	fh := &fakeHomeserver{sent: make(map[string]*event.MessageEventContent)}
+	startFakeHomeserver(t, fh)
+	createdAt := time.UnixMilli(1735689600123)
+	theme := &database.Theme{ID: "meowtheme", Name: "Meow theme"}
+	prev := &database.Commit{ThemeID: "meowtheme", Version: 1, Content: "a\n"}
+	commit := &database.Commit{ThemeID: "meowtheme", Version: 2, Message: "Add b\nmore details", Content: "a\nb\n", CreatedAt: createdAt}
+	for range 2 {
+		// Retries reuse the same transaction ID
+		if err := postCommitAnnouncement(context.Background(), "!room:example.com", theme, commit, prev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fh.sent) != 1 {
+		t.Fatalf("got %d distinct transactions, want 1", len(fh.sent))
+	}
+	content, ok := fh.sent["!room:example.com/gcss-meowtheme-2-1735689600123"]
+	if !ok {
+		t.Fatalf("message wasn't sent with the expected transaction ID: %v", fh.sent)
+	}
+	want := "Meow theme v2: Add b (1 lines added, 0 lines removed) https://css.example.com/theme/meowtheme/commit/2"
+	if content.Body != want {
+		t.Errorf("got body %q, want %q", content.Body, want)
+	}
+}
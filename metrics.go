@@ -0,0 +1,192 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/requestlog"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gomuks_css_http_requests_total",
+		Help: "Number of HTTP requests by route pattern and status code.",
+	}, []string{"pattern", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gomuks_css_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests by route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"pattern"})
+	cssBytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gomuks_css_css_bytes_served_total",
+		Help: "Number of bytes of theme CSS served.",
+	})
+	commitsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gomuks_css_commits_total",
+		Help: "Number of theme versions published by source (web, api or git).",
+	}, []string{"source"})
+	themesCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gomuks_css_themes_created_total",
+		Help: "Number of themes created by source (web, api or git).",
+	}, []string{"source"})
+	loginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gomuks_css_logins_total",
+		Help: "Number of login attempts by result (success, failure, blocked or error).",
+	}, []string{"result"})
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gomuks_css_db_query_duration_seconds",
+		Help:    "Time taken by database queries by method.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method"})
+)
+
+// countCommit records a published version after the transaction that added it has been committed.
+func countCommit(source string, version int) {
+	commitsCreated.WithLabelValues(source).Inc()
+	if version == 1 {
+		themesCreated.WithLabelValues(source).Inc()
+	}
+}
+
+// httpMetricsMiddleware records request counts and latencies labeled with the mux pattern
+// that the request matched, so that path parameters don't create new series.
+func httpMetricsMiddleware(mux *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := mux.Handler(r)
+			if pattern == "" {
+				pattern = "unmatched"
+			}
+			crw := &requestlog.CountingResponseWriter{
+				ResponseWriter: w,
+				ResponseLength: -1,
+				StatusCode:     -1,
+			}
+			start := time.Now()
+			next.ServeHTTP(crw, r)
+			duration := time.Since(start)
+			status := crw.StatusCode
+			if status == -1 {
+				status = http.StatusOK
+			}
+			httpRequests.WithLabelValues(pattern, strconv.Itoa(status)).Inc()
+			httpRequestDuration.WithLabelValues(pattern).Observe(duration.Seconds())
+		})
+	}
+}
+
+// dbMetricsLogger records the duration of every query before passing it on to the logger.
+type dbMetricsLogger struct {
+	dbutil.DatabaseLogger
+}
+
+func newDBLogger(log zerolog.Logger) dbutil.DatabaseLogger {
+	return &dbMetricsLogger{dbutil.ZeroLogger(log, dbutil.ZeroLogSettings{
+		// Skip LoggingExecable.ExecContext, dbMetricsLogger.QueryTiming and zeroLogger.QueryTiming
+		CallerSkipFrame: 3,
+		Caller:          true,
+	})}
+}
+
+func (dml *dbMetricsLogger) QueryTiming(ctx context.Context, method, query string, args []any, nrows int, duration time.Duration, err error) {
+	dbQueryDuration.WithLabelValues(method).Observe(duration.Seconds())
+	dml.DatabaseLogger.QueryTiming(ctx, method, query, args, nrows, duration, err)
+}
+
+// sessionKeyCollector reports the number of sessions per token key when metrics are scraped,
+// so operators can see when a retired key is no longer used and can be removed.
+type sessionKeyCollector struct{}
+
+var sessionKeyDesc = prometheus.NewDesc(
+	"gomuks_css_sessions",
+	"Number of unexpired login sessions by the key that signed them. key_state is active, retired or removed.",
+	[]string{"key_id", "key_state"}, nil,
+)
+
+func (sessionKeyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionKeyDesc
+}
+
+func (sessionKeyCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counts, err := db.Session.CountByKey(ctx)
+	if err != nil {
+		defLog.Err(err).Msg("Failed to count sessions for metrics")
+		return
+	}
+	for keyID := range cfg.tokenKeys {
+		if _, ok := counts[keyID]; !ok {
+			counts[keyID] = 0
+		}
+	}
+	for keyID, count := range counts {
+		state := "retired"
+		if keyID == cfg.ActiveTokenKey {
+			state = "active"
+		} else if cfg.TokenKey(keyID) == nil {
+			state = "removed"
+		}
+		ch <- prometheus.MustNewConstMetric(sessionKeyDesc, prometheus.GaugeValue, float64(count), keyID, state)
+	}
+}
+
+// previewStorageCollector reports the number and total size of stored preview images when metrics are scraped.
+type previewStorageCollector struct{}
+
+var (
+	previewCountDesc = prometheus.NewDesc("gomuks_css_preview_images", "Number of stored preview images.", nil, nil)
+	previewSizeDesc  = prometheus.NewDesc("gomuks_css_preview_storage_bytes", "Total size of stored preview images.", nil, nil)
+)
+
+func (previewStorageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- previewCountDesc
+	ch <- previewSizeDesc
+}
+
+func (previewStorageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	count, size, err := db.PreviewImage.GetStorageSize(ctx)
+	if err != nil {
+		defLog.Err(err).Msg("Failed to get preview storage size for metrics")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(previewCountDesc, prometheus.GaugeValue, float64(count))
+	ch <- prometheus.MustNewConstMetric(previewSizeDesc, prometheus.GaugeValue, float64(size))
+}
+
+func init() {
+	prometheus.MustRegister(
+		sessionKeyCollector{},
+		previewStorageCollector{},
+		httpRequests,
+		httpRequestDuration,
+		cssBytesServed,
+		commitsCreated,
+		themesCreated,
+		loginAttempts,
+		dbQueryDuration,
+	)
+}
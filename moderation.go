@@ -0,0 +1,311 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/client"
+	"css.gomuks.app/database"
+)
+
+// isModerator checks whether the user is a site moderator, either in the config or added through the CLI.
+func isModerator(ctx context.Context, userID id.UserID) bool {
+	if userID == "" {
+		return false
+	} else if slices.Contains(cfg.Moderators, userID) {
+		return true
+	}
+	mod, err := db.Moderator.Get(ctx, userID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to check if user is moderator")
+		return false
+	}
+	return mod != nil
+}
+
+// viewerIsModerator checks whether the logged-in user is a moderator. The result is cached for the rest of the request.
+func viewerIsModerator(r *http.Request) bool {
+	cache, ok := r.Context().Value(sessionCacheKey{}).(*sessionCache)
+	if ok && cache.isModerator != nil {
+		return *cache.isModerator
+	}
+	result := isModerator(r.Context(), verifyCookie(r))
+	if ok {
+		cache.isModerator = &result
+	}
+	return result
+}
+
+// verifyModerator returns the logged-in moderator, or writes an error and returns an empty string.
+// Moderation pages pretend not to exist for other users.
+func verifyModerator(w http.ResponseWriter, r *http.Request) id.UserID {
+	userID := verifyCookie(r)
+	if userID == "" && r.Method == http.MethodGet {
+		redirectToLogin(w, r)
+		return ""
+	} else if !viewerIsModerator(r) {
+		http.NotFound(w, r)
+		return ""
+	}
+	return userID
+}
+
+// filterListedThemes removes hidden themes from a listing, except for moderators and the theme's own admins.
+func filterListedThemes(r *http.Request, themes []*database.Theme) []*database.Theme {
+	viewer := verifyCookie(r)
+	if viewerIsModerator(r) {
+		return themes
+	}
+	return slices.DeleteFunc(themes, func(theme *database.Theme) bool {
+		return theme.Hidden && !theme.IsAdmin(viewer)
+	})
+}
+
+type ModerationPageData struct {
+	Themes     []*database.Theme
+	Bans       []*database.Ban
+	Moderators []id.UserID
+}
+
+func getModerationPage(w http.ResponseWriter, r *http.Request) {
+	if verifyModerator(w, r) == "" {
+		return
+	}
+	log := hlog.FromRequest(r)
+	themes, err := db.Theme.GetAll(r.Context())
+	if err != nil {
+		log.Err(err).Msg("Failed to get themes")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	bans, err := db.Ban.GetAll(r.Context())
+	if err != nil {
+		log.Err(err).Msg("Failed to get bans")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	dbMods, err := db.Moderator.GetAll(r.Context())
+	if err != nil {
+		log.Err(err).Msg("Failed to get moderators")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	data := &ModerationPageData{
+		Themes: slices.DeleteFunc(themes, func(theme *database.Theme) bool {
+			return !theme.Hidden && !theme.Frozen
+		}),
+		Bans:       bans,
+		Moderators: slices.Clone(cfg.Moderators),
+	}
+	for _, mod := range dbMods {
+		if !slices.Contains(data.Moderators, mod.UserID) {
+			data.Moderators = append(data.Moderators, mod.UserID)
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, http.StatusOK, &ContainerData{
+		PageTitle: "moderation",
+		Page:      "moderation.gohtml",
+		Data:      data,
+	})
+}
+
+func postModerateTheme(w http.ResponseWriter, r *http.Request) {
+	modID := verifyModerator(w, r)
+	if modID == "" {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	action := r.PostForm.Get("action")
+	log := hlog.FromRequest(r).With().
+		Stringer("moderator_id", modID).
+		Str("theme_id", string(themeID)).
+		Str("action", action).
+		Logger()
+	theme, err := db.Theme.Get(r.Context(), themeID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if theme == nil {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return
+	}
+	redirectTo := fmt.Sprintf("/theme/%s", themeID)
+	audit := &database.AuditEntry{Actor: string(modID), ThemeID: themeID}
+	var apply func(ctx context.Context) error
+	switch action {
+	case "hide", "unhide":
+		audit.Action = database.AuditThemeHide
+		if action == "unhide" {
+			audit.Action = database.AuditThemeUnhide
+		}
+		apply = func(ctx context.Context) error {
+			return db.Theme.SetHidden(ctx, themeID, action == "hide")
+		}
+	case "freeze", "unfreeze":
+		audit.Action = database.AuditThemeFreeze
+		if action == "unfreeze" {
+			audit.Action = database.AuditThemeUnfreeze
+		}
+		apply = func(ctx context.Context) error {
+			return db.Theme.SetFrozen(ctx, themeID, action == "freeze")
+		}
+	case "delete":
+		audit.Action = database.AuditThemeDelete
+		audit.Before = auditJSON(deletedThemeAudit(theme))
+		apply = func(ctx context.Context) error {
+			// Queue the event first, as the webhooks are deleted with the theme
+			err := queueWebhooks(ctx, &client.WebhookPayload{
+				Event:   client.WebhookEventDelete,
+				ThemeID: themeID,
+				Sender:  modID,
+			})
+			if err != nil {
+				return err
+			}
+			return db.Theme.Delete(ctx, themeID)
+		}
+		redirectTo = "/moderation"
+	case "remove_preview":
+		imageID, parseErr := uuid.Parse(r.PostForm.Get("image_id"))
+		if parseErr != nil || !slices.Contains(theme.Previews, imageID) {
+			http.Error(w, "Preview image not found", http.StatusNotFound)
+			return
+		}
+		log = log.With().Stringer("image_id", imageID).Logger()
+		audit.Action = database.AuditPreviewDelete
+		audit.Target = imageID.String()
+		apply = func(ctx context.Context) error {
+			if err := db.PreviewImage.Delete(ctx, imageID); err != nil {
+				return err
+			}
+			return queuePreviewWebhooks(ctx, modID, themeID, nil, []uuid.UUID{imageID})
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		if err := apply(ctx); err != nil {
+			return err
+		}
+		return recordAudit(ctx, audit)
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to apply moderation action")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	log.Info().Msg("Moderator acted on theme")
+	w.Header().Set("Location", redirectTo)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func postModerateUser(w http.ResponseWriter, r *http.Request) {
+	modID := verifyModerator(w, r)
+	if modID == "" {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	userID, err := parseUserID(r.PathValue("userID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("action")
+	log := hlog.FromRequest(r).With().
+		Stringer("moderator_id", modID).
+		Stringer("user_id", userID).
+		Str("action", action).
+		Logger()
+	audit := &database.AuditEntry{Actor: string(modID), Target: string(userID)}
+	switch action {
+	case "ban":
+		reason := strings.TrimSpace(r.PostForm.Get("reason"))
+		if len(reason) > cfg.Limits.DescriptionMaxLength {
+			http.Error(w, "Reason is too long", http.StatusBadRequest)
+			return
+		}
+		ban := &database.Ban{
+			UserID:   userID,
+			Reason:   reason,
+			BannedAt: time.Now(),
+			BannedBy: modID,
+		}
+		audit.Action = database.AuditUserBan
+		audit.After = auditJSON(ban)
+		err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+			if err := db.Ban.Add(ctx, ban); err != nil {
+				return err
+			}
+			return recordAudit(ctx, audit)
+		})
+	case "unban":
+		audit.Action = database.AuditUserUnban
+		err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+			if ban, err := db.Ban.Get(ctx, userID); err != nil {
+				return err
+			} else if ban == nil {
+				return nil
+			} else if err = db.Ban.Remove(ctx, userID); err != nil {
+				return err
+			} else {
+				audit.Before = auditJSON(ban)
+			}
+			return recordAudit(ctx, audit)
+		})
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to apply moderation action")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	log.Info().Msg("Moderator acted on user")
+	w.Header().Set("Location", "/user/"+url.PathEscape(string(userID)))
+	w.WriteHeader(http.StatusSeeOther)
+}
@@ -0,0 +1,223 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/exerrors"
+
+	"css.gomuks.app/client"
+)
+
+type jsonObject = map[string]any
+
+var pathParamRegex = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIGenerator builds JSON schemas from Go types using the same rules as encoding/json.
+// Named structs are put in the components section and referenced from everywhere else.
+type openAPIGenerator struct {
+	schemas jsonObject
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	uuidType = reflect.TypeOf(uuid.UUID{})
+)
+
+func (gen *openAPIGenerator) schemaFor(t reflect.Type) jsonObject {
+	switch t {
+	case timeType:
+		return jsonObject{"type": "string", "format": "date-time"}
+	case uuidType:
+		return jsonObject{"type": "string", "format": "uuid"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return gen.schemaFor(t.Elem())
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObject{"type": "string", "format": "byte"}
+		}
+		return jsonObject{"type": "array", "items": gen.schemaFor(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": gen.schemaFor(t.Elem())}
+	case reflect.Struct:
+		// Unexported API types are named like apiCommitRequest, the prefix is dropped in the document
+		name := strings.TrimPrefix(t.Name(), "api")
+		name = strings.ToUpper(name[:1]) + name[1:]
+		if _, exists := gen.schemas[name]; !exists {
+			// Placeholder to stop recursion for self-referencing types
+			gen.schemas[name] = nil
+			gen.schemas[name] = gen.structSchema(t)
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + name}
+	default:
+		return jsonObject{}
+	}
+}
+
+func (gen *openAPIGenerator) structSchema(t reflect.Type) jsonObject {
+	properties := jsonObject{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = gen.schemaFor(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	schema := jsonObject{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (gen *openAPIGenerator) operation(route *apiRoute) jsonObject {
+	op := jsonObject{
+		"operationId": route.Name,
+		"summary":     route.Summary,
+	}
+	var params []jsonObject
+	for _, match := range pathParamRegex.FindAllStringSubmatch(route.Path, -1) {
+		params = append(params, jsonObject{
+			"name":     match[1],
+			"in":       "path",
+			"required": true,
+			"schema":   jsonObject{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if route.Request != nil {
+		op["requestBody"] = jsonObject{
+			"required": true,
+			"content": jsonObject{
+				"application/json": jsonObject{"schema": gen.schemaFor(reflect.TypeOf(route.Request))},
+			},
+		}
+	} else if len(route.RawRequest) > 0 {
+		content := jsonObject{}
+		for _, contentType := range route.RawRequest {
+			content[contentType] = jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}}
+		}
+		op["requestBody"] = jsonObject{"required": true, "content": content}
+	}
+	responses := jsonObject{
+		strconv.Itoa(route.Status): jsonObject{
+			"description": http.StatusText(route.Status),
+			"content": jsonObject{
+				"application/json": jsonObject{"schema": gen.schemaFor(reflect.TypeOf(route.Response))},
+			},
+		},
+	}
+	errorSchema := gen.schemaFor(reflect.TypeOf(client.Error{}))
+	for _, status := range route.Errors {
+		responses[strconv.Itoa(status)] = jsonObject{
+			"description": http.StatusText(status),
+			"content": jsonObject{
+				"application/json": jsonObject{"schema": errorSchema},
+			},
+		}
+	}
+	responses[strconv.Itoa(http.StatusTooManyRequests)] = jsonObject{
+		"description": http.StatusText(http.StatusTooManyRequests),
+		"headers": jsonObject{
+			"Retry-After": jsonObject{"schema": jsonObject{"type": "integer"}},
+		},
+		"content": jsonObject{
+			"application/json": jsonObject{"schema": errorSchema},
+		},
+	}
+	op["responses"] = responses
+	if route.Auth {
+		op["security"] = []jsonObject{{"bearerAuth": []string{}}}
+	}
+	return op
+}
+
+func generateOpenAPIDocument() jsonObject {
+	gen := &openAPIGenerator{schemas: jsonObject{}}
+	paths := jsonObject{}
+	for _, route := range apiRoutes {
+		pathItem, ok := paths[route.Path].(jsonObject)
+		if !ok {
+			pathItem = jsonObject{}
+			paths[route.Path] = pathItem
+		}
+		pathItem[strings.ToLower(route.Method)] = gen.operation(route)
+	}
+	return jsonObject{
+		"openapi": "3.1.0",
+		"info": jsonObject{
+			"title":   "css.gomuks.app API",
+			"version": strings.TrimPrefix(apiPrefix, "/api/"),
+		},
+		"servers": []jsonObject{{"url": apiPrefix}},
+		"paths":   paths,
+		"components": jsonObject{
+			"schemas": gen.schemas,
+			"securitySchemes": jsonObject{
+				"bearerAuth": jsonObject{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An API token from the /tokens page",
+				},
+			},
+		},
+	}
+}
+
+var openAPIDocument = sync.OnceValue(func() []byte {
+	return exerrors.Must(json.Marshal(generateOpenAPIDocument()))
+})
+
+func getOpenAPIDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_, _ = w.Write(openAPIDocument())
+}
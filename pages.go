@@ -18,6 +18,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	_ "image/jpeg"
 	_ "image/png"
 	"net/http"
@@ -38,6 +39,17 @@ type ThemePageData struct {
 	Themes  []*database.Theme  `json:"themes,omitempty"`
 	Commit  *database.Commit   `json:"commit,omitempty"`
 	Commits []*database.Commit `json:"commits,omitempty"`
+	// Draft is the draft being edited on the edit page
+	Draft *database.Draft `json:"-"`
+
+	// Moderation info, only filled for moderators
+	IsModerator bool          `json:"-"`
+	UserID      id.UserID     `json:"-"`
+	Ban         *database.Ban `json:"-"`
+	// Number of unhandled reports per theme
+	ReportCounts map[database.ThemeID]int `json:"-"`
+
+	CSRFData `json:"-"`
 }
 
 func sendResponse(w http.ResponseWriter, r *http.Request, pageTitle, template string, data *ThemePageData) {
@@ -47,19 +59,20 @@ func sendResponse(w http.ResponseWriter, r *http.Request, pageTitle, template st
 	} else if r.Header.Get("Accept") == "text/css" && data.Theme != nil {
 		w.Header().Set("Content-Type", "text/css; charset=utf-8")
 		w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+		content := data.Theme.LatestCommit.Content
 		if data.Commit != nil {
-			_, _ = w.Write([]byte(data.Commit.Content))
-		} else {
-			_, _ = w.Write([]byte(data.Theme.LatestCommit.Content))
+			content = data.Commit.Content
 		}
+		n, _ := w.Write([]byte(content))
+		cssBytesServed.Add(float64(n))
 	} else {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		exerrors.PanicIfNotNil(Templates.ExecuteTemplate(w, "container.gohtml", &ContainerData{
-			User:      verifyCookie(r),
+		data.IsModerator = viewerIsModerator(r)
+		data.ReportCounts = getReportCounts(r)
+		renderContainer(w, r, http.StatusOK, &ContainerData{
 			PageTitle: pageTitle,
 			Page:      template,
 			Data:      data,
-		}))
+		})
 	}
 }
 
@@ -71,11 +84,15 @@ func getIndexPage(w http.ResponseWriter, r *http.Request) {
 		// TODO write body
 		return
 	}
-	sendResponse(w, r, "", "index.gohtml", &ThemePageData{Themes: themes})
+	sendResponse(w, r, "", "index.gohtml", &ThemePageData{Themes: filterListedThemes(r, themes)})
 }
 
 func getUserPage(w http.ResponseWriter, r *http.Request) {
 	userID := id.UserID(r.PathValue("userID"))
+	if feedUserID, isFeed := strings.CutSuffix(string(userID), ".atom"); isFeed {
+		getUserFeed(w, r, id.UserID(feedUserID))
+		return
+	}
 	themes, err := db.Theme.GetByAdmin(r.Context(), userID)
 	if err != nil {
 		hlog.FromRequest(r).Err(err).Msg("Failed to get themes")
@@ -83,7 +100,16 @@ func getUserPage(w http.ResponseWriter, r *http.Request) {
 		// TODO write body
 		return
 	}
-	sendResponse(w, r, string(userID), "index.gohtml", &ThemePageData{Themes: themes})
+	data := &ThemePageData{Themes: filterListedThemes(r, themes), UserID: userID}
+	if viewerIsModerator(r) {
+		if data.Ban, err = db.Ban.Get(r.Context(), userID); err != nil {
+			hlog.FromRequest(r).Err(err).Msg("Failed to get ban")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		}
+	}
+	sendResponse(w, r, string(userID), "index.gohtml", data)
 }
 
 func getValueWithSuffix(r *http.Request, key string) string {
@@ -99,7 +125,9 @@ func getValueWithSuffix(r *http.Request, key string) string {
 }
 
 func getThemePage(w http.ResponseWriter, r *http.Request) {
-	themeID := database.ThemeID(getValueWithSuffix(r, "themeID"))
+	// The theme ID may be followed by @ and the name of a channel or tag, e.g. /theme/meow@stable.css
+	rawThemeID, releaseName, hasRelease := strings.Cut(getValueWithSuffix(r, "themeID"), "@")
+	themeID := database.ThemeID(rawThemeID)
 	theme, err := db.Theme.Get(r.Context(), themeID)
 	if err != nil {
 		hlog.FromRequest(r).Err(err).Msg("Failed to get theme")
@@ -113,7 +141,33 @@ func getThemePage(w http.ResponseWriter, r *http.Request) {
 	}
 	var commit *database.Commit
 	title := theme.Name
-	if versionStr := getValueWithSuffix(r, "version"); versionStr != "" {
+	versionStr := getValueWithSuffix(r, "version")
+	// Themes can opt in to serving the stable channel at the unversioned CSS URL
+	followStable := !hasRelease && versionStr == "" && theme.FollowStable && r.Header.Get("Accept") == "text/css"
+	if followStable {
+		releaseName = channelStable
+	}
+	if hasRelease && versionStr != "" {
+		w.WriteHeader(http.StatusNotFound)
+		// TODO write body
+		return
+	} else if hasRelease || followStable {
+		release, err := getRelease(r.Context(), themeID, releaseName)
+		if err != nil {
+			hlog.FromRequest(r).Err(err).Msg("Failed to get release")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		} else if release != nil {
+			versionStr = strconv.Itoa(release.Version)
+		} else if hasRelease {
+			w.WriteHeader(http.StatusNotFound)
+			// TODO write body
+			return
+		}
+		// If the theme follows stable but the channel isn't set, the latest version is served
+	}
+	if versionStr != "" {
 		version, err := strconv.Atoi(versionStr)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -131,7 +185,11 @@ func getThemePage(w http.ResponseWriter, r *http.Request) {
 			// TODO write body
 			return
 		}
-		title += " - v" + versionStr
+		if hasRelease {
+			title += " - " + releaseName
+		} else {
+			title += " - v" + versionStr
+		}
 	}
 	sendResponse(w, r, title, "theme.gohtml", &ThemePageData{Theme: theme, Commit: commit})
 }
@@ -162,8 +220,7 @@ func getThemeHistoryPage(w http.ResponseWriter, r *http.Request) {
 func getThemeEditPage(w http.ResponseWriter, r *http.Request) {
 	userID := verifyCookie(r)
 	if userID == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		// TODO write body
+		redirectToLogin(w, r)
 		return
 	}
 	themeID := database.ThemeID(r.PathValue("themeID"))
@@ -188,5 +245,25 @@ func getThemeEditPage(w http.ResponseWriter, r *http.Request) {
 		}
 		pageTitle = "edit " + theme.Name
 	}
-	sendResponse(w, r, pageTitle, "theme-edit.gohtml", &ThemePageData{Theme: theme})
+	var draft *database.Draft
+	if draftIDStr := r.URL.Query().Get("draft"); draftIDStr != "" && theme != nil {
+		draftID, err := strconv.ParseInt(draftIDStr, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			// TODO write body
+			return
+		}
+		draft, err = db.Draft.Get(r.Context(), theme.ID, draftID)
+		if err != nil {
+			hlog.FromRequest(r).Err(err).Msg("Failed to get draft")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		} else if draft == nil {
+			http.Error(w, errDraftNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		pageTitle = fmt.Sprintf("edit %s draft #%d", theme.Name, draft.ID)
+	}
+	sendResponse(w, r, pageTitle, "theme-edit.gohtml", &ThemePageData{Theme: theme, Draft: draft})
 }
@@ -0,0 +1,269 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix/id"
+)
+
+type rateLimitClass string
+
+const (
+	rateLimitLogin  rateLimitClass = "login"
+	rateLimitCommit rateLimitClass = "commit"
+	rateLimitUpload rateLimitClass = "upload"
+	rateLimitRead   rateLimitClass = "read"
+	rateLimitWrite  rateLimitClass = "write"
+)
+
+// rateLimitRoutes maps mux patterns to rate limit classes. Patterns that aren't listed here are
+// in the read class if they're GET, HEAD or OPTIONS requests, and in the write class otherwise.
+// API routes are added by registerAPIRoutes.
+var rateLimitRoutes = map[string]rateLimitClass{
+	"GET /login":                             rateLimitLogin,
+	"POST /theme/commit":                     rateLimitCommit,
+	"POST /theme/{themeID}/git-receive-pack": rateLimitCommit,
+	// Fetching is a POST in the git protocol, but it's a read
+	"POST /theme/{themeID}/git-upload-pack": rateLimitRead,
+	// Probes from the orchestrator are never limited
+	"GET /healthz": "",
+	"GET /readyz":  "",
+}
+
+func (rlc *RateLimitConfig) Rule(class rateLimitClass) *RateLimitRule {
+	switch class {
+	case rateLimitLogin:
+		return &rlc.Login
+	case rateLimitCommit:
+		return &rlc.Commit
+	case rateLimitUpload:
+		return &rlc.Upload
+	case rateLimitRead:
+		return &rlc.Read
+	case rateLimitWrite:
+		return &rlc.Write
+	default:
+		return nil
+	}
+}
+
+// rateLimitStore counts requests in fixed windows.
+type rateLimitStore interface {
+	Hit(ctx context.Context, key string, windowStart, expiresAt time.Time) (int, error)
+}
+
+// rateLimitSweepInterval is how often expired counters are removed from the store.
+const rateLimitSweepInterval = 5 * time.Minute
+
+type memoryRateLimitWindow struct {
+	start time.Time
+	end   time.Time
+	count int
+}
+
+type memoryRateLimitStore struct {
+	lock      sync.Mutex
+	windows   map[string]*memoryRateLimitWindow
+	lastSweep time.Time
+}
+
+func (mrls *memoryRateLimitStore) Hit(_ context.Context, key string, windowStart, expiresAt time.Time) (int, error) {
+	mrls.lock.Lock()
+	defer mrls.lock.Unlock()
+	now := time.Now()
+	if now.Sub(mrls.lastSweep) > rateLimitSweepInterval {
+		for existingKey, window := range mrls.windows {
+			if now.After(window.end) {
+				delete(mrls.windows, existingKey)
+			}
+		}
+		mrls.lastSweep = now
+	}
+	window, ok := mrls.windows[key]
+	if !ok || !window.start.Equal(windowStart) {
+		window = &memoryRateLimitWindow{start: windowStart, end: expiresAt}
+		mrls.windows[key] = window
+	}
+	window.count++
+	return window.count, nil
+}
+
+// postgresRateLimitStore keeps the counters in the database so that all replicas share them.
+type postgresRateLimitStore struct {
+	lastSweep atomic.Int64
+}
+
+func (prls *postgresRateLimitStore) Hit(ctx context.Context, key string, windowStart, expiresAt time.Time) (int, error) {
+	now := time.Now()
+	lastSweep := prls.lastSweep.Load()
+	if now.Sub(time.UnixMilli(lastSweep)) > rateLimitSweepInterval && prls.lastSweep.CompareAndSwap(lastSweep, now.UnixMilli()) {
+		if err := db.RateLimit.DeleteExpired(ctx); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to delete expired rate limit counters")
+		}
+	}
+	return db.RateLimit.Hit(ctx, key, windowStart, expiresAt)
+}
+
+type rateLimiter struct {
+	mux   *http.ServeMux
+	store rateLimitStore
+}
+
+func newRateLimiter(mux *http.ServeMux) *rateLimiter {
+	rl := &rateLimiter{mux: mux}
+	if cfg.RateLimit.Backend == "postgres" {
+		rl.store = &postgresRateLimitStore{}
+	} else {
+		rl.store = &memoryRateLimitStore{windows: make(map[string]*memoryRateLimitWindow)}
+	}
+	return rl
+}
+
+func (rl *rateLimiter) classify(r *http.Request) rateLimitClass {
+	_, pattern := rl.mux.Handler(r)
+	if class, ok := rateLimitRoutes[pattern]; ok {
+		return class
+	} else if pattern == "" {
+		return ""
+	} else if isSafeMethod(r.Method) {
+		return rateLimitRead
+	}
+	return rateLimitWrite
+}
+
+// clientIP returns the IP address to rate limit by. IPv6 addresses are truncated to /64,
+// as a single client usually has the whole block.
+func clientIP(r *http.Request) string {
+	var addr string
+	if cfg.RateLimit.IPHeader != "" && r.Header.Get(cfg.RateLimit.IPHeader) != "" {
+		// The proxy appends the address it saw to the end of the list, the rest can be spoofed
+		parts := strings.Split(r.Header.Get(cfg.RateLimit.IPHeader), ",")
+		addr = strings.TrimSpace(parts[len(parts)-1])
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr = host
+	} else {
+		addr = r.RemoteAddr
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	} else if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// requestAPIToken returns the API token in the password field of HTTP basic auth or in a bearer authorization header.
+func requestAPIToken(r *http.Request) string {
+	if _, token, ok := r.BasicAuth(); ok {
+		return token
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// rateLimitUser returns the user to rate limit by, either from the login cookie or the API token.
+// Unlike checkAPIToken, this doesn't mark the token as used, as the handler will do that.
+func rateLimitUser(r *http.Request) id.UserID {
+	if r.Header.Get("Authorization") == "" {
+		return verifyCookie(r)
+	}
+	token := requestAPIToken(r)
+	if token == "" {
+		return ""
+	}
+	apiToken, err := db.APIToken.GetByHash(r.Context(), hashAPIToken(token))
+	if err != nil {
+		hlog.FromRequest(r).Warn().Err(err).Msg("Failed to get API token for rate limiting")
+		return ""
+	} else if apiToken == nil || apiToken.IsExpired() {
+		return ""
+	}
+	return apiToken.UserID
+}
+
+// check counts the request in the given bucket and returns how long the client has to wait
+// if the limit was exceeded. Errors from the store are logged and the request is allowed.
+func (rl *rateLimiter) check(r *http.Request, key string, limit int, window time.Duration) time.Duration {
+	now := time.Now()
+	windowStart := now.Truncate(window)
+	windowEnd := windowStart.Add(window)
+	count, err := rl.store.Hit(r.Context(), key, windowStart, windowEnd)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Str("rate_limit_key", key).Msg("Failed to check rate limit")
+		return 0
+	} else if count <= limit {
+		return 0
+	}
+	return windowEnd.Sub(now)
+}
+
+// Middleware rejects requests with 429 Too Many Requests when the client IP or user has exceeded the
+// limits of the route class. It must be after sessionCacheMiddleware so that the session lookup is cached,
+// and before csrfMiddleware so that requests are limited before their form bodies are parsed.
+func (rl *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := rl.classify(r)
+		rule := cfg.RateLimit.Rule(class)
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var retryAfter time.Duration
+		var bucket, bucketKey string
+		var limit int
+		if rule.PerIP > 0 {
+			bucket, bucketKey, limit = "ip", clientIP(r), rule.PerIP
+			retryAfter = rl.check(r, string(class)+":ip:"+bucketKey, limit, rule.Window)
+		}
+		if retryAfter == 0 && rule.PerUser > 0 {
+			if userID := rateLimitUser(r); userID != "" {
+				bucket, bucketKey, limit = "user", string(userID), rule.PerUser
+				retryAfter = rl.check(r, string(class)+":user:"+bucketKey, limit, rule.Window)
+			}
+		}
+		if retryAfter == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hlog.FromRequest(r).Warn().
+			Str("rate_limit_class", string(class)).
+			Str("rate_limit_bucket", bucket).
+			Str("rate_limit_key", bucketKey).
+			Int("limit", limit).
+			Dur("retry_after", retryAfter).
+			Msg("Request rate limited")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, try again later")
+		} else {
+			http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := &memoryRateLimitStore{windows: make(map[string]*memoryRateLimitWindow), lastSweep: time.Now()}
+	ctx := context.Background()
+	window := time.Minute
+	first := time.Now().Truncate(window)
+	second := first.Add(window)
+	steps := []struct {
+		key   string
+		start time.Time
+		want  int
+	}{
+		// A burst within one window counts up
+		{"a", first, 1},
+		{"a", first, 2},
+		{"a", first, 3},
+		// Other keys have their own counters
+		{"b", first, 1},
+		// The next window starts from zero again
+		{"a", second, 1},
+		{"a", second, 2},
+		{"b", second, 1},
+	}
+	for i, step := range steps {
+		count, err := store.Hit(ctx, step.key, step.start, step.start.Add(window))
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		} else if count != step.want {
+			t.Errorf("step %d: got count %d for %s, want %d", i, count, step.key, step.want)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	store := &memoryRateLimitStore{windows: make(map[string]*memoryRateLimitWindow), lastSweep: time.Now()}
+	ctx := context.Background()
+	now := time.Now()
+	_, _ = store.Hit(ctx, "expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	_, _ = store.Hit(ctx, "active", now.Truncate(time.Hour), now.Truncate(time.Hour).Add(time.Hour))
+	store.lastSweep = now.Add(-2 * rateLimitSweepInterval)
+	_, _ = store.Hit(ctx, "new", now.Truncate(time.Hour), now.Truncate(time.Hour).Add(time.Hour))
+	if _, ok := store.windows["expired"]; ok {
+		t.Error("expired window wasn't swept")
+	}
+	if _, ok := store.windows["active"]; !ok {
+		t.Error("active window was swept")
+	}
+}
+
+func TestRateLimitClassify(t *testing.T) {
+	cfg = defaultConfig()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", noop)
+	mux.HandleFunc("GET /login", noop)
+	mux.HandleFunc("GET /theme/{themeID}", noop)
+	mux.HandleFunc("POST /theme/commit", noop)
+	mux.HandleFunc("POST /theme/{themeID}/git-upload-pack", noop)
+	mux.HandleFunc("POST /theme/{themeID}/git-receive-pack", noop)
+	mux.HandleFunc("POST /theme/{themeID}/webhooks", noop)
+	mux.HandleFunc("POST /tokens", noop)
+	registerAPIRoutes(mux)
+	rl := &rateLimiter{mux: mux}
+	tests := []struct {
+		method string
+		path   string
+		class  rateLimitClass
+	}{
+		{http.MethodGet, "/healthz", ""},
+		{http.MethodGet, "/login", rateLimitLogin},
+		{http.MethodGet, "/theme/meowtheme", rateLimitRead},
+		{http.MethodHead, "/theme/meowtheme", rateLimitRead},
+		{http.MethodPost, "/theme/commit", rateLimitCommit},
+		{http.MethodPost, "/theme/meowtheme/git-receive-pack", rateLimitCommit},
+		{http.MethodPost, "/theme/meowtheme/git-upload-pack", rateLimitRead},
+		{http.MethodPost, "/theme/meowtheme/webhooks", rateLimitWrite},
+		{http.MethodPost, "/tokens", rateLimitWrite},
+		{http.MethodPost, apiPrefix + "/themes/meowtheme/previews", rateLimitUpload},
+		{http.MethodPost, apiPrefix + "/updates", rateLimitRead},
+		{http.MethodOptions, apiPrefix + "/updates", rateLimitRead},
+		{http.MethodGet, "/not-found", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if class := rl.classify(r); class != test.class {
+				t.Errorf("got class %q, want %q", class, test.class)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.RateLimit.Read = RateLimitRule{Window: time.Hour, PerIP: 3}
+	cfg.RateLimit.Write = RateLimitRule{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /theme/{themeID}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /theme/{themeID}/webhooks", func(w http.ResponseWriter, r *http.Request) {})
+	handler := newRateLimiter(mux).Middleware(mux)
+	steps := []struct {
+		method string
+		path   string
+		ip     string
+		status int
+	}{
+		{http.MethodGet, "/theme/a", "192.0.2.1:1234", http.StatusOK},
+		{http.MethodGet, "/theme/b", "192.0.2.1:1234", http.StatusOK},
+		{http.MethodGet, "/theme/c", "192.0.2.1:5678", http.StatusOK},
+		{http.MethodGet, "/theme/a", "192.0.2.1:1234", http.StatusTooManyRequests},
+		// Other IPs have their own bucket
+		{http.MethodGet, "/theme/a", "192.0.2.2:1234", http.StatusOK},
+		// The same IPv6 /64 shares a bucket
+		{http.MethodGet, "/theme/a", "[2001:db8::1]:1234", http.StatusOK},
+		{http.MethodGet, "/theme/a", "[2001:db8::2]:1234", http.StatusOK},
+		{http.MethodGet, "/theme/a", "[2001:db8::3]:1234", http.StatusOK},
+		{http.MethodGet, "/theme/a", "[2001:db8::4]:1234", http.StatusTooManyRequests},
+		// Disabled limits never block
+		{http.MethodPost, "/theme/a/webhooks", "192.0.2.1:1234", http.StatusOK},
+	}
+	for i, step := range steps {
+		r := httptest.NewRequest(step.method, step.path, nil)
+		r.RemoteAddr = step.ip
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != step.status {
+			t.Errorf("step %d: got status %d, want %d", i, w.Code, step.status)
+		} else if step.status == http.StatusTooManyRequests {
+			retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			if err != nil || retryAfter <= 0 || retryAfter > int(time.Hour.Seconds()) {
+				t.Errorf("step %d: invalid Retry-After %q", i, w.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		ipHeader   string
+		remoteAddr string
+		header     string
+		want       string
+	}{
+		{"IPv4", "", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"IPv6 is truncated to /64", "", "[2001:db8:1:2:3:4:5:6]:1234", "", "2001:db8:1:2::/64"},
+		{"header ignored when not configured", "", "192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"header", "X-Forwarded-For", "192.0.2.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"last address in header", "X-Forwarded-For", "192.0.2.1:1234", "203.0.113.1, 198.51.100.1", "198.51.100.1"},
+		{"missing header", "X-Forwarded-For", "192.0.2.1:1234", "", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg = defaultConfig()
+			cfg.RateLimit.IPHeader = test.ipHeader
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.header != "" {
+				r.Header.Set("X-Forwarded-For", test.header)
+			}
+			if got := clientIP(r); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+const (
+	channelStable = "stable"
+	channelBeta   = "beta"
+)
+
+// releaseChannels are the channels that admins can move. Their names can't be used as tags.
+var releaseChannels = []string{channelStable, channelBeta}
+
+var tagNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,63}$`)
+
+var (
+	errReleaseNotFound    = errors.New("tag or channel not found")
+	errTagExists          = errors.New("a tag with that name already exists")
+	errInvalidTagName     = errors.New("tag names must be 1-64 letters, numbers, dots, dashes, underscores or pluses, and can't be a channel name")
+	errUnknownChannel     = fmt.Errorf("channels must be one of %v", releaseChannels)
+	errReleaseVersionGone = errors.New("the theme doesn't have that version")
+
+	errUnknownReleaseAction = errors.New("unknown action")
+)
+
+// getRelease finds the version that a channel or tag of the theme points at.
+func getRelease(ctx context.Context, themeID database.ThemeID, name string) (*database.Release, error) {
+	if slices.Contains(releaseChannels, name) {
+		return db.Channel.Get(ctx, themeID, name)
+	}
+	return db.Tag.Get(ctx, themeID, name)
+}
+
+func checkReleaseVersion(theme *database.Theme, version int) error {
+	if version < 1 || version > theme.LatestCommit.Version {
+		return errReleaseVersionGone
+	}
+	return nil
+}
+
+// createTag adds a tag to a version of the theme. It should be called in a transaction after checking
+// that the user is an admin of the theme. Tags can't be moved, only deleted and created again.
+func createTag(ctx context.Context, userID id.UserID, theme *database.Theme, name string, version int) (*database.Release, error) {
+	if !tagNameRegex.MatchString(name) || slices.Contains(releaseChannels, name) {
+		return nil, errInvalidTagName
+	} else if err := checkReleaseVersion(theme, version); err != nil {
+		return nil, err
+	} else if existing, err := db.Tag.Get(ctx, theme.ID, name); err != nil {
+		return nil, fmt.Errorf("failed to check existing tag: %w", err)
+	} else if existing != nil {
+		return nil, errTagExists
+	}
+	tag := &database.Release{ThemeID: theme.ID, Name: name, Version: version, UpdatedAt: time.Now(), UpdatedBy: userID}
+	if err := db.Tag.Add(ctx, tag); err != nil {
+		return nil, fmt.Errorf("failed to add tag: %w", err)
+	}
+	return tag, recordAudit(ctx, &database.AuditEntry{
+		Actor:   string(userID),
+		Action:  database.AuditTagCreate,
+		ThemeID: theme.ID,
+		Target:  name,
+		After:   auditJSON(version),
+	})
+}
+
+func deleteTag(ctx context.Context, userID id.UserID, theme *database.Theme, name string) error {
+	tag, err := db.Tag.Get(ctx, theme.ID, name)
+	if err != nil {
+		return fmt.Errorf("failed to get tag: %w", err)
+	} else if tag == nil {
+		return errReleaseNotFound
+	} else if err = db.Tag.Delete(ctx, theme.ID, name); err != nil {
+		return fmt.Errorf("failed to delete tag: %w", err)
+	}
+	return recordAudit(ctx, &database.AuditEntry{
+		Actor:   string(userID),
+		Action:  database.AuditTagDelete,
+		ThemeID: theme.ID,
+		Target:  name,
+		Before:  auditJSON(tag.Version),
+	})
+}
+
+// setChannel moves a channel of the theme to the given version.
+func setChannel(ctx context.Context, userID id.UserID, theme *database.Theme, name string, version int) (*database.Release, error) {
+	if !slices.Contains(releaseChannels, name) {
+		return nil, errUnknownChannel
+	} else if err := checkReleaseVersion(theme, version); err != nil {
+		return nil, err
+	}
+	existing, err := db.Channel.Get(ctx, theme.ID, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+	channel := &database.Release{ThemeID: theme.ID, Name: name, Version: version, UpdatedAt: time.Now(), UpdatedBy: userID}
+	if err = db.Channel.Set(ctx, channel); err != nil {
+		return nil, fmt.Errorf("failed to set channel: %w", err)
+	}
+	audit := &database.AuditEntry{
+		Actor:   string(userID),
+		Action:  database.AuditChannelSet,
+		ThemeID: theme.ID,
+		Target:  name,
+		After:   auditJSON(version),
+	}
+	if existing != nil {
+		audit.Before = auditJSON(existing.Version)
+	}
+	return channel, recordAudit(ctx, audit)
+}
+
+func clearChannel(ctx context.Context, userID id.UserID, theme *database.Theme, name string) error {
+	channel, err := db.Channel.Get(ctx, theme.ID, name)
+	if err != nil {
+		return fmt.Errorf("failed to get channel: %w", err)
+	} else if channel == nil {
+		return errReleaseNotFound
+	} else if err = db.Channel.Delete(ctx, theme.ID, name); err != nil {
+		return fmt.Errorf("failed to clear channel: %w", err)
+	}
+	return recordAudit(ctx, &database.AuditEntry{
+		Actor:   string(userID),
+		Action:  database.AuditChannelClear,
+		ThemeID: theme.ID,
+		Target:  name,
+		Before:  auditJSON(channel.Version),
+	})
+}
+
+// setFollowStable changes whether the unversioned CSS URL serves the stable channel.
+func setFollowStable(ctx context.Context, userID id.UserID, theme *database.Theme, followStable bool) error {
+	if theme.FollowStable == followStable {
+		return nil
+	}
+	before := themeMeta(theme)
+	theme.FollowStable = followStable
+	if err := db.Theme.Update(ctx, theme); err != nil {
+		return fmt.Errorf("failed to update theme: %w", err)
+	}
+	return recordAudit(ctx, &database.AuditEntry{
+		Actor:   string(userID),
+		Action:  database.AuditThemeUpdate,
+		ThemeID: theme.ID,
+		Before:  auditJSON(before),
+		After:   auditJSON(themeMeta(theme)),
+	})
+}
+
+// isReleaseUserError returns true for errors caused by invalid input rather than internal failures.
+func isReleaseUserError(err error) bool {
+	return errors.Is(err, errReleaseNotFound) || errors.Is(err, errTagExists) || errors.Is(err, errInvalidTagName) ||
+		errors.Is(err, errUnknownChannel) || errors.Is(err, errReleaseVersionGone) || errors.Is(err, errUnknownReleaseAction)
+}
+
+type ReleasesPageData struct {
+	CSRFData
+	Theme    *database.Theme
+	Channels []*database.Release
+	Tags     []*database.Release
+	// ChannelNames is the list of all channels, including ones that aren't set
+	ChannelNames []string
+	CanEdit      bool
+	Error        string
+}
+
+func getReleasesPage(w http.ResponseWriter, r *http.Request) {
+	theme, err := db.Theme.Get(r.Context(), database.ThemeID(r.PathValue("themeID")))
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if theme == nil {
+		w.WriteHeader(http.StatusNotFound)
+		// TODO write body
+		return
+	}
+	userID := verifyCookie(r)
+	sendReleasesPage(w, r, http.StatusOK, &ReleasesPageData{Theme: theme, CanEdit: userID != "" && theme.IsAdmin(userID)})
+}
+
+func postReleasesPage(w http.ResponseWriter, r *http.Request) {
+	auth := verifyWriteAuth(w, r)
+	if auth == nil {
+		return
+	}
+	userID := auth.UserID
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	if !auth.CanWrite(themeID) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		// TODO write body
+		return
+	}
+	name := r.PostForm.Get("name")
+	version, _ := strconv.Atoi(r.PostForm.Get("version"))
+	data := &ReleasesPageData{CanEdit: true}
+	err := db.DoTxn(r.Context(), nil, func(ctx context.Context) (err error) {
+		data.Theme, err = getAdminTheme(ctx, themeID, userID)
+		if err != nil {
+			return err
+		}
+		switch r.PostForm.Get("action") {
+		case "create_tag":
+			_, err = createTag(ctx, userID, data.Theme, name, version)
+		case "delete_tag":
+			err = deleteTag(ctx, userID, data.Theme, name)
+		case "set_channel":
+			_, err = setChannel(ctx, userID, data.Theme, name, version)
+		case "clear_channel":
+			err = clearChannel(ctx, userID, data.Theme, name)
+		case "follow_stable":
+			err = setFollowStable(ctx, userID, data.Theme, r.PostForm.Get("follow_stable") == "on")
+		default:
+			err = errUnknownReleaseAction
+		}
+		return
+	})
+	switch {
+	case err == nil:
+		sendReleasesPage(w, r, http.StatusOK, data)
+	case errors.Is(err, errThemeNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		// TODO write body
+	case errors.Is(err, errNotAdmin):
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+	case isReleaseUserError(err):
+		data.Error = err.Error()
+		sendReleasesPage(w, r, http.StatusBadRequest, data)
+	default:
+		hlog.FromRequest(r).Err(err).Msg("Failed to update releases")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+	}
+}
+
+func sendReleasesPage(w http.ResponseWriter, r *http.Request, status int, data *ReleasesPageData) {
+	var err error
+	if data.Channels, err = db.Channel.GetByTheme(r.Context(), data.Theme.ID); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get channels")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if data.Tags, err = db.Tag.GetByTheme(r.Context(), data.Theme.ID); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get tags")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	data.ChannelNames = releaseChannels
+	renderContainer(w, r, status, &ContainerData{
+		PageTitle: data.Theme.Name + " - releases",
+		Page:      "releases.gohtml",
+		Data:      data,
+	})
+}
@@ -0,0 +1,97 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+func TestThemeFormsAcceptAPITokens(t *testing.T) {
+	cfg = defaultConfig()
+	ctx := setupTestDB(t)
+	const userID id.UserID = "@meow:example.com"
+	for _, themeID := range []database.ThemeID{"meowtheme", "othertheme"} {
+		err := db.DoTxn(ctx, nil, func(ctx context.Context) error {
+			_, err := addThemeCommit(ctx, userID, &themeCommitParams{ThemeID: themeID, Version: 1, Name: string(themeID), Content: "body { color: pink; }"})
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	makeAPIToken := func(name string, writeThemes ...database.ThemeID) string {
+		t.Helper()
+		token := random.Token(apiTokenPrefix, 32)
+		err := db.APIToken.Create(ctx, &database.APIToken{
+			UserID:      userID,
+			Name:        name,
+			CreatedAt:   time.Now(),
+			ReadThemes:  writeThemes,
+			WriteThemes: writeThemes,
+		}, hashAPIToken(token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	scopedToken := makeAPIToken("scoped", "meowtheme")
+	otherToken := makeAPIToken("other", "othertheme")
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		form    url.Values
+		token   string
+		status  int
+	}{
+		{"releases", postReleasesPage, "/theme/meowtheme/releases", url.Values{"action": {"follow_stable"}, "follow_stable": {"on"}}, scopedToken, http.StatusOK},
+		{"releases out of scope", postReleasesPage, "/theme/meowtheme/releases", url.Values{"action": {"follow_stable"}}, otherToken, http.StatusForbidden},
+		{"drafts out of scope", postDraftsPage, "/theme/meowtheme/drafts", url.Values{"action": {"delete"}, "draft_id": {"1"}}, otherToken, http.StatusForbidden},
+		{"webhooks out of scope", postWebhooksPage, "/theme/meowtheme/webhooks", url.Values{"action": {"delete"}, "webhook_id": {"1"}}, otherToken, http.StatusForbidden},
+		{"invalid token", postReleasesPage, "/theme/meowtheme/releases", url.Values{"action": {"follow_stable"}}, apiTokenPrefix + "_invalid", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.form.Encode())).WithContext(ctx)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Authorization", "Bearer "+test.token)
+			req.SetPathValue("themeID", "meowtheme")
+			w := httptest.NewRecorder()
+			test.handler(w, req)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+		})
+	}
+	if theme, err := db.Theme.Get(ctx, "meowtheme"); err != nil {
+		t.Fatal(err)
+	} else if !theme.FollowStable {
+		t.Error("follow_stable wasn't changed with the scoped token")
+	}
+}
@@ -0,0 +1,309 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/hlog"
+
+	"css.gomuks.app/database"
+)
+
+type reportCategory struct {
+	ID    string
+	Label string
+}
+
+var reportCategories = []reportCategory{
+	{"spam", "Spam or advertising"},
+	{"malicious", "Harmful CSS, like tracking pixels or hiding parts of the interface"},
+	{"offensive", "Offensive or illegal content"},
+	{"impersonation", "Copied from someone else or impersonating them"},
+	{"other", "Something else"},
+}
+
+func isValidReportCategory(category string) bool {
+	return slices.ContainsFunc(reportCategories, func(c reportCategory) bool {
+		return c.ID == category
+	})
+}
+
+type ReportPageData struct {
+	CSRFData
+	Theme      *database.Theme
+	Version    int
+	ImageID    uuid.UUID
+	Categories []reportCategory
+	Error      string
+	Submitted  bool
+}
+
+func (rpd *ReportPageData) HasImage() bool {
+	return rpd.ImageID != uuid.Nil
+}
+
+func sendReportPage(w http.ResponseWriter, r *http.Request, status int, data *ReportPageData) {
+	data.Categories = reportCategories
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, status, &ContainerData{
+		PageTitle: "report " + data.Theme.Name,
+		Page:      "report.gohtml",
+		Data:      data,
+	})
+}
+
+// parseReportTarget loads the reported theme and checks that the version and preview image
+// from the request belong to it. It writes an error and returns nil if they don't.
+func parseReportTarget(w http.ResponseWriter, r *http.Request, values func(string) string) *ReportPageData {
+	theme, err := db.Theme.Get(r.Context(), database.ThemeID(r.PathValue("themeID")))
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return nil
+	} else if theme == nil {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return nil
+	}
+	data := &ReportPageData{Theme: theme, Version: theme.LatestCommit.Version}
+	if versionStr := values("version"); versionStr != "" {
+		data.Version, err = strconv.Atoi(versionStr)
+		if err != nil || data.Version < 1 || data.Version > theme.LatestCommit.Version {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return nil
+		}
+	}
+	if imageStr := values("image"); imageStr != "" {
+		data.ImageID, err = uuid.Parse(imageStr)
+		if err != nil || !slices.Contains(theme.Previews, data.ImageID) {
+			http.Error(w, "Preview image not found", http.StatusNotFound)
+			return nil
+		}
+	}
+	return data
+}
+
+func getReportPage(w http.ResponseWriter, r *http.Request) {
+	if verifyCookie(r) == "" {
+		redirectToLogin(w, r)
+		return
+	}
+	data := parseReportTarget(w, r, r.URL.Query().Get)
+	if data != nil {
+		sendReportPage(w, r, http.StatusOK, data)
+	}
+}
+
+func postReport(w http.ResponseWriter, r *http.Request) {
+	// Reports don't change the reported theme, so API tokens can be used regardless of their theme scopes
+	auth := verifyWriteAuth(w, r)
+	if auth == nil {
+		return
+	}
+	userID := auth.UserID
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	data := parseReportTarget(w, r, r.PostForm.Get)
+	if data == nil {
+		return
+	}
+	category := r.PostForm.Get("category")
+	reason := strings.TrimSpace(r.PostForm.Get("reason"))
+	if !isValidReportCategory(category) {
+		data.Error = "Please choose a category"
+	} else if len(reason) > cfg.Limits.DescriptionMaxLength {
+		data.Error = "The description is too long"
+	} else if category == "other" && reason == "" {
+		data.Error = "Please describe the problem"
+	}
+	if data.Error != "" {
+		sendReportPage(w, r, http.StatusBadRequest, data)
+		return
+	}
+	log := hlog.FromRequest(r)
+	alreadyReported, err := db.Report.HasOpen(r.Context(), data.Theme.ID, data.ImageID, userID)
+	if err != nil {
+		log.Err(err).Msg("Failed to check for existing reports")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if !alreadyReported {
+		report := &database.Report{
+			ThemeID:   data.Theme.ID,
+			Version:   data.Version,
+			ImageID:   data.ImageID,
+			Reporter:  userID,
+			Category:  category,
+			Reason:    reason,
+			CreatedAt: time.Now(),
+			Status:    database.ReportStatusOpen,
+		}
+		if err = db.Report.Create(r.Context(), report); err != nil {
+			log.Err(err).Msg("Failed to create report")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		}
+		log.Info().Int64("report_id", report.ID).Str("theme_id", string(report.ThemeID)).Msg("Theme reported")
+	}
+	data.Submitted = true
+	sendReportPage(w, r, http.StatusOK, data)
+}
+
+type ReportQueueEntry struct {
+	Report *database.Report
+	Theme  *database.Theme
+	Commit *database.Commit
+	// ImageRemoved is set if the reported preview image no longer exists
+	ImageRemoved bool
+}
+
+type ReportQueuePageData struct {
+	CSRFData
+	Entries []*ReportQueueEntry
+}
+
+func getReportQueuePage(w http.ResponseWriter, r *http.Request) {
+	if verifyModerator(w, r) == "" {
+		return
+	}
+	log := hlog.FromRequest(r)
+	reports, err := db.Report.GetQueue(r.Context())
+	if err != nil {
+		log.Err(err).Msg("Failed to get report queue")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	data := &ReportQueuePageData{Entries: make([]*ReportQueueEntry, len(reports))}
+	themes := make(map[database.ThemeID]*database.Theme)
+	for i, report := range reports {
+		entry := &ReportQueueEntry{Report: report, Theme: themes[report.ThemeID]}
+		if entry.Theme == nil {
+			if entry.Theme, err = db.Theme.Get(r.Context(), report.ThemeID); err != nil {
+				log.Err(err).Msg("Failed to get reported theme")
+				w.WriteHeader(http.StatusInternalServerError)
+				// TODO write body
+				return
+			}
+			themes[report.ThemeID] = entry.Theme
+		}
+		if report.HasImage() {
+			entry.ImageRemoved = !slices.Contains(entry.Theme.Previews, report.ImageID)
+		} else if entry.Commit, err = db.Commit.Get(r.Context(), report.ThemeID, report.Version); err != nil {
+			log.Err(err).Msg("Failed to get reported commit")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		}
+		data.Entries[i] = entry
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, http.StatusOK, &ContainerData{
+		PageTitle: "reports",
+		Page:      "reports.gohtml",
+		Data:      data,
+	})
+}
+
+func postReportAction(w http.ResponseWriter, r *http.Request) {
+	modID := verifyModerator(w, r)
+	if modID == "" {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form body", http.StatusBadRequest)
+		return
+	}
+	reportID, err := strconv.ParseInt(r.PathValue("reportID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+	var status database.ReportStatus
+	switch r.PostForm.Get("action") {
+	case "resolve":
+		status = database.ReportStatusResolved
+	case "dismiss":
+		status = database.ReportStatusDismissed
+	case "escalate":
+		status = database.ReportStatusEscalated
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	log := hlog.FromRequest(r).With().
+		Stringer("moderator_id", modID).
+		Int64("report_id", reportID).
+		Str("status", string(status)).
+		Logger()
+	report, err := db.Report.Get(r.Context(), reportID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get report")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if report == nil {
+		http.Error(w, "Report not found", http.StatusNotFound)
+		return
+	}
+	err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+		if err := db.Report.SetStatus(ctx, reportID, status, modID); err != nil {
+			return err
+		}
+		return recordAudit(ctx, &database.AuditEntry{
+			Actor:   string(modID),
+			Action:  database.AuditReportHandle,
+			ThemeID: report.ThemeID,
+			Target:  strconv.FormatInt(reportID, 10),
+			Before:  auditJSON(map[string]any{"status": report.Status}),
+			After:   auditJSON(map[string]any{"status": status}),
+		})
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to update report")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	log.Info().Msg("Moderator handled report")
+	w.Header().Set("Location", "/moderation/reports")
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// getReportCounts returns the number of unhandled reports per theme for moderators, or nil for other users.
+func getReportCounts(r *http.Request) map[database.ThemeID]int {
+	if !viewerIsModerator(r) {
+		return nil
+	}
+	counts, err := db.Report.CountOpen(r.Context())
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to count reports")
+	}
+	return counts
+}
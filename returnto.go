@@ -0,0 +1,104 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	nextCookieName = "gomuks_css_login_next"
+	nextLifetime   = 30 * time.Minute
+)
+
+// isLocalPath checks that a return-to path stays on this site, i.e. it's an absolute path
+// and not a protocol-relative or absolute URL that browsers would send to another origin.
+func isLocalPath(path string) bool {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\\r\n\t") {
+		return false
+	}
+	parsed, err := url.Parse(path)
+	return err == nil && parsed.Scheme == "" && parsed.Host == "" && parsed.User == nil
+}
+
+// signNext signs a return-to path for the login page.
+func signNext(path string) string {
+	if !isLocalPath(path) {
+		return ""
+	}
+	return signToken(tokenPurposeNext, time.Now().Add(nextLifetime), []byte(path))
+}
+
+// verifyNext returns the path inside a signed return-to value, or an empty string if the value
+// is invalid, expired or doesn't point to this site.
+func verifyNext(signed string) string {
+	token := verifySignedToken(tokenPurposeNext, signed)
+	if token == nil || !isLocalPath(string(token.Payload)) {
+		return ""
+	}
+	return string(token.Payload)
+}
+
+// redirectToLogin sends the user to the login page, remembering the current page
+// so that they end up back here after logging in.
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	target := "/login"
+	if r.Method == http.MethodGet {
+		target += "?next=" + url.QueryEscape(signNext(r.URL.RequestURI()))
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// setNextCookie remembers the return-to path while the user goes to gomuks web to log in,
+// as the login link opened by gomuks web doesn't know where the user came from.
+func setNextCookie(w http.ResponseWriter, signed string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     nextCookieName,
+		Value:    signed,
+		Path:     "/login",
+		MaxAge:   int(nextLifetime.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearNextCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     nextCookieName,
+		Value:    "",
+		Path:     "/login",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// getNext returns the verified return-to path from the next query parameter or the cookie set by the login page.
+func getNext(r *http.Request) string {
+	if next := verifyNext(r.URL.Query().Get("next")); next != "" {
+		return next
+	} else if cookie, err := r.Cookie(nextCookieName); err == nil {
+		return verifyNext(cookie.Value)
+	}
+	return ""
+}
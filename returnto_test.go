@@ -0,0 +1,140 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsLocalPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		local bool
+	}{
+		{"/", true},
+		{"/theme/meowtheme", true},
+		{"/theme/meowtheme/edit?foo=bar#baz", true},
+		{"/user/@meow:example.com", true},
+		{"", false},
+		{"theme/meowtheme", false},
+		{"//evil.example.com", false},
+		{"//evil.example.com/theme/meowtheme", false},
+		{"/\\evil.example.com", false},
+		{"\\\\evil.example.com", false},
+		{"/\t/evil.example.com", false},
+		{"/\r\n/evil.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://css.gomuks.app/theme/meowtheme", false},
+		{"javascript:alert(1)", false},
+		{"mailto:meow@example.com", false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			if local := isLocalPath(test.path); local != test.local {
+				t.Errorf("isLocalPath(%q) = %t, want %t", test.path, local, test.local)
+			}
+		})
+	}
+}
+
+func TestSignNext(t *testing.T) {
+	setTokenKeys(t, "a", TokenKey{ID: "a", Secret: "meow"})
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"local path", "/theme/meowtheme/edit?tab=css", "/theme/meowtheme/edit?tab=css"},
+		{"absolute URL", "https://evil.example.com/", ""},
+		{"protocol-relative URL", "//evil.example.com/", ""},
+		{"backslash", "/\\evil.example.com", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verifyNext(signNext(test.path)); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyNext(t *testing.T) {
+	setTokenKeys(t, "a", TokenKey{ID: "a", Secret: "meow"})
+	signed := signNext("/theme/meowtheme")
+	tests := []struct {
+		name   string
+		signed string
+		valid  bool
+	}{
+		{"valid", signed, true},
+		{"empty", "", false},
+		{"not base64", "!" + signed, false},
+		{"truncated", signed[:len(signed)-4], false},
+		{"unsigned path", "/theme/meowtheme", false},
+		// Login cookies use the same format but a different purpose, so they can't be used as return-to values
+		{"login cookie", makeToken(strings.Repeat("s", sessionIDLength), "@meow:example.com", time.Now().Add(time.Hour)), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := verifyNext(test.signed)
+			if test.valid && got != "/theme/meowtheme" {
+				t.Errorf("got %q, want /theme/meowtheme", got)
+			} else if !test.valid && got != "" {
+				t.Errorf("got %q, want empty", got)
+			}
+		})
+	}
+	t.Run("removed key", func(t *testing.T) {
+		setTokenKeys(t, "b", TokenKey{ID: "b", Secret: "meow"})
+		if got := verifyNext(signed); got != "" {
+			t.Errorf("got %q, want empty", got)
+		}
+	})
+}
+
+func TestGetNext(t *testing.T) {
+	setTokenKeys(t, "a", TokenKey{ID: "a", Secret: "meow"})
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		want   string
+	}{
+		{"query", signNext("/theme/a"), "", "/theme/a"},
+		{"cookie", "", signNext("/theme/b"), "/theme/b"},
+		{"query takes precedence", signNext("/theme/a"), signNext("/theme/b"), "/theme/a"},
+		{"invalid query falls back to cookie", "/theme/a", signNext("/theme/b"), "/theme/b"},
+		{"unsigned", "//evil.example.com", "//evil.example.com", ""},
+		{"none", "", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/login?next="+url.QueryEscape(test.query), nil)
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: nextCookieName, Value: test.cookie})
+			}
+			if got := getNext(r); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
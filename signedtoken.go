@@ -0,0 +1,92 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+)
+
+// Purposes of signed tokens. They're included in the signature, so that a token made for one purpose
+// can't be used for another, e.g. a preview link as a login cookie. Login cookies were signed before
+// purposes existed, so they use an empty purpose to keep existing sessions valid.
+const (
+	tokenPurposeLogin        = ""
+	tokenPurposeNext         = "next"
+	tokenPurposeDraftPreview = "draft-preview"
+)
+
+// signToken signs the payload and expiry using the active key. The token consists of the key ID length,
+// the key ID, the expiry, the payload and an HMAC of the purpose followed by everything before it.
+// The key ID is included so that tokens signed with older keys can still be verified.
+func signToken(purpose string, expiry time.Time, payload []byte) string {
+	keyID := cfg.ActiveTokenKey
+	headerLen := 1 + len(keyID) + 8
+	data := make([]byte, headerLen, headerLen+len(payload)+sha256.Size)
+	data[0] = byte(len(keyID))
+	copy(data[1:], keyID)
+	binary.BigEndian.PutUint64(data[1+len(keyID):], uint64(expiry.Unix()))
+	data = append(data, payload...)
+	data = append(data, tokenMAC(cfg.TokenKey(keyID), purpose, data)...)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func tokenMAC(key []byte, purpose string, data []byte) []byte {
+	hasher := hmac.New(sha256.New, key)
+	if purpose != "" {
+		hasher.Write([]byte(purpose))
+		hasher.Write([]byte{0})
+	}
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+type signedToken struct {
+	KeyID   string
+	Expiry  time.Time
+	Payload []byte
+}
+
+// verifySignedToken checks the signature and expiry of a token made by signToken with the same purpose.
+// It returns nil if the token is invalid, expired or signed with a key that is no longer in the key ring.
+func verifySignedToken(purpose, token string) *signedToken {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	headerLen := 1 + int(data[0]) + 8
+	if len(data) < headerLen+sha256.Size {
+		return nil
+	}
+	keyID := string(data[1 : 1+data[0]])
+	key := cfg.TokenKey(keyID)
+	if key == nil {
+		return nil
+	}
+	signed, mac := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if !hmac.Equal(mac, tokenMAC(key, purpose, signed)) {
+		return nil
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(data[headerLen-8:])), 0)
+	if time.Now().After(expiry) {
+		return nil
+	}
+	return &signedToken{KeyID: keyID, Expiry: expiry, Payload: signed[headerLen:]}
+}
@@ -0,0 +1,82 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/dbutil"
+
+	"css.gomuks.app/database"
+)
+
+// setupTestDB points the global db at a fresh schema in the Postgres database given in the
+// GOMUKS_CSS_TEST_DATABASE environment variable. Tests that need a database are skipped if it isn't set.
+func setupTestDB(t *testing.T) context.Context {
+	t.Helper()
+	uri := os.Getenv("GOMUKS_CSS_TEST_DATABASE")
+	if uri == "" {
+		t.Skip("GOMUKS_CSS_TEST_DATABASE is not set")
+	}
+	ctx := zerolog.Nop().WithContext(context.Background())
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	rawDB, err := sql.Open("postgres", uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = rawDB.Close() })
+	if _, err = rawDB.ExecContext(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_, _ = rawDB.ExecContext(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+	})
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lib/pq passes unknown URI parameters to the server as runtime parameters
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	testDB, err := database.New(dbutil.Config{PoolConfig: dbutil.PoolConfig{
+		Type:         "postgres",
+		URI:          parsed.String(),
+		MaxOpenConns: 2,
+		MaxIdleConns: 1,
+	}}, dbutil.NoopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB := db
+	db = testDB
+	t.Cleanup(func() {
+		db = oldDB
+		_ = testDB.Close()
+	})
+	if err = testDB.Upgrade(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
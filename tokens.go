@@ -0,0 +1,294 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/database"
+)
+
+const apiTokenPrefix = "gcss"
+
+// authInfo is the result of authenticating a request to a private endpoint.
+type authInfo struct {
+	UserID id.UserID
+	// Token is set if the request used an API token rather than the login cookie.
+	Token *database.APIToken
+}
+
+// CanWrite checks the token scope. Cookie sessions aren't scoped, so admin checks are still needed separately.
+func (ai *authInfo) CanWrite(themeID database.ThemeID) bool {
+	return ai.Token == nil || ai.Token.CanWrite(themeID)
+}
+
+// CanRead checks the token scope for private data like drafts. Tokens that can write to a theme can also read it.
+func (ai *authInfo) CanRead(themeID database.ThemeID) bool {
+	return ai.Token == nil || ai.Token.CanRead(themeID)
+}
+
+func hashAPIToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// checkAPIToken finds the token in the database and marks it as used.
+// Unknown and expired tokens return nil without an error.
+func checkAPIToken(ctx context.Context, token string) (*database.APIToken, error) {
+	if random.GetTokenPrefix(token) != apiTokenPrefix {
+		return nil, nil
+	}
+	apiToken, err := db.APIToken.GetByHash(ctx, hashAPIToken(token))
+	if err != nil || apiToken == nil || apiToken.IsExpired() {
+		return nil, err
+	}
+	if err = db.APIToken.MarkUsed(ctx, apiToken.ID); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Int64("token_id", apiToken.ID).Msg("Failed to update token last used time")
+	}
+	return apiToken, nil
+}
+
+var (
+	errMissingAuth      = errors.New("authentication required")
+	errUnsupportedAuth  = errors.New("only bearer tokens are supported")
+	errInvalidAPIToken  = errors.New("invalid or expired API token")
+	errTokenScopeDenied = errors.New("the API token doesn't have write access to this theme")
+	errTokenReadDenied  = errors.New("the API token doesn't have read access to this theme")
+	errServerBlocked    = errors.New("users on your homeserver aren't allowed to publish on this site")
+	errUserBanned       = errors.New("you've been banned from publishing on this site")
+)
+
+// checkCanPublish returns an error if the user's homeserver isn't allowed by the server ACL or if the
+// user has been banned. It's checked on every write, so it also applies to existing sessions and API tokens.
+func checkCanPublish(ctx context.Context, userID id.UserID) error {
+	if !cfg.ServerACL.IsAllowed(userID.Homeserver()) {
+		return fmt.Errorf("%w (%s)", errServerBlocked, userID.Homeserver())
+	} else if ban, err := db.Ban.Get(ctx, userID); err != nil {
+		return fmt.Errorf("failed to check ban: %w", err)
+	} else if ban != nil {
+		return errUserBanned
+	}
+	return nil
+}
+
+// authenticateRequest authenticates a request using either an `Authorization: Bearer` API token or the
+// login cookie. Errors other than the ones defined above mean the database lookup failed.
+func authenticateRequest(r *http.Request) (*authInfo, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		if userID := verifyCookie(r); userID != "" {
+			return &authInfo{UserID: userID}, nil
+		}
+		return nil, errMissingAuth
+	}
+	token, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok {
+		return nil, errUnsupportedAuth
+	}
+	apiToken, err := checkAPIToken(r.Context(), token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check API token: %w", err)
+	} else if apiToken == nil {
+		return nil, errInvalidAPIToken
+	}
+	return &authInfo{UserID: apiToken.UserID, Token: apiToken}, nil
+}
+
+// authenticateWrite calls authenticateRequest and also checks that the user is allowed to publish.
+func authenticateWrite(r *http.Request) (*authInfo, error) {
+	auth, err := authenticateRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return auth, checkCanPublish(r.Context(), auth.UserID)
+}
+
+// verifyWriteAuth calls authenticateWrite and writes an error response if it fails.
+func verifyWriteAuth(w http.ResponseWriter, r *http.Request) *authInfo {
+	auth, err := authenticateWrite(r)
+	switch {
+	case err == nil:
+		return auth
+	case errors.Is(err, errMissingAuth):
+		w.WriteHeader(http.StatusUnauthorized)
+		// TODO write body
+	case errors.Is(err, errUnsupportedAuth), errors.Is(err, errInvalidAPIToken):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="css.gomuks.app"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, errServerBlocked), errors.Is(err, errUserBanned):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		hlog.FromRequest(r).Err(err).Msg("Failed to authenticate request")
+		http.Error(w, "Failed to check API token", http.StatusInternalServerError)
+	}
+	return nil
+}
+
+type APITokensPageData struct {
+	CSRFData
+	Tokens   []*database.APIToken
+	Themes   []*database.Theme
+	NewToken string
+	Error    string
+}
+
+var tokenExpiryOptions = []int{0, 7, 30, 90, 365}
+
+func getAPITokensPage(w http.ResponseWriter, r *http.Request) {
+	userID := verifyCookie(r)
+	if userID == "" {
+		redirectToLogin(w, r)
+		return
+	}
+	sendAPITokensPage(w, r, userID, http.StatusOK, &APITokensPageData{})
+}
+
+func postAPITokensPage(w http.ResponseWriter, r *http.Request) {
+	// API tokens can't be used to manage other tokens
+	userID := verifyCookie(r)
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		// TODO write body
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		// TODO write body
+		return
+	}
+	data := &APITokensPageData{}
+	var err error
+	if r.PostForm.Get("action") == "revoke" {
+		tokenID, parseErr := strconv.ParseInt(r.PostForm.Get("token_id"), 10, 64)
+		if parseErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			// TODO write body
+			return
+		}
+		err = db.APIToken.Delete(r.Context(), userID, tokenID)
+	} else {
+		var token *database.APIToken
+		// Revoking tokens is always allowed, but blocked users can't create new ones
+		if err = checkCanPublish(r.Context(), userID); errors.Is(err, errServerBlocked) || errors.Is(err, errUserBanned) {
+			data.Error = err.Error()
+			sendAPITokensPage(w, r, userID, http.StatusForbidden, data)
+			return
+		} else if err != nil {
+			hlog.FromRequest(r).Err(err).Msg("Failed to check if user can publish")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		}
+		token, err = parseNewAPIToken(r, userID)
+		if err != nil {
+			data.Error = err.Error()
+			sendAPITokensPage(w, r, userID, http.StatusBadRequest, data)
+			return
+		}
+		data.NewToken = random.Token(apiTokenPrefix, 32)
+		err = db.APIToken.Create(r.Context(), token, hashAPIToken(data.NewToken))
+	}
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to update API tokens")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	sendAPITokensPage(w, r, userID, http.StatusOK, data)
+}
+
+func parseNewAPIToken(r *http.Request, userID id.UserID) (*database.APIToken, error) {
+	token := &database.APIToken{
+		UserID:    userID,
+		Name:      strings.TrimSpace(r.PostForm.Get("name")),
+		CreatedAt: time.Now(),
+	}
+	if token.Name == "" {
+		return nil, fmt.Errorf("token name is required")
+	} else if len(token.Name) > cfg.Limits.NameMaxLength {
+		return nil, fmt.Errorf("token name is too long (maximum is %d bytes)", cfg.Limits.NameMaxLength)
+	}
+	existing, err := db.APIToken.GetByUser(r.Context(), userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get existing tokens: %w", err)
+	} else if slices.ContainsFunc(existing, func(t *database.APIToken) bool { return t.Name == token.Name }) {
+		return nil, fmt.Errorf("you already have a token named %q", token.Name)
+	}
+	expiryDays, err := strconv.Atoi(r.PostForm.Get("expiry_days"))
+	if err != nil || !slices.Contains(tokenExpiryOptions, expiryDays) {
+		return nil, fmt.Errorf("invalid expiry")
+	} else if expiryDays > 0 {
+		token.ExpiresAt = token.CreatedAt.AddDate(0, 0, expiryDays)
+	}
+	for _, themeID := range r.PostForm["write"] {
+		token.WriteThemes = append(token.WriteThemes, database.ThemeID(themeID))
+	}
+	// Themes that don't exist yet can be listed manually, e.g. to create them with git push
+	for _, themeID := range strings.FieldsFunc(r.PostForm.Get("new_themes"), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if !cfg.Limits.ValidThemeID(themeID) {
+			return nil, fmt.Errorf("invalid theme ID %q", themeID)
+		}
+		token.WriteThemes = append(token.WriteThemes, database.ThemeID(themeID))
+	}
+	token.ReadThemes = slices.Clone(token.WriteThemes)
+	for _, themeID := range r.PostForm["read"] {
+		token.ReadThemes = append(token.ReadThemes, database.ThemeID(themeID))
+	}
+	slices.Sort(token.ReadThemes)
+	token.ReadThemes = slices.Compact(token.ReadThemes)
+	if len(token.ReadThemes) == 0 {
+		return nil, fmt.Errorf("select at least one theme")
+	}
+	return token, nil
+}
+
+func sendAPITokensPage(w http.ResponseWriter, r *http.Request, userID id.UserID, status int, data *APITokensPageData) {
+	var err error
+	if data.Tokens, err = db.APIToken.GetByUser(r.Context(), userID); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get API tokens")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if data.Themes, err = db.Theme.GetByAdmin(r.Context(), userID); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get themes")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, status, &ContainerData{
+		PageTitle: "API tokens",
+		Page:      "api-tokens.gohtml",
+		Data:      data,
+	})
+}
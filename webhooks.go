@@ -0,0 +1,448 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/exerrors"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/id"
+
+	"css.gomuks.app/client"
+	"css.gomuks.app/database"
+)
+
+const (
+	webhookPollInterval  = 5 * time.Second
+	webhookBatchSize     = 20
+	webhookBaseBackoff   = time.Minute
+	webhookMaxBackoff    = 6 * time.Hour
+	webhookRetention     = 30 * 24 * time.Hour
+	webhookDeliveryLimit = 100
+)
+
+// queueWebhooks adds a delivery of the payload to each webhook of the theme. It should be called in
+// the same transaction as the change, so that events are queued if and only if the change is saved.
+// The body is signed here, as the secret is gone by the time a theme deletion event is delivered.
+func queueWebhooks(ctx context.Context, payload *client.WebhookPayload) error {
+	webhooks, err := db.Webhook.GetByTheme(ctx, payload.ThemeID)
+	if err != nil {
+		return fmt.Errorf("failed to get webhooks: %w", err)
+	} else if len(webhooks) == 0 {
+		return nil
+	}
+	payload.Timestamp = time.Now()
+	body := exerrors.Must(json.Marshal(payload))
+	for _, webhook := range webhooks {
+		err = db.Delivery.Add(ctx, &database.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			URL:           webhook.URL,
+			Event:         payload.Event,
+			Payload:       string(body),
+			Signature:     client.SignWebhook(webhook.Secret, body),
+			Status:        database.WebhookDeliveryPending,
+			CreatedAt:     payload.Timestamp,
+			NextAttemptAt: payload.Timestamp,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook delivery: %w", err)
+		}
+	}
+	return nil
+}
+
+func queuePreviewWebhooks(ctx context.Context, sender id.UserID, themeID database.ThemeID, added, removed []uuid.UUID) error {
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	return queueWebhooks(ctx, &client.WebhookPayload{
+		Event:           client.WebhookEventPreview,
+		ThemeID:         themeID,
+		Sender:          sender,
+		AddedPreviews:   added,
+		RemovedPreviews: removed,
+	})
+}
+
+var errPrivateAddress = errors.New("webhooks to private addresses aren't allowed")
+
+// checkWebhookAddress is used as the dialer control function, so that it checks the resolved
+// address that's actually connected to rather than the host in the URL.
+func checkWebhookAddress(_, address string, _ syscall.RawConn) error {
+	if cfg.Webhooks.AllowPrivateAddresses {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w (%s)", errPrivateAddress, host)
+	}
+	return nil
+}
+
+// webhookClient doesn't use proxies from the environment, as checkWebhookAddress would only
+// see the address of the proxy rather than the webhook target.
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkWebhookAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
+
+func deliverWebhook(ctx context.Context, delivery *database.WebhookDelivery) {
+	attemptWebhook(ctx, delivery)
+	if err := db.Delivery.Update(ctx, delivery); err != nil {
+		zerolog.Ctx(ctx).Err(err).Int64("delivery_id", delivery.ID).Msg("Failed to save webhook delivery result")
+	}
+}
+
+// attemptWebhook sends the delivery once and records the result and the next attempt time in it.
+func attemptWebhook(ctx context.Context, delivery *database.WebhookDelivery) {
+	log := zerolog.Ctx(ctx).With().
+		Int64("delivery_id", delivery.ID).
+		Int64("webhook_id", delivery.WebhookID).
+		Str("event", delivery.Event).
+		Logger()
+	statusCode, err := sendWebhook(ctx, delivery)
+	delivery.Attempts++
+	delivery.LastAttemptAt = time.Now()
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+	if err == nil {
+		delivery.Status = database.WebhookDeliveryDelivered
+		log.Debug().Int("status_code", statusCode).Msg("Delivered webhook")
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= cfg.Webhooks.MaxAttempts {
+			delivery.Status = database.WebhookDeliveryFailed
+			log.Warn().Err(err).Int("attempts", delivery.Attempts).Msg("Giving up on webhook delivery")
+		} else {
+			delivery.NextAttemptAt = delivery.LastAttemptAt.Add(webhookBackoff(delivery.Attempts))
+			log.Debug().Err(err).Time("next_attempt_at", delivery.NextAttemptAt).Msg("Webhook delivery failed")
+		}
+	}
+}
+
+func sendWebhook(ctx context.Context, delivery *database.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Webhooks.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "css.gomuks.app webhooks")
+	req.Header.Set(client.WebhookEventHeader, delivery.Event)
+	req.Header.Set(client.WebhookDeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(client.WebhookSignatureHeader, delivery.Signature)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// runWebhookWorker delivers queued webhooks until the context is canceled. Deliveries are claimed
+// with a lease in the database, so multiple replicas can run the worker at the same time.
+func runWebhookWorker(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("component", "webhooks").Logger()
+	ctx = log.WithContext(ctx)
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Time{}
+	for {
+		// Leave enough time for every request in the batch to time out before others retry them
+		deliveries, err := db.Delivery.Claim(ctx, time.Now().Add(webhookBatchSize*cfg.Webhooks.Timeout), webhookBatchSize)
+		if err != nil && ctx.Err() == nil {
+			log.Err(err).Msg("Failed to get pending webhook deliveries")
+		}
+		for _, delivery := range deliveries {
+			deliverWebhook(ctx, delivery)
+		}
+		if time.Since(lastCleanup) > time.Hour {
+			if err = db.Delivery.DeleteOld(ctx, time.Now().Add(-webhookRetention)); err != nil && ctx.Err() == nil {
+				log.Err(err).Msg("Failed to delete old webhook deliveries")
+			}
+			lastCleanup = time.Now()
+		}
+		if len(deliveries) == webhookBatchSize {
+			// There may be more due, don't wait for the next tick
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type WebhooksPageData struct {
+	CSRFData
+	Theme      *database.Theme
+	Webhooks   []*database.Webhook
+	Deliveries []*database.WebhookDelivery
+	CanEdit    bool
+	// MatrixEnabled is true if the bot is configured, MatrixRoom is the room linked to the theme
+	MatrixEnabled bool
+	MatrixRoom    *database.MatrixRoom
+	// NewSecret is the secret of the webhook that was just added, which is only shown once
+	NewSecret string
+	Error     string
+}
+
+func getWebhooksTheme(w http.ResponseWriter, r *http.Request, userID id.UserID) *database.Theme {
+	theme, err := db.Theme.Get(r.Context(), database.ThemeID(r.PathValue("themeID")))
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get theme")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return nil
+	} else if theme == nil {
+		http.Error(w, "Theme not found", http.StatusNotFound)
+		return nil
+	} else if !theme.IsAdmin(userID) && !viewerIsModerator(r) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return nil
+	}
+	return theme
+}
+
+func getWebhooksPage(w http.ResponseWriter, r *http.Request) {
+	userID := verifyCookie(r)
+	if userID == "" {
+		redirectToLogin(w, r)
+		return
+	}
+	theme := getWebhooksTheme(w, r, userID)
+	if theme == nil {
+		return
+	}
+	sendWebhooksPage(w, r, http.StatusOK, &WebhooksPageData{Theme: theme, CanEdit: theme.IsAdmin(userID)})
+}
+
+func postWebhooksPage(w http.ResponseWriter, r *http.Request) {
+	auth := verifyWriteAuth(w, r)
+	if auth == nil {
+		return
+	}
+	userID := auth.UserID
+	themeID := database.ThemeID(r.PathValue("themeID"))
+	if !auth.CanWrite(themeID) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return
+	}
+	theme := getWebhooksTheme(w, r, userID)
+	if theme == nil {
+		return
+	} else if !theme.IsAdmin(userID) {
+		w.WriteHeader(http.StatusForbidden)
+		// TODO write body
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Limits.MaxFormSize)
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		// TODO write body
+		return
+	}
+	data := &WebhooksPageData{Theme: theme, CanEdit: true}
+	var err error
+	switch r.PostForm.Get("action") {
+	case "delete":
+		webhookID, parseErr := strconv.ParseInt(r.PostForm.Get("webhook_id"), 10, 64)
+		if parseErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			// TODO write body
+			return
+		}
+		err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+			if err := db.Webhook.Delete(ctx, theme.ID, webhookID); err != nil {
+				return err
+			}
+			return recordAudit(ctx, &database.AuditEntry{
+				Actor:   string(userID),
+				Action:  database.AuditWebhookRemove,
+				ThemeID: theme.ID,
+				Target:  strconv.FormatInt(webhookID, 10),
+			})
+		})
+	case "link_room":
+		if matrixBot == nil {
+			http.Error(w, "The Matrix bot isn't enabled", http.StatusBadRequest)
+			return
+		}
+		room := &database.MatrixRoom{ThemeID: theme.ID, LinkedAt: time.Now(), LinkedBy: userID}
+		room.RoomID, err = joinMatrixRoom(r.Context(), strings.TrimSpace(r.PostForm.Get("room")), userID)
+		if err != nil {
+			data.Error = err.Error()
+			sendWebhooksPage(w, r, http.StatusBadRequest, data)
+			return
+		}
+		err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+			if err := db.MatrixRoom.Set(ctx, room); err != nil {
+				return err
+			}
+			return recordAudit(ctx, &database.AuditEntry{
+				Actor:   string(userID),
+				Action:  database.AuditMatrixRoomLink,
+				ThemeID: theme.ID,
+				Target:  string(room.RoomID),
+			})
+		})
+	case "unlink_room":
+		err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+			if err := db.MatrixRoom.Delete(ctx, theme.ID); err != nil {
+				return err
+			}
+			return recordAudit(ctx, &database.AuditEntry{
+				Actor:   string(userID),
+				Action:  database.AuditMatrixRoomUnlink,
+				ThemeID: theme.ID,
+			})
+		})
+	default:
+		webhook := &database.Webhook{
+			ThemeID:   theme.ID,
+			Secret:    random.String(32),
+			CreatedAt: time.Now(),
+			CreatedBy: userID,
+		}
+		webhook.URL, err = parseWebhookURL(r.PostForm.Get("url"))
+		if err != nil {
+			data.Error = err.Error()
+			sendWebhooksPage(w, r, http.StatusBadRequest, data)
+			return
+		}
+		err = db.DoTxn(r.Context(), nil, func(ctx context.Context) error {
+			existing, err := db.Webhook.GetByTheme(ctx, theme.ID)
+			if err != nil {
+				return err
+			} else if len(existing) >= cfg.Webhooks.MaxPerTheme {
+				return errTooManyWebhooks
+			} else if err = db.Webhook.Create(ctx, webhook); err != nil {
+				return err
+			}
+			return recordAudit(ctx, &database.AuditEntry{
+				Actor:   string(userID),
+				Action:  database.AuditWebhookAdd,
+				ThemeID: theme.ID,
+				Target:  strconv.FormatInt(webhook.ID, 10),
+				After:   auditJSON(map[string]string{"url": webhook.URL}),
+			})
+		})
+		if errors.Is(err, errTooManyWebhooks) {
+			data.Error = err.Error()
+			sendWebhooksPage(w, r, http.StatusBadRequest, data)
+			return
+		}
+		data.NewSecret = webhook.Secret
+	}
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to update webhooks")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	sendWebhooksPage(w, r, http.StatusOK, data)
+}
+
+var errTooManyWebhooks = errors.New("the theme already has the maximum number of webhooks")
+
+func parseWebhookURL(val string) (string, error) {
+	parsed, err := url.Parse(val)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %w", err)
+	} else if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return "", fmt.Errorf("the URL must be an absolute http(s) URL")
+	} else if parsed.User != nil {
+		return "", fmt.Errorf("the URL must not contain credentials")
+	}
+	return parsed.String(), nil
+}
+
+func sendWebhooksPage(w http.ResponseWriter, r *http.Request, status int, data *WebhooksPageData) {
+	var err error
+	if data.Webhooks, err = db.Webhook.GetByTheme(r.Context(), data.Theme.ID); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get webhooks")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	} else if data.Deliveries, err = db.Delivery.GetByTheme(r.Context(), data.Theme.ID, webhookDeliveryLimit); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to get webhook deliveries")
+		w.WriteHeader(http.StatusInternalServerError)
+		// TODO write body
+		return
+	}
+	data.MatrixEnabled = matrixBot != nil
+	if data.MatrixEnabled {
+		if data.MatrixRoom, err = db.MatrixRoom.Get(r.Context(), data.Theme.ID); err != nil {
+			hlog.FromRequest(r).Err(err).Msg("Failed to get linked Matrix room")
+			w.WriteHeader(http.StatusInternalServerError)
+			// TODO write body
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderContainer(w, r, status, &ContainerData{
+		PageTitle: data.Theme.Name + " - webhooks",
+		Page:      "webhooks.gohtml",
+		Data:      data,
+	})
+}
@@ -0,0 +1,205 @@
+// css.gomuks.app - A user CSS repository for gomuks web.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"css.gomuks.app/client"
+	"css.gomuks.app/database"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, webhookBaseBackoff},
+		{1, webhookBaseBackoff},
+		{2, 2 * webhookBaseBackoff},
+		{3, 4 * webhookBaseBackoff},
+		{6, 32 * webhookBaseBackoff},
+		{9, 256 * webhookBaseBackoff},
+		{10, webhookMaxBackoff},
+		{100, webhookMaxBackoff},
+	}
+	for _, test := range tests {
+		t.Run(strconv.Itoa(test.attempts), func(t *testing.T) {
+			if got := webhookBackoff(test.attempts); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckWebhookAddress(t *testing.T) {
+	tests := []struct {
+		address      string
+		allowPrivate bool
+		allowed      bool
+	}{
+		{"93.184.215.14:443", false, true},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", false, true},
+		{"127.0.0.1:80", false, false},
+		{"[::1]:80", false, false},
+		{"10.1.2.3:80", false, false},
+		{"172.16.0.1:80", false, false},
+		{"192.168.1.1:80", false, false},
+		{"[fd00::1]:80", false, false},
+		{"169.254.169.254:80", false, false},
+		{"[fe80::1]:80", false, false},
+		{"0.0.0.0:80", false, false},
+		{"[::]:80", false, false},
+		{"127.0.0.1:80", true, true},
+		{"169.254.169.254:80", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			cfg = defaultConfig()
+			cfg.Webhooks.AllowPrivateAddresses = test.allowPrivate
+			err := checkWebhookAddress("tcp", test.address, nil)
+			if test.allowed && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !test.allowed && !errors.Is(err, errPrivateAddress) {
+				t.Errorf("expected errPrivateAddress, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAttemptWebhook(t *testing.T) {
+	const secret = "meow"
+	payload := `{"event":"commit","theme_id":"meowtheme"}`
+	var status int
+	var received *http.Request
+	var receivedBody []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	tests := []struct {
+		name         string
+		status       int
+		allowPrivate bool
+		attempts     int
+		wantStatus   database.WebhookDeliveryStatus
+		wantCode     int
+		wantSent     bool
+		wantRetry    bool
+	}{
+		{"delivered", http.StatusNoContent, true, 0, database.WebhookDeliveryDelivered, http.StatusNoContent, true, false},
+		{"retried", http.StatusInternalServerError, true, 0, database.WebhookDeliveryPending, http.StatusInternalServerError, true, true},
+		{"redirect isn't followed", http.StatusFound, true, 0, database.WebhookDeliveryPending, http.StatusFound, true, true},
+		{"failed at max attempts", http.StatusBadGateway, true, 2, database.WebhookDeliveryFailed, http.StatusBadGateway, true, false},
+		{"private address", http.StatusOK, false, 0, database.WebhookDeliveryPending, 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg = defaultConfig()
+			cfg.Webhooks.AllowPrivateAddresses = test.allowPrivate
+			cfg.Webhooks.MaxAttempts = 3
+			status, received, receivedBody = test.status, nil, nil
+			// The address is checked when dialing, so don't reuse connections from other cases
+			webhookClient.CloseIdleConnections()
+			delivery := &database.WebhookDelivery{
+				ID:        42,
+				WebhookID: 1,
+				URL:       receiver.URL + "/hook",
+				Event:     client.WebhookEventCommit,
+				Payload:   payload,
+				Signature: client.SignWebhook(secret, []byte(payload)),
+				Status:    database.WebhookDeliveryPending,
+				Attempts:  test.attempts,
+			}
+			attemptWebhook(context.Background(), delivery)
+			if delivery.Status != test.wantStatus {
+				t.Errorf("got status %s, want %s", delivery.Status, test.wantStatus)
+			}
+			if delivery.Attempts != test.attempts+1 {
+				t.Errorf("got %d attempts, want %d", delivery.Attempts, test.attempts+1)
+			}
+			if delivery.LastStatusCode != test.wantCode {
+				t.Errorf("got status code %d, want %d", delivery.LastStatusCode, test.wantCode)
+			}
+			if (delivery.LastError == "") != (test.wantStatus == database.WebhookDeliveryDelivered) {
+				t.Errorf("unexpected last error %q", delivery.LastError)
+			}
+			if test.wantRetry {
+				wantNext := delivery.LastAttemptAt.Add(webhookBackoff(delivery.Attempts))
+				if !delivery.NextAttemptAt.Equal(wantNext) {
+					t.Errorf("got next attempt at %s, want %s", delivery.NextAttemptAt, wantNext)
+				}
+			}
+			if (received != nil) != test.wantSent {
+				t.Fatalf("got request %t, want %t", received != nil, test.wantSent)
+			} else if received == nil {
+				return
+			}
+			if string(receivedBody) != payload {
+				t.Errorf("got body %q, want %q", receivedBody, payload)
+			}
+			if !client.VerifyWebhookSignature(secret, receivedBody, received.Header.Get(client.WebhookSignatureHeader)) {
+				t.Error("signature doesn't verify with the webhook secret")
+			}
+			if client.VerifyWebhookSignature("other", receivedBody, received.Header.Get(client.WebhookSignatureHeader)) {
+				t.Error("signature verifies with the wrong secret")
+			}
+			if event := received.Header.Get(client.WebhookEventHeader); event != client.WebhookEventCommit {
+				t.Errorf("got event header %q", event)
+			}
+			if deliveryID := received.Header.Get(client.WebhookDeliveryHeader); deliveryID != "42" {
+				t.Errorf("got delivery header %q", deliveryID)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"event":"delete"}`)
+	valid := client.SignWebhook("meow", body)
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		valid     bool
+	}{
+		{"valid", "meow", body, valid, true},
+		{"wrong secret", "nyan", body, valid, false},
+		{"modified body", "meow", []byte(`{"event":"commit"}`), valid, false},
+		{"missing prefix", "meow", body, valid[len("sha256="):], false},
+		{"not hex", "meow", body, "sha256=meow", false},
+		{"empty", "meow", body, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := client.VerifyWebhookSignature(test.secret, test.body, test.signature); got != test.valid {
+				t.Errorf("got %t, want %t", got, test.valid)
+			}
+		})
+	}
+}